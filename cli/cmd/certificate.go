@@ -16,6 +16,7 @@ func newCertificateCmd() *cobra.Command {
 	cmd.AddCommand(newCertificateRoot())
 	cmd.AddCommand(newCertificateIntermediate())
 	cmd.AddCommand(newCertificateChain())
+	cmd.AddCommand(newCertificateVerify())
 
 	return cmd
 }
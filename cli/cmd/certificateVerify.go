@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newCertificateVerify() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify <marble_certificate> <IP:PORT>",
+		Short: "Verifies a Marble's certificate against the certificate chain of the MarbleRun Coordinator",
+		Long: `Verifies a Marble's certificate against the certificate chain of the MarbleRun Coordinator.
+Checks that the certificate is not listed in the Coordinator's certificate revocation list, if the Coordinator provides one.
+Prints the Marble's UUID, subject alternative names, and validity period of the certificate.`,
+		Example: "marblerun certificate verify marble.crt $MARBLERUN",
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			certFile := args[0]
+			hostName := args[1]
+			return cliCertificateVerify(certFile, hostName, eraConfig, insecureEra)
+		},
+		SilenceUsage: true,
+	}
+
+	return cmd
+}
+
+// cliCertificateVerify verifies a Marble's certificate against the certificate chain of the MarbleRun Coordinator.
+func cliCertificateVerify(certFile string, host string, configFilename string, insecure bool) error {
+	certRaw, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	marbleCert, err := parseCertificate(certRaw)
+	if err != nil {
+		return err
+	}
+
+	chain, err := verifyCoordinator(host, configFilename, insecure)
+	if err != nil {
+		return err
+	}
+
+	issuer, err := verifyMarbleCertificate(marbleCert, chain)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Certificate is issued by the MarbleRun Coordinator")
+
+	// Coordinators whose intermediate certificate can't sign revocation lists don't serve one
+	crl, err := cliDataGet(host, "crl", "data.CRL", chain)
+	if err != nil {
+		fmt.Printf("Warning: skipping revocation check, the Coordinator's certificate revocation list is unavailable: %v\n", err)
+	} else {
+		if err := checkRevocation(marbleCert, issuer, crl); err != nil {
+			return err
+		}
+		fmt.Println("Certificate is not revoked")
+	}
+
+	fmt.Printf("UUID: %s\n", marbleCert.Subject.CommonName)
+	fmt.Printf("DNS names: %s\n", strings.Join(marbleCert.DNSNames, ", "))
+	var ips []string
+	for _, ip := range marbleCert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	fmt.Printf("IP addresses: %s\n", strings.Join(ips, ", "))
+	fmt.Printf("Valid from: %s\n", marbleCert.NotBefore)
+	fmt.Printf("Valid until: %s\n", marbleCert.NotAfter)
+
+	return nil
+}
+
+// verifyMarbleCertificate checks if a Marble's certificate chains to the Coordinator's certificates and returns its issuer.
+// The last certificate of the chain is treated as root, all others as intermediates.
+func verifyMarbleCertificate(marbleCert *x509.Certificate, chain []*pem.Block) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("received no certificates from the Coordinator")
+	}
+
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	for idx, block := range chain {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing Coordinator certificate: %w", err)
+		}
+		if idx == len(chain)-1 {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	// Marble certificates are used for both server and client authentication
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	chains, err := marbleCert.Verify(opts)
+	if err != nil {
+		return nil, fmt.Errorf("certificate was not issued by the Coordinator: %w", err)
+	}
+	if len(chains[0]) < 2 {
+		return nil, errors.New("certificate is a Coordinator certificate, not a Marble certificate")
+	}
+	return chains[0][1], nil
+}
+
+// checkRevocation checks that a certificate is not listed in a PEM-encoded certificate revocation list.
+// The list must be signed by the certificate's issuer and must not be outdated.
+func checkRevocation(cert, issuer *x509.Certificate, crlRaw []byte) error {
+	block, _ := pem.Decode(crlRaw)
+	if block == nil || block.Type != "X509 CRL" {
+		return errors.New("received invalid certificate revocation list from the Coordinator")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing certificate revocation list: %w", err)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("certificate revocation list is not signed by the issuer of the certificate: %w", err)
+	}
+	if time.Now().After(crl.NextUpdate) {
+		return fmt.Errorf("certificate revocation list is outdated since %s", crl.NextUpdate)
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return fmt.Errorf("certificate was revoked at %s", entry.RevocationTime)
+		}
+	}
+	return nil
+}
+
+// parseCertificate parses a PEM or DER encoded certificate.
+func parseCertificate(certRaw []byte) (*x509.Certificate, error) {
+	if block, _ := pem.Decode(certRaw); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block type %s, expected CERTIFICATE", block.Type)
+		}
+		certRaw = block.Bytes
+	}
+	return x509.ParseCertificate(certRaw)
+}
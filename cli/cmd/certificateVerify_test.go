@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyMarbleCertificate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rootCert, rootKey := mustCreateTestCert(t, "root", true, nil, nil)
+	intermediateCert, intermediateKey := mustCreateTestCert(t, "intermediate", true, rootCert, rootKey)
+	marbleCert, _ := mustCreateTestCert(t, "marble", false, intermediateCert, intermediateKey)
+	otherRootCert, otherRootKey := mustCreateTestCert(t, "other", true, nil, nil)
+	otherMarbleCert, _ := mustCreateTestCert(t, "marble", false, otherRootCert, otherRootKey)
+
+	chain := []*pem.Block{
+		{Type: "CERTIFICATE", Bytes: intermediateCert.Raw},
+		{Type: "CERTIFICATE", Bytes: rootCert.Raw},
+	}
+
+	issuer, err := verifyMarbleCertificate(marbleCert, chain)
+	assert.NoError(err)
+	assert.Equal(intermediateCert.Raw, issuer.Raw)
+	_, err = verifyMarbleCertificate(otherMarbleCert, chain)
+	assert.Error(err)
+	_, err = verifyMarbleCertificate(marbleCert, chain[1:])
+	assert.Error(err)
+	_, err = verifyMarbleCertificate(marbleCert, nil)
+	assert.Error(err)
+	_, err = verifyMarbleCertificate(rootCert, chain)
+	assert.Error(err)
+
+	// both PEM and DER encoded certificates are accepted
+	cert, err := parseCertificate(marbleCert.Raw)
+	require.NoError(err)
+	assert.Equal(marbleCert.Raw, cert.Raw)
+	cert, err = parseCertificate(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: marbleCert.Raw}))
+	require.NoError(err)
+	assert.Equal(marbleCert.Raw, cert.Raw)
+	_, err = parseCertificate(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: marbleCert.Raw}))
+	assert.Error(err)
+}
+
+func TestCheckRevocation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rootCert, rootKey := mustCreateTestCert(t, "root", true, nil, nil)
+	intermediateCert, intermediateKey := mustCreateTestCert(t, "intermediate", true, rootCert, rootKey)
+	marbleCert, _ := mustCreateTestCert(t, "marble", false, intermediateCert, intermediateKey)
+	revokedCert, _ := mustCreateTestCert(t, "marble", false, intermediateCert, intermediateKey)
+
+	createCRL := func(nextUpdate time.Time, issuer *x509.Certificate, issuerKey *ecdsa.PrivateKey) []byte {
+		template := &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now().Add(-time.Minute),
+			NextUpdate: nextUpdate,
+			RevokedCertificateEntries: []x509.RevocationListEntry{
+				{SerialNumber: revokedCert.SerialNumber, RevocationTime: time.Now()},
+			},
+		}
+		crl, err := x509.CreateRevocationList(rand.Reader, template, issuer, issuerKey)
+		require.NoError(err)
+		return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+	}
+	crl := createCRL(time.Now().Add(time.Hour), intermediateCert, intermediateKey)
+
+	assert.NoError(checkRevocation(marbleCert, intermediateCert, crl))
+	assert.Error(checkRevocation(revokedCert, intermediateCert, crl))
+
+	// the list must be signed by the issuer and up to date
+	assert.Error(checkRevocation(marbleCert, intermediateCert, createCRL(time.Now().Add(time.Hour), rootCert, rootKey)))
+	assert.Error(checkRevocation(marbleCert, intermediateCert, createCRL(time.Now().Add(-time.Second), intermediateCert, intermediateKey)))
+	assert.Error(checkRevocation(marbleCert, intermediateCert, nil))
+	assert.Error(checkRevocation(marbleCert, intermediateCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: marbleCert.Raw})))
+}
+
+func mustCreateTestCert(t *testing.T, commonName string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	require := require.New(t)
+
+	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              []string{"localhost"},
+	}
+	if parent == nil {
+		parent, parentKey = template, privk
+	}
+
+	certRaw, err := x509.CreateCertificate(rand.Reader, template, parent, &privk.PublicKey, parentKey)
+	require.NoError(err)
+	cert, err := x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	return cert, privk
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/edgelesssys/marblerun/coordinator/quote"
+	"github.com/spf13/cobra"
+)
+
+// sgxAttributeDebug is the DEBUG flag of the SGX enclave attributes.
+const sgxAttributeDebug = 0x2
+
+func newGraminePackageCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gramine-package",
+		Short: "Prints the PackageProperties of a signed Gramine application",
+		Long: `Prints the PackageProperties of a signed Gramine application.
+
+The parameter of this command is the path of the signature (.sig) created by gramine-sgx-sign.
+If the path of the signed manifest (.manifest.sgx) is given, the signature next to it is used.
+The output can be copied to the Packages section of a MarbleRun manifest.
+`,
+		Example: "marblerun gramine-package nginx.sig",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sigFile := gramineSigFile(args[0])
+			sigContent, err := ioutil.ReadFile(sigFile)
+			if err != nil {
+				return err
+			}
+
+			pkg, err := packagePropertiesFromSigStruct(sigContent)
+			if err != nil {
+				return fmt.Errorf("parsing %s: %w", sigFile, err)
+			}
+			output, err := json.MarshalIndent(pkg, "", "    ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(output))
+			return nil
+		},
+		SilenceUsage: true,
+	}
+
+	return cmd
+}
+
+// gramineSigFile returns the path of the signature belonging to a signed Gramine manifest.
+// Other paths are returned unchanged.
+func gramineSigFile(path string) string {
+	if strings.HasSuffix(path, ".manifest.sgx") {
+		return strings.TrimSuffix(path, ".manifest.sgx") + ".sig"
+	}
+	return path
+}
+
+// packagePropertiesFromSigStruct returns the PackageProperties of the SIGSTRUCT contained in the given data.
+func packagePropertiesFromSigStruct(data []byte) (quote.PackageProperties, error) {
+	mrenclave, mrsigner, isvprodid, isvsvn, err := parseSigStruct(data)
+	if err != nil {
+		return quote.PackageProperties{}, err
+	}
+	sigStruct, err := findSigStruct(data)
+	if err != nil {
+		return quote.PackageProperties{}, err
+	}
+
+	productID := uint64(binary.LittleEndian.Uint16(isvprodid))
+	securityVersion := uint(binary.LittleEndian.Uint16(isvsvn))
+	attributes := binary.LittleEndian.Uint64(sigStruct[928:936])
+
+	return quote.PackageProperties{
+		Debug:           attributes&sgxAttributeDebug != 0,
+		UniqueID:        hex.EncodeToString(mrenclave),
+		SignerID:        hex.EncodeToString(mrsigner),
+		ProductID:       &productID,
+		SecurityVersion: &securityVersion,
+	}, nil
+}
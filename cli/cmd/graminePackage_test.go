@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackagePropertiesFromSigStruct(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	sgxMetaDataCompressed, err := base64.RawStdEncoding.DecodeString(sgxMetaDataSample)
+	require.NoError(err)
+	r, err := zlib.NewReader(bytes.NewReader(sgxMetaDataCompressed))
+	require.NoError(err)
+	defer r.Close()
+	sgxMetaData, err := ioutil.ReadAll(r)
+	require.NoError(err)
+
+	pkg, err := packagePropertiesFromSigStruct(sgxMetaData)
+	require.NoError(err)
+	assert.Equal("9d0dc627f893fc5471c8089d621a3da3652cf4e67eece9143ec5656406275a26", pkg.UniqueID)
+	assert.Equal("83d719e77deaca1470f6baf62a4d774303c899db69020f9c70ee1dfc08c7ce9e", pkg.SignerID)
+	assert.EqualValues(0, *pkg.ProductID)
+	assert.EqualValues(0, *pkg.SecurityVersion)
+
+	// the output uses the field names of the MarbleRun manifest
+	output, err := json.Marshal(pkg)
+	require.NoError(err)
+	assert.Contains(string(output), `"UniqueID":"9d0dc627f893fc5471c8089d621a3da3652cf4e67eece9143ec5656406275a26"`)
+	assert.Contains(string(output), `"ProductID":0`)
+
+	// the debug flag is read from the enclave attributes
+	assert.False(pkg.Debug)
+	sigStruct, err := findSigStruct(sgxMetaData)
+	require.NoError(err)
+	debugSigStruct := append([]byte{}, sigStruct...)
+	debugSigStruct[928] |= sgxAttributeDebug
+	pkg, err = packagePropertiesFromSigStruct(debugSigStruct)
+	require.NoError(err)
+	assert.True(pkg.Debug)
+
+	_, err = packagePropertiesFromSigStruct([]byte("no sigstruct"))
+	assert.Error(err)
+}
+
+func TestGramineSigFile(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("/app/nginx.sig", gramineSigFile("/app/nginx.manifest.sgx"))
+	assert.Equal("/app/nginx.sig", gramineSigFile("/app/nginx.sig"))
+}
@@ -1,16 +1,21 @@
 package cmd
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/c2h5oh/datasize"
 	"github.com/fatih/color"
@@ -18,12 +23,29 @@ import (
 	"github.com/spf13/cobra"
 )
 
-// premainName is the name of the premain executable used.
-const premainName = "premain-libos"
+// defaultPremainName is the name of the premain executable used, if no other name is specified.
+// It is also the name of the premain release asset on GitHub.
+const defaultPremainName = "premain-libos"
 
-// uuidName is the file name of a Marble's uuid.
+// premainArchPattern matches valid architecture names of the premain, e.g. "arm64".
+var premainArchPattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// uuidName is the default file name of a Marble's uuid.
 const uuidName = "uuid"
 
+// Default minimums for the stack and brk heap sizes Gramine provides to the premain's Go runtime.
+// Gramine's own defaults of 256K each are too small for larger premains.
+const (
+	defaultMinStackSize = 2 * datasize.MB
+	defaultMinBrkSize   = 64 * datasize.MB
+)
+
+// defaultDownloadAttempts is the number of attempts to download the premain, if no other number is specified.
+const defaultDownloadAttempts = 5
+
+// downloadBackoff is the delay before the second download attempt. It doubles with each further attempt.
+var downloadBackoff = time.Second
+
 // commentMarbleRunAdditions holds the marker which is appended to the Gramine manifest before the performed additions.
 const commentMarbleRunAdditions = "\n# MARBLERUN -- auto generated configuration entries \n"
 
@@ -47,6 +69,16 @@ type diff struct {
 }
 
 func newGraminePrepareCmd() *cobra.Command {
+	var premainName string
+	var uuidFile string
+	var entrypoint string
+	var minStackSize string
+	var minBrkSize string
+	var downloadAttempts int
+	var arch string
+	var upgrade bool
+	var noDownload bool
+
 	cmd := &cobra.Command{
 		Use:   "gramine-prepare",
 		Short: "Modifies a Gramine manifest for use with MarbleRun",
@@ -54,16 +86,54 @@ func newGraminePrepareCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			fileName := args[0]
+			if premainName == "" {
+				return errors.New("premain name must not be empty")
+			}
+			if uuidFile == "" {
+				return errors.New("uuid file must not be empty")
+			}
+			var stackSize, brkSize datasize.ByteSize
+			if err := stackSize.UnmarshalText([]byte(minStackSize)); err != nil {
+				return fmt.Errorf("invalid minimum stack size %q: %w", minStackSize, err)
+			}
+			if err := brkSize.UnmarshalText([]byte(minBrkSize)); err != nil {
+				return fmt.Errorf("invalid minimum brk size %q: %w", minBrkSize, err)
+			}
+			if downloadAttempts < 1 {
+				return errors.New("download attempts must be at least 1")
+			}
+			if arch != "" {
+				if !premainArchPattern.MatchString(arch) {
+					return fmt.Errorf("invalid architecture %q", arch)
+				}
+				// premains of different architectures can be placed next to each other
+				if !cmd.Flags().Changed("premain-name") {
+					premainName = premainAssetName(arch)
+				}
+			}
 
-			return addToGramineManifest(fileName)
+			return addToGramineManifest(fileName, premainName, arch, uuidFile, entrypoint, stackSize, brkSize, downloadAttempts, upgrade, noDownload)
 		},
 		SilenceUsage: true,
 	}
 
+	cmd.Flags().StringVar(&premainName, "premain-name", defaultPremainName, "Name or path of the premain executable, relative to the Gramine manifest")
+	cmd.Flags().StringVar(&uuidFile, "uuid-file", uuidName, "Path of the file the premain stores the Marble's UUID in. EDG_MARBLE_UUID_FILE needs to be set to the same path")
+	cmd.Flags().StringVar(&entrypoint, "entrypoint", "", "Binary started by the premain, if it differs from the manifest's current libos.entrypoint. Must be listed in sgx.trusted_files")
+	cmd.Flags().StringVar(&minStackSize, "min-stack-size", formatGramineSize(defaultMinStackSize), "Minimum value of sys.stack.size for the premain's Go runtime. Smaller values are raised, 0 keeps the manifest's value")
+	cmd.Flags().StringVar(&minBrkSize, "min-brk-size", formatGramineSize(defaultMinBrkSize), "Minimum value of sys.brk.max_size for the premain's Go runtime. Smaller values are raised, 0 keeps the manifest's value")
+	cmd.Flags().IntVar(&downloadAttempts, "download-attempts", defaultDownloadAttempts, "Number of attempts to download the premain from GitHub before giving up")
+	cmd.Flags().StringVar(&arch, "arch", "", "Architecture of the premain to download, e.g. arm64, for releases providing a premain per architecture. Also the default premain name is suffixed with it")
+	cmd.Flags().BoolVar(&upgrade, "upgrade", false, "Update the MarbleRun changes of an already prepared manifest in place and download the premain of this MarbleRun version")
+	cmd.Flags().BoolVar(&noDownload, "no-download", false, "Only modify the manifest and do not download the premain, e.g. because it is already part of the base image")
+
 	return cmd
 }
 
-func addToGramineManifest(fileName string) error {
+// addToGramineManifest performs the changes required for MarbleRun on a Gramine manifest.
+// Unless upgrade is set, manifests which already contain MarbleRun changes are rejected.
+// If noDownload is set, the premain is not downloaded and needs to be provided by the operator.
+func addToGramineManifest(fileName, premainName, arch, uuidFile, entrypoint string, minStackSize, minBrkSize datasize.ByteSize, downloadAttempts int, upgrade, noDownload bool) error {
 	// Read Gramine manifest and populate TOML tree
 	fmt.Println("Reading file:", fileName)
 
@@ -71,10 +141,11 @@ func addToGramineManifest(fileName string) error {
 	if err != nil {
 		return err
 	}
-	if strings.Contains(string(file), premainName) || strings.Contains(string(file), "EDG_MARBLE_COORDINATOR_ADDR") ||
+	if !upgrade && (strings.Contains(string(file), premainName) || strings.Contains(string(file), "EDG_MARBLE_COORDINATOR_ADDR") ||
 		strings.Contains(string(file), "EDG_MARBLE_TYPE") || strings.Contains(string(file), "EDG_MARBLE_UUID_FILE") ||
-		strings.Contains(string(file), "EDG_MARBLE_DNS_NAMES") {
+		strings.Contains(string(file), "EDG_MARBLE_DNS_NAMES")) {
 		color.Yellow("The supplied manifest already contains changes for MarbleRun. Have you selected the correct file?")
+		color.Yellow("To update the changes after upgrading MarbleRun, use --upgrade.")
 		return errors.New("manifest already contains MarbleRun changes")
 	}
 
@@ -87,16 +158,20 @@ func addToGramineManifest(fileName string) error {
 	}
 
 	// Parse tree for changes and generate maps with original entries & changes
-	original, changes, err := parseTreeForChanges(tree)
+	original, changes, err := parseTreeForChanges(tree, premainName, uuidFile, entrypoint, minStackSize, minBrkSize)
 	if err != nil {
 		return err
 	}
 
 	// Calculate the differences, apply the changes
-	return performChanges(calculateChanges(original, changes), fileName)
+	return performChanges(calculateChanges(original, changes), signerInfo(original), fileName, premainName, arch, downloadAttempts, upgrade, noDownload)
 }
 
-func parseTreeForChanges(tree *toml.Tree) (map[string]interface{}, map[string]interface{}, error) {
+// parseTreeForChanges returns the relevant original entries of a Gramine manifest and the changes required for MarbleRun.
+// premainName and uuidFile may be relative or absolute paths, optionally given as "file:" URIs.
+// If entrypoint is set, it is used as the binary started by the premain instead of the manifest's libos.entrypoint.
+// sys.stack.size and sys.brk.max_size are raised to minStackSize and minBrkSize, unless these are 0.
+func parseTreeForChanges(tree *toml.Tree, premainName, uuidFile, entrypoint string, minStackSize, minBrkSize datasize.ByteSize) (map[string]interface{}, map[string]interface{}, error) {
 	// Create two maps, one with original values, one with the values we want to add or modify
 	original := make(map[string]interface{})
 	changes := make(map[string]interface{})
@@ -108,11 +183,18 @@ func parseTreeForChanges(tree *toml.Tree) (map[string]interface{}, map[string]in
 	original["sgx.remote_attestation"] = tree.Get("sgx.remote_attestation")
 	original["sgx.enclave_size"] = tree.Get("sgx.enclave_size")
 	original["sgx.thread_num"] = tree.Get("sgx.thread_num")
+	original["sys.stack.size"] = tree.Get("sys.stack.size")
+	original["sys.brk.max_size"] = tree.Get("sys.brk.max_size")
 	original["loader.env.EDG_MARBLE_COORDINATOR_ADDR"] = tree.Get("loader.env.EDG_MARBLE_COORDINATOR_ADDR")
 	original["loader.env.EDG_MARBLE_TYPE"] = tree.Get("loader.env.EDG_MARBLE_TYPE")
 	original["loader.env.EDG_MARBLE_UUID_FILE"] = tree.Get("loader.env.EDG_MARBLE_UUID_FILE")
 	original["loader.env.EDG_MARBLE_DNS_NAMES"] = tree.Get("loader.env.EDG_MARBLE_DNS_NAMES")
 
+	// Signer related values, which are not modified but need to match the package definition in the MarbleRun manifest
+	original["sgx.isvprodid"] = tree.Get("sgx.isvprodid")
+	original["sgx.isvsvn"] = tree.Get("sgx.isvsvn")
+	original["sgx.debug"] = tree.Get("sgx.debug")
+
 	// Abort, if we cannot find an entrypoint
 	if original["libos.entrypoint"] == nil {
 		return nil, nil, errors.New("cannot find libos.entrypoint")
@@ -122,15 +204,29 @@ func parseTreeForChanges(tree *toml.Tree) (map[string]interface{}, map[string]in
 	if err := insertFile(original, changes, "trusted_files", premainName, tree); err != nil {
 		return nil, nil, err
 	}
-	if err := insertFile(original, changes, "allowed_files", uuidName, tree); err != nil {
+	if err := insertFile(original, changes, "allowed_files", uuidFile, tree); err != nil {
 		return nil, nil, err
 	}
 
 	// Add premain-libos executable as trusted file & entry point
-	changes["libos.entrypoint"] = premainName
+	// Older Gramine versions expect the entrypoint as URI, so we keep the style of the original entry
+	if originalEntrypoint, ok := original["libos.entrypoint"].(string); ok && strings.HasPrefix(originalEntrypoint, "file:") {
+		changes["libos.entrypoint"] = fileURI(premainName)
+	} else {
+		changes["libos.entrypoint"] = filePath(premainName)
+	}
 
-	// Set original entrypoint as argv0. If one exists, keep the old one
-	if original["loader.argv0_override"] == nil {
+	// Set original entrypoint as argv0. If one exists, keep the old one, unless another entrypoint was explicitly chosen
+	if entrypoint != "" {
+		trusted, err := isTrustedFile(tree, entrypoint)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !trusted {
+			return nil, nil, fmt.Errorf("entrypoint %s is not listed in sgx.trusted_files", entrypoint)
+		}
+		changes["loader.argv0_override"] = entrypoint
+	} else if original["loader.argv0_override"] == nil {
 		changes["loader.argv0_override"] = original["libos.entrypoint"].(string)
 	}
 
@@ -156,22 +252,103 @@ func parseTreeForChanges(tree *toml.Tree) (map[string]interface{}, map[string]in
 	}
 
 	// Ensure at least 1024 MB of enclave memory for the premain Go runtime
-	var v datasize.ByteSize
-	if original["sgx.enclave_size"] != nil {
-		v.UnmarshalText([]byte(original["sgx.enclave_size"].(string)))
+	enclaveSize, err := parseSize("sgx.enclave_size", original["sgx.enclave_size"])
+	if err != nil {
+		return nil, nil, err
 	}
-	if v.GBytes() < 1.00 {
+	if enclaveSize.GBytes() < 1.00 {
 		changes["sgx.enclave_size"] = "1024M"
 	}
 
 	// Ensure at least 16 SGX threads for the premain Go runtime
-	if original["sgx.thread_num"] == nil || original["sgx.thread_num"].(int64) < 16 {
+	threadNum, err := parseThreadNum(original["sgx.thread_num"])
+	if err != nil {
+		return nil, nil, err
+	}
+	if threadNum < 16 {
 		changes["sgx.thread_num"] = 16
 	}
 
+	// Ensure the stack and brk heap are large enough for the premain Go runtime
+	// Gramine defaults to 256K for both if they are not set
+	for key, minSize := range map[string]datasize.ByteSize{"sys.stack.size": minStackSize, "sys.brk.max_size": minBrkSize} {
+		if minSize == 0 {
+			continue
+		}
+		size, err := parseSize(key, original[key])
+		if err != nil {
+			return nil, nil, err
+		}
+		if original[key] == nil {
+			size = 256 * datasize.KB
+		}
+		if size < minSize {
+			changes[key] = formatGramineSize(minSize)
+		}
+	}
+
 	return original, changes, nil
 }
 
+// parseSize parses the value of a size entry like sgx.enclave_size, which is either a size string like "512M", or a number of bytes.
+// A missing value is returned as 0.
+func parseSize(key string, value interface{}) (datasize.ByteSize, error) {
+	var size datasize.ByteSize
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		if err := size.UnmarshalText([]byte(v)); err != nil {
+			return 0, fmt.Errorf("invalid value for %s %q: %w", key, v, err)
+		}
+		return size, nil
+	case int64:
+		if v < 0 {
+			return 0, fmt.Errorf("invalid value for %s: %d is negative", key, v)
+		}
+		return datasize.ByteSize(v), nil
+	case int:
+		return parseSize(key, int64(v))
+	default:
+		return 0, fmt.Errorf("invalid type %T for %s, expected a size string like \"1024M\"", value, key)
+	}
+}
+
+// formatGramineSize formats a size in the notation of Gramine manifests, e.g. "2M" or "512K".
+func formatGramineSize(size datasize.ByteSize) string {
+	switch {
+	case size != 0 && size%datasize.GB == 0:
+		return fmt.Sprintf("%dG", size/datasize.GB)
+	case size != 0 && size%datasize.MB == 0:
+		return fmt.Sprintf("%dM", size/datasize.MB)
+	case size != 0 && size%datasize.KB == 0:
+		return fmt.Sprintf("%dK", size/datasize.KB)
+	default:
+		return strconv.FormatUint(uint64(size), 10)
+	}
+}
+
+// parseThreadNum parses the value of sgx.thread_num, which is either an integer or a string containing an integer.
+// A missing value is returned as 0.
+func parseThreadNum(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case string:
+		num, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value for sgx.thread_num %q: expected an integer", v)
+		}
+		return num, nil
+	default:
+		return 0, fmt.Errorf("invalid type %T for sgx.thread_num, expected an integer", value)
+	}
+}
+
 // calculateChanges takes two maps with TOML indices and values as input and calculates the difference between them.
 func calculateChanges(original map[string]interface{}, updates map[string]interface{}) []diff {
 	var changeDiffs []diff
@@ -210,8 +387,33 @@ func calculateChanges(original map[string]interface{}, updates map[string]interf
 	return changeDiffs
 }
 
+// signerInfo returns the package properties the MarbleRun manifest needs to reference for the Gramine enclave.
+func signerInfo(original map[string]interface{}) []string {
+	// Gramine defaults to 0 for both ISVPRODID and ISVSVN if they are not set
+	prodID, svn := original["sgx.isvprodid"], original["sgx.isvsvn"]
+	if prodID == nil {
+		prodID = 0
+	}
+	if svn == nil {
+		svn = 0
+	}
+	debug, _ := original["sgx.debug"].(bool)
+
+	info := []string{
+		fmt.Sprintf("ProductID: %v (sgx.isvprodid)", prodID),
+		fmt.Sprintf("SecurityVersion: %v (sgx.isvsvn)", svn),
+		fmt.Sprintf("Debug: %v (sgx.debug)", debug),
+		"SignerID: MRSIGNER of the key used with gramine-sgx-sign. Run 'marblerun package-info' on the resulting .sig file to retrieve it.",
+	}
+	if debug {
+		info = append(info, "Warning: the enclave is built in debug mode. The MarbleRun manifest needs to set Debug for the package, which should not be used in production.")
+	}
+	return info
+}
+
 // performChanges displays the suggested changes to the user and tries to automatically perform them.
-func performChanges(changeDiffs []diff, fileName string) error {
+// When upgrading, the manifest is backed up under a separate name, so the backup of the original manifest is kept.
+func performChanges(changeDiffs []diff, signerInfo []string, fileName, premainName, arch string, downloadAttempts int, upgrade, noDownload bool) error {
 	fmt.Println("\nMarbleRun suggests the following changes to your Gramine manifest:")
 	for _, entry := range changeDiffs {
 		if entry.alreadyExists {
@@ -221,6 +423,15 @@ func performChanges(changeDiffs []diff, fileName string) error {
 		}
 	}
 
+	fmt.Println("\nThe package definition in your MarbleRun manifest needs to match the enclave's signature:")
+	for _, entry := range signerInfo {
+		if strings.HasPrefix(entry, "Warning:") {
+			color.Yellow(entry)
+		} else {
+			fmt.Println(entry)
+		}
+	}
+
 	accepted, err := promptYesNo(os.Stdin, promptForChanges)
 	if err != nil {
 		return err
@@ -247,6 +458,9 @@ func performChanges(changeDiffs []diff, fileName string) error {
 
 	// Backup original manifest
 	backupFileName := filepath.Base(fileName) + ".bak"
+	if upgrade {
+		backupFileName = filepath.Base(fileName) + ".upgrade.bak"
+	}
 	fmt.Printf("Saving original manifest as %s...\n", backupFileName)
 	if err := ioutil.WriteFile(filepath.Join(directory, backupFileName), manifestContentOriginal, 0o644); err != nil {
 		return err
@@ -259,31 +473,49 @@ func performChanges(changeDiffs []diff, fileName string) error {
 		return err
 	}
 
-	fmt.Println("Downloading MarbleRun premain from GitHub...")
-	// Download MarbleRun premain for Gramine from GitHub
-	if err := downloadPremain(directory); err != nil {
-		color.Red("ERROR: Cannot download '%s' from GitHub. Please add the file manually.", premainName)
-	}
+	providePremain(directory, premainName, arch, downloadAttempts, noDownload)
 
 	fmt.Println("\nDone! You should be good to go for MarbleRun!")
 
 	return nil
 }
 
-func downloadPremain(directory string) error {
+// providePremain downloads the premain next to the manifest, unless noDownload is set because the operator provides it separately.
+// A failed download is reported, but does not fail the command, since the premain can be added manually.
+func providePremain(directory, premainName, arch string, downloadAttempts int, noDownload bool) {
+	if noDownload {
+		color.Yellow("Skipping the download of the premain. Make sure to provide %s yourself, matching the sgx.trusted_files entry.", premainName)
+		return
+	}
+
+	fmt.Println("Downloading MarbleRun premain from GitHub...")
+	// Download MarbleRun premain for Gramine from GitHub
+	if err := downloadPremain(directory, premainName, arch, downloadAttempts); err != nil {
+		color.Red("ERROR: Cannot download '%s' from GitHub: %v. Please add the file manually.", premainName, err)
+	}
+}
+
+// downloadPremain downloads the premain-libos executable for the given architecture and saves it as premainName.
+// A relative premainName is resolved against directory. An empty arch downloads the single premain of the release.
+// Transient failures are retried up to the given number of attempts.
+func downloadPremain(directory, premainName, arch string, attempts int) error {
 	cleanVersion := "v" + strings.Split(Version, "-")[0]
 
 	// Download premain-libos executable
-	resp, err := http.Get(fmt.Sprintf("https://github.com/edgelesssys/marblerun/releases/download/%s/%s", cleanVersion, premainName))
+	resp, err := getWithRetry(fmt.Sprintf("https://github.com/edgelesssys/marblerun/releases/download/%s/%s", cleanVersion, premainAssetName(arch)), attempts)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("received a non-successful HTTP response")
-	}
 
-	out, err := os.Create(filepath.Join(directory, premainName))
+	target := filepath.FromSlash(filePath(premainName))
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(directory, target)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	out, err := os.Create(target)
 	if err != nil {
 		return err
 	}
@@ -298,6 +530,64 @@ func downloadPremain(directory string) error {
 	return nil
 }
 
+// premainAssetName returns the name of the premain release asset for the given architecture.
+func premainAssetName(arch string) string {
+	if arch == "" {
+		return defaultPremainName
+	}
+	return defaultPremainName + "-" + arch
+}
+
+// getWithRetry sends a GET request to url and returns the successful response.
+// Network errors, server errors, and rate limiting are retried with exponential backoff and jitter,
+// honoring the Retry-After header of rate-limited responses. Other failures are returned immediately.
+func getWithRetry(url string, attempts int) (*http.Response, error) {
+	backoff := downloadBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := http.Get(url)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		delay := backoff + time.Duration(rand.Int63n(int64(backoff)+1))
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("received HTTP status %s", resp.Status)
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError {
+				return nil, err
+			}
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = retryAfter
+			}
+		}
+		if attempt >= attempts {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+		}
+
+		fmt.Printf("Download failed: %v. Retrying in %s...\n", err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+		backoff *= 2
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, given either in seconds or as HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := time.Until(date); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
 /*
 	Perform the manifest modification.
 	For existing entries: Run a RegEx search, replace the line.
@@ -343,7 +633,8 @@ func appendAndReplace(changeDiffs []diff, manifestContent []byte) ([]byte, error
 			newManifestContent = regex.ReplaceAll(newManifestContent, []byte(value.manifestEntry))
 		} else {
 			// If a value was not defined previously, we append the new entries down below
-			if !firstAdditionDone {
+			// Manifests prepared before already end with the MarbleRun additions, so the marker is only added once
+			if !firstAdditionDone && !bytes.Contains(newManifestContent, []byte(commentMarbleRunAdditions)) {
 				appendToFile := commentMarbleRunAdditions
 				newManifestContent = append(newManifestContent, []byte(appendToFile)...)
 				firstAdditionDone = true
@@ -356,25 +647,96 @@ func appendAndReplace(changeDiffs []diff, manifestContent []byte) ([]byte, error
 	return newManifestContent, nil
 }
 
+// isTrustedFile checks if fileName is covered by the trusted files of a Gramine manifest.
+func isTrustedFile(tree *toml.Tree, fileName string) (bool, error) {
+	return isListedFile(tree, "trusted_files", fileName)
+}
+
+// isListedFile checks if fileName is covered by the trusted or allowed files of a Gramine manifest, depending on fileType.
+// Files may be declared in legacy format, as TOML-array of URIs, or as TOML-array of tables with an uri key.
+// A directory, declared by an URI ending in '/', covers all files below it.
+func isListedFile(tree *toml.Tree, fileType, fileName string) (bool, error) {
+	var uris []interface{}
+	switch files := tree.Get("sgx." + fileType).(type) {
+	case nil:
+		return false, nil
+	case *toml.Tree:
+		// legacy format
+		for _, key := range files.Keys() {
+			uris = append(uris, files.Get(key))
+		}
+	case []interface{}:
+		uris = files
+	case []*toml.Tree:
+		for _, file := range files {
+			uris = append(uris, file.Get("uri"))
+		}
+	default:
+		return false, errors.New("could not read files from Gramine manifest")
+	}
+
+	fileName = filePath(fileName)
+	for _, uri := range uris {
+		if tree, ok := uri.(*toml.Tree); ok {
+			uri = tree.Get("uri")
+		}
+		path, ok := uri.(string)
+		if !ok {
+			continue
+		}
+		path = strings.TrimPrefix(path, "file:")
+		if path != "" && !strings.HasSuffix(path, "/") {
+			path = filePath(path)
+		}
+		if path == fileName || (strings.HasSuffix(path, "/") && strings.HasPrefix(fileName, path)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// legacyKeyReplacer matches characters which are not allowed in bare TOML keys.
+var legacyKeyReplacer = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
 // insertFile checks what trusted/allowed file declaration is used in the manifest and inserts files accordingly.
 // Trusted/allowed files are either present in legacy 'sgx.trusted_files.identifier = "file:/path/file"' format
 // or in TOML-array format.
 func insertFile(original, changes map[string]interface{}, fileType, fileName string, tree *toml.Tree) error {
+	// files listed by a previous run are not added again
+	listed, err := isListedFile(tree, fileType, fileName)
+	if err != nil {
+		return err
+	}
+	if listed {
+		return nil
+	}
+
 	fileTree := tree.Get("sgx." + fileType)
 	switch fileTree.(type) {
 	case nil:
 		// No files are defined in the original manifest
-		changes["sgx."+fileType] = []interface{}{"file:" + fileName}
+		changes["sgx."+fileType] = []interface{}{fileURI(fileName)}
 		return nil
 	case *toml.Tree:
-		// legacy format
-		changes["sgx."+fileType+".marblerun_"+fileName] = "file:" + fileName
+		// legacy format, the file name may contain characters which are not allowed in bare TOML keys
+		changes["sgx."+fileType+".marblerun_"+legacyKeyReplacer.ReplaceAllString(strings.TrimPrefix(filePath(fileName), "/"), "_")] = fileURI(fileName)
 	case []interface{}:
 		// TOML-array format, append file to the array
 		original["sgx."+fileType] = tree.Get("sgx." + fileType)
-		changes["sgx."+fileType] = append(original["sgx."+fileType].([]interface{}), "file:"+fileName)
+		changes["sgx."+fileType] = append(original["sgx."+fileType].([]interface{}), fileURI(fileName))
 	default:
 		return errors.New("could not read files from Gramine manifest")
 	}
 	return nil
 }
+
+// filePath returns the cleaned path of a file given either as path or as "file:" URI.
+// Relative paths stay relative, absolute paths stay absolute.
+func filePath(fileName string) string {
+	return path.Clean(strings.TrimPrefix(fileName, "file:"))
+}
+
+// fileURI returns the "file:" URI of a file given either as path or as URI, e.g. "file:/usr/bin/premain" or "file:premain".
+func fileURI(fileName string) string {
+	return "file:" + filePath(fileName)
+}
@@ -2,10 +2,12 @@ package cmd
 
 import (
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/c2h5oh/datasize"
 	"github.com/jarcoal/httpmock"
@@ -68,7 +70,7 @@ func TestParseTreeForChanges(t *testing.T) {
 
 	// Checking all possible combinations will result in tremendous effort...
 	// So for this, we check if we at least changed the entry point and the memory/thread requirements for the Go runtime
-	original, changes, err := parseTreeForChanges(tree)
+	original, changes, err := parseTreeForChanges(tree, defaultPremainName, uuidName, "", defaultMinStackSize, defaultMinBrkSize)
 	require.NoError(err)
 	assert.NotEmpty(original)
 	assert.NotEmpty(changes)
@@ -76,11 +78,266 @@ func TestParseTreeForChanges(t *testing.T) {
 	// Verify minimum changes
 	var v datasize.ByteSize
 
-	assert.Equal(premainName, changes["libos.entrypoint"])
+	assert.Equal(defaultPremainName, changes["libos.entrypoint"])
 	assert.GreaterOrEqual(changes["sgx.thread_num"], 16)
 	require.NoError(v.UnmarshalText([]byte(changes["sgx.enclave_size"].(string))))
 	assert.GreaterOrEqual(v.GBytes(), 1.00)
 	assert.Equal([]interface{}{"file:/usr/favorite.file", "file:/usr/lib/important.so", "file:premain-libos"}, changes["sgx.trusted_files"])
+
+	// A custom premain name is used for both the entry point and the trusted file
+	_, changes, err = parseTreeForChanges(tree, "bin/premain-custom", uuidName, "", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Equal("bin/premain-custom", changes["libos.entrypoint"])
+	assert.Equal([]interface{}{"file:/usr/favorite.file", "file:/usr/lib/important.so", "file:bin/premain-custom"}, changes["sgx.trusted_files"])
+
+	// In legacy format, the file name is sanitized for use as a key
+	legacyTree, err := toml.Load("libos.entrypoint = \"app\"\nsgx.trusted_files.app = \"file:app\"\n")
+	require.NoError(err)
+	_, changes, err = parseTreeForChanges(legacyTree, "bin/premain.custom", uuidName, "", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Equal("file:bin/premain.custom", changes["sgx.trusted_files.marblerun_bin_premain_custom"])
+
+	// Absolute paths, URIs, and directory prefixes are normalized
+	_, changes, err = parseTreeForChanges(tree, "file:/opt/marblerun/../marblerun/premain", "./data/uuid", "", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Equal("/opt/marblerun/premain", changes["libos.entrypoint"])
+	assert.Equal([]interface{}{"file:/usr/favorite.file", "file:/usr/lib/important.so", "file:/opt/marblerun/premain"}, changes["sgx.trusted_files"])
+	assert.Equal("file:data/uuid", changes["sgx.allowed_files.marblerun_data_uuid"])
+	_, changes, err = parseTreeForChanges(legacyTree, "/opt/premain", "file:/var/uuid", "", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Equal("file:/opt/premain", changes["sgx.trusted_files.marblerun_opt_premain"])
+	assert.Equal([]interface{}{"file:/var/uuid"}, changes["sgx.allowed_files"])
+
+	// If the original entrypoint is an URI, the premain is set as URI as well
+	uriTree, err := toml.Load("libos.entrypoint = \"file:app\"\n")
+	require.NoError(err)
+	_, changes, err = parseTreeForChanges(uriTree, "/opt/premain", uuidName, "", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Equal("file:/opt/premain", changes["libos.entrypoint"])
+}
+
+func TestParseTreeForChangesNumericTypes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const entrypoint = "libos.entrypoint = \"app\"\n"
+
+	testCases := map[string]struct {
+		manifest        string
+		wantErr         bool
+		wantEnclaveSize bool
+		wantThreadNum   bool
+	}{
+		"sufficient values": {
+			manifest: entrypoint + "sgx.enclave_size = \"2G\"\nsgx.thread_num = 32\n",
+		},
+		"quoted thread_num": {
+			manifest:      entrypoint + "sgx.enclave_size = \"2G\"\nsgx.thread_num = \"8\"\n",
+			wantThreadNum: true,
+		},
+		"enclave_size as number of bytes": {
+			manifest:        entrypoint + "sgx.enclave_size = 268435456\nsgx.thread_num = \"32\"\n",
+			wantEnclaveSize: true,
+		},
+		"missing values": {
+			manifest:        entrypoint,
+			wantEnclaveSize: true,
+			wantThreadNum:   true,
+		},
+		"invalid enclave_size": {
+			manifest: entrypoint + "sgx.enclave_size = \"lots\"\n",
+			wantErr:  true,
+		},
+		"invalid thread_num": {
+			manifest: entrypoint + "sgx.thread_num = \"many\"\n",
+			wantErr:  true,
+		},
+		"thread_num of wrong type": {
+			manifest: entrypoint + "sgx.thread_num = 1.5\n",
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tree, err := toml.Load(tc.manifest)
+			require.NoError(err)
+
+			_, changes, err := parseTreeForChanges(tree, defaultPremainName, uuidName, "", defaultMinStackSize, defaultMinBrkSize)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			_, ok := changes["sgx.enclave_size"]
+			assert.Equal(tc.wantEnclaveSize, ok)
+			_, ok = changes["sgx.thread_num"]
+			assert.Equal(tc.wantThreadNum, ok)
+		})
+	}
+}
+
+func TestParseTreeForChangesRuntimeSizes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const entrypoint = "libos.entrypoint = \"app\"\n"
+
+	testCases := map[string]struct {
+		manifest      string
+		minStackSize  datasize.ByteSize
+		minBrkSize    datasize.ByteSize
+		wantStackSize interface{}
+		wantBrkSize   interface{}
+		wantErr       bool
+	}{
+		"missing values are set": {
+			manifest:      entrypoint,
+			minStackSize:  defaultMinStackSize,
+			minBrkSize:    defaultMinBrkSize,
+			wantStackSize: "2M",
+			wantBrkSize:   "64M",
+		},
+		"small values are raised": {
+			manifest:      entrypoint + "sys.stack.size = \"1M\"\nsys.brk.max_size = 1048576\n",
+			minStackSize:  defaultMinStackSize,
+			minBrkSize:    defaultMinBrkSize,
+			wantStackSize: "2M",
+			wantBrkSize:   "64M",
+		},
+		"sufficient values are kept": {
+			manifest:     entrypoint + "sys.stack.size = \"8M\"\nsys.brk.max_size = \"1G\"\n",
+			minStackSize: defaultMinStackSize,
+			minBrkSize:   defaultMinBrkSize,
+		},
+		"custom minimums": {
+			manifest:      entrypoint + "sys.stack.size = \"8M\"\n",
+			minStackSize:  16 * datasize.MB,
+			minBrkSize:    128 * datasize.KB,
+			wantStackSize: "16M",
+		},
+		"disabled checks": {
+			manifest: entrypoint + "sys.stack.size = \"64K\"\n",
+		},
+		"invalid stack size": {
+			manifest:     entrypoint + "sys.stack.size = \"huge\"\n",
+			minStackSize: defaultMinStackSize,
+			wantErr:      true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tree, err := toml.Load(tc.manifest)
+			require.NoError(err)
+
+			_, changes, err := parseTreeForChanges(tree, defaultPremainName, uuidName, "", tc.minStackSize, tc.minBrkSize)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(tc.wantStackSize, changes["sys.stack.size"])
+			assert.Equal(tc.wantBrkSize, changes["sys.brk.max_size"])
+		})
+	}
+
+	assert.Equal("2M", formatGramineSize(2*datasize.MB))
+	assert.Equal("512K", formatGramineSize(512*datasize.KB))
+	assert.Equal("1G", formatGramineSize(datasize.GB))
+	assert.Equal("1000", formatGramineSize(1000))
+}
+
+func TestParseTreeForChangesEntrypoint(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tree, err := toml.Load(someManifest)
+	require.NoError(err)
+
+	// by default, the original entrypoint is started by the premain
+	_, changes, err := parseTreeForChanges(tree, defaultPremainName, uuidName, "", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Equal("myapplication", changes["loader.argv0_override"])
+
+	// an explicitly chosen entrypoint needs to be a trusted file
+	_, changes, err = parseTreeForChanges(tree, defaultPremainName, uuidName, "/usr/lib/important.so", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Equal("/usr/lib/important.so", changes["loader.argv0_override"])
+	_, _, err = parseTreeForChanges(tree, defaultPremainName, uuidName, "/usr/bin/untrusted", defaultMinStackSize, defaultMinBrkSize)
+	assert.Error(err)
+
+	// an existing argv0_override is replaced by the chosen entrypoint
+	tree, err = toml.Load(someManifest + "loader.argv0_override = \"myapplication\"\n")
+	require.NoError(err)
+	_, changes, err = parseTreeForChanges(tree, defaultPremainName, uuidName, "file:/usr/favorite.file", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Equal("file:/usr/favorite.file", changes["loader.argv0_override"])
+
+	testCases := map[string]struct {
+		trustedFiles string
+		trusted      bool
+	}{
+		"legacy format": {
+			trustedFiles: "sgx.trusted_files.app = \"file:/usr/bin/app\"\n",
+			trusted:      true,
+		},
+		"table format": {
+			trustedFiles: "sgx.trusted_files = [ { uri = \"file:/usr/bin/app\" } ]\n",
+			trusted:      true,
+		},
+		"trusted directory": {
+			trustedFiles: "sgx.trusted_files = [ \"file:/usr/bin/\" ]\n",
+			trusted:      true,
+		},
+		"other file": {
+			trustedFiles: "sgx.trusted_files = [ \"file:/usr/bin/app2\" ]\n",
+			trusted:      false,
+		},
+		"no trusted files": {
+			trusted: false,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tree, err := toml.Load("libos.entrypoint = \"app\"\n" + tc.trustedFiles)
+			require.NoError(err)
+			trusted, err := isTrustedFile(tree, "/usr/bin/app")
+			require.NoError(err)
+			assert.Equal(tc.trusted, trusted)
+		})
+	}
+}
+
+func TestSignerInfo(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Values not set in the manifest should be reported with Gramine's defaults
+	tree, err := toml.Load(someManifest)
+	require.NoError(err)
+	original, _, err := parseTreeForChanges(tree, defaultPremainName, uuidName, "", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+
+	info := signerInfo(original)
+	require.Len(info, 4)
+	assert.Equal("ProductID: 0 (sgx.isvprodid)", info[0])
+	assert.Equal("SecurityVersion: 0 (sgx.isvsvn)", info[1])
+	assert.Equal("Debug: false (sgx.debug)", info[2])
+
+	// Debug enclaves should result in a warning
+	tree, err = toml.Load(someManifest + "sgx.isvprodid = 3\nsgx.isvsvn = 2\nsgx.debug = true\n")
+	require.NoError(err)
+	original, _, err = parseTreeForChanges(tree, defaultPremainName, uuidName, "", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+
+	info = signerInfo(original)
+	require.Len(info, 5)
+	assert.Equal("ProductID: 3 (sgx.isvprodid)", info[0])
+	assert.Equal("SecurityVersion: 2 (sgx.isvsvn)", info[1])
+	assert.Equal("Debug: true (sgx.debug)", info[2])
+	assert.True(strings.HasPrefix(info[4], "Warning:"))
 }
 
 func TestAppendAndReplace(t *testing.T) {
@@ -127,6 +384,36 @@ func TestAppendAndReplace(t *testing.T) {
 	assert.EqualValues(changedFiles, newTrustedFiles)
 }
 
+func TestUpgradePreparedManifest(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	prepare := func(manifest, premainName string) string {
+		tree, err := toml.Load(manifest)
+		require.NoError(err)
+		original, changes, err := parseTreeForChanges(tree, premainName, uuidName, "", defaultMinStackSize, defaultMinBrkSize)
+		require.NoError(err)
+		prepared, err := appendAndReplace(calculateChanges(original, changes), []byte(manifest))
+		require.NoError(err)
+		return string(prepared)
+	}
+
+	prepared := prepare(someManifest, defaultPremainName)
+	assert.Equal(1, strings.Count(prepared, commentMarbleRunAdditions))
+
+	// preparing again does not change the manifest
+	assert.Equal(prepared, prepare(prepared, defaultPremainName))
+
+	// changed settings are updated in place
+	upgraded := prepare(prepared, premainAssetName("arm64"))
+	assert.Equal(1, strings.Count(upgraded, commentMarbleRunAdditions))
+	tree, err := toml.Load(upgraded)
+	require.NoError(err)
+	assert.Equal("premain-libos-arm64", tree.Get("libos.entrypoint"))
+	assert.Equal("myapplication", tree.Get("loader.argv0_override"))
+	assert.Equal([]interface{}{"file:/usr/favorite.file", "file:/usr/lib/important.so", "file:premain-libos", "file:premain-libos-arm64"}, tree.Get("sgx.trusted_files"))
+}
+
 func TestDownloadPremain(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -146,12 +433,142 @@ func TestDownloadPremain(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Try to download premain
-	assert.NoError(downloadPremain(tempDir))
-	content, err := ioutil.ReadFile(filepath.Join(tempDir, premainName))
+	assert.NoError(downloadPremain(tempDir, defaultPremainName, "", 1))
+	content, err := ioutil.ReadFile(filepath.Join(tempDir, defaultPremainName))
 	assert.NoError(err)
 	assert.Equal(testContent, content)
 
-	// We should have one download here
+	// A custom name or path only changes the download target
+	assert.NoError(downloadPremain(tempDir, "bin/premain-custom", "", 1))
+	content, err = ioutil.ReadFile(filepath.Join(tempDir, "bin", "premain-custom"))
+	assert.NoError(err)
+	assert.Equal(testContent, content)
+
+	// An absolute path is used as is
+	absolutePath := filepath.Join(tempDir, "absolute", "premain")
+	assert.NoError(downloadPremain(filepath.Join(tempDir, "ignored"), "file:"+filepath.ToSlash(absolutePath), "", 1))
+	content, err = ioutil.ReadFile(absolutePath)
+	assert.NoError(err)
+	assert.Equal(testContent, content)
+
+	// We should have three downloads here
 	info := httpmock.GetCallCountInfo()
-	assert.Equal(1, info[`GET =~^https://github\.com/edgelesssys/marblerun/releases/download/v[0-9\.]*/premain-libos`])
+	assert.Equal(3, info[`GET =~^https://github\.com/edgelesssys/marblerun/releases/download/v[0-9\.]*/premain-libos`])
+}
+
+func TestProvidePremainNoDownload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", `=~^https://github\.com/edgelesssys/marblerun/releases/download/v[0-9\.]*/premain-libos`,
+		httpmock.NewBytesResponder(200, []byte("premain")))
+
+	dir, err := ioutil.TempDir("", "unittest")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// the premain is neither requested nor written
+	providePremain(dir, defaultPremainName, "", 1, true)
+	assert.Zero(httpmock.GetTotalCallCount())
+	_, err = os.Stat(filepath.Join(dir, defaultPremainName))
+	assert.True(os.IsNotExist(err))
+
+	providePremain(dir, defaultPremainName, "", 1, false)
+	assert.Equal(1, httpmock.GetTotalCallCount())
+	_, err = os.Stat(filepath.Join(dir, defaultPremainName))
+	assert.NoError(err)
+}
+
+func TestDownloadPremainArch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", `=~^https://github\.com/edgelesssys/marblerun/releases/download/v[0-9\.]*/premain-libos$`,
+		httpmock.NewStringResponder(200, "default"))
+	httpmock.RegisterResponder("GET", `=~^https://github\.com/edgelesssys/marblerun/releases/download/v[0-9\.]*/premain-libos-arm64$`,
+		httpmock.NewStringResponder(200, "arm64"))
+
+	tempDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	// the architecture selects the release asset
+	assert.NoError(downloadPremain(tempDir, premainAssetName("arm64"), "arm64", 1))
+	content, err := ioutil.ReadFile(filepath.Join(tempDir, "premain-libos-arm64"))
+	assert.NoError(err)
+	assert.Equal("arm64", string(content))
+
+	// without an architecture, the single premain of the release is downloaded
+	assert.NoError(downloadPremain(tempDir, defaultPremainName, "", 1))
+	content, err = ioutil.ReadFile(filepath.Join(tempDir, defaultPremainName))
+	assert.NoError(err)
+	assert.Equal("default", string(content))
+}
+
+func TestDownloadPremainRetry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(backoff time.Duration) { downloadBackoff = backoff }(downloadBackoff)
+	downloadBackoff = time.Millisecond
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	testContent := []byte("premain")
+	const url = `=~^https://github\.com/edgelesssys/marblerun/releases/download/v[0-9\.]*/premain-libos`
+	rateLimited := httpmock.NewStringResponse(http.StatusTooManyRequests, "")
+	rateLimited.Header.Set("Retry-After", "0")
+
+	tempDir, err := ioutil.TempDir("", "")
+	require.NoError(err)
+	defer os.RemoveAll(tempDir)
+
+	// server errors and rate limiting are retried
+	httpmock.RegisterResponder("GET", url, httpmock.ResponderFromMultipleResponses([]*http.Response{
+		httpmock.NewStringResponse(http.StatusServiceUnavailable, ""),
+		rateLimited,
+		httpmock.NewBytesResponse(http.StatusOK, testContent),
+	}))
+	assert.NoError(downloadPremain(tempDir, defaultPremainName, "", 3))
+	content, err := ioutil.ReadFile(filepath.Join(tempDir, defaultPremainName))
+	assert.NoError(err)
+	assert.Equal(testContent, content)
+	assert.Equal(3, httpmock.GetTotalCallCount())
+
+	// the download gives up after the given number of attempts
+	httpmock.Reset()
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusBadGateway, ""))
+	assert.Error(downloadPremain(tempDir, defaultPremainName, "", 2))
+	assert.Equal(2, httpmock.GetTotalCallCount())
+
+	// other client errors are not retried
+	httpmock.Reset()
+	httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusNotFound, ""))
+	assert.Error(downloadPremain(tempDir, defaultPremainName, "", 3))
+	assert.Equal(1, httpmock.GetTotalCallCount())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	delay, ok := parseRetryAfter("120")
+	assert.True(ok)
+	assert.Equal(2*time.Minute, delay)
+
+	delay, ok = parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(ok)
+	assert.InDelta(time.Hour, delay, float64(time.Minute))
+
+	delay, ok = parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(ok)
+	assert.Zero(delay)
+
+	_, ok = parseRetryAfter("")
+	assert.False(ok)
+	_, ok = parseRetryAfter("soon")
+	assert.False(ok)
 }
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/fatih/color"
+	"github.com/pelletier/go-toml"
+	"github.com/spf13/cobra"
+)
+
+func newGramineVerifyCmd() *cobra.Command {
+	var premainName string
+	var uuidFile string
+	var minStackSize string
+	var minBrkSize string
+
+	cmd := &cobra.Command{
+		Use:   "gramine-verify",
+		Short: "Verifies that a Gramine manifest is prepared for use with MarbleRun",
+		Long: `Verifies that a Gramine manifest is prepared for use with MarbleRun.
+
+This command checks all requirements gramine-prepare takes care of, e.g., after the manifest was edited manually.
+It lists every missing or insufficient entry and fails if the manifest is not compatible with MarbleRun.
+
+The parameter of this command is the path of the Gramine manifest template you want to verify.
+`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var stackSize, brkSize datasize.ByteSize
+			if err := stackSize.UnmarshalText([]byte(minStackSize)); err != nil {
+				return fmt.Errorf("invalid minimum stack size %q: %w", minStackSize, err)
+			}
+			if err := brkSize.UnmarshalText([]byte(minBrkSize)); err != nil {
+				return fmt.Errorf("invalid minimum brk size %q: %w", minBrkSize, err)
+			}
+
+			tree, err := toml.LoadFile(args[0])
+			if os.IsNotExist(err) {
+				return fmt.Errorf("file does not exist: %v", args[0])
+			} else if err != nil {
+				return fmt.Errorf("cannot parse manifest: %w", err)
+			}
+
+			problems, err := verifyGramineManifest(tree, premainName, uuidFile, stackSize, brkSize)
+			if err != nil {
+				return err
+			}
+			if len(problems) > 0 {
+				color.Red("The Gramine manifest is not compatible with MarbleRun:")
+				for _, problem := range problems {
+					fmt.Println(" -", problem)
+				}
+				return fmt.Errorf("found %d problems in Gramine manifest", len(problems))
+			}
+			color.Green("The Gramine manifest is compatible with MarbleRun.")
+			return nil
+		},
+		SilenceUsage: true,
+	}
+
+	cmd.Flags().StringVar(&premainName, "premain-name", defaultPremainName, "Name or path of the premain executable, relative to the Gramine manifest")
+	cmd.Flags().StringVar(&uuidFile, "uuid-file", uuidName, "Path of the file the premain stores the Marble's UUID in")
+	cmd.Flags().StringVar(&minStackSize, "min-stack-size", formatGramineSize(defaultMinStackSize), "Minimum value of sys.stack.size for the premain's Go runtime, 0 skips the check")
+	cmd.Flags().StringVar(&minBrkSize, "min-brk-size", formatGramineSize(defaultMinBrkSize), "Minimum value of sys.brk.max_size for the premain's Go runtime, 0 skips the check")
+
+	return cmd
+}
+
+// verifyGramineManifest checks if a Gramine manifest satisfies all requirements of MarbleRun and returns a description of each unsatisfied one.
+func verifyGramineManifest(tree *toml.Tree, premainName, uuidFile string, minStackSize, minBrkSize datasize.ByteSize) ([]string, error) {
+	if premainName == "" {
+		return nil, errors.New("premain name must not be empty")
+	}
+	if uuidFile == "" {
+		return nil, errors.New("uuid file must not be empty")
+	}
+
+	original, changes, err := parseTreeForChanges(tree, premainName, uuidFile, "", minStackSize, minBrkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	// gramine-prepare always proposes the entrypoint and file entries, so they are checked directly
+	if entrypoint, _ := original["libos.entrypoint"].(string); filePath(entrypoint) != filePath(premainName) {
+		problems = append(problems, fmt.Sprintf("libos.entrypoint is %q, but must be the premain %q", entrypoint, filePath(premainName)))
+	}
+	if trusted, err := isListedFile(tree, "trusted_files", premainName); err != nil {
+		return nil, err
+	} else if !trusted {
+		problems = append(problems, fmt.Sprintf("premain %q is not listed in sgx.trusted_files", filePath(premainName)))
+	}
+	if allowed, err := isListedFile(tree, "allowed_files", uuidFile); err != nil {
+		return nil, err
+	} else if !allowed {
+		problems = append(problems, fmt.Sprintf("uuid file %q is not listed in sgx.allowed_files", filePath(uuidFile)))
+	}
+	for key := range changes {
+		if key == "libos.entrypoint" || strings.HasPrefix(key, "sgx.trusted_files") || strings.HasPrefix(key, "sgx.allowed_files") {
+			delete(changes, key)
+		}
+	}
+
+	// every other change gramine-prepare would perform is an unsatisfied requirement
+	for _, change := range calculateChanges(original, changes) {
+		if change.alreadyExists {
+			problems = append(problems, "insufficient value, expected: "+change.manifestEntry)
+		} else {
+			problems = append(problems, "missing entry: "+change.manifestEntry)
+		}
+	}
+	return problems, nil
+}
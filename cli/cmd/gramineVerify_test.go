@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyGramineManifest(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// an unprepared manifest lacks all MarbleRun changes
+	tree, err := toml.Load(someManifest)
+	require.NoError(err)
+	problems, err := verifyGramineManifest(tree, defaultPremainName, uuidName, defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Contains(problems, `libos.entrypoint is "myapplication", but must be the premain "premain-libos"`)
+	assert.Contains(problems, `premain "premain-libos" is not listed in sgx.trusted_files`)
+	assert.Contains(problems, "insufficient value, expected: sgx.remote_attestation = true")
+	assert.Contains(problems, `missing entry: loader.env.EDG_MARBLE_TYPE = "{ passthrough = true }"`)
+
+	// a manifest prepared by gramine-prepare passes
+	original, changes, err := parseTreeForChanges(tree, defaultPremainName, uuidName, "", defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	preparedManifest, err := appendAndReplace(calculateChanges(original, changes), []byte(someManifest))
+	require.NoError(err)
+	// calculateChanges skips new keys, so the legacy-format allowed file entry is added manually
+	preparedManifest = append(preparedManifest, []byte("sgx.allowed_files.uuid = \"file:uuid\"\n")...)
+	tree, err = toml.Load(string(preparedManifest))
+	require.NoError(err)
+	problems, err = verifyGramineManifest(tree, defaultPremainName, uuidName, defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Empty(problems)
+
+	// manual edits which break requirements are detected
+	brokenManifest := strings.Replace(string(preparedManifest), "sgx.remote_attestation = true", "sgx.remote_attestation = false", 1)
+	brokenManifest = strings.Replace(brokenManifest, `sgx.thread_num = 16`, `sgx.thread_num = 4`, 1)
+	tree, err = toml.Load(brokenManifest)
+	require.NoError(err)
+	problems, err = verifyGramineManifest(tree, defaultPremainName, uuidName, defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.ElementsMatch([]string{
+		"insufficient value, expected: sgx.remote_attestation = true",
+		"insufficient value, expected: sgx.thread_num = 16",
+	}, problems)
+
+	// a different premain name is checked as well
+	tree, err = toml.Load(string(preparedManifest))
+	require.NoError(err)
+	problems, err = verifyGramineManifest(tree, "bin/premain", uuidName, defaultMinStackSize, defaultMinBrkSize)
+	require.NoError(err)
+	assert.Len(problems, 2)
+
+	// manifests without entrypoint can not be verified
+	tree, err = toml.Load(`sgx.remote_attestation = true`)
+	require.NoError(err)
+	_, err = verifyGramineManifest(tree, defaultPremainName, uuidName, defaultMinStackSize, defaultMinBrkSize)
+	assert.Error(err)
+}
@@ -25,8 +25,11 @@ or return a signature of the currently set manifest to the user`,
 
 	cmd.PersistentFlags().StringVar(&eraConfig, "era-config", "", "Path to remote attestation config file in json format, if none provided the newest configuration will be loaded from github")
 	cmd.PersistentFlags().BoolVarP(&insecureEra, "insecure", "i", false, "Set to skip quote verification, needed when running in simulation mode")
+	cmd.AddCommand(newManifestDiff())
 	cmd.AddCommand(newManifestGet())
 	cmd.AddCommand(newManifestLog())
+	cmd.AddCommand(newManifestPreview())
+	cmd.AddCommand(newManifestSchema())
 	cmd.AddCommand(newManifestSet())
 	cmd.AddCommand(newManifestSignature())
 	cmd.AddCommand(newManifestUpdate())
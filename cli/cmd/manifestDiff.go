@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/edgelesssys/marblerun/coordinator/manifest"
+	"github.com/spf13/cobra"
+)
+
+func newManifestDiff() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff <old.json> <new.json>",
+		Short: "Shows the differences between two MarbleRun manifests",
+		Long: `Shows the differences between two MarbleRun manifests.
+Packages, Marbles, Secrets, and Infrastructures are compared by their definitions,
+so reordering entries or changing the formatting of a manifest does not show up as a difference.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			oldManifest, err := loadManifestStruct(args[0])
+			if err != nil {
+				return err
+			}
+			newManifest, err := loadManifestStruct(args[1])
+			if err != nil {
+				return err
+			}
+
+			cliManifestDiff(os.Stdout, oldManifest, newManifest)
+			return nil
+		},
+		SilenceUsage: true,
+	}
+
+	return cmd
+}
+
+// loadManifestStruct loads a JSON or YAML manifest file and unmarshals it.
+func loadManifestStruct(filename string) (manifest.Manifest, error) {
+	rawManifest, err := loadManifestFile(filename)
+	if err != nil {
+		return manifest.Manifest{}, err
+	}
+	var mnf manifest.Manifest
+	if err := json.Unmarshal(rawManifest, &mnf); err != nil {
+		return manifest.Manifest{}, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+	return mnf, nil
+}
+
+// cliManifestDiff writes the differences between two manifests to out.
+func cliManifestDiff(out io.Writer, oldManifest, newManifest manifest.Manifest) {
+	sections := []struct {
+		name    string
+		entries []string
+	}{
+		{"Packages", diffEntries(oldManifest.Packages, newManifest.Packages, fieldChanges)},
+		{"Marbles", diffEntries(oldManifest.Marbles, newManifest.Marbles, marbleChanges)},
+		{"Secrets", diffEntries(oldManifest.Secrets, newManifest.Secrets, fieldChanges)},
+		{"Infrastructures", diffEntries(oldManifest.Infrastructures, newManifest.Infrastructures, fieldChanges)},
+	}
+
+	var changed bool
+	for _, section := range sections {
+		if len(section.entries) == 0 {
+			continue
+		}
+		changed = true
+		fmt.Fprintf(out, "%s:\n", section.name)
+		for _, entry := range section.entries {
+			fmt.Fprintf(out, "  %s\n", entry)
+		}
+	}
+	if !changed {
+		fmt.Fprintln(out, "No differences in Packages, Marbles, Secrets, or Infrastructures")
+	}
+}
+
+// diffEntries compares two maps of manifest entries and returns a sorted list of added, removed, and changed entries.
+// changes is called for entries present in both maps and returns a description of each changed property.
+func diffEntries(oldEntries, newEntries interface{}, changes func(oldValue, newValue interface{}) []string) []string {
+	oldMap, newMap := reflect.ValueOf(oldEntries), reflect.ValueOf(newEntries)
+
+	names := map[string]bool{}
+	for _, key := range oldMap.MapKeys() {
+		names[key.String()] = true
+	}
+	for _, key := range newMap.MapKeys() {
+		names[key.String()] = true
+	}
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	var entries []string
+	for _, name := range sortedNames {
+		oldValue := oldMap.MapIndex(reflect.ValueOf(name))
+		newValue := newMap.MapIndex(reflect.ValueOf(name))
+		switch {
+		case !oldValue.IsValid():
+			entries = append(entries, fmt.Sprintf("+ %s (added)", name))
+		case !newValue.IsValid():
+			entries = append(entries, fmt.Sprintf("- %s (removed)", name))
+		default:
+			for _, change := range changes(oldValue.Interface(), newValue.Interface()) {
+				entries = append(entries, fmt.Sprintf("~ %s: %s", name, change))
+			}
+		}
+	}
+	return entries
+}
+
+// fieldChanges compares the exported fields of two structs of the same type.
+// Changes of simple values are shown as "Field: old -> new", other fields are only reported as changed.
+func fieldChanges(oldValue, newValue interface{}) []string {
+	oldStruct, newStruct := reflect.ValueOf(oldValue), reflect.ValueOf(newValue)
+
+	var changes []string
+	for i := 0; i < oldStruct.NumField(); i++ {
+		field := oldStruct.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		oldField, newField := oldStruct.Field(i).Interface(), newStruct.Field(i).Interface()
+		if reflect.DeepEqual(oldField, newField) {
+			continue
+		}
+		oldString, oldOK := formatSimpleValue(oldField)
+		newString, newOK := formatSimpleValue(newField)
+		if oldOK && newOK {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", field.Name, oldString, newString))
+		} else {
+			changes = append(changes, fmt.Sprintf("%s changed", field.Name))
+		}
+	}
+	return changes
+}
+
+// marbleChanges compares two Marbles, describing changes of their Parameters in detail.
+func marbleChanges(oldValue, newValue interface{}) []string {
+	oldMarble, newMarble := oldValue.(manifest.Marble), newValue.(manifest.Marble)
+	oldParams, newParams := oldMarble.Parameters, newMarble.Parameters
+	oldMarble.Parameters, newMarble.Parameters = manifest.Parameters{}, manifest.Parameters{}
+
+	changes := fieldChanges(oldMarble, newMarble)
+	for _, entry := range diffEntries(oldParams.Files, newParams.Files, changedFile) {
+		changes = append(changes, "Parameters.Files "+entry)
+	}
+	for _, entry := range diffEntries(oldParams.Env, newParams.Env, changedFile) {
+		changes = append(changes, "Parameters.Env "+entry)
+	}
+	if !reflect.DeepEqual(oldParams.Argv, newParams.Argv) {
+		changes = append(changes, fmt.Sprintf("Parameters.Argv: %q -> %q", oldParams.Argv, newParams.Argv))
+	}
+	return changes
+}
+
+// changedFile reports a change of a File or environment variable without printing its content, which may be sensitive.
+func changedFile(oldValue, newValue interface{}) []string {
+	if reflect.DeepEqual(oldValue, newValue) {
+		return nil
+	}
+	return []string{"changed"}
+}
+
+// formatSimpleValue formats booleans, numbers, strings, and pointers to them.
+// It returns false for other types.
+func formatSimpleValue(value interface{}) (string, bool) {
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "<unset>", true
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return fmt.Sprintf("%v", v.Interface()), true
+	case reflect.String:
+		return fmt.Sprintf("%q", v.String()), true
+	default:
+		return "", false
+	}
+}
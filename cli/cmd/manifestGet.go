@@ -34,7 +34,12 @@ Optionally get the manifests signature or merge updates into the displayed manif
 			if err != nil {
 				return err
 			}
-			manifest, err := decodeManifest(displayUpdate, gjson.GetBytes(response, "Manifest").String(), hostName, cert)
+			encodedManifest := gjson.GetBytes(response, "Manifest").String()
+			// the effective manifest already contains the updated Marbles and Bundles
+			if effectiveManifest := gjson.GetBytes(response, "EffectiveManifest"); displayUpdate && effectiveManifest.Exists() {
+				encodedManifest = effectiveManifest.String()
+			}
+			manifest, err := decodeManifest(displayUpdate, encodedManifest, hostName, cert)
 			if err != nil {
 				return err
 			}
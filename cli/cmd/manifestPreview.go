@@ -0,0 +1,481 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/edgelesssys/marblerun/coordinator/manifest"
+	"github.com/edgelesssys/marblerun/util"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+func newManifestPreview() *cobra.Command {
+	var marbleUUID string
+	var marbleName string
+	var secretName string
+	var namespace string
+
+	cmd := &cobra.Command{
+		Use:   "preview <manifest.json>",
+		Short: "Shows the secrets and parameters a manifest produces",
+		Long: `Shows the secrets and parameters a manifest produces, without a Coordinator.
+Lists how each secret is generated and renders the parameters of each Marble using sample secret values.
+The sample values are generated locally and differ from the values provided by the Coordinator.
+
+With --k8s-secret, the rendered Env and Files of the Marble selected by --marble are printed as a Kubernetes Secret instead.
+Environment variables are stored under their name, files under their base name.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mnf, err := loadManifestStruct(args[0])
+			if err != nil {
+				return err
+			}
+			id, err := uuid.Parse(marbleUUID)
+			if err != nil {
+				return fmt.Errorf("parsing UUID: %w", err)
+			}
+			if marbleName != "" {
+				if _, ok := mnf.Marbles[marbleName]; !ok {
+					return fmt.Errorf("marble %s is not defined in the manifest", marbleName)
+				}
+			}
+
+			if secretName != "" {
+				if marbleName == "" {
+					return errors.New("--k8s-secret requires a Marble selected by --marble")
+				}
+				return cliManifestPreviewSecret(os.Stdout, mnf, id, marbleName, secretName, namespace)
+			}
+			return cliManifestPreview(os.Stdout, mnf, id, marbleName)
+		},
+		SilenceUsage: true,
+	}
+
+	cmd.Flags().StringVar(&marbleUUID, "uuid", uuid.New().String(), "Sample UUID of the Marble used to derive per-Marble secrets")
+	cmd.Flags().StringVar(&marbleName, "marble", "", "Only render the parameters of this Marble")
+	cmd.Flags().StringVar(&secretName, "k8s-secret", "", "Print the parameters of the Marble as a Kubernetes Secret with this name")
+	cmd.Flags().StringVar(&namespace, "namespace", "", "Namespace of the Kubernetes Secret")
+
+	return cmd
+}
+
+// previewReservedSecrets mirrors the reserved secrets available to templates as {{ .MarbleRun }}.
+type previewReservedSecrets struct {
+	RootCA          manifest.Secret
+	MarbleCert      manifest.Secret
+	UUID            string
+	Tags            map[string]string
+	PreviousSecrets map[string]manifest.Secret
+}
+
+// previewSecretsWrapper mirrors the data templates are executed with during a Marble's activation.
+type previewSecretsWrapper struct {
+	MarbleRun previewReservedSecrets
+	Secrets   map[string]manifest.Secret
+}
+
+// cliManifestPreview writes the secrets of a manifest and the parameters of its Marbles rendered with sample secrets to out.
+// If marbleName is set, only the parameters of this Marble are rendered.
+func cliManifestPreview(out io.Writer, mnf manifest.Manifest, marbleUUID uuid.UUID, marbleName string) error {
+	secretNames := make([]string, 0, len(mnf.Secrets))
+	for name := range mnf.Secrets {
+		secretNames = append(secretNames, name)
+	}
+	sort.Strings(secretNames)
+
+	fmt.Fprintln(out, "Secrets:")
+	for _, name := range secretNames {
+		secret := mnf.Secrets[name]
+		fmt.Fprintf(out, "  %s: %s %s\n", name, describeSecretType(secret), describeSecretSource(secret))
+	}
+
+	data, err := samplePreviewData(mnf, marbleUUID)
+	if err != nil {
+		return err
+	}
+
+	marbleNames := make([]string, 0, len(mnf.Marbles))
+	for name := range mnf.Marbles {
+		if marbleName == "" || name == marbleName {
+			marbleNames = append(marbleNames, name)
+		}
+	}
+	sort.Strings(marbleNames)
+
+	for _, name := range marbleNames {
+		params, err := renderPreviewParameters(mnf, name, data)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "\nMarble %s (UUID %s):\n", name, marbleUUID)
+		fmt.Fprintf(out, "  Argv: %q\n", params.Argv)
+
+		fmt.Fprintln(out, "  Env:")
+		for _, envName := range sortedFileNames(params.Env) {
+			fmt.Fprintf(out, "    %s=%s\n", envName, indentPreview(params.Env[envName].Data, "      "))
+		}
+
+		fmt.Fprintln(out, "  Files:")
+		for _, path := range sortedFileNames(params.Files) {
+			fmt.Fprintf(out, "    %s:\n      %s\n", path, indentPreview(params.Files[path].Data, "      "))
+		}
+	}
+
+	return nil
+}
+
+// cliManifestPreviewSecret writes a Kubernetes Secret holding the Env and Files of a Marble rendered with sample secrets to out.
+// Environment variables are stored under their name, files under their base name.
+func cliManifestPreviewSecret(out io.Writer, mnf manifest.Manifest, marbleUUID uuid.UUID, marbleName, secretName, namespace string) error {
+	if errs := validation.IsDNS1123Subdomain(secretName); len(errs) > 0 {
+		return fmt.Errorf("invalid Kubernetes Secret name %s: %s", secretName, strings.Join(errs, ", "))
+	}
+
+	data, err := samplePreviewData(mnf, marbleUUID)
+	if err != nil {
+		return err
+	}
+	params, err := renderPreviewParameters(mnf, marbleName, data)
+	if err != nil {
+		return err
+	}
+
+	secretData := map[string][]byte{}
+	addEntry := func(key, source, value string) error {
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			return fmt.Errorf("%s can not be stored in a Kubernetes Secret: %s", source, strings.Join(errs, ", "))
+		}
+		if _, ok := secretData[key]; ok {
+			return fmt.Errorf("%s can not be stored in a Kubernetes Secret: key %s is used more than once", source, key)
+		}
+		secretData[key] = []byte(value)
+		return nil
+	}
+	for _, envName := range sortedFileNames(params.Env) {
+		if err := addEntry(envName, "env variable "+envName, params.Env[envName].Data); err != nil {
+			return err
+		}
+	}
+	for _, path := range sortedFileNames(params.Files) {
+		if err := addEntry(filepath.Base(path), "file "+path, params.Files[path].Data); err != nil {
+			return err
+		}
+	}
+
+	secret := corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+			Labels:    map[string]string{"marblerun/marbletype": marbleName},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: secretData,
+	}
+	secretYAML, err := yaml.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(secretYAML)
+	return err
+}
+
+// samplePreviewData generates the data templates are executed with, using sample values for all secrets.
+func samplePreviewData(mnf manifest.Manifest, marbleUUID uuid.UUID) (previewSecretsWrapper, error) {
+	// derived secrets use a sample key, as the Coordinator's root key never leaves the Coordinator
+	sampleRootKey := make([]byte, 32)
+	if _, err := rand.Read(sampleRootKey); err != nil {
+		return previewSecretsWrapper{}, err
+	}
+
+	secrets := make(map[string]manifest.Secret, len(mnf.Secrets))
+	for name, secret := range mnf.Secrets {
+		sample, err := sampleSecret(name, secret, marbleUUID, sampleRootKey)
+		if err != nil {
+			return previewSecretsWrapper{}, fmt.Errorf("generating sample value for secret %s: %w", name, err)
+		}
+		secrets[name] = sample
+	}
+
+	sampleMarbleCert, err := sampleSecret("MarbleCert", manifest.Secret{Type: "cert-ecdsa", Size: 256}, marbleUUID, sampleRootKey)
+	if err != nil {
+		return previewSecretsWrapper{}, err
+	}
+	return previewSecretsWrapper{
+		MarbleRun: previewReservedSecrets{
+			RootCA:     manifest.Secret{Cert: sampleMarbleCert.Cert},
+			MarbleCert: sampleMarbleCert,
+			UUID:       marbleUUID.String(),
+			// outside of a rotation's grace period, the previous secrets equal the current ones
+			PreviousSecrets: secrets,
+		},
+		Secrets: secrets,
+	}, nil
+}
+
+// renderPreviewParameters resolves the parameters of a Marble and executes their templates.
+// The Data of the returned Files and Env holds the rendered values.
+func renderPreviewParameters(mnf manifest.Manifest, marbleName string, data previewSecretsWrapper) (manifest.Parameters, error) {
+	marble := mnf.Marbles[marbleName]
+	params, err := mnf.ResolveParameters(marble)
+	if err != nil {
+		return manifest.Parameters{}, fmt.Errorf("marble %s: %w", marbleName, err)
+	}
+	data.MarbleRun.Tags = marble.Tags
+	// secrets restricted to a group of Marbles are only received by its members
+	secrets := make(map[string]manifest.Secret, len(data.Secrets))
+	for name, secret := range data.Secrets {
+		if secret.AvailableTo(marbleName) {
+			secrets[name] = secret
+		}
+	}
+	data.Secrets = secrets
+	data.MarbleRun.PreviousSecrets = secrets
+	fileFuncMap := previewFuncMap(manifest.ManifestFileTemplateFuncMap, mnf.CoordinatorEnv, mnf.CoordinatorFiles)
+	envFuncMap := previewFuncMap(manifest.ManifestEnvTemplateFuncMap, mnf.CoordinatorEnv, mnf.CoordinatorFiles)
+
+	rendered := manifest.Parameters{
+		Argv:  make([]string, 0, len(params.Argv)),
+		Env:   make(map[string]manifest.File, len(params.Env)),
+		Files: make(map[string]manifest.File, len(params.Files)),
+	}
+	for i, arg := range params.Argv {
+		value, err := renderPreviewTemplate(arg, envFuncMap, data)
+		if err != nil {
+			return manifest.Parameters{}, fmt.Errorf("marble %s: argument %d: %w", marbleName, i, err)
+		}
+		rendered.Argv = append(rendered.Argv, value)
+	}
+	for envName, file := range params.Env {
+		value, err := renderPreviewFile(file, envFuncMap, data)
+		if err != nil {
+			return manifest.Parameters{}, fmt.Errorf("marble %s: env variable %s: %w", marbleName, envName, err)
+		}
+		rendered.Env[envName] = manifest.File{Data: value}
+	}
+	for path, file := range params.Files {
+		value, err := renderPreviewFile(file, fileFuncMap, data)
+		if err != nil {
+			return manifest.Parameters{}, fmt.Errorf("marble %s: file %s: %w", marbleName, path, err)
+		}
+		rendered.Files[path] = manifest.File{Data: value}
+	}
+	return rendered, nil
+}
+
+// describeSecretType returns the type of a secret including its size and algorithm, if set.
+func describeSecretType(secret manifest.Secret) string {
+	description := secret.Type
+	if secret.Size != 0 {
+		description += fmt.Sprintf(" (%d bits)", secret.Size)
+	}
+	if secret.Type == "hmac" {
+		description += " " + secret.WithDefaultAlgorithm().Algorithm
+	}
+	if secret.Type == "ca-cert" {
+		description += fmt.Sprintf(" with path length %d", secret.PathLen)
+	}
+	return description
+}
+
+// describeSecretSource returns how the Coordinator generates a secret.
+func describeSecretSource(secret manifest.Secret) string {
+	switch {
+	case secret.UserDefined:
+		return "(set by a user)"
+	case secret.Shared && secret.Deterministic:
+		return "(shared, derived from the Coordinator's root key)"
+	case secret.Shared:
+		return "(shared, random)"
+	case secret.Type == "symmetric-key" || secret.Type == "hmac":
+		return "(per Marble, derived from the Coordinator's root key and the Marble's UUID)"
+	default:
+		return "(random per activation)"
+	}
+}
+
+// sampleSecret generates a sample value for a secret, mirroring the generation of the Coordinator.
+func sampleSecret(name string, secret manifest.Secret, marbleUUID uuid.UUID, sampleRootKey []byte) (manifest.Secret, error) {
+	switch secret.Type {
+	case "symmetric-key", "hmac":
+		if secret.Size == 0 || secret.Size%8 != 0 {
+			return manifest.Secret{}, fmt.Errorf("invalid secret size: %d", secret.Size)
+		}
+		var value []byte
+		if (secret.Shared && !secret.Deterministic) || secret.UserDefined {
+			value = make([]byte, secret.Size/8)
+			if _, err := rand.Read(value); err != nil {
+				return manifest.Secret{}, err
+			}
+		} else {
+			id := marbleUUID
+			if secret.Shared {
+				id = uuid.Nil
+			}
+			var err error
+			value, err = util.DeriveKey(sampleRootKey, []byte(id.String()+name), secret.Size/8)
+			if err != nil {
+				return manifest.Secret{}, err
+			}
+		}
+		secret = secret.WithDefaultAlgorithm()
+		secret.Private = value
+		secret.Public = value
+		return secret, nil
+	case "plain":
+		secret.Private = []byte("sample-" + name)
+		secret.Public = []byte("sample-" + name)
+		return secret, nil
+	case "cert-rsa", "cert-ecdsa", "cert-ed25519", "ca-cert":
+		return sampleCertificate(secret)
+	default:
+		return manifest.Secret{}, fmt.Errorf("unknown secret type: %s", secret.Type)
+	}
+}
+
+// sampleCertificate generates a self-signed certificate for a certificate secret.
+func sampleCertificate(secret manifest.Secret) (manifest.Secret, error) {
+	var privKey crypto.Signer
+	var err error
+	switch secret.Type {
+	case "cert-rsa":
+		privKey, err = rsa.GenerateKey(rand.Reader, int(secret.Size))
+	case "cert-ed25519":
+		_, privKey, err = ed25519.GenerateKey(rand.Reader)
+	case "cert-ecdsa", "ca-cert":
+		curves := map[uint]elliptic.Curve{224: elliptic.P224(), 256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}
+		curve, ok := curves[secret.Size]
+		if !ok {
+			return manifest.Secret{}, fmt.Errorf("unsupported size %d: does not map to a supported curve", secret.Size)
+		}
+		privKey, err = ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	if err != nil {
+		return manifest.Secret{}, err
+	}
+
+	template := x509.Certificate(secret.Cert)
+	template.SerialNumber = big.NewInt(1)
+	if template.Subject.CommonName == "" {
+		template.Subject.CommonName = "localhost"
+	}
+	template.NotBefore = time.Now()
+	template.NotAfter = template.NotBefore.AddDate(0, 0, 1)
+	if secret.Type == "ca-cert" {
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+		template.MaxPathLen = secret.PathLen
+		template.MaxPathLenZero = secret.PathLen == 0
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	certRaw, err := x509.CreateCertificate(rand.Reader, &template, &template, privKey.Public(), privKey)
+	if err != nil {
+		return manifest.Secret{}, err
+	}
+	cert, err := x509.ParseCertificate(certRaw)
+	if err != nil {
+		return manifest.Secret{}, err
+	}
+
+	secret.Cert = manifest.Certificate(*cert)
+	if secret.Private, err = x509.MarshalPKCS8PrivateKey(privKey); err != nil {
+		return manifest.Secret{}, err
+	}
+	if secret.Public, err = x509.MarshalPKIXPublicKey(privKey.Public()); err != nil {
+		return manifest.Secret{}, err
+	}
+	return secret, nil
+}
+
+// previewFuncMap returns a copy of funcMap with coordinatorEnv and hostFile functions returning placeholders.
+func previewFuncMap(funcMap template.FuncMap, allowedEnv []string, allowedFiles map[string]string) template.FuncMap {
+	newFuncMap := template.FuncMap{
+		"coordinatorEnv": func(name string) (string, error) {
+			for _, allowed := range allowedEnv {
+				if name == allowed {
+					return "<Coordinator environment variable " + name + ">", nil
+				}
+			}
+			return "", fmt.Errorf("environment variable %s is not listed in CoordinatorEnv", name)
+		},
+		"hostFile": func(path string) (string, error) {
+			if _, ok := allowedFiles[path]; !ok {
+				return "", fmt.Errorf("file %s is not listed in CoordinatorFiles", path)
+			}
+			return "<Coordinator host file " + path + ">", nil
+		},
+	}
+	for name, fn := range funcMap {
+		newFuncMap[name] = fn
+	}
+	// sample secrets are no JSON documents, so the extracted field is replaced by a placeholder
+	newFuncMap["jsonField"] = func(data interface{}, path string) (string, error) {
+		if err := manifest.CheckJSONFieldPath(path); err != nil {
+			return "", err
+		}
+		if _, err := manifest.EncodeSecretDataToRaw(data); err != nil {
+			return "", err
+		}
+		return "<JSON field " + path + ">", nil
+	}
+	return newFuncMap
+}
+
+// renderPreviewFile executes the templates of a File, unless they are disabled.
+func renderPreviewFile(file manifest.File, funcMap template.FuncMap, data previewSecretsWrapper) (string, error) {
+	if file.Secret != "" {
+		return renderPreviewTemplate(file.SecretTemplate(), funcMap, data)
+	}
+	if file.NoTemplates {
+		return file.Data, nil
+	}
+	return renderPreviewTemplate(file.Data, funcMap, data)
+}
+
+func renderPreviewTemplate(data string, funcMap template.FuncMap, secrets previewSecretsWrapper) (string, error) {
+	tpl, err := template.New("data").Funcs(funcMap).Parse(data)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := tpl.Execute(&rendered, secrets); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// indentPreview indents all lines but the first of a multi-line value.
+func indentPreview(value, indent string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(value, "\n"), "\n", "\n"+indent)
+}
+
+func sortedFileNames(files map[string]manifest.File) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/edgelesssys/marblerun/coordinator/manifest"
+	"github.com/spf13/cobra"
+)
+
+func newManifestSchema() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "schema",
+		Short: "Prints a JSON Schema of the MarbleRun manifest",
+		Long: `Prints a JSON Schema of the MarbleRun manifest.
+The schema is generated from the manifest types of this version of MarbleRun.
+Editors can use it to complete and validate manifests before they are set.
+It only describes the structure of a manifest, the Coordinator checks its semantics when it is set.`,
+		Example: "manifest schema -o manifest.schema.json",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			schema, err := manifest.JSONSchema()
+			if err != nil {
+				return err
+			}
+			if len(output) > 0 {
+				return ioutil.WriteFile(output, schema, 0o644)
+			}
+			fmt.Println(string(schema))
+			return nil
+		},
+		SilenceUsage: true,
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Save output to file instead of printing to stdout")
+	return cmd
+}
@@ -2,26 +2,43 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/spf13/cobra"
 	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
 	"sigs.k8s.io/yaml"
 )
 
+// manifestDownloadTimeout limits the time to download a manifest given by a URL.
+var manifestDownloadTimeout = 30 * time.Second
+
+// maxManifestDownloadSize limits the size of a manifest downloaded from a URL.
+const maxManifestDownloadSize = 10 << 20
+
 func newManifestSet() *cobra.Command {
 	var recoveryFilename string
+	var allowHTTP bool
 
 	cmd := &cobra.Command{
 		Use:   "set <manifest.json> <IP:PORT>",
 		Short: "Sets the manifest for the MarbleRun Coordinator",
-		Long:  "Sets the manifest for the MarbleRun Coordinator",
-		Args:  cobra.ExactArgs(2),
+		Long: `Sets the manifest for the MarbleRun Coordinator.
+The manifest can be given as a file or as an https:// URL. A downloaded manifest is checked before it is set.`,
+		Example: "marblerun manifest set https://config.example.com/manifest.json example.com:4433",
+		Args:    cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			manifestFile := args[0]
 			hostName := args[1]
@@ -34,7 +51,7 @@ func newManifestSet() *cobra.Command {
 			fmt.Println("Successfully verified Coordinator, now uploading manifest")
 
 			// Load manifest
-			manifest, err := loadManifestFile(manifestFile)
+			manifest, err := loadManifest(manifestFile, allowHTTP, checkManifest)
 			if err != nil {
 				return err
 			}
@@ -47,6 +64,7 @@ func newManifestSet() *cobra.Command {
 	}
 
 	cmd.Flags().StringVarP(&recoveryFilename, "recoverydata", "r", "", "File to write recovery data to, print to stdout if non specified")
+	cmd.Flags().BoolVar(&allowHTTP, "allow-http", false, "Allow downloading the manifest from an unencrypted http:// URL")
 
 	return cmd
 }
@@ -77,12 +95,16 @@ func cliManifestSet(manifest []byte, host string, cert []*pem.Block, recover str
 			return nil
 		}
 
-		response := gjson.GetBytes(respBody, "data")
+		for _, warning := range gjson.GetBytes(respBody, "data.Warnings").Array() {
+			fmt.Printf("Warning: %s\n", warning.String())
+		}
 
 		// Skip outputting secrets if we do not get any recovery secrets back
-		if len(response.String()) == 0 {
+		recoverySecrets := gjson.GetBytes(respBody, "data.RecoverySecrets")
+		if !recoverySecrets.Exists() {
 			return nil
 		}
+		response := gjson.Parse(`{"RecoverySecrets":` + recoverySecrets.Raw + `}`)
 
 		// recovery secret was sent, print or save to file
 		if recover == "" {
@@ -108,17 +130,156 @@ func cliManifestSet(manifest []byte, host string, cert []*pem.Block, recover str
 }
 
 // loadManifestFile loads a manifest in either json or yaml format and returns the data as json.
+// User certificates referenced by a CertificateFile are inlined.
 func loadManifestFile(filename string) ([]byte, error) {
 	manifestData, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	manifestData, err = manifestToJSON(manifestData)
+	if err != nil {
+		return nil, err
+	}
+	return inlineUserCertificates(manifestData, filepath.Dir(filename))
+}
 
-	// if Valid is true the file was in JSON format and we can just return the data
-	if json.Valid(manifestData) {
-		return manifestData, err
+// loadManifest loads a manifest from a file or, if source is an http(s):// URL, downloads it and returns the data as json.
+// A downloaded manifest is parsed and passed to validate, so an unexpected response is not submitted to the Coordinator.
+// Manifests are only downloaded over plain http if allowHTTP is set.
+func loadManifest(source string, allowHTTP bool, validate func(manifest.Manifest) error) ([]byte, error) {
+	manifestURL, err := url.Parse(source)
+	if err != nil || (manifestURL.Scheme != "https" && manifestURL.Scheme != "http") {
+		return loadManifestFile(source)
+	}
+	if manifestURL.Scheme == "http" && !allowHTTP {
+		return nil, fmt.Errorf("refusing to download the manifest from %s over unencrypted http, use --allow-http to allow it", source)
+	}
+
+	manifestData, err := downloadManifest(manifestURL.String(), allowHTTP)
+	if err != nil {
+		return nil, fmt.Errorf("downloading manifest: %w", err)
+	}
+	manifestData, err = manifestToJSON(manifestData)
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest downloaded from %s: %w", source, err)
+	}
+	var mnf manifest.Manifest
+	if err := json.Unmarshal(manifestData, &mnf); err != nil {
+		return nil, fmt.Errorf("parsing manifest downloaded from %s: %w", source, err)
+	}
+	if err := validate(mnf); err != nil {
+		return nil, fmt.Errorf("manifest downloaded from %s is invalid: %w", source, err)
 	}
+	return manifestData, nil
+}
 
-	// otherwise we try to convert from YAML to json
+// downloadManifest fetches a manifest using the system's root certificates to verify the server.
+// Redirects to plain http are only followed if allowHTTP is set.
+func downloadManifest(manifestURL string, allowHTTP bool) ([]byte, error) {
+	client := http.Client{
+		Timeout: manifestDownloadTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" && !allowHTTP {
+				return fmt.Errorf("refusing to follow redirect to %s over unencrypted http, use --allow-http to allow it", req.URL)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %d %s", manifestURL, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	manifestData, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestDownloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(manifestData) > maxManifestDownloadSize {
+		return nil, fmt.Errorf("%s: manifest exceeds the maximum size of %d bytes", manifestURL, maxManifestDownloadSize)
+	}
+	return manifestData, nil
+}
+
+// checkManifest checks a complete manifest before it is set.
+func checkManifest(mnf manifest.Manifest) error {
+	return mnf.Check(context.Background(), zap.NewNop())
+}
+
+// manifestToJSON returns manifest data in either json or yaml format as json.
+func manifestToJSON(manifestData []byte) ([]byte, error) {
+	// if Valid is false the data was not in JSON format and we try to convert from YAML to json
+	if json.Valid(manifestData) {
+		return manifestData, nil
+	}
 	return yaml.YAMLToJSON(manifestData)
 }
+
+// inlineUserCertificates replaces the CertificateFile of each user with the Certificate read from the referenced PEM file.
+// Relative paths are resolved against baseDir. If CertificateFile is a directory, the file <user name>.pem in this directory is used.
+// Manifests without a CertificateFile are returned unchanged, so their signature does not change.
+func inlineUserCertificates(manifestData []byte, baseDir string) ([]byte, error) {
+	needsInlining := false
+	gjson.GetBytes(manifestData, "Users").ForEach(func(_, user gjson.Result) bool {
+		needsInlining = user.Get("CertificateFile").Exists()
+		return !needsInlining
+	})
+	if !needsInlining {
+		return manifestData, nil
+	}
+
+	var mnf map[string]json.RawMessage
+	if err := json.Unmarshal(manifestData, &mnf); err != nil {
+		return nil, err
+	}
+	var users map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(mnf["Users"], &users); err != nil {
+		return nil, err
+	}
+
+	for userName, user := range users {
+		rawCertFile, ok := user["CertificateFile"]
+		if !ok {
+			continue
+		}
+		if _, ok := user["Certificate"]; ok {
+			return nil, fmt.Errorf("user %s specifies both Certificate and CertificateFile", userName)
+		}
+		var certFile string
+		if err := json.Unmarshal(rawCertFile, &certFile); err != nil {
+			return nil, fmt.Errorf("parsing CertificateFile of user %s: %w", userName, err)
+		}
+		if !filepath.IsAbs(certFile) {
+			certFile = filepath.Join(baseDir, certFile)
+		}
+		if info, err := os.Stat(certFile); err == nil && info.IsDir() {
+			certFile = filepath.Join(certFile, userName+".pem")
+		}
+
+		cert, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading certificate of user %s: %w", userName, err)
+		}
+		if block, _ := pem.Decode(cert); block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("certificate file %s of user %s does not contain a PEM certificate", certFile, userName)
+		}
+
+		user["Certificate"], err = json.Marshal(string(cert))
+		if err != nil {
+			return nil, err
+		}
+		delete(user, "CertificateFile")
+	}
+
+	var err error
+	mnf["Users"], err = json.Marshal(users)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mnf)
+}
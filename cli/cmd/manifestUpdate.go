@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/spf13/cobra"
 	"github.com/tidwall/gjson"
 )
@@ -16,6 +17,7 @@ import (
 func newManifestUpdate() *cobra.Command {
 	var clientAdminCert string
 	var clientAdminKey string
+	var allowHTTP bool
 
 	cmd := &cobra.Command{
 		Use:   "update <manifest.json> <IP:PORT>",
@@ -23,6 +25,7 @@ func newManifestUpdate() *cobra.Command {
 		Long: `
 Updates the MarbleRun Coordinator with the specified manifest.
 An admin certificate specified in the original manifest is needed to verify the authenticity of the update manifest.
+The update manifest can be given as a file or as an https:// URL.
 `,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -41,7 +44,8 @@ An admin certificate specified in the original manifest is needed to verify the
 			}
 
 			// Load manifest
-			manifest, err := loadManifestFile(manifestFile)
+			// update manifests are partial, so a downloaded one is only parsed and checked by the Coordinator
+			manifest, err := loadManifest(manifestFile, allowHTTP, func(manifest.Manifest) error { return nil })
 			if err != nil {
 				return err
 			}
@@ -57,6 +61,7 @@ An admin certificate specified in the original manifest is needed to verify the
 	cmd.MarkFlagRequired("cert")
 	cmd.Flags().StringVarP(&clientAdminKey, "key", "k", "", "PEM encoded admin key file (required)")
 	cmd.MarkFlagRequired("key")
+	cmd.Flags().BoolVar(&allowHTTP, "allow-http", false, "Allow downloading the update manifest from an unencrypted http:// URL")
 
 	return cmd
 }
@@ -1,22 +1,31 @@
 package cmd
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/server"
 	"github.com/edgelesssys/marblerun/test"
+	"github.com/google/uuid"
+	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tidwall/gjson"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
 )
 
 func TestCliManifestGet(t *testing.T) {
@@ -133,7 +142,10 @@ func TestCliManifestSet(t *testing.T) {
 		if string(reqData) == "11" {
 			serverResp := server.GeneralResponse{
 				Status: "success",
-				Data:   "returned recovery secret",
+				Data: server.RecoveryDataResp{
+					RecoverySecrets: map[string]string{"admin": "c2VjcmV0"},
+					Warnings:        []string{"package backend is in debug mode"},
+				},
 			}
 			assert.NoError(json.NewEncoder(w).Encode(serverResp))
 			return
@@ -161,6 +173,10 @@ func TestCliManifestSet(t *testing.T) {
 	responseFile := filepath.Join(dir, "tmp-recovery.json")
 	err = cliManifestSet([]byte("11"), host, []*pem.Block{cert}, responseFile)
 	require.NoError(err)
+	// warnings are printed, but not saved with the recovery data
+	recoveryData, err := ioutil.ReadFile(responseFile)
+	require.NoError(err)
+	assert.JSONEq(`{"RecoverySecrets": {"admin": "c2VjcmV0"}}`, string(recoveryData))
 
 	err = cliManifestSet([]byte("22"), host, []*pem.Block{cert}, "")
 	require.Error(err)
@@ -302,6 +318,134 @@ This should return an error
 	assert.False(json.Valid(dataJSON))
 }
 
+func TestLoadUserCertificateFiles(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "unittest")
+	require.NoError(err)
+	defer os.RemoveAll(tmpDir)
+
+	require.NoError(os.Mkdir(filepath.Join(tmpDir, "certs"), 0o700))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, "certs", "admin.pem"), test.AdminCert, 0o600))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, "reader.pem"), test.AdminCert, 0o600))
+	require.NoError(ioutil.WriteFile(filepath.Join(tmpDir, "invalid.pem"), []byte("not a certificate"), 0o600))
+
+	writeManifest := func(content string) string {
+		manifestFile := filepath.Join(tmpDir, "manifest.yaml")
+		require.NoError(ioutil.WriteFile(manifestFile, []byte(content), 0o600))
+		return manifestFile
+	}
+
+	// certificates are read from a directory or a single file, relative to the manifest
+	dataJSON, err := loadManifestFile(writeManifest(`
+Users:
+  admin:
+    CertificateFile: certs
+    Roles: ["updateManager"]
+  reader:
+    CertificateFile: reader.pem
+`))
+	require.NoError(err)
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal(dataJSON, &mnf))
+	assert.Equal(string(test.AdminCert), mnf.Users["admin"].Certificate)
+	assert.Equal([]string{"updateManager"}, mnf.Users["admin"].Roles)
+	assert.Equal(string(test.AdminCert), mnf.Users["reader"].Certificate)
+	assert.False(gjson.GetBytes(dataJSON, "Users.admin.CertificateFile").Exists())
+
+	// certificate files need to contain a PEM certificate
+	_, err = loadManifestFile(writeManifest(`
+Users:
+  admin:
+    CertificateFile: invalid.pem
+`))
+	assert.Error(err)
+
+	_, err = loadManifestFile(writeManifest(`
+Users:
+  admin:
+    CertificateFile: missing.pem
+`))
+	assert.Error(err)
+
+	// Certificate and CertificateFile are mutually exclusive
+	_, err = loadManifestFile(writeManifest(`
+Users:
+  admin:
+    Certificate: inline
+    CertificateFile: reader.pem
+`))
+	assert.Error(err)
+}
+
+func TestLoadManifestURL(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	noValidation := func(manifest.Manifest) error { return nil }
+
+	// the server certificate is verified
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(test.ManifestJSON))
+	}))
+	defer server.Close()
+	_, err := loadManifest(server.URL, false, noValidation)
+	assert.Error(err)
+
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	httpmock.RegisterResponder("GET", "https://config.example.com/manifest.json", httpmock.NewStringResponder(200, test.ManifestJSON))
+	httpmock.RegisterResponder("GET", "http://config.example.com/manifest.json", httpmock.NewStringResponder(200, test.ManifestJSON))
+	httpmock.RegisterResponder("GET", "https://config.example.com/login", httpmock.NewStringResponder(200, "<html>Please log in</html>"))
+	httpmock.RegisterResponder("GET", "https://config.example.com/update.json", httpmock.NewStringResponder(200, `{"Marbles":{"frontend":{"LogLevel":"debug"}}}`))
+	httpmock.RegisterResponder("GET", "https://config.example.com/missing.json", httpmock.NewStringResponder(404, ""))
+	httpmock.RegisterResponder("GET", "https://config.example.com/large.json", httpmock.NewStringResponder(200, strings.Repeat(" ", maxManifestDownloadSize)+test.ManifestJSON))
+	redirect := func(location string) httpmock.Responder {
+		return func(*http.Request) (*http.Response, error) {
+			resp := httpmock.NewStringResponse(http.StatusFound, "")
+			resp.Header.Set("Location", location)
+			return resp, nil
+		}
+	}
+	httpmock.RegisterResponder("GET", "https://config.example.com/moved.json", redirect("https://config.example.com/manifest.json"))
+	httpmock.RegisterResponder("GET", "https://config.example.com/downgrade.json", redirect("http://config.example.com/manifest.json"))
+
+	manifestData, err := loadManifest("https://config.example.com/manifest.json", false, checkManifest)
+	require.NoError(err)
+	assert.JSONEq(test.ManifestJSON, string(manifestData))
+
+	// plain http needs to be allowed explicitly
+	calls := httpmock.GetTotalCallCount()
+	_, err = loadManifest("http://config.example.com/manifest.json", false, checkManifest)
+	assert.Error(err)
+	assert.Equal(calls, httpmock.GetTotalCallCount())
+	_, err = loadManifest("http://config.example.com/manifest.json", true, checkManifest)
+	assert.NoError(err)
+
+	// unexpected responses are not returned
+	_, err = loadManifest("https://config.example.com/login", false, noValidation)
+	assert.Error(err)
+	_, err = loadManifest("https://config.example.com/missing.json", false, noValidation)
+	assert.Error(err)
+	_, err = loadManifest("https://config.example.com/large.json", false, noValidation)
+	assert.Error(err)
+
+	// redirects to plain http need to be allowed explicitly
+	_, err = loadManifest("https://config.example.com/moved.json", false, checkManifest)
+	assert.NoError(err)
+	_, err = loadManifest("https://config.example.com/downgrade.json", false, checkManifest)
+	assert.Error(err)
+	_, err = loadManifest("https://config.example.com/downgrade.json", true, checkManifest)
+	assert.NoError(err)
+
+	// an update manifest does not pass the check of a complete manifest
+	_, err = loadManifest("https://config.example.com/update.json", false, checkManifest)
+	assert.Error(err)
+	_, err = loadManifest("https://config.example.com/update.json", false, noValidation)
+	assert.NoError(err)
+}
+
 func TestCliManifestSignature(t *testing.T) {
 	assert := assert.New(t)
 
@@ -367,3 +511,121 @@ func TestGetSignatureFromString(t *testing.T) {
 	_, err = getSignatureFromString("invalidFilename")
 	assert.Error(err)
 }
+
+func TestCliManifestDiff(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var oldManifest, newManifest manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &oldManifest))
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &newManifest))
+
+	// identical manifests have no differences
+	var out bytes.Buffer
+	cliManifestDiff(&out, oldManifest, newManifest)
+	assert.Equal("No differences in Packages, Marbles, Secrets, or Infrastructures\n", out.String())
+
+	securityVersion := uint(4)
+	frontendPackage := newManifest.Packages["frontend"]
+	frontendPackage.SecurityVersion = &securityVersion
+	newManifest.Packages["frontend"] = frontendPackage
+	delete(newManifest.Marbles, "backendFirst")
+	newManifest.Marbles["backendThird"] = manifest.Marble{Package: "backend"}
+	frontend := newManifest.Marbles["frontend"]
+	frontend.MaxActivations = 3
+	frontend.Parameters.Env = map[string]manifest.File{"LOG_LEVEL": {Data: "debug"}}
+	frontend.Parameters.Argv = []string{"frontend", "--verbose"}
+	newManifest.Marbles["frontend"] = frontend
+	symmetricKey := newManifest.Secrets["symmetricKeyShared"]
+	symmetricKey.Size = 256
+	newManifest.Secrets["symmetricKeyShared"] = symmetricKey
+
+	out.Reset()
+	cliManifestDiff(&out, oldManifest, newManifest)
+	assert.Equal(`Packages:
+  ~ frontend: SecurityVersion: 3 -> 4
+Marbles:
+  - backendFirst (removed)
+  + backendThird (added)
+  ~ frontend: MaxActivations: 0 -> 3
+  ~ frontend: Parameters.Env + LOG_LEVEL (added)
+  ~ frontend: Parameters.Argv: [] -> ["frontend" "--verbose"]
+Secrets:
+  ~ symmetricKeyShared: Size: 128 -> 256
+`, out.String())
+}
+
+func TestCliManifestPreview(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &mnf))
+	mnf.Secrets["deterministicKey"] = manifest.Secret{Type: "symmetric-key", Size: 128, Shared: true, Deterministic: true}
+	mnf.Secrets["userKey"] = manifest.Secret{Type: "symmetric-key", Size: 128, UserDefined: true}
+	frontend := mnf.Marbles["frontend"]
+	frontend.Parameters.Env = map[string]manifest.File{
+		"UUID":      {Data: "{{ .MarbleRun.UUID }}"},
+		"KEY":       {Data: "{{ hex .Secrets.symmetricKeyPrivate }}"},
+		"UNTOUCHED": {Data: "{{ raw .Secrets.symmetricKeyPrivate }}", NoTemplates: true},
+	}
+	mnf.Marbles["frontend"] = frontend
+	marbleUUID := uuid.New()
+
+	var out bytes.Buffer
+	require.NoError(cliManifestPreview(&out, mnf, marbleUUID, "frontend"))
+	output := out.String()
+
+	// secrets are listed with the way they are generated
+	assert.Contains(output, "certPrivate: cert-rsa (2048 bits) (random per activation)\n")
+	assert.Contains(output, "certShared: cert-ed25519 (shared, random)\n")
+	assert.Contains(output, "deterministicKey: symmetric-key (128 bits) (shared, derived from the Coordinator's root key)\n")
+	assert.Contains(output, "symmetricKeyPrivate: symmetric-key (256 bits) (per Marble, derived from the Coordinator's root key and the Marble's UUID)\n")
+	assert.Contains(output, "userKey: symmetric-key (128 bits) (set by a user)\n")
+
+	// only the requested Marble is rendered
+	assert.Contains(output, "Marble frontend (UUID "+marbleUUID.String()+"):\n")
+	assert.NotContains(output, "Marble backendFirst")
+	assert.Contains(output, "    UUID="+marbleUUID.String()+"\n")
+	assert.Regexp(`    KEY=[0-9a-f]{64}\n`, output)
+	assert.Contains(output, "    UNTOUCHED={{ raw .Secrets.symmetricKeyPrivate }}\n")
+
+	// templates of all Marbles are rendered by default
+	out.Reset()
+	require.NoError(cliManifestPreview(&out, mnf, marbleUUID, ""))
+	assert.Contains(out.String(), "Marble backendFirst")
+	assert.Contains(out.String(), "TEST_SECRET_CERT=-----BEGIN CERTIFICATE-----\n")
+}
+
+func TestCliManifestPreviewSecret(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &mnf))
+	frontend := mnf.Marbles["frontend"]
+	frontend.Parameters.Env = map[string]manifest.File{"UUID": {Data: "{{ .MarbleRun.UUID }}"}}
+	frontend.Parameters.Files = map[string]manifest.File{"/etc/frontend/key": {Data: "{{ hex .Secrets.symmetricKeyPrivate }}"}}
+	mnf.Marbles["frontend"] = frontend
+	marbleUUID := uuid.New()
+
+	var out bytes.Buffer
+	require.NoError(cliManifestPreviewSecret(&out, mnf, marbleUUID, "frontend", "frontend-parameters", "marblerun"))
+
+	var secret corev1.Secret
+	require.NoError(yaml.Unmarshal(out.Bytes(), &secret))
+	assert.Equal("Secret", secret.Kind)
+	assert.Equal("frontend-parameters", secret.Name)
+	assert.Equal("marblerun", secret.Namespace)
+	assert.Equal("frontend", secret.Labels["marblerun/marbletype"])
+	assert.Equal(marbleUUID.String(), string(secret.Data["UUID"]))
+	assert.Regexp(`^[0-9a-f]{64}$`, string(secret.Data["key"]))
+	// values are base64 encoded
+	assert.Contains(out.String(), base64.StdEncoding.EncodeToString([]byte(marbleUUID.String())))
+
+	// keys need to be unique and valid
+	frontend.Parameters.Files["/etc/UUID"] = manifest.File{Data: "duplicate"}
+	mnf.Marbles["frontend"] = frontend
+	assert.Error(cliManifestPreviewSecret(&out, mnf, marbleUUID, "frontend", "frontend-parameters", ""))
+	assert.Error(cliManifestPreviewSecret(&out, mnf, marbleUUID, "frontend", "Invalid_Name", ""))
+}
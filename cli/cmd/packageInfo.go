@@ -120,6 +120,26 @@ func decodeSGXSDKSigStruct(path string, isDirectory bool) error {
 }
 
 func parseSigStruct(sgxMetaData []byte) ([]byte, []byte, []byte, []byte, error) {
+	sigStruct, err := findSigStruct(sgxMetaData)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	// Get MRENCLAVE (UniqueID), ISVPRODID (ProductID) and ISVSVN (SecurityVersion) directly from SIGSTRUCT
+	// Get Modulus so we can calculate MRSIGNER (= SHA256 hash of modulus)
+	modulus := sigStruct[128:512]
+	mrenclave := sigStruct[960:992]
+	isvprodid := sigStruct[1024:1026]
+	isvsvn := sigStruct[1026:1028]
+
+	// Calculate MRSIGNER, which is the SHA-256 hash of the modulus stored in SIGSTRUCT
+	mrsigner := sha256.Sum256(modulus)
+
+	return mrenclave, mrsigner[:], isvprodid, isvsvn, nil
+}
+
+// findSigStruct returns the SIGSTRUCT contained in the given data.
+func findSigStruct(sgxMetaData []byte) ([]byte, error) {
 	/*
 	 * From the "Intel(r) 64 and IA-32 Architectures Software Developer
 	 * Manual, Volume 3: System Programming Guide", Chapter 38, Section 13,
@@ -129,14 +149,14 @@ func parseSigStruct(sgxMetaData []byte) ([]byte, []byte, []byte, []byte, error)
 
 	sigStructIndex := bytes.Index(sgxMetaData, sigStructHeader)
 	if sigStructIndex == -1 {
-		return nil, nil, nil, nil, errors.New("could not find SIGSTRUCT header in given file")
+		return nil, errors.New("could not find SIGSTRUCT header in given file")
 	}
 
 	// The Intel Software Developer Manual specifies SIGSTRUCT entries up to 1808 bytes.
 	// We use this as a cutoff for our sigStruct slice.
 	const sigStructLen = 1808
 	if len(sgxMetaData) < sigStructIndex+sigStructLen {
-		return nil, nil, nil, nil, errors.New("SGX metadata/SIGSTRUCT appears to be too small")
+		return nil, errors.New("SGX metadata/SIGSTRUCT appears to be too small")
 	}
 
 	sigStruct := sgxMetaData[sigStructIndex : sigStructIndex+sigStructLen]
@@ -146,20 +166,10 @@ func parseSigStruct(sgxMetaData []byte) ([]byte, []byte, []byte, []byte, error)
 	sigStructHeader2 := []byte{0x01, 0x01, 0x00, 0x00, 0x60, 0x00, 0x00, 0x00, 0x60, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
 	sigStructHeader2Index := bytes.Index(sigStruct, sigStructHeader2)
 	if sigStructHeader2Index == -1 {
-		return nil, nil, nil, nil, errors.New("found first SIGSTRUCT header, but cannot find second one")
+		return nil, errors.New("found first SIGSTRUCT header, but cannot find second one")
 	}
 
-	// Get MRENCLAVE (UniqueID), ISVPRODID (ProductID) and ISVSVN (SecurityVersion) directly from SIGSTRUCT
-	// Get Modulus so we can calculate MRSIGNER (= SHA256 hash of modulus)
-	modulus := sigStruct[128:512]
-	mrenclave := sigStruct[960:992]
-	isvprodid := sigStruct[1024:1026]
-	isvsvn := sigStruct[1026:1028]
-
-	// Calculate MRSIGNER, which is the SHA-256 hash of the modulus stored in SIGSTRUCT
-	mrsigner := sha256.Sum256(modulus)
-
-	return mrenclave, mrsigner[:], isvprodid, isvsvn, nil
+	return sigStruct, nil
 }
 
 func decodeGramineSigStruct(path string, isDirectory bool) error {
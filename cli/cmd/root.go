@@ -27,7 +27,9 @@ func init() {
 	rootCmd.AddCommand(newCertificateCmd())
 	rootCmd.AddCommand(newCheckCmd())
 	rootCmd.AddCommand(newCompletionCmd())
+	rootCmd.AddCommand(newGraminePackageCmd())
 	rootCmd.AddCommand(newGraminePrepareCmd())
+	rootCmd.AddCommand(newGramineVerifyCmd())
 	rootCmd.AddCommand(newInstallCmd())
 	rootCmd.AddCommand(newManifestCmd())
 	rootCmd.AddCommand(newPrecheckCmd())
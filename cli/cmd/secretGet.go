@@ -142,11 +142,14 @@ func printSecrets(response gjson.Result) error {
 		output = prettyFormat(output, "Type:", secretType.String())
 
 		switch secretType.String() {
-		case "cert-rsa", "cert-ecdsa", "cert-ed25519":
+		case "cert-rsa", "cert-ecdsa", "cert-ed25519", "ca-cert":
 			output = prettyFormat(output, "UserDefined:", userDefined.String())
-			if secretType.String() == "cert-rsa" || secretType.String() == "cert-ecdsa" {
+			if secretType.String() != "cert-ed25519" {
 				output = prettyFormat(output, "Size:", secretSize.String())
 			}
+			if secretType.String() == "ca-cert" {
+				output = prettyFormat(output, "Path Length:", singleResponse.Get("PathLen").String())
+			}
 			output = prettyFormat(output, "Valid For:", validFor.String())
 			output = prettyFormat(output, "Certificate:", cert.String())
 			output = prettyFormat(output, "Public Key:", public.String())
@@ -155,6 +158,11 @@ func printSecrets(response gjson.Result) error {
 			output = prettyFormat(output, "UserDefined:", userDefined.String())
 			output = prettyFormat(output, "Size:", secretSize.String())
 			output = prettyFormat(output, "Key:", public.String())
+		case "hmac":
+			output = prettyFormat(output, "UserDefined:", userDefined.String())
+			output = prettyFormat(output, "Size:", secretSize.String())
+			output = prettyFormat(output, "Algorithm:", singleResponse.Get("Algorithm").String())
+			output = prettyFormat(output, "Key:", public.String())
 		case "plain":
 			output = prettyFormat(output, "Data:", public.String())
 		default:
@@ -7,9 +7,14 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/edgelesssys/marblerun/coordinator/config"
 	"github.com/edgelesssys/marblerun/coordinator/core"
@@ -17,6 +22,8 @@ import (
 	"github.com/edgelesssys/marblerun/coordinator/recovery"
 	"github.com/edgelesssys/marblerun/coordinator/seal"
 	"github.com/edgelesssys/marblerun/coordinator/server"
+	"github.com/edgelesssys/marblerun/coordinator/store"
+	"github.com/edgelesssys/marblerun/coordinator/webhook"
 	"github.com/edgelesssys/marblerun/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -55,6 +62,7 @@ func run(validator quote.Validator, issuer quote.Issuer, sealDir string, sealer
 	clientServerAddr := util.Getenv(config.ClientAddr, config.ClientAddrDefault)
 	meshServerAddr := util.Getenv(config.MeshAddr, config.MeshAddrDefault)
 	promServerAddr := os.Getenv(config.PromAddr)
+	debugEndpoints := util.Getenv(config.DebugEndpoints, config.DebugEndpointsDefault) == "1"
 
 	// Create Prometheus resources and start the Prometheus server.
 	var promRegistry *prometheus.Registry
@@ -80,27 +88,74 @@ func run(validator quote.Validator, issuer quote.Issuer, sealDir string, sealer
 	if err := os.MkdirAll(sealDir, 0o700); err != nil {
 		zapLogger.Fatal("Cannot create or access sealdir. Please check the permissions for the specified path.", zap.Error(err))
 	}
-	co, err := core.NewCore(dnsNames, validator, issuer, sealer, recovery, zapLogger, promFactoryPtr)
+	var co *core.Core
+	if storeDSN := os.Getenv(config.StoreDSN); storeDSN != "" {
+		zapLogger.Info("connecting to the database")
+		stor, storeErr := store.NewPostgresStore(context.Background(), storeDSN, sealer)
+		if storeErr != nil {
+			zapLogger.Fatal("Cannot create the database store", zap.Error(storeErr))
+		}
+		defer stor.Close()
+		co, err = core.NewCoreWithStore(dnsNames, validator, issuer, sealer, stor, recovery, zapLogger, promFactoryPtr)
+	} else {
+		co, err = core.NewCore(dnsNames, validator, issuer, sealer, recovery, zapLogger, promFactoryPtr)
+	}
 	if err != nil {
 		if _, ok := err.(core.QuoteError); !ok || !devMode {
 			zapLogger.Fatal("Cannot create Coordinator core", zap.Error(err))
 		}
 	}
 
+	// dispatch activation events to a webhook
+	if webhookURL := os.Getenv(config.WebhookURL); webhookURL != "" {
+		webhookKey := os.Getenv(config.WebhookKey)
+		if webhookKey == "" {
+			zapLogger.Fatal("A webhook URL is set, but no key to sign the events.", zap.String("variable", config.WebhookKey))
+		}
+		dispatcher := webhook.NewDispatcher(webhookURL, []byte(webhookKey), zapLogger)
+		defer dispatcher.Close()
+		co.SetActivationWebhook(dispatcher)
+	}
+
+	// limit the size of activation requests
+	co.SetActivationSizeLimits(
+		mustGetSizeEnv(config.MaxCSRSize, core.DefaultMaxCSRSize, zapLogger),
+		mustGetSizeEnv(config.MaxQuoteSize, core.DefaultMaxQuoteSize, zapLogger),
+	)
+	co.SetMaxCSRSANs(mustGetCountEnv(config.MaxCSRSANs, core.DefaultMaxCSRSANs, zapLogger))
+	co.SetMaxParametersSize(mustGetSizeEnv(config.MaxParametersSize, core.DefaultMaxParametersSize, zapLogger))
+	co.SetCertClockSkew(mustGetDurationEnv(config.CertClockSkew, core.DefaultCertClockSkew, zapLogger))
+	if util.Getenv(config.AllowMarbleSimulation, config.AllowMarbleSimulationDefault) == "1" {
+		zapLogger.Warn("Marbles allowing simulation mode are not attested. Do not use this setting in production.")
+		co.SetAllowMarbleSimulation(true)
+	}
+	shutdownTimeout := mustGetDurationEnv(config.ShutdownTimeout, core.DefaultShutdownTimeout, zapLogger)
+
+	// drain in-flight requests before exiting, e.g., during a rolling deployment
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
 	// start client server
 	zapLogger.Info("starting the client server")
 	mux := server.CreateServeMux(co, promFactoryPtr)
+	if debugEndpoints {
+		zapLogger.Warn("debug endpoints are enabled, do not use this setting in production")
+		server.EnableDebugEndpoints(mux, co)
+	}
 	clientServerTLSConfig, err := co.GetTLSConfig()
 	if err != nil {
 		zapLogger.Fatal("Cannot create TLS credentials", zap.Error(err))
 	}
-	go server.RunClientServer(mux, clientServerAddr, clientServerTLSConfig, zapLogger)
+	// the servers are stopped before deferred cleanups, e.g., closing the webhook dispatcher, run
+	serverCtx, stopServers := context.WithCancel(context.Background())
+	defer stopServers()
+	go server.RunClientServer(serverCtx, mux, clientServerAddr, clientServerTLSConfig, zapLogger)
 
 	// run marble server
 	zapLogger.Info("starting the marble server")
 	addrChan := make(chan string)
 	errChan := make(chan error)
-	go server.RunMarbleServer(co, meshServerAddr, addrChan, errChan, zapLogger, promRegistry)
+	go server.RunMarbleServer(serverCtx, co, meshServerAddr, addrChan, errChan, zapLogger, promRegistry, debugEndpoints)
 	for {
 		select {
 		case err := <-errChan:
@@ -110,6 +165,53 @@ func run(validator quote.Validator, issuer quote.Issuer, sealDir string, sealer
 			return
 		case grpcAddr := <-addrChan:
 			zapLogger.Info("started gRPC server", zap.String("grpcAddr", grpcAddr))
+		case sig := <-signals:
+			zapLogger.Info("shutting down", zap.Stringer("signal", sig))
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := co.Shutdown(ctx); err != nil {
+				zapLogger.Warn("Not all in-flight requests finished before the shutdown timeout", zap.Error(err))
+			}
+			cancel()
+			return
 		}
 	}
 }
+
+// mustGetSizeEnv returns the size in bytes set in the environment variable name, or defaultSize if it is unset.
+func mustGetSizeEnv(name string, defaultSize int, zapLogger *zap.Logger) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultSize
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		zapLogger.Fatal("Invalid size limit, expected a positive number of bytes.", zap.String("variable", name), zap.String("value", value))
+	}
+	return size
+}
+
+// mustGetCountEnv returns the count set in the environment variable name, or defaultCount if it is unset.
+func mustGetCountEnv(name string, defaultCount int, zapLogger *zap.Logger) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultCount
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count <= 0 {
+		zapLogger.Fatal("Invalid limit, expected a positive number.", zap.String("variable", name), zap.String("value", value))
+	}
+	return count
+}
+
+// mustGetDurationEnv returns the duration set in the environment variable name, or defaultDuration if it is unset.
+func mustGetDurationEnv(name string, defaultDuration time.Duration, zapLogger *zap.Logger) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultDuration
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		zapLogger.Fatal("Invalid duration, expected a non-negative duration like \"5m\".", zap.String("variable", name), zap.String("value", value))
+	}
+	return duration
+}
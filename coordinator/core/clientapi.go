@@ -9,19 +9,30 @@ package core
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"math/big"
+	"sort"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/edgelesssys/ego/ecrypto"
 	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
+	"github.com/edgelesssys/marblerun/coordinator/recovery"
+	"github.com/edgelesssys/marblerun/coordinator/rpc"
 	"github.com/edgelesssys/marblerun/coordinator/store"
 	"github.com/edgelesssys/marblerun/coordinator/user"
+	"github.com/edgelesssys/marblerun/util"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
@@ -31,13 +42,110 @@ type ClientCore interface {
 	SetManifest(ctx context.Context, rawManifest []byte) (recoverySecretMap map[string][]byte, err error)
 	GetCertQuote(ctx context.Context) (cert string, certQuote []byte, err error)
 	GetManifestSignature(ctx context.Context) (manifestSignature []byte, manifest []byte)
+	// GetEffectiveManifestSignature returns the hash of the manifest with the applied parameter updates, or nil if no parameters were updated.
+	GetEffectiveManifestSignature(ctx context.Context) (manifestSignature []byte, manifest []byte)
 	GetSecrets(ctx context.Context, requestedSecrets []string, requestUser *user.User) (map[string]manifest.Secret, error)
 	GetStatus(ctx context.Context) (statusCode int, status string, err error)
 	GetUpdateLog(ctx context.Context) (updateLog string, err error)
 	Recover(ctx context.Context, encryptionKey []byte) (int, error)
 	VerifyUser(ctx context.Context, clientCerts []*x509.Certificate) (*user.User, error)
+	VerifyManifestReader(ctx context.Context, clientCerts []*x509.Certificate) error
 	UpdateManifest(ctx context.Context, rawUpdateManifest []byte, updater *user.User) error
+	SignCertificate(ctx context.Context, rawCSR []byte, requester *user.User) ([]byte, error)
 	WriteSecrets(ctx context.Context, rawSecretManifest []byte, updater *user.User) error
+	GetDebugState(ctx context.Context) (DebugState, error)
+	RenderMarbleParameters(ctx context.Context, marbleType string) (*rpc.Parameters, error)
+	// RenderActivationResponse returns the activation response a Marble of the given type would receive, with placeholder secrets.
+	RenderActivationResponse(ctx context.Context, marbleType string) (*rpc.ActivationResp, error)
+	// RenderTTLSConfig returns the TTLS config a Marble of the given type would receive, with placeholder secrets, and the skipped TLS entries.
+	RenderTTLSConfig(ctx context.Context, marbleType string) ([]byte, []string, error)
+	ExportSecrets(ctx context.Context, marbleUUID string, requestedSecrets []string, requester *user.User) (SecretBackup, error)
+	SetPaused(ctx context.Context, paused bool, requester *user.User) error
+	// RotateDerivationRoot replaces the root of the keys derived for Marbles.
+	// The keys derived from the previous root remain available to Marbles for gracePeriod.
+	RotateDerivationRoot(ctx context.Context, gracePeriod time.Duration, requester *user.User) error
+	// RotateRecoveryKey replaces a recovery key and re-encrypts the state for the new set of recovery keys.
+	// It returns the new recovery secrets.
+	RotateRecoveryKey(ctx context.Context, name string, newRecoveryKey string, proof []byte, requester *user.User) (map[string][]byte, error)
+	// SetActivations sets the number of activations counted for a Marble type.
+	SetActivations(ctx context.Context, marbleType string, activations uint, requester *user.User) error
+	// GetActivations returns the activation budget, count, and resource hints of each Marble type in the manifest.
+	GetActivations(ctx context.Context) (map[string]MarbleActivations, error)
+	// GetIssuanceLog returns all certificates issued by the Coordinator's intermediate CA, signed with the Coordinator's root key.
+	GetIssuanceLog(ctx context.Context, requester *user.User) (IssuanceLog, error)
+	// DryRunUpdateManifest checks a proposed update manifest of packages against the quotes of previous activations without applying it.
+	DryRunUpdateManifest(ctx context.Context, rawUpdateManifest []byte, updater *user.User) (map[string]UpdateImpact, error)
+	// RevokeMarbleCertificates revokes all unexpired certificates issued for a Marble type and returns the number of newly revoked certificates.
+	RevokeMarbleCertificates(ctx context.Context, marbleType string, exhaustActivations bool, requester *user.User) (int, error)
+	// GetCRL returns the DER-encoded certificate revocation list of the Coordinator's intermediate CA.
+	GetCRL(ctx context.Context) ([]byte, error)
+}
+
+// SecretBackup holds secrets of a Marble encrypted for the manifest's RecoveryKeys.
+type SecretBackup struct {
+	// EncryptionKeys holds the AES-GCM key of the backup, encrypted with RSA-OAEP for each recovery key.
+	EncryptionKeys map[string][]byte
+	// Secrets holds the JSON-encoded map of exported secrets, encrypted with AES-GCM. The nonce is prepended to the ciphertext.
+	Secrets []byte
+}
+
+// MarbleActivations is the activation budget and count of a Marble type.
+type MarbleActivations struct {
+	// MaxActivations is the maximum number of activations of the Marble type, 0 means unlimited.
+	MaxActivations uint
+	// Activations is the number of activations counted for the Marble type.
+	Activations uint
+	// Resources are the resource hints of the Marble type, if the manifest defines them.
+	Resources *manifest.Resources `json:",omitempty"`
+}
+
+// IssuedCertificate is an entry of the issuance log, recording a certificate signed by the Coordinator.
+type IssuedCertificate struct {
+	// Serial is the decimal serial number of the certificate.
+	Serial string
+	// MarbleType is the type of the Marble the certificate was issued for. It is empty for certificates signed for users.
+	MarbleType string `json:",omitempty"`
+	// User is the name of the user who requested the certificate. It is empty for Marble certificates.
+	User string `json:",omitempty"`
+	// Issued is the time the certificate was signed.
+	Issued time.Time
+	// Certificate is the DER-encoded certificate.
+	Certificate []byte
+}
+
+// IssuanceLog is the signed export of all certificates issued by the Coordinator.
+type IssuanceLog struct {
+	// Entries holds the issued certificates in order of issuance.
+	Entries []IssuedCertificate
+	// TreeHash is the root of a Merkle tree over the DER-encoded certificates, computed as specified in RFC 6962.
+	TreeHash []byte
+	// Signature is an ASN.1-encoded ECDSA signature of the Coordinator's root key over the SHA-256 hash
+	// of the number of entries as 8-byte big-endian integer followed by TreeHash.
+	Signature []byte
+}
+
+// RevokedCertificate is an entry of the certificate revocation list.
+type RevokedCertificate struct {
+	// Serial is the decimal serial number of the certificate.
+	Serial string
+	// MarbleType is the type of the Marble the certificate was issued for.
+	MarbleType string
+	// Revoked is the time the certificate was revoked.
+	Revoked time.Time
+	// NotAfter is the end of the certificate's validity. Expired certificates are omitted from the revocation list.
+	NotAfter time.Time
+}
+
+// DebugState is a snapshot of the Coordinator's internal state.
+type DebugState struct {
+	// State is the internal state of the Coordinator.
+	State int
+	// SimulationMode is true if the Coordinator runs without SGX and does not verify quotes.
+	SimulationMode bool
+	// Activations holds the number of activations per Marble type.
+	Activations map[string]uint
+	// Paused is true if activations are paused for maintenance.
+	Paused bool
 }
 
 // SetManifest sets the manifest, once and for all.
@@ -67,13 +175,13 @@ func (c *Core) SetManifest(ctx context.Context, rawManifest []byte) (map[string]
 	}
 
 	// Generate shared secrets specified in manifest
-	secrets, err := c.generateSecrets(ctx, mnf.Secrets, uuid.Nil, marbleRootCert, intermediatePrivK)
+	secrets, err := c.generateSecrets(c.data.withContext(ctx), mnf.Secrets, uuid.Nil, marbleRootCert, intermediatePrivK)
 	if err != nil {
 		c.zaplogger.Error("Could not generate specified secrets for the given manifest.", zap.Error(err))
 		return nil, err
 	}
 	// generate placeholders for private secrets specified in manifest
-	privSecrets, err := c.generateSecrets(ctx, mnf.Secrets, uuid.New(), marbleRootCert, intermediatePrivK)
+	privSecrets, err := c.generateSecrets(c.data.withContext(ctx), mnf.Secrets, uuid.New(), marbleRootCert, intermediatePrivK)
 	if err != nil {
 		c.zaplogger.Error("Could not generate specified secrets for the given manifest.", zap.Error(err))
 		return nil, err
@@ -90,7 +198,10 @@ func (c *Core) SetManifest(ctx context.Context, rawManifest []byte) (map[string]
 		c.zaplogger.Error("could not generate recovery data", zap.Error(err))
 		return nil, err
 	}
-	c.sealer.SetEncryptionKey(encryptionKey)
+	if err := c.setEncryptionKey(encryptionKey); err != nil {
+		c.zaplogger.Error("could not set up encryption key for sealing the state", zap.Error(err))
+		return nil, err
+	}
 
 	// Parse X.509 user certificates and permissions from manifest
 	users, err := generateUsersFromManifest(mnf.Users, mnf.Roles)
@@ -99,12 +210,12 @@ func (c *Core) SetManifest(ctx context.Context, rawManifest []byte) (map[string]
 		return nil, err
 	}
 
-	tx, err := c.store.BeginTransaction()
+	tx, err := c.store.BeginTransaction(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
-	txdata := storeWrapper{tx}
+	txdata := storeWrapper{store: tx}
 
 	for k, v := range privSecrets {
 		secrets[k] = v
@@ -167,7 +278,7 @@ func (c *Core) SetManifest(ctx context.Context, rawManifest []byte) (map[string]
 	}
 
 	c.advanceState(stateAcceptingMarbles, tx)
-	if store, ok := c.store.(*store.StdStore); ok {
+	if store, ok := c.store.(sealedStore); ok {
 		store.SetRecoveryData(recoveryData)
 	}
 	if err := tx.Commit(); err != nil {
@@ -222,6 +333,19 @@ func (c *Core) GetManifestSignature(ctx context.Context) ([]byte, []byte) {
 	return hash[:], rawManifest
 }
 
+// GetEffectiveManifestSignature returns the hash of the effective manifest.
+//
+// The effective manifest is the manifest with the Marbles and Bundles replaced by the definitions of applied parameter updates.
+// Nil values are returned if no parameters have been updated, in which case the manifest itself is effective.
+func (c *Core) GetEffectiveManifestSignature(ctx context.Context) ([]byte, []byte) {
+	rawManifest, err := c.data.withContext(ctx).getEffectiveRawManifest()
+	if err != nil {
+		return nil, nil
+	}
+	hash := sha256.Sum256(rawManifest)
+	return hash[:], rawManifest
+}
+
 // Recover sets an encryption key (ideally decrypted from the recovery data) and tries to unseal and load a saved state again.
 func (c *Core) Recover(ctx context.Context, secret []byte) (int, error) {
 	defer c.mux.Unlock()
@@ -259,260 +383,1515 @@ func (c *Core) GetUpdateLog(ctx context.Context) (string, error) {
 	return c.data.getUpdateLog()
 }
 
-// VerifyUser checks if a given client certificate matches the admin certificates specified in the manifest.
-func (c *Core) VerifyUser(ctx context.Context, clientCerts []*x509.Certificate) (*user.User, error) {
-	userIter, err := c.data.getIterator(requestUser)
+// GetDebugState returns a snapshot of the Coordinator's internal state for debugging purposes.
+func (c *Core) GetDebugState(ctx context.Context) (DebugState, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	curState, err := c.data.getState()
 	if err != nil {
-		return nil, err
+		return DebugState{}, err
 	}
-	// Check if a supplied client cert matches the supplied ones from the manifest stored in the core
-	// NOTE: We do not use the "correct" X.509 verify here since we do not really care about expiration and chain verification here.
-	for _, suppliedCert := range clientCerts {
-		for userIter.HasNext() {
-			name, err := userIter.GetNext()
-			if err != nil {
-				return nil, err
-			}
-			user, err := c.data.getUser(name)
-			if err != nil {
-				return nil, err
-			}
-			if suppliedCert.Equal(user.Certificate()) {
-				return user, nil
-			}
+
+	activations := make(map[string]uint)
+	iter, err := c.data.getIterator(requestActivations)
+	if err != nil {
+		return DebugState{}, err
+	}
+	for iter.HasNext() {
+		marbleType, err := iter.GetNext()
+		if err != nil {
+			return DebugState{}, err
+		}
+		activations[marbleType], err = c.data.getActivations(marbleType)
+		if err != nil {
+			return DebugState{}, err
 		}
 	}
 
-	return nil, errors.New("client certificate did not match any MarbleRun users")
+	return DebugState{
+		State:          int(curState),
+		SimulationMode: c.inSimulationMode(),
+		Activations:    activations,
+		Paused:         c.paused,
+	}, nil
 }
 
-// UpdateManifest allows to update certain package parameters, supplied via a JSON manifest.
-func (c *Core) UpdateManifest(ctx context.Context, rawUpdateManifest []byte, updater *user.User) error {
+// RenderMarbleParameters returns the parameters a Marble of the given type would receive on activation.
+//
+// Secrets are replaced by placeholder values. No activation is counted and no certificate is issued.
+func (c *Core) RenderMarbleParameters(ctx context.Context, marbleType string) (*rpc.Parameters, error) {
 	defer c.mux.Unlock()
-
-	// Only accept update manifest if we already have a manifest
 	if err := c.requireState(stateAcceptingMarbles); err != nil {
-		return err
-	}
-
-	// Unmarshal & check update manifest
-	var updateManifest manifest.Manifest
-	if err := json.Unmarshal(rawUpdateManifest, &updateManifest); err != nil {
-		return err
+		return nil, err
 	}
 
-	// verify updater is allowed to commit the update
-	var wantedPackages []string
-	for pkg := range updateManifest.Packages {
-		wantedPackages = append(wantedPackages, pkg)
+	data := c.data.withContext(ctx)
+	mnf, err := data.getCurrentManifest()
+	if err != nil {
+		return nil, err
 	}
-	if !updater.IsGranted(user.NewPermission(user.PermissionUpdatePackage, wantedPackages)) {
-		return fmt.Errorf("user %s is not allowed to update one or more packages of %v", updater.Name(), wantedPackages)
+	storedSecrets, err := data.getSecretMap()
+	if err != nil {
+		return nil, err
 	}
+	return renderPlaceholderParameters(mnf, marbleType, storedSecrets)
+}
 
-	currentPackages := make(map[string]quote.PackageProperties)
-	for pkgName := range updateManifest.Packages {
-		pkg, err := c.data.getPackage(pkgName)
-		if err != nil {
-			return err
-		}
-		currentPackages[pkgName] = pkg
-	}
-	if err := updateManifest.CheckUpdate(ctx, currentPackages); err != nil {
-		return err
+// RenderActivationResponse returns the activation response a Marble of the given type would receive.
+//
+// Like RenderMarbleParameters, secrets and the Marble's credentials are replaced by placeholder values, so the response is reproducible
+// and can be used as a fixture to test applications without a Coordinator. No activation is counted and no certificate is issued.
+func (c *Core) RenderActivationResponse(ctx context.Context, marbleType string) (*rpc.ActivationResp, error) {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return nil, err
 	}
 
-	// update manifest was valid, increase svn and regenerate secrets
-	for pkgName, pkg := range updateManifest.Packages {
-		*currentPackages[pkgName].SecurityVersion = *pkg.SecurityVersion
+	data := c.data.withContext(ctx)
+	mnf, err := data.getCurrentManifest()
+	if err != nil {
+		return nil, err
 	}
-
-	rootCert, err := c.data.getCertificate(sKCoordinatorRootCert)
+	storedSecrets, err := data.getSecretMap()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	rootPrivK, err := c.data.getPrivK(sKCoordinatorRootKey)
+	params, err := renderPlaceholderParameters(mnf, marbleType, storedSecrets)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	resp := &rpc.ActivationResp{Parameters: params}
+	if err := setActivationCredentials(resp, placeholderReservedSecrets()); err != nil {
+		return nil, err
 	}
 
-	// Generate new cross-signed intermediate CA for Marble gRPC authentication
-	intermediateCert, intermediatePrivK, err := generateCert(rootCert.DNSNames, coordinatorIntermediateName, nil, rootCert, rootPrivK)
+	originalManifest, err := data.getManifest()
 	if err != nil {
-		c.zaplogger.Error("Could not generate a new intermediate CA for Marble authentication.", zap.Error(err))
-		return err
+		return nil, err
 	}
-	marbleRootCert, _, err := generateCert(rootCert.DNSNames, coordinatorIntermediateName, intermediatePrivK, nil, nil)
+	packageName := mnf.Marbles[marbleType].Package
+	pkg, err := data.getPackage(packageName)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	resp.PackageUpdated, resp.SecurityVersion = packagePolicy(originalManifest.Packages[packageName], pkg)
+	return resp, nil
+}
 
-	// Gather all shared certificate secrets we need to regenerate
-	secretsToRegenerate := make(map[string]manifest.Secret)
-	secrets, err := c.data.getSecretMap()
+// RenderTTLSConfig returns the TTLS config a Marble of the given type would receive on activation in MARBLE_TTLS_CONFIG.
+// If the manifest sets LenientTLS, it additionally returns the TLS entries which would be skipped.
+//
+// Like RenderMarbleParameters, secrets and the Marble's credentials are replaced by placeholder values.
+// The returned config is nil if the Marble type has no TLS tags.
+func (c *Core) RenderTTLSConfig(ctx context.Context, marbleType string) ([]byte, []string, error) {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return nil, nil, err
+	}
+
+	data := c.data.withContext(ctx)
+	mnf, err := data.getCurrentManifest()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	for name, secret := range secrets {
-		if secret.Shared && secret.Type != "symmetric-key" {
-			secretsToRegenerate[name] = secret
+	marble, ok := mnf.Marbles[marbleType]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown marble type %s", marbleType)
+	}
+	storedSecrets, err := data.getSecretMap()
+	if err != nil {
+		return nil, nil, err
+	}
+	specialSecrets := placeholderReservedSecrets()
+	specialSecrets.Tags = marble.Tags
+	return c.renderTTLSConfig(data, marble, specialSecrets, placeholderSecrets(mnf, marbleType, storedSecrets), mnf.LenientTLS)
+}
+
+// placeholderSecrets returns the secrets a Marble of the given type receives, with their values replaced by placeholders.
+// User-defined secrets which have not been set in storedSecrets keep their empty values, as a Marble would receive them.
+func placeholderSecrets(mnf manifest.Manifest, marbleType string, storedSecrets map[string]manifest.Secret) map[string]manifest.Secret {
+	platformBound := mnf.Marbles[marbleType].PlatformBoundSecrets
+	secrets := make(map[string]manifest.Secret, len(mnf.Secrets))
+	for name, secret := range mnf.Secrets {
+		if !secret.AvailableTo(marbleType) || (platformBound && isPlatformBoundSecret(secret)) {
+			continue
+		}
+		if secret.UserDefined && !isSecretSet(storedSecrets[name]) {
+			secrets[name] = secret
+			continue
 		}
+		secret.Cert.Raw = []byte{0x41}
+		secret.Private = []byte{0x41}
+		secret.Public = []byte{0x41}
+		secrets[name] = secret
 	}
+	return secrets
+}
 
-	// Regenerate shared secrets specified in manifest
-	regeneratedSecrets, err := c.generateSecrets(ctx, secretsToRegenerate, uuid.Nil, marbleRootCert, intermediatePrivK)
-	if err != nil {
-		c.zaplogger.Error("Could not generate specified secrets for the given manifest.", zap.Error(err))
-		return err
+// isSecretSet returns true if a secret holds a value.
+func isSecretSet(secret manifest.Secret) bool {
+	return len(secret.Cert.Raw) > 0 || len(secret.Private) > 0 || len(secret.Public) > 0
+}
+
+// renderPlaceholderParameters renders the parameters of a Marble type with placeholder secrets.
+func renderPlaceholderParameters(mnf manifest.Manifest, marbleType string, storedSecrets map[string]manifest.Secret) (*rpc.Parameters, error) {
+	marble, ok := mnf.Marbles[marbleType]
+	if !ok {
+		return nil, fmt.Errorf("unknown marble type %s", marbleType)
 	}
 
-	// Retrieve current recovery data before we seal the state again
-	currentRecoveryData, err := c.recovery.GetRecoveryData()
+	params, err := mnf.ResolveParameters(marble)
 	if err != nil {
-		c.zaplogger.Error("Could not retrieve the current recovery data from the recovery module. Cannot reseal the state, the update manifest will not be applied.")
-		return err
+		return nil, err
 	}
+	specialSecrets := placeholderReservedSecrets()
+	specialSecrets.Tags = marble.Tags
+	fileFuncMap := placeholderFuncMap(mnf.TemplateFuncMap(manifest.ManifestFileTemplateFuncMap))
+	envFuncMap := placeholderFuncMap(mnf.TemplateFuncMap(manifest.ManifestEnvTemplateFuncMap))
+	// placeholder secrets differ in size from the actual ones, so the size limit is not checked
+	customParams, err := customizeParametersWithFuncs(params, specialSecrets, placeholderSecrets(mnf, marbleType, storedSecrets), fileFuncMap, envFuncMap, 0)
+	if err != nil {
+		return nil, err
+	}
+	setLogLevel(customParams, marble.LogLevel)
+	omitReservedEnv(customParams, marble.OmitReservedEnv)
+	if marble.FilesArchive {
+		if err := archiveFiles(customParams); err != nil {
+			return nil, err
+		}
+	}
+	return customParams, nil
+}
 
-	c.updateLogger.Reset()
-	for pkgName, pkg := range updateManifest.Packages {
-		c.updateLogger.Info("SecurityVersion increased", zap.String("user", updater.Name()), zap.String("package", pkgName), zap.Uint("new version", *pkg.SecurityVersion))
+// SignCertificate issues a short-lived certificate for a CSR, signed by the Coordinator's intermediate CA.
+//
+// The requesting user needs to be granted the SignCertificate action. The CSR's public key, subject, and subject alternative names are used for the certificate.
+// Each DNS name and IP address of the CSR needs to be named in the ResourceNames of one of the user's roles granting SignCertificate.
+// To prevent impersonation of Marbles, the CommonName of the CSR may not be a UUID.
+func (c *Core) SignCertificate(ctx context.Context, rawCSR []byte, requester *user.User) ([]byte, error) {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return nil, err
 	}
 
-	tx, err := c.store.BeginTransaction()
-	if err != nil {
-		return err
+	if !requester.IsGranted(user.NewPermission(user.PermissionSignCert, nil)) {
+		return nil, fmt.Errorf("user %s is not allowed to sign certificates", requester.Name())
 	}
-	defer tx.Rollback()
-	txdata := storeWrapper{tx}
 
-	if err := txdata.putCertificate(skCoordinatorIntermediateCert, intermediateCert); err != nil {
-		return err
+	csr, err := x509.ParseCertificateRequest(rawCSR)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR: %w", err)
 	}
-	if err := txdata.putCertificate(sKMarbleRootCert, marbleRootCert); err != nil {
-		return err
+	if err := csr.CheckSignature(); err != nil {
+		return nil, errors.New("signature over CSR is invalid")
 	}
-	if err := txdata.putPrivK(sKCoordinatorIntermediateKey, intermediatePrivK); err != nil {
-		return err
+	// Marble certificates use the Marble's UUID as CommonName
+	if _, err := uuid.Parse(csr.Subject.CommonName); err == nil {
+		return nil, errors.New("CSR uses a UUID as CommonName, which is reserved for Marbles")
 	}
-	if err := txdata.appendUpdateLog(c.updateLogger.String()); err != nil {
-		return err
+
+	// users may only request the subject alternative names their roles grant
+	names := append([]string{}, csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if !requester.IsGranted(user.NewPermission(user.PermissionSignCert, names)) {
+		return nil, fmt.Errorf("user %s is not allowed to sign certificates for all of: %s", requester.Name(), strings.Join(names, ", "))
 	}
 
-	// Overwrite updated packages in core
-	for name, pkg := range currentPackages {
-		if err := txdata.putPackage(name, pkg); err != nil {
-			return err
-		}
+	keyUsage, extKeyUsage, err := util.KeyUsageFromCSR(csr)
+	if err != nil {
+		return nil, err
 	}
-	// Overwrite regenerated secrets in core
-	for name, secret := range regeneratedSecrets {
-		if err := txdata.putSecret(name, secret); err != nil {
-			return err
-		}
+
+	data := c.data.withContext(ctx)
+	marbleRootCert, err := data.getCertificate(sKMarbleRootCert)
+	if err != nil {
+		return nil, err
+	}
+	intermediatePrivK, err := c.getIntermediatePrivK(data)
+	if err != nil {
+		return nil, err
 	}
 
-	c.zaplogger.Info("An update manifest overriding package settings from the original manifest was set.")
-	c.zaplogger.Info("Please restart your Marbles to enforce the update.")
+	certRaw, err := util.CreateCertificateFromCSR(csr, csr.PublicKey, keyUsage, extKeyUsage, nil, nil, x509.UnknownSignatureAlgorithm, time.Now().Add(-c.certClockSkew), time.Now().Add(signedCertValidity), marbleRootCert, intermediatePrivK)
+	if err != nil {
+		return nil, err
+	}
 
-	if store, ok := c.store.(*store.StdStore); ok {
-		store.SetRecoveryData(currentRecoveryData)
+	if err := c.recordIssuedCertificate(ctx, certRaw, "", requester.Name()); err != nil {
+		return nil, err
 	}
-	return tx.Commit()
+
+	c.zaplogger.Info("signed certificate", zap.String("user", requester.Name()), zap.String("CommonName", csr.Subject.CommonName))
+	return certRaw, nil
 }
 
-// GetSecrets allows a user to read out secrets from the core.
-func (c *Core) GetSecrets(ctx context.Context, requestedSecrets []string, client *user.User) (map[string]manifest.Secret, error) {
+// GetIssuanceLog returns all certificates issued by the Coordinator's intermediate CA in order of issuance.
+//
+// The log is hashed into a Merkle tree and the tree hash is signed with the Coordinator's root key,
+// so an exported log can be compared against later exports to detect tampering.
+// The requesting user needs to be granted the ReadIssuanceLog action.
+func (c *Core) GetIssuanceLog(ctx context.Context, requester *user.User) (IssuanceLog, error) {
 	defer c.mux.Unlock()
-
-	// we can only return secrets if a manifest has already been set
 	if err := c.requireState(stateAcceptingMarbles); err != nil {
-		return nil, err
+		return IssuanceLog{}, err
 	}
 
-	// verify user is allowed to read the requested secrets
-	if !client.IsGranted(user.NewPermission(user.PermissionReadSecret, requestedSecrets)) {
-		return nil, fmt.Errorf("user %s is not allowed to read one or more secrets of: %v", client.Name(), requestedSecrets)
+	if !requester.IsGranted(user.NewPermission(user.PermissionReadIssuanceLog, nil)) {
+		return IssuanceLog{}, fmt.Errorf("user %s is not allowed to read the issuance log", requester.Name())
 	}
 
-	secrets := make(map[string]manifest.Secret)
-	for _, requestedSecret := range requestedSecrets {
-		returnedSecret, err := c.data.getSecret(requestedSecret)
+	data := c.data.withContext(ctx)
+	size, err := data.getIssuanceLogSize()
+	if err != nil {
+		return IssuanceLog{}, err
+	}
+	log := IssuanceLog{Entries: make([]IssuedCertificate, 0, size)}
+	leaves := make([][]byte, 0, size)
+	for i := uint64(0); i < size; i++ {
+		entry, err := data.getIssuedCertificate(i)
 		if err != nil {
-			return nil, err
+			return IssuanceLog{}, err
 		}
-		secrets[requestedSecret] = returnedSecret
+		log.Entries = append(log.Entries, entry)
+		leaves = append(leaves, entry.Certificate)
 	}
 
-	return secrets, nil
+	rootPrivK, err := data.getPrivK(sKCoordinatorRootKey)
+	if err != nil {
+		return IssuanceLog{}, err
+	}
+	log.TreeHash = merkleTreeHash(leaves)
+	log.Signature, err = rootPrivK.Sign(rand.Reader, issuanceLogDigest(size, log.TreeHash), crypto.SHA256)
+	if err != nil {
+		return IssuanceLog{}, err
+	}
+	return log, nil
 }
 
-// WriteSecrets allows a user to set certain user-defined secrets.
-func (c *Core) WriteSecrets(ctx context.Context, rawSecretManifest []byte, updater *user.User) error {
+// RevokeMarbleCertificates revokes every unexpired certificate the issuance log records for a Marble type, e.g., if the service is compromised.
+//
+// The certificates are added to the certificate revocation list in a single transaction. If exhaustActivations is set,
+// the activation count is raised to the Marble's MaxActivations, so no replacements can be activated until the count is lowered via SetActivations.
+// Peers that don't check the revocation list accept a revoked certificate until it expires after marbleCertValidity.
+// The requesting user needs to be granted the RevokeCertificates action for the Marble.
+func (c *Core) RevokeMarbleCertificates(ctx context.Context, marbleType string, exhaustActivations bool, requester *user.User) (int, error) {
 	defer c.mux.Unlock()
-
-	// Only accept secrets if we already have a manifest
 	if err := c.requireState(stateAcceptingMarbles); err != nil {
-		return err
+		return 0, err
 	}
 
-	// Unmarshal & check secret manifest
-	var secretManifest map[string]manifest.UserSecret
-	if err := json.Unmarshal(rawSecretManifest, &secretManifest); err != nil {
-		return err
+	if !requester.IsGranted(user.NewPermission(user.PermissionRevokeCertificates, []string{marbleType})) {
+		return 0, fmt.Errorf("user %s is not allowed to revoke the certificates of marble %s", requester.Name(), marbleType)
 	}
 
-	// validate and parse new secrets
-	secretMeta, err := c.data.getSecretMap()
-	if err != nil {
-		return err
-	}
-	newSecrets, err := manifest.ParseUserSecrets(ctx, secretManifest, secretMeta)
+	tx, err := c.store.BeginTransaction(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer tx.Rollback()
+	txdata := storeWrapper{store: tx, ctx: ctx}
 
-	// perform a dry run to check if the new secrets can be parsed as env vars or files
-	//
-	// set dummy values for user-defined secrets, only used for template validation, we do not care if any of these were set before
-	for k, v := range secretMeta {
-		if v.UserDefined {
-			v.Cert.Raw = []byte{0x41}
-			v.Private = []byte{0x41}
-			v.Public = []byte{0x41}
-			secretMeta[k] = v
-		}
+	marble, err := txdata.getMarble(marbleType)
+	if store.IsStoreValueUnsetError(err) {
+		return 0, fmt.Errorf("unknown marble type %s", marbleType)
+	} else if err != nil {
+		return 0, err
 	}
-	// merge new secrets with existing secrets
-	for k, v := range newSecrets {
-		secretMeta[k] = v
+	// MaxActivations == 0 means infinite budget, which can not be exhausted
+	if exhaustActivations && marble.MaxActivations == 0 {
+		return 0, fmt.Errorf("marble %s has no MaxActivations, so its activations can not be exhausted", marbleType)
 	}
-	mnf, err := c.data.getManifest()
+
+	// revocations which can never be published in a signed list would silently have no effect
+	marbleRootCert, err := txdata.getCertificate(sKMarbleRootCert)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	// perform the dry run
-	if err := templateDryRun(mnf, secretMeta); err != nil {
-		return err
+	if marbleRootCert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return 0, errIntermediateCannotSignCRL
 	}
 
-	tx, err := c.store.BeginTransaction()
+	size, err := txdata.getIssuanceLogSize()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer tx.Rollback()
-	txdata := storeWrapper{tx}
-
-	c.updateLogger.Reset()
-	for secretName, secret := range newSecrets {
-		// verify user is allowed to set the secret
-		if !updater.IsGranted(user.NewPermission(user.PermissionWriteSecret, []string{secretName})) {
-			return fmt.Errorf("user %s is not allowed to update secret: %s", updater.Name(), secretName)
+	now := time.Now().UTC()
+	revoked := 0
+	for i := uint64(0); i < size; i++ {
+		entry, err := txdata.getIssuedCertificate(i)
+		if err != nil {
+			return 0, err
 		}
-		if err := txdata.putSecret(secretName, secret); err != nil {
-			return err
+		if entry.MarbleType != marbleType {
+			continue
 		}
-		c.updateLogger.Info("secret set", zap.String("user", updater.Name()), zap.String("secret", secretName), zap.String("type", secret.Type))
-	}
+		if _, err := txdata.getRevokedCertificate(entry.Serial); err == nil {
+			continue
+		} else if !store.IsStoreValueUnsetError(err) {
+			return 0, err
+		}
+		cert, err := x509.ParseCertificate(entry.Certificate)
+		if err != nil {
+			return 0, err
+		}
+		if now.After(cert.NotAfter) {
+			continue
+		}
+		if err := txdata.putRevokedCertificate(RevokedCertificate{Serial: entry.Serial, MarbleType: marbleType, Revoked: now, NotAfter: cert.NotAfter}); err != nil {
+			return 0, err
+		}
+		revoked++
+	}
+
+	if exhaustActivations {
+		if err := txdata.putActivations(marbleType, marble.MaxActivations); err != nil {
+			return 0, err
+		}
+	}
+	c.updateLogger.Reset()
+	c.updateLogger.Info("Marble certificates revoked", zap.String("user", requester.Name()), zap.String("marble", marbleType), zap.Int("certificates", revoked), zap.Bool("activations exhausted", exhaustActivations))
+	if err := txdata.appendUpdateLog(c.updateLogger.String()); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	c.zaplogger.Info("marble certificates revoked", zap.String("user", requester.Name()), zap.String("marble", marbleType), zap.Int("certificates", revoked))
+	return revoked, nil
+}
+
+// errIntermediateCannotSignCRL is returned if the intermediate certificate predates the CRLSign key usage.
+// Updating the manifest with a new package SecurityVersion rotates the intermediate certificate.
+var errIntermediateCannotSignCRL = errors.New("the Coordinator's intermediate certificate was created without the CRLSign key usage and can not sign revocation lists")
+
+// GetCRL returns the certificate revocation list of the Coordinator's intermediate CA, signed with the intermediate key.
+//
+// Expired certificates are omitted. Relying parties should fetch a new list before NextUpdate.
+func (c *Core) GetCRL(ctx context.Context) ([]byte, error) {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return nil, err
+	}
+
+	data := c.data.withContext(ctx)
+	revokedCerts, err := data.getRevokedCertificates()
+	if err != nil {
+		return nil, err
+	}
+	marbleRootCert, err := data.getCertificate(sKMarbleRootCert)
+	if err != nil {
+		return nil, err
+	}
+	if marbleRootCert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, errIntermediateCannotSignCRL
+	}
+	intermediatePrivK, err := data.getPrivK(sKCoordinatorIntermediateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	template := &x509.RevocationList{
+		// the number only needs to increase with each list, so the current time suffices
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(crlValidity),
+	}
+	for _, revoked := range revokedCerts {
+		if now.After(revoked.NotAfter) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(revoked.Serial, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %q of revoked certificate", revoked.Serial)
+		}
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: revoked.Revoked,
+		})
+	}
+	return x509.CreateRevocationList(rand.Reader, template, marbleRootCert, intermediatePrivK)
+}
+
+// VerifyManifestReader checks if the given client certificates belong to a user allowed to read the manifest.
+//
+// Reading the manifest and update log is only restricted if the manifest defines a role granting the ReadManifest action.
+// Otherwise, anyone is allowed to read them.
+func (c *Core) VerifyManifestReader(ctx context.Context, clientCerts []*x509.Certificate) error {
+	mnf, err := c.data.getManifest()
+	if err != nil {
+		if store.IsStoreValueUnsetError(err) {
+			return nil
+		}
+		return err
+	}
+	if !mnf.RestrictsManifestRead() {
+		return nil
+	}
+
+	reader, err := c.VerifyUser(ctx, clientCerts)
+	if err != nil {
+		return err
+	}
+	if !reader.IsGranted(user.NewPermission(user.PermissionReadManifest, nil)) {
+		return fmt.Errorf("user %s is not allowed to read the manifest", reader.Name())
+	}
+	return nil
+}
+
+// VerifyUser checks if a given client certificate matches the admin certificates specified in the manifest.
+func (c *Core) VerifyUser(ctx context.Context, clientCerts []*x509.Certificate) (*user.User, error) {
+	userIter, err := c.data.getIterator(requestUser)
+	if err != nil {
+		return nil, err
+	}
+	// Check if a supplied client cert matches the supplied ones from the manifest stored in the core
+	// NOTE: We do not use the "correct" X.509 verify here since we do not really care about expiration and chain verification here.
+	for _, suppliedCert := range clientCerts {
+		for userIter.HasNext() {
+			name, err := userIter.GetNext()
+			if err != nil {
+				return nil, err
+			}
+			user, err := c.data.getUser(name)
+			if err != nil {
+				return nil, err
+			}
+			if suppliedCert.Equal(user.Certificate()) {
+				return user, nil
+			}
+		}
+	}
+
+	return nil, errors.New("client certificate did not match any MarbleRun users")
+}
+
+// UpdateManifest allows to update certain package parameters, supplied via a JSON manifest.
+func (c *Core) UpdateManifest(ctx context.Context, rawUpdateManifest []byte, updater *user.User) error {
+	defer c.mux.Unlock()
+
+	// Only accept update manifest if we already have a manifest
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return err
+	}
+
+	// Unmarshal & check update manifest
+	var updateManifest manifest.Manifest
+	if err := json.Unmarshal(rawUpdateManifest, &updateManifest); err != nil {
+		return err
+	}
+
+	// updates of Marbles and Bundles do not affect packages and are handled separately
+	if len(updateManifest.Marbles) > 0 || len(updateManifest.Bundles) > 0 {
+		return c.updateParameters(ctx, rawUpdateManifest, updateManifest, updater)
+	}
+
+	currentPackages, blocklists, err := c.proposedPackages(ctx, c.data, updateManifest, updater)
+	if err != nil {
+		return err
+	}
+
+	// Only tightened package properties rotate the intermediate CA, which forces all Marbles to activate again.
+	// Blocked entries are enforced on the next activation of the affected Marbles.
+	var rotation *intermediateRotation
+	if len(updateManifest.Packages) > 0 {
+		rotation, err = c.rotateIntermediate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Retrieve current recovery data before we seal the state again
+	currentRecoveryData, err := c.recovery.GetRecoveryData()
+	if err != nil {
+		c.zaplogger.Error("Could not retrieve the current recovery data from the recovery module. Cannot reseal the state, the update manifest will not be applied.")
+		return err
+	}
+
+	c.updateLogger.Reset()
+	for pkgName, pkg := range updateManifest.Packages {
+		c.updateLogger.Info("SecurityVersion increased", zap.String("user", updater.Name()), zap.String("package", pkgName), zap.Uint("new version", *pkg.SecurityVersion))
+	}
+	for pkgName, blockedEntries := range updateManifest.BlockedPackages {
+		for _, entry := range blockedEntries {
+			c.updateLogger.Info("Package entry blocked", zap.String("user", updater.Name()), zap.String("package", pkgName), zap.String("uniqueID", entry.UniqueID), zap.String("signerID", entry.SignerID), zap.Uint64p("productID", entry.ProductID))
+		}
+	}
+
+	tx, err := c.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	txdata := storeWrapper{store: tx}
+
+	if rotation != nil {
+		if err := rotation.put(txdata); err != nil {
+			return err
+		}
+	}
+	if err := txdata.appendUpdateLog(c.updateLogger.String()); err != nil {
+		return err
+	}
+
+	// Overwrite updated packages in core
+	for name, pkg := range currentPackages {
+		if err := txdata.putPackage(name, pkg); err != nil {
+			return err
+		}
+	}
+	for name, blocklist := range blocklists {
+		if err := txdata.putBlocklist(name, blocklist); err != nil {
+			return err
+		}
+	}
+
+	c.zaplogger.Info("An update manifest overriding package settings from the original manifest was set.")
+	if rotation != nil {
+		c.zaplogger.Info("Please restart your Marbles to enforce the update.")
+	}
+
+	if store, ok := c.store.(sealedStore); ok {
+		store.SetRecoveryData(currentRecoveryData)
+	}
+	return tx.Commit()
+}
+
+// intermediateRotation holds a new intermediate CA and the shared secrets regenerated with it.
+type intermediateRotation struct {
+	intermediateCert   *x509.Certificate
+	marbleRootCert     *x509.Certificate
+	intermediatePrivK  *ecdsa.PrivateKey
+	regeneratedSecrets map[string]manifest.Secret
+}
+
+// rotateIntermediate generates a new cross-signed intermediate CA and regenerates the shared certificate secrets with it.
+// Nothing is saved to the store, which is left to the caller.
+func (c *Core) rotateIntermediate(ctx context.Context) (*intermediateRotation, error) {
+	rootCert, err := c.data.getCertificate(sKCoordinatorRootCert)
+	if err != nil {
+		return nil, err
+	}
+	rootPrivK, err := c.data.getPrivK(sKCoordinatorRootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate new cross-signed intermediate CA for Marble gRPC authentication
+	intermediateCert, intermediatePrivK, err := generateCert(rootCert.DNSNames, coordinatorIntermediateName, nil, rootCert, rootPrivK)
+	if err != nil {
+		c.zaplogger.Error("Could not generate a new intermediate CA for Marble authentication.", zap.Error(err))
+		return nil, err
+	}
+	marbleRootCert, _, err := generateCert(rootCert.DNSNames, coordinatorIntermediateName, intermediatePrivK, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gather all shared certificate secrets we need to regenerate
+	secretsToRegenerate := make(map[string]manifest.Secret)
+	secrets, err := c.data.getSecretMap()
+	if err != nil {
+		return nil, err
+	}
+	for name, secret := range secrets {
+		if secret.Shared && secret.Type != "symmetric-key" && secret.Type != "hmac" {
+			secretsToRegenerate[name] = secret
+		}
+	}
+
+	// Regenerate shared secrets specified in manifest
+	regeneratedSecrets, err := c.generateSecrets(c.data.withContext(ctx), secretsToRegenerate, uuid.Nil, marbleRootCert, intermediatePrivK)
+	if err != nil {
+		c.zaplogger.Error("Could not generate specified secrets for the given manifest.", zap.Error(err))
+		return nil, err
+	}
+
+	return &intermediateRotation{
+		intermediateCert:   intermediateCert,
+		marbleRootCert:     marbleRootCert,
+		intermediatePrivK:  intermediatePrivK,
+		regeneratedSecrets: regeneratedSecrets,
+	}, nil
+}
+
+// put saves the new intermediate CA and the regenerated secrets to store.
+func (r *intermediateRotation) put(data storeWrapper) error {
+	if err := data.putCertificate(skCoordinatorIntermediateCert, r.intermediateCert); err != nil {
+		return err
+	}
+	if err := data.putCertificate(sKMarbleRootCert, r.marbleRootCert); err != nil {
+		return err
+	}
+	if err := data.putPrivK(sKCoordinatorIntermediateKey, r.intermediatePrivK); err != nil {
+		return err
+	}
+	for name, secret := range r.regeneratedSecrets {
+		if err := data.putSecret(name, secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// proposedPackages returns the Packages and blocklists which result from applying a package update manifest.
+// It verifies that the updater is allowed to update the packages and that the update is valid.
+func (c *Core) proposedPackages(ctx context.Context, data storeWrapper, updateManifest manifest.Manifest, updater *user.User) (map[string]quote.PackageProperties, map[string][]quote.PackageProperties, error) {
+	// verify updater is allowed to commit the update
+	var wantedPackages []string
+	for pkg := range updateManifest.Packages {
+		wantedPackages = append(wantedPackages, pkg)
+	}
+	for pkg := range updateManifest.BlockedPackages {
+		if _, ok := updateManifest.Packages[pkg]; !ok {
+			wantedPackages = append(wantedPackages, pkg)
+		}
+	}
+	if !updater.IsGranted(user.NewPermission(user.PermissionUpdatePackage, wantedPackages)) {
+		return nil, nil, fmt.Errorf("user %s is not allowed to update one or more packages of %v", updater.Name(), wantedPackages)
+	}
+
+	currentPackages := make(map[string]quote.PackageProperties)
+	for _, pkgName := range wantedPackages {
+		pkg, err := data.getPackage(pkgName)
+		if err != nil && !store.IsStoreValueUnsetError(err) {
+			return nil, nil, err
+		}
+		if err == nil {
+			currentPackages[pkgName] = pkg
+		}
+	}
+	if err := updateManifest.CheckUpdate(ctx, currentPackages); err != nil {
+		return nil, nil, err
+	}
+
+	// add newly blocked entries to the existing blocklists
+	blocklists := make(map[string][]quote.PackageProperties)
+	for pkgName, blockedEntries := range updateManifest.BlockedPackages {
+		blocklist, err := data.getBlocklist(pkgName)
+		if err != nil && !store.IsStoreValueUnsetError(err) {
+			return nil, nil, err
+		}
+		blocklists[pkgName] = append(blocklist, blockedEntries...)
+	}
+
+	// update manifest was valid, increase svn
+	for pkgName, pkg := range updateManifest.Packages {
+		*currentPackages[pkgName].SecurityVersion = *pkg.SecurityVersion
+	}
+
+	return currentPackages, blocklists, nil
+}
+
+// UpdateImpact describes how a proposed update manifest affects the activations of a Marble type.
+type UpdateImpact struct {
+	// Package is the updated or blocked package of the Marble type.
+	Package string
+	// Sampled is true if the quote of the latest activation of each measurement of the Marble type was checked against the proposed update.
+	// Marble types without a recorded activation, or whose recorded quotes are not accepted by the current manifest either, are not sampled.
+	Sampled bool
+	// Failing is true if any sampled quote would be rejected after the update.
+	Failing bool
+	// Reason describes why a sampled quote would be rejected.
+	Reason string `json:",omitempty"`
+}
+
+// DryRunUpdateManifest checks a proposed update manifest of packages without applying it.
+//
+// It returns the impact on each Marble type whose quote is validated and whose package is updated or blocked.
+// The quote of the latest activation of each measurement of a Marble type is validated against the proposed requirements,
+// which reveals the Marble types that would begin failing their activation.
+func (c *Core) DryRunUpdateManifest(ctx context.Context, rawUpdateManifest []byte, updater *user.User) (map[string]UpdateImpact, error) {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return nil, err
+	}
+
+	var updateManifest manifest.Manifest
+	if err := json.Unmarshal(rawUpdateManifest, &updateManifest); err != nil {
+		return nil, err
+	}
+	if len(updateManifest.Marbles) > 0 || len(updateManifest.Bundles) > 0 {
+		return nil, errors.New("a dry run is only supported for updates of packages")
+	}
+
+	data := c.data.withContext(ctx)
+	packages, blocklists, err := c.proposedPackages(ctx, data, updateManifest, updater)
+	if err != nil {
+		return nil, err
+	}
+
+	marbleIter, err := data.getIterator(requestMarble)
+	if err != nil {
+		return nil, err
+	}
+	impacts := make(map[string]UpdateImpact)
+	for marbleIter.HasNext() {
+		marbleType, err := marbleIter.GetNext()
+		if err != nil {
+			return nil, err
+		}
+		marble, err := data.getMarble(marbleType)
+		if err != nil {
+			return nil, err
+		}
+		pkg, updated := packages[marble.Package]
+		blocklist, blocked := blocklists[marble.Package]
+		if !updated && !blocked {
+			continue
+		}
+		if c.skipsQuoteValidation(marble) {
+			continue
+		}
+
+		impact, err := c.sampleUpdateImpact(data, marbleType, marble.Package, pkg, updated, blocklist, blocked)
+		if err != nil {
+			return nil, err
+		}
+		impacts[marbleType] = impact
+	}
+	return impacts, nil
+}
+
+// sampleUpdateImpact validates the quote samples of a Marble type against the proposed package and blocklist.
+// If the package or blocklist is not updated, the current one is used.
+// The Marble type is reported as failing if the sample of any measurement which is currently accepted would be rejected.
+func (c *Core) sampleUpdateImpact(data storeWrapper, marbleType, pkgName string, pkg quote.PackageProperties, updated bool, blocklist []quote.PackageProperties, blocked bool) (UpdateImpact, error) {
+	impact := UpdateImpact{Package: pkgName}
+	samples, err := data.getQuoteSamples(marbleType)
+	if store.IsStoreValueUnsetError(err) {
+		return impact, nil
+	}
+	if err != nil {
+		return UpdateImpact{}, err
+	}
+
+	currentPkg, err := data.getPackage(pkgName)
+	if err != nil {
+		return UpdateImpact{}, err
+	}
+	currentBlocklist, err := data.getBlocklist(pkgName)
+	if err != nil && !store.IsStoreValueUnsetError(err) {
+		return UpdateImpact{}, err
+	}
+	if !updated {
+		pkg = currentPkg
+	}
+	if !blocked {
+		blocklist = currentBlocklist
+	}
+
+	// check the measurements in a fixed order, so the reported reason is deterministic
+	measurements := make([]string, 0, len(samples))
+	for measurement := range samples {
+		measurements = append(measurements, measurement)
+	}
+	sort.Strings(measurements)
+
+	for _, measurement := range measurements {
+		sample := samples[measurement]
+		var infra quote.InfrastructureProperties
+		if sample.Infrastructure != "" {
+			infra, err = data.getInfrastructure(sample.Infrastructure)
+			if err != nil {
+				return UpdateImpact{}, err
+			}
+		}
+
+		// a sample which is not accepted anymore, e.g., because the platform's TCB is outdated, does not tell anything about the update
+		if c.qv.Validate(sample.Quote, sample.Cert, currentPkg, infra) != nil || c.isBlocked(sample.Quote, sample.Cert, currentBlocklist, infra) {
+			continue
+		}
+		impact.Sampled = true
+
+		if err := c.qv.Validate(sample.Quote, sample.Cert, pkg, infra); err != nil {
+			impact.Failing = true
+			impact.Reason = "invalid quote: " + err.Error()
+			return impact, nil
+		} else if c.isBlocked(sample.Quote, sample.Cert, blocklist, infra) {
+			impact.Failing = true
+			impact.Reason = "quote matches a blocked package entry"
+			return impact, nil
+		}
+	}
+	return impact, nil
+}
+
+// updateParameters replaces the Parameters of existing Marbles for future activations.
+//
+// Packages, secrets, and certificates are left untouched. The caller needs to hold the Core's lock.
+func (c *Core) updateParameters(ctx context.Context, rawUpdateManifest []byte, updateManifest manifest.Manifest, updater *user.User) error {
+	tx, err := c.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	txdata := storeWrapper{store: tx, ctx: ctx}
+
+	mnf, err := txdata.getCurrentManifest()
+	if err != nil {
+		return err
+	}
+
+	// updating a bundle changes the parameters of all Marbles including it
+	var wantedMarbles []string
+	affectedMarbles := map[string]bool{}
+	for marbleName := range updateManifest.Marbles {
+		wantedMarbles = append(wantedMarbles, marbleName)
+		affectedMarbles[marbleName] = true
+	}
+	for marbleName, marble := range mnf.Marbles {
+		for _, bundleName := range marble.Bundles {
+			if _, ok := updateManifest.Bundles[bundleName]; ok && !affectedMarbles[marbleName] {
+				affectedMarbles[marbleName] = true
+				wantedMarbles = append(wantedMarbles, marbleName)
+			}
+		}
+	}
+	if !updater.IsGranted(user.NewPermission(user.PermissionUpdateParams, wantedMarbles)) {
+		return fmt.Errorf("user %s is not allowed to update the parameters of one or more marbles of %v", updater.Name(), wantedMarbles)
+	}
+
+	setFields, err := setMarbleFields(rawUpdateManifest)
+	if err != nil {
+		return err
+	}
+	if err := updateManifest.CheckParametersUpdate(ctx, mnf.Marbles, mnf.Bundles, setFields); err != nil {
+		return err
+	}
+	for marbleName, marble := range updateManifest.Marbles {
+		fields := setFields[marbleName]
+		if !fields["parameters"] && !fields["maxactivations"] && !fields["loglevel"] {
+			return fmt.Errorf("update manifest does not specify Parameters, MaxActivations, or LogLevel for marble %s", marbleName)
+		}
+		updatedMarble := mnf.Marbles[marbleName]
+		if fields["parameters"] {
+			updatedMarble.Parameters = marble.Parameters
+		}
+		if fields["maxactivations"] {
+			updatedMarble.MaxActivations = marble.MaxActivations
+		}
+		if fields["loglevel"] {
+			updatedMarble.LogLevel = marble.LogLevel
+		}
+		mnf.Marbles[marbleName] = updatedMarble
+	}
+	for bundleName, bundle := range updateManifest.Bundles {
+		mnf.Bundles[bundleName] = bundle
+	}
+
+	// make sure the new parameters can be templated, user-defined secrets may not be set yet
+	secrets, err := txdata.getSecretMap()
+	if err != nil {
+		return err
+	}
+	for k, v := range secrets {
+		if v.UserDefined {
+			v.Cert.Raw = []byte{0x41}
+			v.Private = []byte{0x41}
+			v.Public = []byte{0x41}
+			secrets[k] = v
+		}
+	}
+	if err := templateDryRun(mnf, secrets); err != nil {
+		return err
+	}
+
+	// the effective manifest makes the updated definitions retrievable and verifiable via its signature
+	effectiveManifest, err := txdata.getEffectiveRawManifest()
+	if store.IsStoreValueUnsetError(err) {
+		effectiveManifest, err = txdata.getRawManifest()
+	}
+	if err != nil {
+		return err
+	}
+	updatedMarbles := make(map[string]interface{}, len(updateManifest.Marbles))
+	for marbleName := range updateManifest.Marbles {
+		updatedMarbles[marbleName] = mnf.Marbles[marbleName]
+	}
+	updatedBundles := make(map[string]interface{}, len(updateManifest.Bundles))
+	for bundleName, bundle := range updateManifest.Bundles {
+		updatedBundles[bundleName] = bundle
+	}
+	if effectiveManifest, err = patchRawManifest(effectiveManifest, "Marbles", updatedMarbles); err != nil {
+		return err
+	}
+	if effectiveManifest, err = patchRawManifest(effectiveManifest, "Bundles", updatedBundles); err != nil {
+		return err
+	}
+	if err := txdata.putEffectiveRawManifest(effectiveManifest); err != nil {
+		return err
+	}
+	effectiveManifestHash := sha256.Sum256(effectiveManifest)
+
+	c.updateLogger.Reset()
+	for bundleName, bundle := range updateManifest.Bundles {
+		if err := txdata.putBundle(bundleName, bundle); err != nil {
+			return err
+		}
+		c.updateLogger.Info("Bundle updated", zap.String("user", updater.Name()), zap.String("bundle", bundleName), zap.String("new version", bundle.Version))
+	}
+	for marbleName := range updateManifest.Marbles {
+		marble := mnf.Marbles[marbleName]
+		if err := txdata.putMarble(marbleName, marble); err != nil {
+			return err
+		}
+		if setFields[marbleName]["parameters"] {
+			rawParameters, err := json.Marshal(marble.Parameters)
+			if err != nil {
+				return err
+			}
+			parametersHash := sha256.Sum256(rawParameters)
+			c.updateLogger.Info("Marble parameters updated", zap.String("user", updater.Name()), zap.String("marble", marbleName),
+				zap.String("new parameters hash", hex.EncodeToString(parametersHash[:])))
+		}
+		if setFields[marbleName]["maxactivations"] {
+			c.updateLogger.Info("Marble MaxActivations updated", zap.String("user", updater.Name()), zap.String("marble", marbleName), zap.Uint("new max activations", marble.MaxActivations))
+			// a lowered budget only rejects future activations, running Marbles keep their certificates
+			activations, err := txdata.getActivations(marbleName)
+			if err != nil && !store.IsStoreValueUnsetError(err) {
+				return err
+			}
+			if marble.MaxActivations > 0 && activations > marble.MaxActivations {
+				c.zaplogger.Warn("MaxActivations was lowered below the number of activations. Further activations are rejected.",
+					zap.String("marble", marbleName), zap.Uint("activations", activations), zap.Uint("max activations", marble.MaxActivations))
+			}
+		}
+		if setFields[marbleName]["loglevel"] {
+			c.updateLogger.Info("Marble LogLevel updated", zap.String("user", updater.Name()), zap.String("marble", marbleName), zap.String("new log level", marble.LogLevel))
+		}
+	}
+	c.updateLogger.Info("Effective manifest updated", zap.String("user", updater.Name()), zap.String("signature", hex.EncodeToString(effectiveManifestHash[:])))
+	if err := txdata.appendUpdateLog(c.updateLogger.String()); err != nil {
+		return err
+	}
+
+	c.zaplogger.Info("An update manifest changing Marbles or Bundles was set. The changes apply to future activations.")
+	return tx.Commit()
+}
+
+// patchRawManifest replaces the named entries of a section of a raw manifest, e.g., single Marbles of the "Marbles" section.
+// Other entries and sections are kept as they are.
+func patchRawManifest(rawManifest []byte, section string, entries map[string]interface{}) ([]byte, error) {
+	if len(entries) == 0 {
+		return rawManifest, nil
+	}
+	var mnf map[string]json.RawMessage
+	if err := json.Unmarshal(rawManifest, &mnf); err != nil {
+		return nil, err
+	}
+	// encoding/json matches section names case-insensitively, so the manifest may use a different case
+	for key := range mnf {
+		if strings.EqualFold(key, section) {
+			section = key
+			break
+		}
+	}
+	sectionEntries := map[string]json.RawMessage{}
+	if rawSection, ok := mnf[section]; ok {
+		if err := json.Unmarshal(rawSection, &sectionEntries); err != nil {
+			return nil, err
+		}
+	}
+	for name, entry := range entries {
+		rawEntry, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		sectionEntries[name] = rawEntry
+	}
+	var err error
+	mnf[section], err = json.Marshal(sectionEntries)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mnf)
+}
+
+// setMarbleFields returns the lowercased names of the fields set for each Marble of a raw update manifest.
+// It is used to distinguish fields that are absent from fields explicitly set to their zero value, e.g., MaxActivations set to 0.
+func setMarbleFields(rawUpdateManifest []byte) (map[string]map[string]bool, error) {
+	var rawManifest struct {
+		Marbles map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(rawUpdateManifest, &rawManifest); err != nil {
+		return nil, err
+	}
+
+	setFields := make(map[string]map[string]bool, len(rawManifest.Marbles))
+	for marbleName, rawMarble := range rawManifest.Marbles {
+		fields := make(map[string]bool, len(rawMarble))
+		for field := range rawMarble {
+			// encoding/json matches field names case-insensitively as well
+			fields[strings.ToLower(field)] = true
+		}
+		setFields[marbleName] = fields
+	}
+	return setFields, nil
+}
+
+// GetSecrets allows a user to read out secrets from the core.
+func (c *Core) GetSecrets(ctx context.Context, requestedSecrets []string, client *user.User) (map[string]manifest.Secret, error) {
+	defer c.mux.Unlock()
+
+	// we can only return secrets if a manifest has already been set
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return nil, err
+	}
+
+	// verify user is allowed to read the requested secrets
+	if !client.IsGranted(user.NewPermission(user.PermissionReadSecret, requestedSecrets)) {
+		return nil, fmt.Errorf("user %s is not allowed to read one or more secrets of: %v", client.Name(), requestedSecrets)
+	}
+
+	secrets := make(map[string]manifest.Secret)
+	for _, requestedSecret := range requestedSecrets {
+		returnedSecret, err := c.data.getSecret(requestedSecret)
+		if err != nil {
+			return nil, err
+		}
+		secrets[requestedSecret] = returnedSecret
+	}
+
+	return secrets, nil
+}
+
+// SetPaused pauses or resumes activations of Marbles, e.g., during a maintenance window.
+//
+// While paused, the Coordinator keeps serving the Client API but rejects activations with FailedPrecondition.
+// The paused state is not persisted and is reset when the Coordinator restarts.
+// The requesting user needs to be granted the PauseActivations action.
+func (c *Core) SetPaused(ctx context.Context, paused bool, requester *user.User) error {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return err
+	}
+
+	if !requester.IsGranted(user.NewPermission(user.PermissionPause, nil)) {
+		return fmt.Errorf("user %s is not allowed to pause activations", requester.Name())
+	}
+
+	c.paused = paused
+	if paused {
+		c.zaplogger.Info("activations paused", zap.String("user", requester.Name()))
+	} else {
+		c.zaplogger.Info("activations resumed", zap.String("user", requester.Name()))
+	}
+	return nil
+}
+
+// SetActivations sets the number of activations counted for a Marble type.
+//
+// When migrating an existing fleet, this lets the activation budget start from the number of already running instances.
+// The count must not exceed the Marble's MaxActivations. The requesting user needs to be granted the SetActivations action for the Marble.
+func (c *Core) SetActivations(ctx context.Context, marbleType string, activations uint, requester *user.User) error {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return err
+	}
+
+	if !requester.IsGranted(user.NewPermission(user.PermissionSetActivations, []string{marbleType})) {
+		return fmt.Errorf("user %s is not allowed to set the activations of marble %s", requester.Name(), marbleType)
+	}
+
+	marble, err := c.data.withContext(ctx).getMarble(marbleType)
+	if store.IsStoreValueUnsetError(err) {
+		return fmt.Errorf("unknown marble type %s", marbleType)
+	} else if err != nil {
+		return err
+	}
+	if marble.MaxActivations > 0 && activations > marble.MaxActivations {
+		return fmt.Errorf("activations %d exceed MaxActivations %d of marble %s", activations, marble.MaxActivations, marbleType)
+	}
+
+	tx, err := c.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	txdata := storeWrapper{store: tx}
+
+	previous, err := txdata.getActivations(marbleType)
+	if err != nil && !store.IsStoreValueUnsetError(err) {
+		return err
+	}
+	if err := txdata.putActivations(marbleType, activations); err != nil {
+		return err
+	}
+	c.updateLogger.Reset()
+	c.updateLogger.Info("Marble activations set", zap.String("user", requester.Name()), zap.String("marble", marbleType), zap.Uint("previous activations", previous), zap.Uint("activations", activations))
+	if err := txdata.appendUpdateLog(c.updateLogger.String()); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	c.zaplogger.Info("activations set", zap.String("user", requester.Name()), zap.String("marble", marbleType), zap.Uint("activations", activations))
+	return nil
+}
+
+// GetActivations returns the activation budget and count of each Marble type in the manifest.
+// MaxActivations reflects updates of the manifest.
+func (c *Core) GetActivations(ctx context.Context) (map[string]MarbleActivations, error) {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return nil, err
+	}
+
+	data := c.data.withContext(ctx)
+	mnf, err := data.getManifest()
+	if err != nil {
+		return nil, err
+	}
+	activations := make(map[string]MarbleActivations, len(mnf.Marbles))
+	for marbleType := range mnf.Marbles {
+		marble, err := data.getMarble(marbleType)
+		if err != nil {
+			return nil, err
+		}
+		count, err := data.getActivations(marbleType)
+		if err != nil && !store.IsStoreValueUnsetError(err) {
+			return nil, err
+		}
+		activations[marbleType] = MarbleActivations{MaxActivations: marble.MaxActivations, Activations: count, Resources: marble.Resources}
+	}
+	return activations, nil
+}
+
+// RotateDerivationRoot replaces the root of the symmetric keys the Coordinator derives for Marbles.
+//
+// Shared deterministic secrets are re-derived from the new root.
+// Until gracePeriod has passed, activated Marbles additionally receive the keys derived from the previous root as {{ .MarbleRun.PreviousSecrets }},
+// so they can unseal their data and seal it again with the new keys.
+func (c *Core) RotateDerivationRoot(ctx context.Context, gracePeriod time.Duration, requester *user.User) error {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return err
+	}
+
+	if !requester.IsGranted(user.NewPermission(user.PermissionRotateDerivationRoot, nil)) {
+		return fmt.Errorf("user %s is not allowed to rotate the derivation root", requester.Name())
+	}
+	if gracePeriod < 0 {
+		return errors.New("grace period must not be negative")
+	}
+
+	tx, err := c.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	txdata := storeWrapper{store: tx, ctx: ctx}
+
+	root, err := txdata.getDerivationRoot()
+	if err != nil {
+		return err
+	}
+	if root.previousValid(time.Now()) {
+		return fmt.Errorf("grace period of the previous rotation ends at %s", root.PreviousValidUntil.UTC().Format(time.RFC3339))
+	}
+	newRoot := derivationRoot{
+		Current:            make([]byte, 32),
+		Previous:           root.Current,
+		PreviousValidUntil: time.Now().Add(gracePeriod),
+	}
+	if _, err := rand.Read(newRoot.Current); err != nil {
+		return err
+	}
+
+	secrets, err := txdata.getSecretMap()
+	if err != nil {
+		return err
+	}
+
+	c.updateLogger.Reset()
+	c.updateLogger.Info("derivation root rotated", zap.String("user", requester.Name()), zap.Duration("grace period", gracePeriod))
+	for name, secret := range secrets {
+		if !secret.Shared || !isDerivedSecret(secret) {
+			continue
+		}
+		value, err := deriveSecretValue(newRoot.Current, uuid.Nil, name, secret.Size)
+		if err != nil {
+			return err
+		}
+		secret.Private = value
+		secret.Public = value
+		if err := txdata.putSecret(name, secret); err != nil {
+			return err
+		}
+		c.updateLogger.Info("secret re-derived", zap.String("secret", name))
+	}
+	if err := txdata.putDerivationRoot(newRoot); err != nil {
+		return err
+	}
+	if err := txdata.appendUpdateLog(c.updateLogger.String()); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	c.zaplogger.Info("derivation root rotated", zap.String("user", requester.Name()), zap.Duration("grace period", gracePeriod))
+	return nil
+}
+
+// RotateRecoveryKey replaces the recovery key name with the PEM-encoded RSA public key newRecoveryKey.
+//
+// proof needs to be an RSA-PSS signature over the SHA-256 hash of newRecoveryKey, created with the current private key of the recovery key.
+// The state is sealed with a newly generated encryption key, so the previous recovery secrets can not decrypt it anymore.
+// The returned recovery secrets replace the ones returned when the manifest was set.
+// The requesting user needs to be granted the RotateRecoveryKey action.
+func (c *Core) RotateRecoveryKey(ctx context.Context, name string, newRecoveryKey string, proof []byte, requester *user.User) (map[string][]byte, error) {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return nil, err
+	}
+
+	if !requester.IsGranted(user.NewPermission(user.PermissionRotateRecoveryKey, nil)) {
+		return nil, fmt.Errorf("user %s is not allowed to rotate recovery keys", requester.Name())
+	}
+
+	mnf, err := c.data.withContext(ctx).getCurrentManifest()
+	if err != nil {
+		return nil, err
+	}
+	currentKey, ok := mnf.RecoveryKeys[name]
+	if !ok {
+		return nil, fmt.Errorf("manifest does not define a recovery key %s", name)
+	}
+	if err := recovery.VerifyProof(currentKey, []byte(newRecoveryKey), proof); err != nil {
+		return nil, fmt.Errorf("invalid proof of possession of recovery key %s: %w", name, err)
+	}
+
+	recoveryKeys := make(map[string]string, len(mnf.RecoveryKeys))
+	for keyName, key := range mnf.RecoveryKeys {
+		recoveryKeys[keyName] = key
+	}
+	recoveryKeys[name] = newRecoveryKey
+
+	// Set encryption key & generate recovery data for the new recovery keys
+	encryptionKey, err := c.recovery.GenerateEncryptionKey(recoveryKeys)
+	if err != nil {
+		return nil, err
+	}
+	recoverySecretMap, recoveryData, err := c.recovery.GenerateRecoveryData(recoveryKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := c.store.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	txdata := storeWrapper{store: tx}
+
+	if err := txdata.putRecoveryKeys(recoveryKeys); err != nil {
+		return nil, err
+	}
+	c.updateLogger.Reset()
+	c.updateLogger.Info("recovery key rotated", zap.String("user", requester.Name()), zap.String("recovery key", name))
+	if err := txdata.appendUpdateLog(c.updateLogger.String()); err != nil {
+		return nil, err
+	}
+
+	// the state is sealed with the new encryption key on commit, so the previous key is restored if the commit fails
+	previousEncryptionKey, err := c.sealer.GetEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	previousRecoveryData, err := c.recovery.GetRecoveryData()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.setEncryptionKey(encryptionKey); err != nil {
+		return nil, err
+	}
+	sealed, isSealedStore := c.store.(sealedStore)
+	if isSealedStore {
+		sealed.SetRecoveryData(recoveryData)
+	}
+	if err := tx.Commit(); err != nil {
+		c.zaplogger.Error("sealing of state failed", zap.Error(err))
+		if previousEncryptionKey != nil {
+			if err := c.setEncryptionKey(previousEncryptionKey); err != nil {
+				c.zaplogger.Error("restoring the previous encryption key failed", zap.Error(err))
+			}
+		}
+		if isSealedStore {
+			sealed.SetRecoveryData(previousRecoveryData)
+		}
+		return nil, err
+	}
+
+	c.zaplogger.Info("recovery key rotated", zap.String("user", requester.Name()), zap.String("recovery key", name))
+	return recoverySecretMap, nil
+}
+
+// ExportSecrets returns secrets of a Marble encrypted for the manifest's RecoveryKeys.
+//
+// Shared and user-defined secrets are retrieved from the store, per-Marble symmetric keys are re-derived for the given UUID.
+// Other per-Marble secrets are generated randomly on activation and can not be exported.
+// Neither can per-Marble symmetric keys received by Marbles with PlatformBoundSecrets, as only the Marble knows the bound value.
+// The requesting user needs to be granted the ExportSecret action for all requested secrets.
+func (c *Core) ExportSecrets(ctx context.Context, marbleUUID string, requestedSecrets []string, requester *user.User) (SecretBackup, error) {
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return SecretBackup{}, err
+	}
+
+	if !requester.IsGranted(user.NewPermission(user.PermissionExportSecret, requestedSecrets)) {
+		return SecretBackup{}, fmt.Errorf("user %s is not allowed to export one or more secrets of: %v", requester.Name(), requestedSecrets)
+	}
+
+	id, err := uuid.Parse(marbleUUID)
+	if err != nil {
+		return SecretBackup{}, fmt.Errorf("invalid Marble UUID: %w", err)
+	}
+	if id == uuid.Nil {
+		return SecretBackup{}, errors.New("invalid Marble UUID: nil UUID")
+	}
+
+	mnf, err := c.data.getCurrentManifest()
+	if err != nil {
+		return SecretBackup{}, err
+	}
+	if len(mnf.RecoveryKeys) == 0 {
+		return SecretBackup{}, errors.New("manifest does not define a RecoveryKey to encrypt the secrets for")
+	}
+	storedSecrets, err := c.data.getSecretMap()
+	if err != nil {
+		return SecretBackup{}, err
+	}
+
+	exported := make(map[string]manifest.Secret, len(requestedSecrets))
+	perMarbleSecrets := make(map[string]manifest.Secret)
+	for _, name := range requestedSecrets {
+		secret, ok := mnf.Secrets[name]
+		if !ok {
+			return SecretBackup{}, fmt.Errorf("secret %s is not defined in the manifest", name)
+		}
+		if secret.Shared || secret.UserDefined {
+			stored := storedSecrets[name]
+			if !isSecretSet(stored) {
+				return SecretBackup{}, fmt.Errorf("secret %s has not been set", name)
+			}
+			exported[name] = stored
+			continue
+		}
+		if secret.Type != "symmetric-key" && secret.Type != "hmac" {
+			return SecretBackup{}, fmt.Errorf("secret %s is unique to each Marble and can not be re-derived", name)
+		}
+		// Marbles bind such secrets to their platform, so the re-derived value differs from the one they use
+		for marbleType, marble := range mnf.Marbles {
+			if marble.PlatformBoundSecrets && secret.AvailableTo(marbleType) {
+				return SecretBackup{}, fmt.Errorf("secret %s is bound to the platform of marble type %s and can not be exported", name, marbleType)
+			}
+		}
+		perMarbleSecrets[name] = secret
+	}
+
+	derivedSecrets, err := c.generateSecrets(c.data.withContext(ctx), perMarbleSecrets, id, nil, nil)
+	if err != nil {
+		return SecretBackup{}, err
+	}
+	for name, secret := range derivedSecrets {
+		exported[name] = secret
+	}
+
+	rawSecrets, err := json.Marshal(exported)
+	if err != nil {
+		return SecretBackup{}, err
+	}
+	encryptionKey := make([]byte, 32)
+	if _, err := rand.Read(encryptionKey); err != nil {
+		return SecretBackup{}, err
+	}
+	encryptedSecrets, err := ecrypto.Encrypt(rawSecrets, encryptionKey, nil)
+	if err != nil {
+		return SecretBackup{}, err
+	}
+	encryptedKeys, err := recovery.EncryptForRecoveryKeys(mnf.RecoveryKeys, encryptionKey)
+	if err != nil {
+		return SecretBackup{}, err
+	}
+
+	c.zaplogger.Info("exported secrets", zap.String("user", requester.Name()), zap.String("UUID", id.String()), zap.Strings("secrets", requestedSecrets))
+	return SecretBackup{EncryptionKeys: encryptedKeys, Secrets: encryptedSecrets}, nil
+}
+
+// WriteSecrets allows a user to set certain user-defined secrets.
+func (c *Core) WriteSecrets(ctx context.Context, rawSecretManifest []byte, updater *user.User) error {
+	defer c.mux.Unlock()
+
+	// Only accept secrets if we already have a manifest
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return err
+	}
+
+	// Unmarshal & check secret manifest
+	var secretManifest map[string]manifest.UserSecret
+	if err := json.Unmarshal(rawSecretManifest, &secretManifest); err != nil {
+		return err
+	}
+
+	// validate and parse new secrets
+	secretMeta, err := c.data.getSecretMap()
+	if err != nil {
+		return err
+	}
+	newSecrets, err := manifest.ParseUserSecrets(ctx, secretManifest, secretMeta)
+	if err != nil {
+		return err
+	}
+
+	// perform a dry run to check if the new secrets can be parsed as env vars or files
+	//
+	// set dummy values for user-defined secrets, only used for template validation, we do not care if any of these were set before
+	for k, v := range secretMeta {
+		if v.UserDefined {
+			v.Cert.Raw = []byte{0x41}
+			v.Private = []byte{0x41}
+			v.Public = []byte{0x41}
+			secretMeta[k] = v
+		}
+	}
+	// merge new secrets with existing secrets
+	for k, v := range newSecrets {
+		secretMeta[k] = v
+	}
+	mnf, err := c.data.getCurrentManifest()
+	if err != nil {
+		return err
+	}
+	// perform the dry run
+	if err := templateDryRun(mnf, secretMeta); err != nil {
+		return err
+	}
+
+	tx, err := c.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	txdata := storeWrapper{store: tx}
+
+	c.updateLogger.Reset()
+	for secretName, secret := range newSecrets {
+		// verify user is allowed to set the secret
+		if !updater.IsGranted(user.NewPermission(user.PermissionWriteSecret, []string{secretName})) {
+			return fmt.Errorf("user %s is not allowed to update secret: %s", updater.Name(), secretName)
+		}
+		if err := txdata.putSecret(secretName, secret); err != nil {
+			return err
+		}
+		c.updateLogger.Info("secret set", zap.String("user", updater.Name()), zap.String("secret", secretName), zap.String("type", secret.Type))
+	}
 	if err := txdata.appendUpdateLog(c.updateLogger.String()); err != nil {
 		return err
 	}
@@ -526,13 +1905,22 @@ func (c *Core) performRecovery(encryptionKey []byte) error {
 	}
 
 	// load state
-	store := store.NewStdStore(c.sealer)
-	recoveryData, err := store.LoadState()
-	if err != nil {
-		return err
+	var recoveryData []byte
+	if pgStore, ok := c.store.(*store.PostgresStore); ok {
+		// the key of a shared state is obtained from the database
+		var err error
+		if recoveryData, err = pgStore.Recover(encryptionKey); err != nil {
+			return err
+		}
+	} else {
+		stdStore := store.NewStdStore(c.sealer)
+		var err error
+		if recoveryData, err = stdStore.LoadState(); err != nil {
+			return err
+		}
+		c.store = stdStore
+		c.data = storeWrapper{store: stdStore}
 	}
-	c.store = store
-	c.data = storeWrapper{store}
 	if err := c.recovery.SetRecoveryData(recoveryData); err != nil {
 		c.zaplogger.Error("Could not retrieve recovery data from state. Recovery will be unavailable", zap.Error(err))
 	}
@@ -549,36 +1937,66 @@ func (c *Core) performRecovery(encryptionKey []byte) error {
 // templateDryRun performs a dry run for Files and Env declarations in a manifest.
 func templateDryRun(mnf manifest.Manifest, secrets map[string]manifest.Secret) error {
 	templateSecrets := secretsWrapper{
-		Secrets: secrets,
-		MarbleRun: reservedSecrets{
-			RootCA: manifest.Secret{
-				Cert: manifest.Certificate{Raw: []byte{0x41}},
-			},
-			MarbleCert: manifest.Secret{
-				Cert:    manifest.Certificate{Raw: []byte{0x41}},
-				Public:  []byte{0x41},
-				Private: []byte{0x41},
-			},
-		},
+		MarbleRun: placeholderReservedSecrets(),
 	}
+	fileFuncMap := placeholderFuncMap(mnf.TemplateFuncMap(manifest.ManifestFileTemplateFuncMap))
+	envFuncMap := placeholderFuncMap(mnf.TemplateFuncMap(manifest.ManifestEnvTemplateFuncMap))
+
 	// make sure templates in file/env declarations can actually be executed
-	for mN, m := range mnf.Marbles {
-		for fN, file := range m.Parameters.Files {
-			if !file.NoTemplates {
-				if err := checkFileTemplates(file.Data, manifest.ManifestFileTemplateFuncMap, templateSecrets); err != nil {
+	for marbleName, m := range mnf.Marbles {
+		params, err := mnf.ResolveParameters(m)
+		if err != nil {
+			return fmt.Errorf("in Marble %s: %v", marbleName, err)
+		}
+		// the parameters of each infrastructure are checked as well
+		paramSets := map[string]manifest.Parameters{marbleName: params}
+		for infraName := range m.InfrastructureParameters {
+			infraParams, err := mnf.ResolveInfrastructureParameters(m, infraName)
+			if err != nil {
+				return fmt.Errorf("in Marble %s: %v", marbleName, err)
+			}
+			paramSets[fmt.Sprintf("%s (infrastructure %s)", marbleName, infraName)] = infraParams
+		}
+		templateSecrets.MarbleRun.Tags = m.Tags
+		// templates may only reference secrets the Marble receives
+		templateSecrets.Secrets = secretsAvailableTo(secrets, marbleName)
+		if m.PlatformBoundSecrets {
+			templateSecrets.Secrets, _ = splitPlatformBoundSecrets(templateSecrets.Secrets)
+		}
+		templateSecrets.MarbleRun.PreviousSecrets = templateSecrets.Secrets
+
+		for mN, params := range paramSets {
+			for fN, file := range params.Files {
+				if err := checkFileSecret(file, fileFuncMap, templateSecrets); err != nil {
 					return fmt.Errorf("in Marble %s: file %s: %v", mN, fN, err)
 				}
+				if !file.NoTemplates && file.Secret == "" {
+					if err := checkFileTemplates(file.Data, fileFuncMap, templateSecrets); err != nil {
+						return fmt.Errorf("in Marble %s: file %s: %v", mN, fN, err)
+					}
+				}
 			}
-		}
-		for eN, env := range m.Parameters.Env {
-			// make sure environment variables dont contain NULL bytes, we perform another check at runtime to catch NULL bytes in secrets
-			if strings.Contains(env.Data, string([]byte{0x00})) {
-				return fmt.Errorf("in Marble %s: env variable: %s: content contains null bytes", mN, eN)
+			for i, arg := range params.Argv {
+				if strings.Contains(arg, string([]byte{0x00})) {
+					return fmt.Errorf("in Marble %s: argument %d: content contains null bytes", mN, i)
+				}
+				if err := checkFileTemplates(arg, envFuncMap, templateSecrets); err != nil {
+					return fmt.Errorf("in Marble %s: argument %d: %v", mN, i, err)
+				}
 			}
-			if !env.NoTemplates {
-				if err := checkFileTemplates(env.Data, manifest.ManifestEnvTemplateFuncMap, templateSecrets); err != nil {
+			for eN, env := range params.Env {
+				// make sure environment variables dont contain NULL bytes, we perform another check at runtime to catch NULL bytes in secrets
+				if strings.Contains(env.Data, string([]byte{0x00})) {
+					return fmt.Errorf("in Marble %s: env variable: %s: content contains null bytes", mN, eN)
+				}
+				if err := checkFileSecret(env, envFuncMap, templateSecrets); err != nil {
 					return fmt.Errorf("in Marble %s: env variable %s: %v", mN, eN, err)
 				}
+				if !env.NoTemplates && env.Secret == "" {
+					if err := checkFileTemplates(env.Data, envFuncMap, templateSecrets); err != nil {
+						return fmt.Errorf("in Marble %s: env variable %s: %v", mN, eN, err)
+					}
+				}
 			}
 		}
 	}
@@ -586,6 +2004,77 @@ func templateDryRun(mnf manifest.Manifest, secrets map[string]manifest.Secret) e
 	return nil
 }
 
+// secretsAvailableTo returns the secrets which Marbles of type marbleType receive.
+func secretsAvailableTo(secrets map[string]manifest.Secret, marbleType string) map[string]manifest.Secret {
+	available := make(map[string]manifest.Secret, len(secrets))
+	for name, secret := range secrets {
+		if secret.AvailableTo(marbleType) {
+			available[name] = secret
+		}
+	}
+	return available
+}
+
+// placeholderFuncMap returns a copy of funcMap for executing templates with placeholder secrets.
+// Placeholders are no JSON documents, so jsonField only checks its arguments and returns a placeholder value.
+// hostFile and coordinatorEnv return placeholders as well, so rendered parameters never reveal values of the Coordinator's host.
+func placeholderFuncMap(funcMap template.FuncMap) template.FuncMap {
+	newFuncMap := make(template.FuncMap, len(funcMap))
+	for name, fn := range funcMap {
+		newFuncMap[name] = fn
+	}
+	newFuncMap["jsonField"] = func(data interface{}, path string) (string, error) {
+		if err := manifest.CheckJSONFieldPath(path); err != nil {
+			return "", err
+		}
+		return manifest.EncodeSecretDataToRaw(data)
+	}
+	// host files are read to make sure they are accessible, but their contents are not revealed
+	if hostFile, ok := funcMap["hostFile"].(func(string) (string, error)); ok {
+		newFuncMap["hostFile"] = func(path string) (string, error) {
+			if _, err := hostFile(path); err != nil {
+				return "", err
+			}
+			return "<contents of " + path + ">", nil
+		}
+	}
+	if coordinatorEnv, ok := funcMap["coordinatorEnv"].(func(string) (string, error)); ok {
+		newFuncMap["coordinatorEnv"] = func(name string) (string, error) {
+			if _, err := coordinatorEnv(name); err != nil {
+				return "", err
+			}
+			return "<value of " + name + ">", nil
+		}
+	}
+	return newFuncMap
+}
+
+// placeholderReservedSecrets returns dummy reserved secrets used to execute templates without activating a Marble.
+func placeholderReservedSecrets() reservedSecrets {
+	return reservedSecrets{
+		RootCA: manifest.Secret{
+			Cert: manifest.Certificate{Raw: []byte{0x41}},
+		},
+		MarbleCert: manifest.Secret{
+			Cert:    manifest.Certificate{Raw: []byte{0x41}},
+			Public:  []byte{0x41},
+			Private: []byte{0x41},
+		},
+		UUID: uuid.Nil.String(),
+	}
+}
+
+// checkFileSecret checks that the Secret of a File or Env variable exists and is not combined with Data.
+func checkFileSecret(file manifest.File, tplFunc template.FuncMap, secrets secretsWrapper) error {
+	if file.Secret == "" {
+		return nil
+	}
+	if file.Data != "" {
+		return errors.New("only one of Data and Secret may be set")
+	}
+	return checkFileTemplates(file.SecretTemplate(), tplFunc, secrets)
+}
+
 func checkFileTemplates(data string, tplFunc template.FuncMap, secrets secretsWrapper) error {
 	tpl, err := template.New("data").Funcs(tplFunc).Parse(data)
 	if err != nil {
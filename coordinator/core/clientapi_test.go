@@ -7,20 +7,41 @@
 package core
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/edgelesssys/ego/ecrypto"
 	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
+	"github.com/edgelesssys/marblerun/coordinator/recovery"
+	"github.com/edgelesssys/marblerun/coordinator/seal"
+	"github.com/edgelesssys/marblerun/coordinator/store"
 	"github.com/edgelesssys/marblerun/coordinator/user"
 	"github.com/edgelesssys/marblerun/test"
+	"github.com/edgelesssys/marblerun/util"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func mustSetup() (*Core, *manifest.Manifest) {
@@ -276,6 +297,46 @@ func TestManifestTemplateChecks(t *testing.T) {
 			}
 		}
 	}
+}`)
+	coordinatorEnv := []byte(`{
+	"Packages": {
+		"backend": {
+			"UniqueID": "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			"Debug": false
+		}
+	},
+	"Marbles": {
+		"backend_first": {
+			"Package": "backend",
+			"MaxActivations": 1,
+			"Parameters": {
+				"Env": {
+					"REGION": "{{ coordinatorEnv \"REGION\" }}"
+				}
+			}
+		}
+	},
+	"CoordinatorEnv": ["REGION"]
+}`)
+	coordinatorEnvNotAllowed := []byte(`{
+	"Packages": {
+		"backend": {
+			"UniqueID": "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			"Debug": false
+		}
+	},
+	"Marbles": {
+		"backend_first": {
+			"Package": "backend",
+			"MaxActivations": 1,
+			"Parameters": {
+				"Env": {
+					"SEAL_DIR": "{{ coordinatorEnv \"EDG_COORDINATOR_SEAL_DIR\" }}"
+				}
+			}
+		}
+	},
+	"CoordinatorEnv": ["REGION"]
 }`)
 	assert := assert.New(t)
 
@@ -283,6 +344,14 @@ func TestManifestTemplateChecks(t *testing.T) {
 	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
 	assert.NoError(err)
 
+	c = NewCoreWithMocks()
+	_, err = c.SetManifest(context.TODO(), coordinatorEnv)
+	assert.NoError(err)
+
+	c = NewCoreWithMocks()
+	_, err = c.SetManifest(context.TODO(), coordinatorEnvNotAllowed)
+	assert.Error(err)
+
 	c = NewCoreWithMocks()
 	_, err = c.SetManifest(context.TODO(), missingSecret)
 	assert.Error(err)
@@ -364,6 +433,154 @@ func TestVerifyUser(t *testing.T) {
 	assert.Error(err)
 }
 
+func TestSignCertificate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	adminTestCert, _ := test.MustSetupTestCerts(test.RecoveryPrivateKey)
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "tool"},
+		DNSNames: []string{"tool.example.com"},
+	}, csrKey)
+	require.NoError(err)
+	uuidCSR, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: uuid.New().String()},
+	}, csrKey)
+	require.NoError(err)
+
+	// Users without the SignCertificate permission are not allowed to sign certificates
+	c, _ := mustSetup()
+	_, err = c.SetManifest(context.TODO(), []byte(test.ManifestJSONWithRecoveryKey))
+	require.NoError(err)
+	admin, err := c.VerifyUser(context.TODO(), []*x509.Certificate{adminTestCert})
+	require.NoError(err)
+	_, err = c.SignCertificate(context.TODO(), csr, admin)
+	assert.Error(err)
+
+	// Grant the permission to the admin user
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["signer"] = manifest.Role{ResourceType: "Certificates", ResourceNames: []string{"tool.example.com"}, Actions: []string{"SignCertificate"}}
+	adminUser := mnf.Users["admin"]
+	adminUser.Roles = append(adminUser.Roles, "signer")
+	mnf.Users["admin"] = adminUser
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	c, _ = mustSetup()
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	admin, err = c.VerifyUser(context.TODO(), []*x509.Certificate{adminTestCert})
+	require.NoError(err)
+
+	// Names not granted by the user's roles are rejected
+	otherNameCSR, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "tool"},
+		DNSNames:    []string{"tool.example.com"},
+		IPAddresses: []net.IP{{10, 0, 0, 1}},
+	}, csrKey)
+	require.NoError(err)
+	_, err = c.SignCertificate(context.TODO(), otherNameCSR, admin)
+	assert.Error(err)
+
+	certRaw, err := c.SignCertificate(context.TODO(), csr, admin)
+	require.NoError(err)
+	cert, err := x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.Equal("tool", cert.Subject.CommonName)
+	assert.Equal([]string{"tool.example.com"}, cert.DNSNames)
+	assert.Equal(&csrKey.PublicKey, cert.PublicKey)
+	assert.True(cert.NotAfter.Before(time.Now().Add(signedCertValidity + time.Minute)))
+
+	// The certificate chains to the Coordinator's intermediate CA
+	intermediateCert, err := c.data.getCertificate(skCoordinatorIntermediateCert)
+	require.NoError(err)
+	rootCert, err := c.data.getCertificate(sKCoordinatorRootCert)
+	require.NoError(err)
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediateCert)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	assert.NoError(err)
+
+	// CommonNames reserved for Marbles and invalid CSRs are rejected
+	_, err = c.SignCertificate(context.TODO(), uuidCSR, admin)
+	assert.Error(err)
+	_, err = c.SignCertificate(context.TODO(), []byte("invalid"), admin)
+	assert.Error(err)
+}
+
+func TestGetIssuanceLog(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	adminTestCert, _ := test.MustSetupTestCerts(test.RecoveryPrivateKey)
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "tool"}}, csrKey)
+	require.NoError(err)
+
+	// grant admin the permission to sign certificates, but not to read the issuance log
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["signer"] = manifest.Role{ResourceType: "Certificates", Actions: []string{"SignCertificate"}}
+	mnf.Roles["auditor"] = manifest.Role{ResourceType: "Certificates", Actions: []string{"ReadIssuanceLog"}}
+	adminUser := mnf.Users["admin"]
+	adminUser.Roles = append(adminUser.Roles, "signer")
+	mnf.Users["admin"] = adminUser
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	c, _ := mustSetup()
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	admin, err := c.VerifyUser(context.TODO(), []*x509.Certificate{adminTestCert})
+	require.NoError(err)
+	_, err = c.GetIssuanceLog(context.TODO(), admin)
+	assert.Error(err)
+	admin.Assign(user.NewPermission(user.PermissionReadIssuanceLog, nil))
+
+	// an empty log is signed as well
+	log, err := c.GetIssuanceLog(context.TODO(), admin)
+	require.NoError(err)
+	assert.Empty(log.Entries)
+	assert.Equal(merkleTreeHash(nil), log.TreeHash)
+
+	// certificates signed for users and Marbles are recorded in order of issuance
+	userCert, err := c.SignCertificate(context.TODO(), csr, admin)
+	require.NoError(err)
+	marbleCSR, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, csrKey)
+	require.NoError(err)
+	marbleCert, err := c.generateCertFromCSR(c.data, marbleCSR, csrKey.PublicKey, "frontend", uuid.New().String())
+	require.NoError(err)
+
+	log, err = c.GetIssuanceLog(context.TODO(), admin)
+	require.NoError(err)
+	require.Len(log.Entries, 2)
+	assert.Equal(userCert, log.Entries[0].Certificate)
+	assert.Equal("admin", log.Entries[0].User)
+	assert.Empty(log.Entries[0].MarbleType)
+	assert.Equal(marbleCert, log.Entries[1].Certificate)
+	assert.Equal("frontend", log.Entries[1].MarbleType)
+	assert.Empty(log.Entries[1].User)
+	cert, err := x509.ParseCertificate(marbleCert)
+	require.NoError(err)
+	assert.Equal(cert.SerialNumber.String(), log.Entries[1].Serial)
+	assert.Equal(merkleTreeHash([][]byte{userCert, marbleCert}), log.TreeHash)
+
+	// the tree hash is signed with the Coordinator's root key
+	rootCert, err := c.data.getCertificate(sKCoordinatorRootCert)
+	require.NoError(err)
+	var signature struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(log.Signature, &signature)
+	require.NoError(err)
+	assert.True(ecdsa.Verify(rootCert.PublicKey.(*ecdsa.PublicKey), issuanceLogDigest(2, log.TreeHash), signature.R, signature.S))
+	assert.False(ecdsa.Verify(rootCert.PublicKey.(*ecdsa.PublicKey), issuanceLogDigest(1, log.TreeHash), signature.R, signature.S))
+}
+
 func TestUpdateManifest(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -445,6 +662,729 @@ func TestUpdateManifest(t *testing.T) {
 	assert.Contains(updateLog, `"package":"frontend"`)
 }
 
+func TestUpdateParameters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	c, _ := mustSetup()
+
+	// grant admin the permission to update the parameters of the frontend
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["parameterManager"] = manifest.Role{
+		ResourceType:  "Marbles",
+		ResourceNames: []string{"frontend"},
+		Actions:       []string{"UpdateParameters"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "parameterManager")
+	mnf.Users["admin"] = admin
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+	marbleRootCertBeforeUpdate, err := c.data.getCertificate(sKMarbleRootCert)
+	require.NoError(err)
+
+	err = c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"Parameters": {"Env": {"LOG_LEVEL": "debug"}}}}}`), adminUser)
+	require.NoError(err)
+
+	// future activations receive the new parameters, everything else stays the same
+	marble, err := c.data.getMarble("frontend")
+	require.NoError(err)
+	assert.Equal("frontend", marble.Package)
+	assert.Equal("debug", marble.Parameters.Env["LOG_LEVEL"].Data)
+	params, err := c.RenderMarbleParameters(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.Equal("debug", string(params.Env["LOG_LEVEL"]))
+	marbleRootCertAfterUpdate, err := c.data.getCertificate(sKMarbleRootCert)
+	require.NoError(err)
+	assert.Equal(marbleRootCertBeforeUpdate, marbleRootCertAfterUpdate)
+	updateLog, err := c.GetUpdateLog(context.TODO())
+	require.NoError(err)
+	assert.Contains(updateLog, `"marble":"frontend"`)
+
+	// user is not allowed to update envMarble
+	err = c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"envMarble": {"Parameters": {"Env": {"LOG_LEVEL": "debug"}}}}}`), adminUser)
+	assert.Error(err)
+	// only parameters can be updated
+	err = c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"Package": "frontend"}}}`), adminUser)
+	assert.Error(err)
+	for _, field := range []string{`"EncryptedParameters": {}`, `"OmitReservedEnv": ["MARBLE_PREDEFINED_ROOT_CA"]`, `"Metadata": {"team": "web"}`, `"Unknown": 1`} {
+		err = c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"LogLevel": "debug", `+field+`}}}`), adminUser)
+		assert.Error(err, field)
+	}
+	err = c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {}}, "Packages": {"frontend": {"SecurityVersion": 5}}}`), adminUser)
+	assert.Error(err)
+	// templates need to be valid
+	err = c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"Parameters": {"Env": {"SECRET": "{{ raw .Secrets.unknown }}"}}}}}`), adminUser)
+	assert.Error(err)
+	// at least one updatable value needs to be set
+	err = c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {}}}`), adminUser)
+	assert.Error(err)
+}
+
+func TestUpdateMaxActivations(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	c, _ := mustSetup()
+
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["parameterManager"] = manifest.Role{
+		ResourceType:  "Marbles",
+		ResourceNames: []string{"frontend"},
+		Actions:       []string{"UpdateParameters"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "parameterManager")
+	mnf.Users["admin"] = admin
+	frontend := mnf.Marbles["frontend"]
+	frontend.MaxActivations = 2
+	frontend.Parameters.Env = map[string]manifest.File{"LOG_LEVEL": {Encoding: "string", Data: "info"}}
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+	require.NoError(c.data.incrementActivations("frontend"))
+	require.NoError(c.data.incrementActivations("frontend"))
+
+	// raising the budget keeps the parameters
+	require.NoError(c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"MaxActivations": 5}}}`), adminUser))
+	marble, err := c.data.getMarble("frontend")
+	require.NoError(err)
+	assert.EqualValues(5, marble.MaxActivations)
+	assert.Equal("info", marble.Parameters.Env["LOG_LEVEL"].Data)
+	updateLog, err := c.GetUpdateLog(context.TODO())
+	require.NoError(err)
+	assert.Contains(updateLog, "Marble MaxActivations updated")
+
+	// lowering the budget below the number of activations is accepted
+	require.NoError(c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"MaxActivations": 1}}}`), adminUser))
+	marble, err = c.data.getMarble("frontend")
+	require.NoError(err)
+	assert.EqualValues(1, marble.MaxActivations)
+	activations, err := c.data.getActivations("frontend")
+	require.NoError(err)
+	assert.EqualValues(2, activations)
+
+	// an explicit 0 removes the limit, updating only the parameters keeps the budget
+	require.NoError(c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"maxActivations": 0}}}`), adminUser))
+	require.NoError(c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"Parameters": {"Env": {"LOG_LEVEL": "debug"}}}}}`), adminUser))
+	marble, err = c.data.getMarble("frontend")
+	require.NoError(err)
+	assert.EqualValues(0, marble.MaxActivations)
+	assert.Equal("debug", marble.Parameters.Env["LOG_LEVEL"].Data)
+}
+
+func TestUpdateLogLevel(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	c, _ := mustSetup()
+
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["parameterManager"] = manifest.Role{
+		ResourceType:  "Marbles",
+		ResourceNames: []string{"frontend"},
+		Actions:       []string{"UpdateParameters"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "parameterManager")
+	mnf.Users["admin"] = admin
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+
+	// no log level is passed by default
+	params, err := c.RenderMarbleParameters(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.NotContains(params.Env, manifest.MarbleEnvironmentLogLevel)
+
+	signature, _ := c.GetEffectiveManifestSignature(context.TODO())
+	assert.Nil(signature)
+
+	require.NoError(c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"LogLevel": "debug"}}}`), adminUser))
+
+	// the update is part of the effective manifest, while the manifest itself is unchanged
+	originalSignature, originalManifest := c.GetManifestSignature(context.TODO())
+	assert.Equal(rawManifest, originalManifest)
+	signature, effectiveManifest := c.GetEffectiveManifestSignature(context.TODO())
+	expectedSignature := sha256.Sum256(effectiveManifest)
+	assert.Equal(expectedSignature[:], signature)
+	assert.NotEqual(originalSignature, signature)
+	var effectiveMnf manifest.Manifest
+	require.NoError(json.Unmarshal(effectiveManifest, &effectiveMnf))
+	assert.Equal("debug", effectiveMnf.Marbles["frontend"].LogLevel)
+	assert.Equal(mnf.Marbles["envMarble"], effectiveMnf.Marbles["envMarble"])
+	assert.Equal(mnf.Users, effectiveMnf.Users)
+	marble, err := c.data.getMarble("frontend")
+	require.NoError(err)
+	assert.Equal("debug", marble.LogLevel)
+	assert.Equal(mnf.Marbles["frontend"].Parameters, marble.Parameters)
+	params, err = c.RenderMarbleParameters(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.Equal([]byte("debug"), params.Env[manifest.MarbleEnvironmentLogLevel])
+	updateLog, err := c.GetUpdateLog(context.TODO())
+	require.NoError(err)
+	assert.Contains(updateLog, "Marble LogLevel updated")
+	assert.Contains(updateLog, hex.EncodeToString(signature))
+
+	// invalid values are rejected
+	assert.Error(c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"LogLevel": "debug\nOTHER=1"}}}`), adminUser))
+
+	// an empty value removes the log level
+	require.NoError(c.UpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"LogLevel": ""}}}`), adminUser))
+	params, err = c.RenderMarbleParameters(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.NotContains(params.Env, manifest.MarbleEnvironmentLogLevel)
+}
+
+func TestRenderTTLSConfigUnsetSecret(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, err := NewCore([]string{"localhost"}, quote.NewMockValidator(), quote.NewMockIssuer(), &seal.MockSealer{}, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.LenientTLS = true
+	mnf.TLS = map[string]manifest.TLStag{
+		"web": {Incoming: []manifest.TLSTagEntry{{Port: "8443", Cert: "certUnset", DisableClientAuth: true}}},
+	}
+	frontend := mnf.Marbles["frontend"]
+	frontend.TLS = []string{"web"}
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	// an unset user-defined certificate is reported as skipped instead of being rendered with a placeholder
+	_, skipped, err := c.RenderTTLSConfig(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.Equal([]string{"web.Incoming.*:8443"}, skipped)
+
+	admin, err := c.data.getUser("admin")
+	require.NoError(err)
+	require.NoError(c.WriteSecrets(context.TODO(), []byte(test.UserSecrets), admin))
+	_, skipped, err = c.RenderTTLSConfig(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.Empty(skipped)
+}
+
+func TestRenderMarbleParametersCoordinatorEnv(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	require.NoError(os.Setenv("REGION", "eu-west"))
+	defer os.Unsetenv("REGION")
+
+	c := NewCoreWithMocks()
+	_, err := c.SetManifest(context.TODO(), []byte(`{
+	"Packages": {
+		"backend": {
+			"UniqueID": "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			"Debug": false
+		}
+	},
+	"Marbles": {
+		"backend_first": {
+			"Package": "backend",
+			"Parameters": {
+				"Env": {
+					"REGION": "{{ coordinatorEnv \"REGION\" }}"
+				}
+			}
+		}
+	},
+	"CoordinatorEnv": ["REGION"]
+}`))
+	require.NoError(err)
+
+	// the value of the Coordinator's environment is never revealed by the render endpoint
+	params, err := c.RenderMarbleParameters(context.TODO(), "backend_first")
+	require.NoError(err)
+	assert.Equal("<value of REGION>", string(params.Env["REGION"]))
+	assert.NotContains(string(params.Env["REGION"]), "eu-west")
+}
+
+func TestUpdateBundle(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	c, _ := mustSetup()
+
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Bundles = map[string]manifest.Bundle{
+		"config": {Version: "1", Files: map[string]manifest.File{"/etc/app.conf": {Data: "version 1", Encoding: "string"}}},
+	}
+	frontend := mnf.Marbles["frontend"]
+	frontend.Bundles = []string{"config"}
+	mnf.Marbles["frontend"] = frontend
+	mnf.Roles["parameterManager"] = manifest.Role{
+		ResourceType:  "Marbles",
+		ResourceNames: []string{"envMarble"},
+		Actions:       []string{"UpdateParameters"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "parameterManager")
+	mnf.Users["admin"] = admin
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+
+	params, err := c.RenderMarbleParameters(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.Equal([]byte("version 1"), params.Files["/etc/app.conf"])
+
+	update := []byte(`{"Bundles": {"config": {"Version": "2", "Files": {"/etc/app.conf": "version 2"}}}}`)
+
+	// updating a bundle requires permission to update all Marbles including it
+	assert.Error(c.UpdateManifest(context.TODO(), update, adminUser))
+	mnf.Roles["parameterManager"] = manifest.Role{
+		ResourceType:  "Marbles",
+		ResourceNames: []string{"frontend"},
+		Actions:       []string{"UpdateParameters"},
+	}
+	c, _ = mustSetup()
+	rawManifest, err = json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	adminUser, err = c.data.getUser("admin")
+	require.NoError(err)
+
+	require.NoError(c.UpdateManifest(context.TODO(), update, adminUser))
+	params, err = c.RenderMarbleParameters(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.Equal([]byte("version 2"), params.Files["/etc/app.conf"])
+	currentManifest, err := c.data.getCurrentManifest()
+	require.NoError(err)
+	assert.Equal("2", currentManifest.Bundles["config"].Version)
+	updateLog, err := c.GetUpdateLog(context.TODO())
+	require.NoError(err)
+	assert.Contains(updateLog, "Bundle updated")
+
+	// the version has to change with every update
+	assert.Error(c.UpdateManifest(context.TODO(), update, adminUser))
+}
+
+// keySealer is a MockSealer which only unseals the state with the encryption key it was sealed with.
+type keySealer struct {
+	seal.MockSealer
+	key       []byte
+	sealedKey []byte
+}
+
+func (s *keySealer) SetEncryptionKey(key []byte) error {
+	s.key = key
+	return nil
+}
+
+func (s *keySealer) GetEncryptionKey() ([]byte, error) {
+	return s.key, nil
+}
+
+func (s *keySealer) Seal(unencryptedData []byte, toBeEncrypted []byte) error {
+	s.sealedKey = s.key
+	return s.MockSealer.Seal(unencryptedData, toBeEncrypted)
+}
+
+func (s *keySealer) Unseal() ([]byte, []byte, error) {
+	if !bytes.Equal(s.key, s.sealedKey) {
+		return nil, nil, seal.ErrEncryptionKey
+	}
+	return s.MockSealer.Unseal()
+}
+
+func TestRotateRecoveryKey(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// grant admin the permission to rotate recovery keys
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["recoveryManager"] = manifest.Role{
+		ResourceType: "Coordinator",
+		Actions:      []string{"RotateRecoveryKey"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "recoveryManager")
+	mnf.Users["admin"] = admin
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	sealer := &keySealer{}
+	c, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	recoverySecrets, err := c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	oldSecret, err := util.DecryptOAEP(test.RecoveryPrivateKey, recoverySecrets["testRecKey1"])
+	require.NoError(err)
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+
+	newPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	pkixPublicKey, err := x509.MarshalPKIXPublicKey(&newPrivKey.PublicKey)
+	require.NoError(err)
+	newRecoveryKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkixPublicKey}))
+	sign := func(privKey *rsa.PrivateKey, message string) []byte {
+		hash := sha256.Sum256([]byte(message))
+		signature, err := rsa.SignPSS(rand.Reader, privKey, crypto.SHA256, hash[:], nil)
+		require.NoError(err)
+		return signature
+	}
+
+	// the rotation requires a proof of possession of the current private key
+	_, err = c.RotateRecoveryKey(context.TODO(), "testRecKey1", newRecoveryKey, sign(newPrivKey, newRecoveryKey), adminUser)
+	assert.Error(err)
+	_, err = c.RotateRecoveryKey(context.TODO(), "unknownKey", newRecoveryKey, sign(test.RecoveryPrivateKey, newRecoveryKey), adminUser)
+	assert.Error(err)
+	_, err = c.RotateRecoveryKey(context.TODO(), "testRecKey1", "invalid", sign(test.RecoveryPrivateKey, "invalid"), adminUser)
+	assert.Error(err)
+
+	recoverySecrets, err = c.RotateRecoveryKey(context.TODO(), "testRecKey1", newRecoveryKey, sign(test.RecoveryPrivateKey, newRecoveryKey), adminUser)
+	require.NoError(err)
+	newSecret, err := util.DecryptOAEP(newPrivKey, recoverySecrets["testRecKey1"])
+	require.NoError(err)
+	assert.NotEqual(oldSecret, newSecret)
+
+	// the current manifest lists the new key, the manifest signature is unchanged
+	currentManifest, err := c.data.getCurrentManifest()
+	require.NoError(err)
+	assert.Equal(newRecoveryKey, currentManifest.RecoveryKeys["testRecKey1"])
+	signature, _ := c.GetManifestSignature(context.TODO())
+	expectedSignature := sha256.Sum256(rawManifest)
+	assert.Equal(expectedSignature[:], signature)
+	updateLog, err := c.GetUpdateLog(context.TODO())
+	require.NoError(err)
+	assert.Contains(updateLog, "recovery key rotated")
+
+	// the recovery key can only be rotated by the current owner
+	_, err = c.RotateRecoveryKey(context.TODO(), "testRecKey1", newRecoveryKey, sign(test.RecoveryPrivateKey, newRecoveryKey), adminUser)
+	assert.Error(err)
+
+	// after losing the sealed encryption key, only the new recovery secret recovers the state
+	sealer.key = nil
+	c2, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	c2State, err := c2.data.getState()
+	require.NoError(err)
+	require.Equal(stateRecovery, c2State)
+	_, err = c2.Recover(context.TODO(), oldSecret)
+	assert.Error(err)
+	_, err = c2.Recover(context.TODO(), newSecret)
+	require.NoError(err)
+	recoveredManifest, err := c2.data.getCurrentManifest()
+	require.NoError(err)
+	assert.Equal(newRecoveryKey, recoveredManifest.RecoveryKeys["testRecKey1"])
+}
+
+// commitFailStore is a StdStore whose transactions fail to commit.
+type commitFailStore struct {
+	*store.StdStore
+}
+
+func (s *commitFailStore) BeginTransaction(ctx context.Context) (store.Transaction, error) {
+	tx, err := s.StdStore.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &commitFailTransaction{Transaction: tx}, nil
+}
+
+// commitFailTransaction fails to commit.
+type commitFailTransaction struct {
+	store.Transaction
+}
+
+func (t *commitFailTransaction) Commit() error {
+	return errors.New("sealing failed")
+}
+
+func TestRotateRecoveryKeyCommitFails(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// grant admin the permission to rotate recovery keys
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["recoveryManager"] = manifest.Role{
+		ResourceType: "Coordinator",
+		Actions:      []string{"RotateRecoveryKey"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "recoveryManager")
+	mnf.Users["admin"] = admin
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	sealer := &keySealer{}
+	c, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	recoverySecrets, err := c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	oldSecret, err := util.DecryptOAEP(test.RecoveryPrivateKey, recoverySecrets["testRecKey1"])
+	require.NoError(err)
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+	oldKey := sealer.key
+
+	newPrivKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	pkixPublicKey, err := x509.MarshalPKIXPublicKey(&newPrivKey.PublicKey)
+	require.NoError(err)
+	newRecoveryKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkixPublicKey}))
+	hash := sha256.Sum256([]byte(newRecoveryKey))
+	proof, err := rsa.SignPSS(rand.Reader, test.RecoveryPrivateKey, crypto.SHA256, hash[:], nil)
+	require.NoError(err)
+
+	stdStore := c.store.(*store.StdStore)
+	c.store = &commitFailStore{StdStore: stdStore}
+	c.data = storeWrapper{store: c.store}
+	_, err = c.RotateRecoveryKey(context.TODO(), "testRecKey1", newRecoveryKey, proof, adminUser)
+	require.Error(err)
+
+	// the previous encryption key is restored, so the state is still sealed with it
+	assert.Equal(oldKey, sealer.key)
+	c.store = stdStore
+	c.data = storeWrapper{store: stdStore}
+	currentManifest, err := c.data.getCurrentManifest()
+	require.NoError(err)
+	assert.Equal(mnf.RecoveryKeys["testRecKey1"], currentManifest.RecoveryKeys["testRecKey1"])
+
+	// the next commit seals with the restored key, so the old recovery secret still recovers the state
+	require.NoError(c.data.putRecoveryKeys(currentManifest.RecoveryKeys))
+	sealer.key = nil
+	c2, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	_, err = c2.Recover(context.TODO(), oldSecret)
+	require.NoError(err)
+}
+
+func TestSetActivations(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// grant admin the permission to set the activations of frontend
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["fleetManager"] = manifest.Role{
+		ResourceType:  "Marbles",
+		ResourceNames: []string{"frontend"},
+		Actions:       []string{"SetActivations"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "fleetManager")
+	mnf.Users["admin"] = admin
+	frontend := mnf.Marbles["frontend"]
+	frontend.MaxActivations = 3
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	c, err := NewCore([]string{"localhost"}, validator, issuer, &seal.MockSealer{}, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	spawner := marbleSpawner{
+		assert:     assert,
+		require:    require,
+		issuer:     issuer,
+		validator:  validator,
+		manifest:   mnf,
+		coreServer: c,
+	}
+
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+	otherUser := user.NewUser("other", nil)
+
+	// only users with the SetActivations permission for the Marble can set its activations
+	assert.Error(c.SetActivations(context.TODO(), "frontend", 2, otherUser))
+	assert.Error(c.SetActivations(context.TODO(), "backendFirst", 2, adminUser))
+
+	// the count can not exceed MaxActivations, and the Marble must exist
+	assert.Error(c.SetActivations(context.TODO(), "frontend", 4, adminUser))
+	assert.Error(c.SetActivations(context.TODO(), "unknown", 1, adminUser))
+	activations, _ := c.data.getActivations("frontend")
+	assert.EqualValues(0, activations)
+
+	require.NoError(c.SetActivations(context.TODO(), "frontend", 2, adminUser))
+	activations, err = c.data.getActivations("frontend")
+	require.NoError(err)
+	assert.EqualValues(2, activations)
+	updateLog, err := c.GetUpdateLog(context.TODO())
+	require.NoError(err)
+	assert.Contains(updateLog, "Marble activations set")
+
+	// the pre-seeded activations count towards the budget
+	spawner.newMarble("frontend", "Azure", true)
+	spawner.newMarble("frontend", "Azure", false)
+
+	// the counts are reported with the budget of each Marble type
+	fleet, err := c.GetActivations(context.TODO())
+	require.NoError(err)
+	assert.Len(fleet, len(mnf.Marbles))
+	assert.Equal(MarbleActivations{MaxActivations: 3, Activations: 3}, fleet["frontend"])
+	assert.Equal(MarbleActivations{MaxActivations: mnf.Marbles["backendFirst"].MaxActivations}, fleet["backendFirst"])
+}
+
+func TestRevokeMarbleCertificates(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// grant admin the permission to revoke the certificates of frontend and envMarble
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["incidentResponder"] = manifest.Role{
+		ResourceType:  "Marbles",
+		ResourceNames: []string{"frontend", "envMarble"},
+		Actions:       []string{"RevokeCertificates"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "incidentResponder")
+	mnf.Users["admin"] = admin
+	frontend := mnf.Marbles["frontend"]
+	frontend.MaxActivations = 5
+	mnf.Marbles["frontend"] = frontend
+	envMarble := mnf.Marbles["envMarble"]
+	envMarble.MaxActivations = 0
+	mnf.Marbles["envMarble"] = envMarble
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	c, err := NewCore([]string{"localhost"}, validator, issuer, &seal.MockSealer{}, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	spawner := marbleSpawner{
+		assert:     assert,
+		require:    require,
+		issuer:     issuer,
+		validator:  validator,
+		manifest:   mnf,
+		coreServer: c,
+	}
+	spawner.newMarble("frontend", "Azure", true)
+	spawner.newMarble("frontend", "Azure", true)
+
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+	otherUser := user.NewUser("other", nil)
+
+	// only users with the RevokeCertificates permission for the Marble can revoke its certificates
+	_, err = c.RevokeMarbleCertificates(context.TODO(), "frontend", false, otherUser)
+	assert.Error(err)
+	_, err = c.RevokeMarbleCertificates(context.TODO(), "unknown", false, adminUser)
+	assert.Error(err)
+	// an unlimited activation budget can not be exhausted
+	_, err = c.RevokeMarbleCertificates(context.TODO(), "envMarble", true, adminUser)
+	assert.Error(err)
+
+	crl, err := c.GetCRL(context.TODO())
+	require.NoError(err)
+	revocationList, err := x509.ParseRevocationList(crl)
+	require.NoError(err)
+	assert.Empty(revocationList.RevokedCertificateEntries)
+
+	revoked, err := c.RevokeMarbleCertificates(context.TODO(), "frontend", true, adminUser)
+	require.NoError(err)
+	assert.Equal(2, revoked)
+	updateLog, err := c.GetUpdateLog(context.TODO())
+	require.NoError(err)
+	assert.Contains(updateLog, "Marble certificates revoked")
+
+	// the revoked certificates are listed in the CRL signed by the intermediate CA
+	crl, err = c.GetCRL(context.TODO())
+	require.NoError(err)
+	revocationList, err = x509.ParseRevocationList(crl)
+	require.NoError(err)
+	marbleRootCert, err := c.data.getCertificate(sKMarbleRootCert)
+	require.NoError(err)
+	assert.NoError(revocationList.CheckSignatureFrom(marbleRootCert))
+	var revokedSerials []string
+	for _, entry := range revocationList.RevokedCertificateEntries {
+		revokedSerials = append(revokedSerials, entry.SerialNumber.String())
+	}
+	size, err := c.data.getIssuanceLogSize()
+	require.NoError(err)
+	for i := uint64(0); i < size; i++ {
+		entry, err := c.data.getIssuedCertificate(i)
+		require.NoError(err)
+		assert.Contains(revokedSerials, entry.Serial)
+	}
+	assert.Len(revokedSerials, 2)
+
+	// certificates are only revoked once
+	revoked, err = c.RevokeMarbleCertificates(context.TODO(), "frontend", false, adminUser)
+	require.NoError(err)
+	assert.Zero(revoked)
+
+	// no replacements can be activated until the budget is re-seeded
+	spawner.newMarble("frontend", "Azure", false)
+	activations, err := c.data.getActivations("frontend")
+	require.NoError(err)
+	assert.EqualValues(5, activations)
+
+	// an intermediate certificate created without CRLSign can neither revoke nor sign revocation lists
+	intermediatePrivK, err := c.data.getPrivK(sKCoordinatorIntermediateKey)
+	require.NoError(err)
+	marbleRootCert.KeyUsage &^= x509.KeyUsageCRLSign
+	legacyCertRaw, err := x509.CreateCertificate(rand.Reader, marbleRootCert, marbleRootCert, marbleRootCert.PublicKey, intermediatePrivK)
+	require.NoError(err)
+	legacyCert, err := x509.ParseCertificate(legacyCertRaw)
+	require.NoError(err)
+	require.NoError(c.data.putCertificate(sKMarbleRootCert, legacyCert))
+	_, err = c.RevokeMarbleCertificates(context.TODO(), "frontend", false, adminUser)
+	assert.Equal(errIntermediateCannotSignCRL, err)
+	_, err = c.GetCRL(context.TODO())
+	assert.Equal(errIntermediateCannotSignCRL, err)
+}
+
+func TestGetActivationsResources(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	frontend := mnf.Marbles["frontend"]
+	frontend.Resources = &manifest.Resources{Memory: "2G", CPU: "500m"}
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	// the resource hints are reported with the activations of each Marble type
+	fleet, err := c.GetActivations(context.TODO())
+	require.NoError(err)
+	assert.Equal(&manifest.Resources{Memory: "2G", CPU: "500m"}, fleet["frontend"].Resources)
+	assert.Nil(fleet["backendFirst"].Resources)
+}
+
 func TestUpdateManifestInvalid(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -575,6 +1515,247 @@ func TestGetSecret(t *testing.T) {
 	assert.Empty(sec["symmetricKeyUnset"].Private)
 }
 
+func TestExportSecrets(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	c, _ := mustSetup()
+
+	// grant admin the permission to export secrets
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Secrets["hmacPrivate"] = manifest.Secret{Type: "hmac", Size: 256}
+	mnf.Roles["backupManager"] = manifest.Role{
+		ResourceType:  "Secrets",
+		ResourceNames: []string{"symmetricKeyPrivate", "symmetricKeyShared", "symmetricKeyUnset", "hmacPrivate"},
+		Actions:       []string{"ExportSecret"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "backupManager")
+	mnf.Users["admin"] = admin
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+	marbleUUID := uuid.New()
+
+	backup, err := c.ExportSecrets(context.TODO(), marbleUUID.String(), []string{"symmetricKeyPrivate", "symmetricKeyShared", "hmacPrivate"}, adminUser)
+	require.NoError(err)
+
+	// decrypt the backup using the recovery key
+	require.Contains(backup.EncryptionKeys, "testRecKey1")
+	encryptionKey, err := util.DecryptOAEP(test.RecoveryPrivateKey, backup.EncryptionKeys["testRecKey1"])
+	require.NoError(err)
+	rawSecrets, err := ecrypto.Decrypt(backup.Secrets, encryptionKey, nil)
+	require.NoError(err)
+	var exported map[string]manifest.Secret
+	require.NoError(json.Unmarshal(rawSecrets, &exported))
+
+	// shared secrets are retrieved, per-Marble secrets are re-derived for the UUID
+	sharedSecret, err := c.data.getSecret("symmetricKeyShared")
+	require.NoError(err)
+	assert.Equal(sharedSecret.Private, exported["symmetricKeyShared"].Private)
+	derivedSecrets, err := c.generateSecrets(c.data, map[string]manifest.Secret{
+		"symmetricKeyPrivate": mnf.Secrets["symmetricKeyPrivate"],
+		"hmacPrivate":         mnf.Secrets["hmacPrivate"],
+	}, marbleUUID, nil, nil)
+	require.NoError(err)
+	assert.Equal(derivedSecrets["symmetricKeyPrivate"].Private, exported["symmetricKeyPrivate"].Private)
+	assert.Len(exported["symmetricKeyPrivate"].Private, 32)
+	assert.Equal(derivedSecrets["hmacPrivate"].Private, exported["hmacPrivate"].Private)
+	assert.Len(exported["hmacPrivate"].Private, 32)
+
+	// unset user-defined secrets can not be exported
+	_, err = c.ExportSecrets(context.TODO(), marbleUUID.String(), []string{"symmetricKeyUnset"}, adminUser)
+	assert.Error(err)
+	// exporting requires permission for all secrets
+	_, err = c.ExportSecrets(context.TODO(), marbleUUID.String(), []string{"symmetricKeyPrivate", "certPrivate"}, adminUser)
+	assert.Error(err)
+	// a valid UUID is required
+	_, err = c.ExportSecrets(context.TODO(), "invalid", []string{"symmetricKeyPrivate"}, adminUser)
+	assert.Error(err)
+	_, err = c.ExportSecrets(context.TODO(), uuid.Nil.String(), []string{"symmetricKeyPrivate"}, adminUser)
+	assert.Error(err)
+
+	// randomly generated per-Marble secrets can not be granted for export
+	mnf.Roles["backupManager"] = manifest.Role{
+		ResourceType:  "Secrets",
+		ResourceNames: []string{"certPrivate"},
+		Actions:       []string{"ExportSecret"},
+	}
+	assert.Error(mnf.Check(context.TODO(), c.zaplogger))
+
+	// per-Marble secrets bound to the platform of a Marble are only known to the Marble
+	mnf.Roles["backupManager"] = manifest.Role{
+		ResourceType:  "Secrets",
+		ResourceNames: []string{"symmetricKeyPrivate"},
+		Actions:       []string{"ExportSecret"},
+	}
+	frontend := mnf.Marbles["frontend"]
+	frontend.PlatformBoundSecrets = true
+	mnf.Marbles["frontend"] = frontend
+	c, _ = mustSetup()
+	rawManifest, err = json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	adminUser, err = c.data.getUser("admin")
+	require.NoError(err)
+	_, err = c.ExportSecrets(context.TODO(), marbleUUID.String(), []string{"symmetricKeyPrivate"}, adminUser)
+	require.Error(err)
+	assert.Contains(err.Error(), "bound to the platform")
+}
+
+func TestRotateDerivationRoot(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.TODO()
+
+	// grant admin the permission to rotate the derivation root
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["rotator"] = manifest.Role{
+		ResourceType: "Coordinator",
+		Actions:      []string{"RotateDerivationRoot"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "rotator")
+	mnf.Users["admin"] = admin
+	mnf.Secrets["deterministicKey"] = manifest.Secret{Type: "symmetric-key", Size: 128, Shared: true, Deterministic: true}
+	// templates can reference the keys derived from the previous root
+	frontend := mnf.Marbles["frontend"]
+	frontend.Parameters.Env = map[string]manifest.File{
+		"PREVIOUS_KEY": {Encoding: "string", Data: "{{ hex .MarbleRun.PreviousSecrets.symmetricKeyPrivate }}"},
+	}
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	c, err := NewCore([]string{"localhost"}, quote.NewMockValidator(), quote.NewMockIssuer(), &seal.MockSealer{}, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	_, err = c.SetManifest(ctx, rawManifest)
+	require.NoError(err)
+
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+	otherUser := user.NewUser("other", nil)
+
+	marbleUUID := uuid.New()
+	perMarbleSecrets := map[string]manifest.Secret{"symmetricKeyPrivate": mnf.Secrets["symmetricKeyPrivate"]}
+	oldDerived, err := c.generateSecrets(c.data.withContext(ctx), perMarbleSecrets, marbleUUID, nil, nil)
+	require.NoError(err)
+	oldSecrets, err := c.data.getSecretMap()
+	require.NoError(err)
+
+	// only users with the RotateDerivationRoot permission can rotate the root
+	assert.Error(c.RotateDerivationRoot(ctx, time.Hour, otherUser))
+	assert.Error(c.RotateDerivationRoot(ctx, -time.Hour, adminUser))
+	require.NoError(c.RotateDerivationRoot(ctx, time.Hour, adminUser))
+
+	// derived secrets change, random shared secrets are kept
+	newDerived, err := c.generateSecrets(c.data.withContext(ctx), perMarbleSecrets, marbleUUID, nil, nil)
+	require.NoError(err)
+	assert.NotEqual(oldDerived["symmetricKeyPrivate"].Private, newDerived["symmetricKeyPrivate"].Private)
+	newSecrets, err := c.data.getSecretMap()
+	require.NoError(err)
+	assert.NotEqual(oldSecrets["deterministicKey"].Private, newSecrets["deterministicKey"].Private)
+	assert.Equal(oldSecrets["symmetricKeyShared"], newSecrets["symmetricKeyShared"])
+
+	// during the grace period, the previous keys can be re-derived
+	root, err := c.data.getDerivationRoot()
+	require.NoError(err)
+	newSecrets["symmetricKeyPrivate"] = newDerived["symmetricKeyPrivate"]
+	previousSecrets, err := previousDerivedSecrets(root, newSecrets, marbleUUID)
+	require.NoError(err)
+	assert.Equal(oldDerived["symmetricKeyPrivate"].Private, previousSecrets["symmetricKeyPrivate"].Private)
+	assert.Equal(oldSecrets["deterministicKey"].Private, previousSecrets["deterministicKey"].Private)
+	assert.Equal(newSecrets["symmetricKeyShared"], previousSecrets["symmetricKeyShared"])
+
+	// the previous root must not be discarded before its grace period has ended
+	assert.Error(c.RotateDerivationRoot(ctx, time.Hour, adminUser))
+
+	// after the grace period, the current secrets are provided instead
+	root.PreviousValidUntil = time.Now().Add(-time.Minute)
+	require.NoError(c.data.putDerivationRoot(root))
+	previousSecrets, err = previousDerivedSecrets(root, newSecrets, marbleUUID)
+	require.NoError(err)
+	assert.Equal(newSecrets, previousSecrets)
+	assert.NoError(c.RotateDerivationRoot(ctx, 0, adminUser))
+
+	updateLog, err := c.data.getUpdateLog()
+	require.NoError(err)
+	assert.Contains(updateLog, "derivation root rotated")
+}
+
+func TestSetPaused(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// grant admin the permission to pause activations
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["maintainer"] = manifest.Role{
+		ResourceType: "Coordinator",
+		Actions:      []string{"PauseActivations"},
+	}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "maintainer")
+	mnf.Users["admin"] = admin
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	c, err := NewCore([]string{"localhost"}, validator, issuer, &seal.MockSealer{}, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	spawner := marbleSpawner{
+		assert:     assert,
+		require:    require,
+		issuer:     issuer,
+		validator:  validator,
+		manifest:   mnf,
+		coreServer: c,
+	}
+
+	adminUser, err := c.data.getUser("admin")
+	require.NoError(err)
+	otherUser := user.NewUser("other", nil)
+
+	spawner.newMarble("frontend", "Azure", true)
+
+	// only users with the PauseActivations permission can pause the Coordinator
+	assert.Error(c.SetPaused(context.TODO(), true, otherUser))
+	spawner.newMarble("frontend", "Azure", true)
+
+	require.NoError(c.SetPaused(context.TODO(), true, adminUser))
+	spawner.newMarble("frontend", "Azure", false)
+	_, status, err := c.GetStatus(context.TODO())
+	require.NoError(err)
+	assert.Contains(status, "paused")
+	debugState, err := c.GetDebugState(context.TODO())
+	require.NoError(err)
+	assert.True(debugState.Paused)
+
+	// the Client API keeps working while paused
+	_, err = c.GetSecrets(context.TODO(), []string{"symmetricKeyShared"}, adminUser)
+	assert.NoError(err)
+
+	require.NoError(c.SetPaused(context.TODO(), false, adminUser))
+	spawner.newMarble("frontend", "Azure", true)
+
+	// Coordinator roles can not name resources
+	mnf.Roles["maintainer"] = manifest.Role{
+		ResourceType:  "Coordinator",
+		ResourceNames: []string{"frontend"},
+		Actions:       []string{"PauseActivations"},
+	}
+	assert.Error(mnf.Check(context.TODO(), zap.NewNop()))
+}
+
 func TestWriteSecret(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -649,7 +1830,7 @@ func TestWriteSecret(t *testing.T) {
 	}
 	pC, _ := c.data.getCertificate(sKMarbleRootCert)
 	pK, _ := c.data.getPrivK(sKCoordinatorIntermediateKey)
-	priv, err = c.generateSecrets(context.TODO(), priv, uuid.New(), pC, pK)
+	priv, err = c.generateSecrets(c.data, priv, uuid.New(), pC, pK)
 	assert.NoError(err)
 	assert.Equal("MarbleRun Unit Test Private", priv["certPrivate"].Cert.Subject.CommonName)
 }
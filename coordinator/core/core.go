@@ -15,9 +15,11 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -34,6 +36,7 @@ import (
 	"github.com/edgelesssys/marblerun/coordinator/store"
 	"github.com/edgelesssys/marblerun/coordinator/updatelog"
 	"github.com/edgelesssys/marblerun/coordinator/user"
+	"github.com/edgelesssys/marblerun/coordinator/webhook"
 	"github.com/edgelesssys/marblerun/util"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -55,9 +58,62 @@ type Core struct {
 	updateLogger *updatelog.Logger
 	zaplogger    *zap.Logger
 	metrics      *coreMetrics
+	// activationWebhook is notified about the outcome of every activation, if set
+	activationWebhook ActivationNotifier
+	// paused rejects activations during maintenance. It is only held in memory and reset on restart.
+	paused bool
+	// draining rejects all requests checking the state once Shutdown was called.
+	// It is guarded by drainMux, so it can be set while a request holds mux.
+	draining bool
+	drainMux sync.Mutex
+	// maxCSRSize and maxQuoteSize limit the size of activation requests
+	maxCSRSize   int
+	maxQuoteSize int
+	// maxCSRSANs limits the number of subject alternative names of certificates issued to Marbles
+	maxCSRSANs int
+	// maxParametersSize limits the total size of the rendered Files and Env of activation responses
+	maxParametersSize int
+	// certClockSkew backdates the NotBefore of issued certificates
+	certClockSkew time.Duration
+	// activationGroups holds the incomplete activation groups by name. It is guarded by mux.
+	activationGroups map[string]*activationGroup
+	// groupActivationTimeout is the time the members of an activation group wait for the group to complete
+	groupActivationTimeout time.Duration
+	// allowMarbleSimulation honors AllowSimulation of Marbles although the Coordinator does not run in simulation mode
+	allowMarbleSimulation bool
 	rpc.UnimplementedMarbleServer
 }
 
+// Default size limits for activation requests.
+const (
+	DefaultMaxCSRSize   = 64 * 1024
+	DefaultMaxQuoteSize = 1024 * 1024
+)
+
+// DefaultMaxCSRSANs is the default maximum number of subject alternative names in a Marble's CSR.
+const DefaultMaxCSRSANs = 100
+
+// DefaultMaxParametersSize is the default maximum total size of a Marble's rendered Files and Env.
+// It matches the default maximum message size of gRPC clients.
+const DefaultMaxParametersSize = 4 * 1024 * 1024
+
+// DefaultCertClockSkew is the default duration by which the NotBefore of issued certificates is backdated.
+const DefaultCertClockSkew = 5 * time.Minute
+
+// DefaultGroupActivationTimeout is the default duration the members of an activation group wait for the remaining members.
+const DefaultGroupActivationTimeout = time.Minute
+
+// DefaultShutdownTimeout is the default duration the Coordinator waits for in-flight requests when it shuts down.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// errDraining is returned by requireState once the Coordinator shuts down.
+var errDraining = errors.New("the Coordinator is shutting down")
+
+// ActivationNotifier receives events about activations. Notify must not block.
+type ActivationNotifier interface {
+	Notify(event webhook.ActivationEvent)
+}
+
 // The sequence of states a Coordinator may be in.
 type state int
 
@@ -75,6 +131,19 @@ const coordinatorName string = "MarbleRun Coordinator"
 // coordinatorIntermediateName is the name of the Coordinator. It is used as CN of the intermediate certificate which is set when setting or updating a certificate.
 const coordinatorIntermediateName string = "MarbleRun Coordinator - Intermediate CA"
 
+// marbleOrganization is used as Organization of Marble certificates if the intermediate certificate does not specify one.
+const marbleOrganization string = "MarbleRun"
+
+// signedCertValidity is the validity duration of certificates signed for users via the Client API.
+const signedCertValidity = 24 * time.Hour
+
+// marbleCertValidity is the validity duration of certificates issued to Marbles on activation.
+// It bounds how long a revoked Marble certificate is accepted by peers that do not check the certificate revocation list.
+const marbleCertValidity = 30 * 24 * time.Hour
+
+// crlValidity is the duration after which relying parties should fetch a new certificate revocation list.
+const crlValidity = 24 * time.Hour
+
 // storage keys for the used in the Coordinator.
 const (
 	sKCoordinatorRootCert         string = "coordinatorRootCert"
@@ -84,9 +153,31 @@ const (
 	sKCoordinatorIntermediateKey  string = "coordinatorIntermediateKey"
 )
 
+// derivationRoot holds the roots of the symmetric keys the Coordinator derives for Marbles.
+// It is independent of the Coordinator's root certificate, so both can be rotated separately.
+type derivationRoot struct {
+	// Current is used to derive keys.
+	Current []byte
+	// Previous is the root used before the last rotation.
+	// Until PreviousValidUntil, Marbles receive the keys derived from it as well, so they can re-seal their data.
+	Previous           []byte `json:",omitempty"`
+	PreviousValidUntil time.Time
+}
+
+// previousValid returns true if the keys derived from the previous root are still provided to Marbles.
+func (r derivationRoot) previousValid(now time.Time) bool {
+	return len(r.Previous) > 0 && now.Before(r.PreviousValidUntil)
+}
+
 // Needs to be paired with `defer c.mux.Unlock()`.
 func (c *Core) requireState(states ...state) error {
 	c.mux.Lock()
+	c.drainMux.Lock()
+	draining := c.draining
+	c.drainMux.Unlock()
+	if draining {
+		return errDraining
+	}
 	curState, err := c.data.getState()
 	if err != nil {
 		return err
@@ -99,8 +190,33 @@ func (c *Core) requireState(states ...state) error {
 	return errors.New("server is not in expected state")
 }
 
+// Shutdown stops accepting requests which check the Coordinator's state, e.g., activations and manifest updates.
+// It waits until the request in progress has finished, so its changes to the store, like the activation counter, are complete.
+// An error is returned if ctx is done before.
+func (c *Core) Shutdown(ctx context.Context) error {
+	c.drainMux.Lock()
+	c.draining = true
+	c.drainMux.Unlock()
+	c.zaplogger.Info("Draining in-flight requests")
+
+	// requests hold mux until they are done, new requests are rejected once they acquire it
+	drained := make(chan struct{})
+	go func() {
+		c.mux.Lock()
+		c.mux.Unlock()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		c.zaplogger.Info("All in-flight requests finished")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (c *Core) advanceState(newState state, tx store.Transaction) error {
-	txdata := storeWrapper{tx}
+	txdata := storeWrapper{store: tx}
 	curState, err := txdata.getState()
 	if err != nil {
 		return err
@@ -111,17 +227,50 @@ func (c *Core) advanceState(newState state, tx store.Transaction) error {
 	return txdata.putState(newState)
 }
 
-// NewCore creates and initializes a new Core object.
+// sealedStore is implemented by stores whose state is protected with the encryption key of the sealer,
+// so it can be recovered with the recovery data.
+type sealedStore interface {
+	LoadState() ([]byte, error)
+	SetRecoveryData(recoveryData []byte)
+}
+
+// setEncryptionKey sets the encryption key the state is sealed with, which is recovered with the recovery data.
+func (c *Core) setEncryptionKey(encryptionKey []byte) error {
+	if err := c.sealer.SetEncryptionKey(encryptionKey); err != nil {
+		return err
+	}
+	if pgStore, ok := c.store.(*store.PostgresStore); ok {
+		return pgStore.SetEncryptionKey(encryptionKey)
+	}
+	return nil
+}
+
+// NewCore creates and initializes a new Core object that keeps its state in a sealed StdStore.
 func NewCore(dnsNames []string, qv quote.Validator, qi quote.Issuer, sealer seal.Sealer, recovery recovery.Recovery, zapLogger *zap.Logger, promFactory *promauto.Factory) (*Core, error) {
-	stor := store.NewStdStore(sealer)
+	return NewCoreWithStore(dnsNames, qv, qi, sealer, store.NewStdStore(sealer), recovery, zapLogger, promFactory)
+}
+
+// NewCoreWithStore creates and initializes a new Core object that keeps its state in the given store.
+// Stores protected with the sealer, i.e., StdStore and PostgresStore, are loaded and can be recovered.
+// Stores other than StdStore may be shared by multiple Coordinators, so an existing root certificate is reused instead of generating a new one.
+func NewCoreWithStore(dnsNames []string, qv quote.Validator, qi quote.Issuer, sealer seal.Sealer, stor store.Store, recovery recovery.Recovery, zapLogger *zap.Logger, promFactory *promauto.Factory) (*Core, error) {
+	_, isStdStore := stor.(*store.StdStore)
+	sealed, isSealedStore := stor.(sealedStore)
 	c := &Core{
-		qv:        qv,
-		qi:        qi,
-		recovery:  recovery,
-		store:     stor,
-		data:      storeWrapper{store: stor},
-		sealer:    sealer,
-		zaplogger: zapLogger,
+		qv:                     qv,
+		qi:                     qi,
+		recovery:               recovery,
+		store:                  stor,
+		data:                   storeWrapper{store: stor},
+		sealer:                 sealer,
+		zaplogger:              zapLogger,
+		maxCSRSize:             DefaultMaxCSRSize,
+		maxQuoteSize:           DefaultMaxQuoteSize,
+		maxCSRSANs:             DefaultMaxCSRSANs,
+		maxParametersSize:      DefaultMaxParametersSize,
+		certClockSkew:          DefaultCertClockSkew,
+		activationGroups:       map[string]*activationGroup{},
+		groupActivationTimeout: DefaultGroupActivationTimeout,
 	}
 	c.metrics = newCoreMetrics(promFactory, c, "coordinator")
 
@@ -131,18 +280,22 @@ func NewCore(dnsNames []string, qv quote.Validator, qi quote.Issuer, sealer seal
 		return nil, err
 	}
 
-	zapLogger.Info("loading state")
-	recoveryData, loadErr := stor.LoadState()
-	if err := c.recovery.SetRecoveryData(recoveryData); err != nil {
-		c.zaplogger.Error("Could not retrieve recovery data from state. Recovery will be unavailable", zap.Error(err))
+	var recoveryData []byte
+	var loadErr error
+	if isSealedStore {
+		zapLogger.Info("loading state")
+		recoveryData, loadErr = sealed.LoadState()
+		if err := c.recovery.SetRecoveryData(recoveryData); err != nil {
+			c.zaplogger.Error("Could not retrieve recovery data from state. Recovery will be unavailable", zap.Error(err))
+		}
 	}
 
-	tx, err := c.store.BeginTransaction()
+	tx, err := c.store.BeginTransaction(context.Background())
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
-	txdata := storeWrapper{tx}
+	txdata := storeWrapper{store: tx}
 
 	// set core to uninitialized if no state is set
 	if _, err := txdata.getState(); err != nil {
@@ -169,18 +322,22 @@ func NewCore(dnsNames []string, qv quote.Validator, qi quote.Issuer, sealer seal
 		}
 	} else if _, err := txdata.getRawManifest(); store.IsStoreValueUnsetError(err) {
 		// no state was found, wait for manifest
-		c.zaplogger.Info("No sealed state found. Proceeding with new state.")
-		if err := c.setCAData(dnsNames, tx); err != nil {
-			return nil, err
+		if _, err := txdata.getCertificate(sKCoordinatorRootCert); !isStdStore && err == nil {
+			c.zaplogger.Info("No manifest found. Proceeding with the root certificate of the shared state.")
+		} else {
+			c.zaplogger.Info("No sealed state found. Proceeding with new state.")
+			if err := c.setCAData(dnsNames, tx); err != nil {
+				return nil, err
+			}
 		}
 		if err := txdata.putState(stateAcceptingManifest); err != nil {
 			return nil, err
 		}
 	} else if err != nil {
 		return nil, err
-	} else {
+	} else if isSealedStore {
 		// recovered from a sealed state, reload components and finish the store transaction
-		stor.SetRecoveryData(recoveryData)
+		sealed.SetRecoveryData(recoveryData)
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -214,11 +371,61 @@ func NewCoreWithMocks() *Core {
 	return core
 }
 
+// SetActivationWebhook sets a notifier which receives an event for every successful or failed activation.
+// It needs to be called before the Marble API is served.
+func (c *Core) SetActivationWebhook(notifier ActivationNotifier) {
+	c.activationWebhook = notifier
+}
+
+// SetActivationSizeLimits sets the maximum sizes in bytes of the CSR and the quote of activation requests.
+// Larger requests are rejected before they are parsed. It needs to be called before the Marble API is served.
+func (c *Core) SetActivationSizeLimits(maxCSRSize, maxQuoteSize int) {
+	c.maxCSRSize = maxCSRSize
+	c.maxQuoteSize = maxQuoteSize
+}
+
+// SetMaxCSRSANs sets the maximum number of subject alternative names (DNS names, IP addresses, and URIs) in the CSR of activation requests.
+// It needs to be called before the Marble API is served.
+func (c *Core) SetMaxCSRSANs(maxCSRSANs int) {
+	c.maxCSRSANs = maxCSRSANs
+}
+
+// SetMaxParametersSize sets the maximum total size in bytes of the rendered Files and Env of a Marble.
+// Activations exceeding it fail. It needs to be called before the Marble API is served.
+func (c *Core) SetMaxParametersSize(maxParametersSize int) {
+	c.maxParametersSize = maxParametersSize
+}
+
+// SetCertClockSkew sets the duration by which the NotBefore of issued certificates is backdated,
+// so clients with clocks slightly behind the Coordinator's accept them. It needs to be called before the Marble API is served.
+func (c *Core) SetCertClockSkew(skew time.Duration) {
+	c.certClockSkew = skew
+}
+
+// SetAllowMarbleSimulation sets whether Marbles with AllowSimulation skip quote validation
+// although the Coordinator does not run in simulation mode. It needs to be called before the Marble API is served.
+func (c *Core) SetAllowMarbleSimulation(allow bool) {
+	c.allowMarbleSimulation = allow
+}
+
 // inSimulationMode returns true if we operate in OE_SIMULATION mode.
 func (c *Core) inSimulationMode() bool {
 	return len(c.quote) == 0
 }
 
+// skipsQuoteValidation returns true if the quotes of a Marble are not validated.
+// Marbles may always require quote validation. They may only skip it if the Coordinator runs in simulation mode
+// or the Coordinator's operator explicitly allowed Marbles in simulation mode.
+func (c *Core) skipsQuoteValidation(marble manifest.Marble) bool {
+	if marble.AllowSimulation != nil && !*marble.AllowSimulation {
+		return false
+	}
+	if c.inSimulationMode() {
+		return true
+	}
+	return marble.AllowSimulation != nil && c.allowMarbleSimulation
+}
+
 // GetTLSConfig gets the core's TLS configuration.
 func (c *Core) GetTLSConfig() (*tls.Config, error) {
 	return &tls.Config{
@@ -289,6 +496,11 @@ func generateCert(dnsNames []string, commonName string, privk *ecdsa.PrivateKey,
 	if err != nil {
 		return nil, nil, err
 	}
+	// the intermediate and the Marble root certificate share their key, so they share their Subject Key Identifier as well
+	subjectKeyID, err := util.SubjectKeyID(&privk.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// TODO: what else do we need to set here?
 	// Do we need x509.KeyUsageKeyEncipherment?
@@ -302,10 +514,11 @@ func generateCert(dnsNames []string, commonName string, privk *ecdsa.PrivateKey,
 		NotBefore:   notBefore,
 		NotAfter:    notAfter,
 
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
+		SubjectKeyId:          subjectKeyID,
 	}
 
 	if parentCertificate == nil {
@@ -367,7 +580,14 @@ func (c *Core) getStatus(ctx context.Context) (int, string, error) {
 	case stateAcceptingManifest:
 		status = "Coordinator is ready to accept a manifest."
 	case stateAcceptingMarbles:
-		status = "Coordinator is running correctly and ready to accept marbles."
+		c.mux.Lock()
+		paused := c.paused
+		c.mux.Unlock()
+		if paused {
+			status = "Coordinator is paused for maintenance and does not accept marbles."
+		} else {
+			status = "Coordinator is running correctly and ready to accept marbles."
+		}
 	default:
 		return -1, "Cannot determine coordinator status.", errors.New("cannot determine coordinator status")
 	}
@@ -375,11 +595,115 @@ func (c *Core) getStatus(ctx context.Context) (int, string, error) {
 	return int(curState), status, nil
 }
 
-func (c *Core) generateSecrets(ctx context.Context, secrets map[string]manifest.Secret, id uuid.UUID, parentCertificate *x509.Certificate, parentPrivKey *ecdsa.PrivateKey) (map[string]manifest.Secret, error) {
+// recordIssuedCertificate appends a certificate signed by the Coordinator to the issuance log in its own transaction.
+func (c *Core) recordIssuedCertificate(ctx context.Context, certRaw []byte, marbleType, userName string) error {
+	tx, err := c.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := (storeWrapper{store: tx, ctx: ctx}).recordIssuedCertificate(certRaw, marbleType, userName); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// merkleTreeHash returns the Merkle Tree Hash of the leaves as defined in RFC 6962, section 2.1.
+func merkleTreeHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	case 1:
+		hash := sha256.Sum256(append([]byte{0x00}, leaves[0]...))
+		return hash[:]
+	}
+
+	// split at the largest power of two smaller than the number of leaves
+	split := 1
+	for split*2 < len(leaves) {
+		split *= 2
+	}
+	node := append([]byte{0x01}, merkleTreeHash(leaves[:split])...)
+	node = append(node, merkleTreeHash(leaves[split:])...)
+	hash := sha256.Sum256(node)
+	return hash[:]
+}
+
+// issuanceLogDigest returns the digest signed for an issuance log with the given size and Merkle tree hash.
+func issuanceLogDigest(size uint64, treeHash []byte) []byte {
+	signed := make([]byte, 8, 8+len(treeHash))
+	binary.BigEndian.PutUint64(signed, size)
+	digest := sha256.Sum256(append(signed, treeHash...))
+	return digest[:]
+}
+
+// deriveSecretValue derives the value of a symmetric secret from a derivation root.
+// The salt consists of the Marble's UUID, or uuid.Nil for shared secrets, and the secret's name.
+func deriveSecretValue(rootKey []byte, id uuid.UUID, name string, size uint) ([]byte, error) {
+	return util.DeriveKey(rootKey, []byte(id.String()+name), size/8)
+}
+
+// isDerivedSecret returns true if the Coordinator derives the value of a secret from the derivation root.
+func isDerivedSecret(secret manifest.Secret) bool {
+	if secret.UserDefined || (secret.Shared && !secret.Deterministic) {
+		return false
+	}
+	return secret.Type == "symmetric-key" || secret.Type == "hmac"
+}
+
+// isPlatformBoundSecret returns true if a Marble with PlatformBoundSecrets receives the secret unrendered, so its premain binds it to the platform.
+func isPlatformBoundSecret(secret manifest.Secret) bool {
+	return isDerivedSecret(secret) && !secret.Shared
+}
+
+// splitPlatformBoundSecrets removes the derived per-Marble secrets from a Marble's secrets and returns their values separately.
+// The Marble's premain binds the values to the platform's seal key, so the Coordinator never learns the bound values.
+func splitPlatformBoundSecrets(secrets map[string]manifest.Secret) (map[string]manifest.Secret, map[string][]byte) {
+	remaining := make(map[string]manifest.Secret, len(secrets))
+	bound := make(map[string][]byte)
+	for name, secret := range secrets {
+		if isPlatformBoundSecret(secret) {
+			bound[name] = secret.Private
+			continue
+		}
+		remaining[name] = secret
+	}
+	return remaining, bound
+}
+
+// previousDerivedSecrets returns a copy of a Marble's secrets with the derived secrets replaced by the values derived from the previous root.
+// If the grace period of the previous root has ended, the secrets are returned unchanged.
+func previousDerivedSecrets(root derivationRoot, secrets map[string]manifest.Secret, marbleUUID uuid.UUID) (map[string]manifest.Secret, error) {
+	if !root.previousValid(time.Now()) {
+		return secrets, nil
+	}
+
+	previousSecrets := make(map[string]manifest.Secret, len(secrets))
+	for name, secret := range secrets {
+		if isDerivedSecret(secret) {
+			id := marbleUUID
+			if secret.Shared {
+				id = uuid.Nil
+			}
+			value, err := deriveSecretValue(root.Previous, id, name, secret.Size)
+			if err != nil {
+				return nil, err
+			}
+			secret.Private = value
+			secret.Public = value
+		}
+		previousSecrets[name] = secret
+	}
+	return previousSecrets, nil
+}
+
+func (c *Core) generateSecrets(data storeWrapper, secrets map[string]manifest.Secret, id uuid.UUID, parentCertificate *x509.Certificate, parentPrivKey *ecdsa.PrivateKey) (map[string]manifest.Secret, error) {
 	// Create a new map so we do not overwrite the entries in the manifest
 	newSecrets := make(map[string]manifest.Secret)
 
-	rootPrivK, err := c.data.getPrivK(sKCoordinatorRootKey)
+	root, err := data.getDerivationRoot()
 	if err != nil {
 		return nil, err
 	}
@@ -399,31 +723,31 @@ func (c *Core) generateSecrets(ctx context.Context, secrets map[string]manifest.
 		c.zaplogger.Info("generating secret", zap.String("name", name), zap.String("type", secret.Type), zap.Uint("size", secret.Size))
 		switch secret.Type {
 		// Raw = Symmetric Key
-		case "symmetric-key":
+		case "symmetric-key", "hmac":
 			// Check secret size
 			if secret.Size == 0 || secret.Size%8 != 0 {
 				return nil, fmt.Errorf("invalid secret size: %v", name)
 			}
 
 			var generatedValue []byte
-			// If a secret is shared, we generate a completely random key. If a secret is constrained to a marble, we derive a key from the core's private key.
-			if secret.Shared {
+			// If a secret is shared, we generate a completely random key. If a secret is constrained to a marble, we derive a key from the derivation root.
+			// Shared secrets marked as deterministic are derived from the derivation root as well, using only the secret's name as salt.
+			if secret.Shared && !secret.Deterministic {
 				generatedValue = make([]byte, secret.Size/8)
 				_, err := rand.Read(generatedValue)
 				if err != nil {
 					return nil, err
 				}
 			} else {
-				salt := id.String() + name
-				secretKeyDerive := rootPrivK.D.Bytes()
 				var err error
-				generatedValue, err = util.DeriveKey(secretKeyDerive, []byte(salt), secret.Size/8)
+				generatedValue, err = deriveSecretValue(root.Current, id, name, secret.Size)
 				if err != nil {
 					return nil, err
 				}
 			}
 
 			// Get secret object from manifest, create a copy, modify it and put in in the new map so we do not overwrite the manifest entries
+			secret = secret.WithDefaultAlgorithm()
 			secret.Private = generatedValue
 			secret.Public = generatedValue
 
@@ -461,7 +785,8 @@ func (c *Core) generateSecrets(ctx context.Context, secrets map[string]manifest.
 				return nil, err
 			}
 
-		case "cert-ecdsa":
+		case "cert-ecdsa", "ca-cert":
+			// ca-cert secrets are ECDSA certificates as well, but are issued as CA by generateCertificateForSecret
 			var curve elliptic.Curve
 
 			switch secret.Size {
@@ -503,24 +828,42 @@ func (c *Core) generateCertificateForSecret(secret manifest.Secret, parentCertif
 	// Load given information from manifest as template
 	template := x509.Certificate(secret.Cert)
 
-	// Define or overwrite some values for sane standards
-	if template.DNSNames == nil {
-		template.DNSNames = []string{"localhost"}
-	}
-	if template.IPAddresses == nil {
-		template.IPAddresses = util.DefaultCertificateIPAddresses
-	}
-	if template.KeyUsage == 0 {
-		template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
-	}
-	if template.ExtKeyUsage == nil {
-		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
-	}
-	if template.Subject.CommonName == "" {
-		if len(template.DNSNames) == 1 {
-			template.Subject.CommonName = template.DNSNames[0]
-		} else {
-			template.Subject.CommonName = "MarbleRun Generated Certificate"
+	if secret.Type == "ca-cert" {
+		// CA certificates allow the Marble to issue certificates up to the depth of PathLen
+		template.IsCA = true
+		template.MaxPathLen = secret.PathLen
+		template.MaxPathLenZero = secret.PathLen == 0
+		if secret.NameConstraints != nil {
+			if err := secret.NameConstraints.ApplyTo(&template); err != nil {
+				return manifest.Secret{}, err
+			}
+		}
+		if template.KeyUsage == 0 {
+			template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		}
+		if template.Subject.CommonName == "" {
+			template.Subject.CommonName = "MarbleRun Generated CA"
+		}
+	} else {
+		// Define or overwrite some values for sane standards
+		if template.DNSNames == nil {
+			template.DNSNames = []string{"localhost"}
+		}
+		if template.IPAddresses == nil {
+			template.IPAddresses = util.DefaultCertificateIPAddresses
+		}
+		if template.KeyUsage == 0 {
+			template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+		}
+		if template.ExtKeyUsage == nil {
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		}
+		if template.Subject.CommonName == "" {
+			if len(template.DNSNames) == 1 {
+				template.Subject.CommonName = template.DNSNames[0]
+			} else {
+				template.Subject.CommonName = "MarbleRun Generated Certificate"
+			}
 		}
 	}
 	var err error
@@ -617,7 +960,7 @@ func (c *Core) setCAData(dnsNames []string, tx store.Transaction) error {
 		return err
 	}
 
-	txdata := storeWrapper{tx}
+	txdata := storeWrapper{store: tx}
 	if err := txdata.putCertificate(sKCoordinatorRootCert, rootCert); err != nil {
 		return err
 	}
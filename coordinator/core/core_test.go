@@ -8,24 +8,32 @@ package core
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"math/big"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
 	"github.com/edgelesssys/marblerun/coordinator/recovery"
+	"github.com/edgelesssys/marblerun/coordinator/rpc"
 	"github.com/edgelesssys/marblerun/coordinator/seal"
+	"github.com/edgelesssys/marblerun/coordinator/store"
 	"github.com/edgelesssys/marblerun/coordinator/user"
 	"github.com/edgelesssys/marblerun/test"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestCore(t *testing.T) {
@@ -235,6 +243,9 @@ func TestGenerateSecrets(t *testing.T) {
 		"cert-ecdsa521-test":      {Type: "cert-ecdsa", Size: 521, ValidFor: 14, Shared: true},
 		"cert-rsa-specified-test": {Type: "cert-rsa", Size: 2048, Cert: manifest.Certificate{}, Shared: true},
 		"cert-ed25519-ca-test":    {Type: "cert-ed25519", Cert: manifest.Certificate{IsCA: true}, Shared: true},
+		"hmac-test":               {Type: "hmac", Size: 256, Shared: true},
+		"hmac-sha512-test":        {Type: "hmac", Size: 512, Algorithm: "sha512", Shared: true},
+		"ca-cert-test":            {Type: "ca-cert", Size: 256, PathLen: 1, Shared: true, NameConstraints: &manifest.NameConstraints{PermittedDNSDomains: []string{"example.com"}}},
 	}
 
 	secretsNoSize := map[string]manifest.Secret{
@@ -263,7 +274,7 @@ func TestGenerateSecrets(t *testing.T) {
 	assert.NoError(err)
 
 	// This should return valid secrets
-	generatedSecrets, err := c.generateSecrets(context.TODO(), secretsToGenerate, uuid.Nil, rootCert, rootPrivK)
+	generatedSecrets, err := c.generateSecrets(c.data, secretsToGenerate, uuid.Nil, rootCert, rootPrivK)
 	require.NoError(err)
 	// Check if rawTest1 has 128 Bits/16 Bytes and rawTest2 256 Bits/8 Bytes
 	assert.Len(generatedSecrets["rawTest1"].Public, 16)
@@ -276,6 +287,20 @@ func TestGenerateSecrets(t *testing.T) {
 	assert.NotNil(generatedSecrets["cert-ecdsa521-test"].Cert.Raw)
 	assert.NotNil(generatedSecrets["cert-rsa-specified-test"].Cert.Raw)
 	assert.NotNil(generatedSecrets["cert-ed25519-ca-test"].Cert.Raw)
+	assert.Len(generatedSecrets["hmac-test"].Public, 32)
+	assert.Len(generatedSecrets["hmac-sha512-test"].Public, 64)
+
+	// hmac secrets default to sha256
+	assert.Equal("sha256", generatedSecrets["hmac-test"].Algorithm)
+	assert.Equal("sha512", generatedSecrets["hmac-sha512-test"].Algorithm)
+
+	// ca-cert secrets are CAs signed by the parent certificate, regular certificates are not
+	caCert := x509.Certificate(generatedSecrets["ca-cert-test"].Cert)
+	assert.True(caCert.IsCA)
+	assert.Equal(1, caCert.MaxPathLen)
+	assert.NotZero(caCert.KeyUsage & x509.KeyUsageCertSign)
+	assert.NoError(caCert.CheckSignatureFrom(rootCert))
+	assert.False(generatedSecrets["cert-ecdsa256-test"].Cert.IsCA)
 
 	// If unspecified, CN and DNS names should be set to localhost
 	assert.Equal("localhost", generatedSecrets["cert-rsa-test"].Cert.Subject.CommonName)
@@ -283,10 +308,24 @@ func TestGenerateSecrets(t *testing.T) {
 
 	// Make sure a certificate gets a new serial number if its regenerated
 	firstSerial := generatedSecrets["cert-rsa-test"].Cert.SerialNumber
-	secondGeneration, err := c.generateSecrets(context.TODO(), generatedSecrets, uuid.Nil, rootCert, rootPrivK)
+	secondGeneration, err := c.generateSecrets(c.data, generatedSecrets, uuid.Nil, rootCert, rootPrivK)
 	assert.NoError(err)
 	assert.NotEqualValues(*firstSerial, *secondGeneration["cert-rsa-test"].Cert.SerialNumber)
 
+	// Shared secrets are random, unless they are marked as deterministic
+	assert.NotEqual(generatedSecrets["rawTest1"].Public, secondGeneration["rawTest1"].Public)
+	deterministicSecrets := map[string]manifest.Secret{
+		"deterministic":      {Type: "symmetric-key", Size: 128, Shared: true, Deterministic: true},
+		"otherDeterministic": {Type: "symmetric-key", Size: 128, Shared: true, Deterministic: true},
+	}
+	firstDeterministic, err := c.generateSecrets(c.data, deterministicSecrets, uuid.Nil, rootCert, rootPrivK)
+	require.NoError(err)
+	secondDeterministic, err := c.generateSecrets(c.data, deterministicSecrets, uuid.Nil, rootCert, rootPrivK)
+	require.NoError(err)
+	assert.Len(firstDeterministic["deterministic"].Public, 16)
+	assert.Equal(firstDeterministic["deterministic"].Public, secondDeterministic["deterministic"].Public)
+	assert.NotEqual(firstDeterministic["deterministic"].Public, firstDeterministic["otherDeterministic"].Public)
+
 	// Check if CA certificate can generate another certificate
 	pub, _, err := ed25519.GenerateKey(rand.Reader)
 	require.NoError(err)
@@ -325,31 +364,31 @@ func TestGenerateSecrets(t *testing.T) {
 	assert.NoError(err)
 
 	// Check if we get an empty secret map as output for an empty map as input
-	generatedSecrets, err = c.generateSecrets(context.TODO(), secretsEmptyMap, uuid.Nil, rootCert, rootPrivK)
+	generatedSecrets, err = c.generateSecrets(c.data, secretsEmptyMap, uuid.Nil, rootCert, rootPrivK)
 	require.NoError(err)
 	assert.IsType(map[string]manifest.Secret{}, generatedSecrets)
 	assert.Len(generatedSecrets, 0)
 
 	// Check if we get an empty secret map as output for nil
-	generatedSecrets, err = c.generateSecrets(context.TODO(), nil, uuid.Nil, rootCert, rootPrivK)
+	generatedSecrets, err = c.generateSecrets(c.data, nil, uuid.Nil, rootCert, rootPrivK)
 	require.NoError(err)
 	assert.IsType(map[string]manifest.Secret{}, generatedSecrets)
 	assert.Len(generatedSecrets, 0)
 
 	// If no size is specified, the function should fail
-	_, err = c.generateSecrets(context.TODO(), secretsNoSize, uuid.Nil, rootCert, rootPrivK)
+	_, err = c.generateSecrets(c.data, secretsNoSize, uuid.Nil, rootCert, rootPrivK)
 	assert.Error(err)
 
 	// Also, it should fail if we try to generate a secret with an unknown type
-	_, err = c.generateSecrets(context.TODO(), secretsInvalidType, uuid.Nil, rootCert, rootPrivK)
+	_, err = c.generateSecrets(c.data, secretsInvalidType, uuid.Nil, rootCert, rootPrivK)
 	assert.Error(err)
 
 	// If Ed25519 key size is specified, we should fail
-	_, err = c.generateSecrets(context.TODO(), secretsEd25519WrongKeySize, uuid.Nil, rootCert, rootPrivK)
+	_, err = c.generateSecrets(c.data, secretsEd25519WrongKeySize, uuid.Nil, rootCert, rootPrivK)
 	assert.Error(err)
 
 	// However, for ECDSA we fail as we can have multiple curves
-	_, err = c.generateSecrets(context.TODO(), secretsECDSAWrongKeySize, uuid.Nil, rootCert, rootPrivK)
+	_, err = c.generateSecrets(c.data, secretsECDSAWrongKeySize, uuid.Nil, rootCert, rootPrivK)
 	assert.Error(err)
 }
 
@@ -385,3 +424,161 @@ func TestUnsetRestart(t *testing.T) {
 
 	assert.NotEqual(*cCert, *c2Cert)
 }
+
+// sharedStore hides the StdStore type, so the Core treats it like an external store shared by multiple Coordinators.
+type sharedStore struct {
+	store.Store
+}
+
+func TestSharedStoreRestart(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	zapLogger, err := zap.NewDevelopment()
+	require.NoError(err)
+	defer zapLogger.Sync()
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	sealer := &seal.MockSealer{}
+	recovery := recovery.NewSinglePartyRecovery()
+	stor := sharedStore{store.NewStdStore(sealer)}
+
+	c1, err := NewCoreWithStore([]string{"localhost"}, validator, issuer, sealer, stor, recovery, zapLogger, nil)
+	require.NoError(err)
+	c1Cert, err := c1.data.getCertificate(sKCoordinatorRootCert)
+	require.NoError(err)
+
+	// a second core using the same store keeps the root certificate even though no manifest was set
+	c2, err := NewCoreWithStore([]string{"localhost"}, validator, issuer, sealer, stor, recovery, zapLogger, nil)
+	require.NoError(err)
+	c2State, err := c2.data.getState()
+	assert.NoError(err)
+	assert.Equal(stateAcceptingManifest, c2State)
+	c2Cert, err := c2.data.getCertificate(sKCoordinatorRootCert)
+	assert.NoError(err)
+	assert.Equal(c1Cert.Raw, c2Cert.Raw)
+
+	// a manifest set on one core is visible to the other
+	_, err = c1.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+	c2State, err = c2.data.getState()
+	assert.NoError(err)
+	assert.Equal(stateAcceptingMarbles, c2State)
+}
+
+func TestCASecretConstraints(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := NewCoreWithMocks()
+	rootCert, err := c.data.getCertificate(sKCoordinatorRootCert)
+	require.NoError(err)
+	rootPrivK, err := c.data.getPrivK(sKCoordinatorRootKey)
+	require.NoError(err)
+
+	secrets, err := c.generateSecrets(c.data, map[string]manifest.Secret{
+		"issuer": {Type: "ca-cert", Size: 256, Shared: true, NameConstraints: &manifest.NameConstraints{
+			PermittedDNSDomains: []string{"example.com"},
+			ExcludedDNSDomains:  []string{"secret.example.com"},
+			PermittedIPRanges:   []string{"10.0.0.0/8"},
+		}},
+	}, uuid.Nil, rootCert, rootPrivK)
+	require.NoError(err)
+	caCert := x509.Certificate(secrets["issuer"].Cert)
+	assert.True(caCert.PermittedDNSDomainsCritical)
+	assert.True(caCert.MaxPathLenZero)
+	caKey, err := x509.ParsePKCS8PrivateKey(secrets["issuer"].Private)
+	require.NoError(err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(&caCert)
+
+	// issue returns a certificate signed by parent, which is a CA if isCA is set
+	issue := func(template *x509.Certificate, parent *x509.Certificate, parentKey interface{}) (*x509.Certificate, interface{}) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(err)
+		template.SerialNumber = big.NewInt(1)
+		template.NotBefore = time.Now().Add(-time.Minute)
+		template.NotAfter = time.Now().Add(time.Hour)
+		template.BasicConstraintsValid = true
+		raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		require.NoError(err)
+		cert, err := x509.ParseCertificate(raw)
+		require.NoError(err)
+		return cert, key
+	}
+	verify := func(cert *x509.Certificate, intermediates *x509.CertPool) error {
+		_, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+
+	leaf, _ := issue(&x509.Certificate{DNSNames: []string{"app.example.com"}, IPAddresses: []net.IP{{10, 1, 2, 3}}}, &caCert, caKey)
+	assert.NoError(verify(leaf, intermediates))
+
+	// certificates outside of the constraints fail verification
+	leaf, _ = issue(&x509.Certificate{DNSNames: []string{"app.other.com"}}, &caCert, caKey)
+	assert.Error(verify(leaf, intermediates))
+	leaf, _ = issue(&x509.Certificate{DNSNames: []string{"db.secret.example.com"}}, &caCert, caKey)
+	assert.Error(verify(leaf, intermediates))
+	leaf, _ = issue(&x509.Certificate{IPAddresses: []net.IP{{192, 168, 0, 1}}}, &caCert, caKey)
+	assert.Error(verify(leaf, intermediates))
+
+	// the CA can not issue further CAs with the default PathLen of 0
+	subCA, subCAKey := issue(&x509.Certificate{IsCA: true, KeyUsage: x509.KeyUsageCertSign}, &caCert, caKey)
+	leaf, _ = issue(&x509.Certificate{DNSNames: []string{"app.example.com"}}, subCA, subCAKey)
+	intermediates.AddCert(subCA)
+	assert.Error(verify(leaf, intermediates))
+}
+
+func TestShutdown(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	// simulate a request in progress
+	c.mux.Lock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(c.Shutdown(ctx), context.DeadlineExceeded)
+
+	shutdownDone := make(chan error)
+	go func() { shutdownDone <- c.Shutdown(context.Background()) }()
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned while a request was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.mux.Unlock()
+	assert.NoError(<-shutdownDone)
+
+	// new requests are rejected, activations with a retryable status
+	_, err = c.Activate(context.TODO(), &rpc.ActivationReq{MarbleType: "backendFirst", UUID: uuid.New().String()})
+	assert.Equal(codes.Unavailable, status.Code(err))
+	_, err = c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	assert.Error(err)
+}
+
+func TestMerkleTreeHash(t *testing.T) {
+	// test vectors of RFC 6962's reference implementation
+	leaves := [][]byte{{}, {0x00}, {0x10}, {0x20, 0x21}, {0x30, 0x31}}
+	testCases := []struct {
+		size int
+		root string
+	}{
+		{0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{1, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		{2, "fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125"},
+		{3, "aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77"},
+		{4, "d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7"},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.root, hex.EncodeToString(merkleTreeHash(leaves[:tc.size])), "size %d", tc.size)
+	}
+}
@@ -7,24 +7,33 @@
 package core
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"math"
+	"net"
+	"sort"
+	"strings"
 	"text/template"
 	"time"
 
+	"github.com/edgelesssys/ego/ecrypto"
 	"github.com/edgelesssys/ego/marble"
 	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
 	"github.com/edgelesssys/marblerun/coordinator/rpc"
 	"github.com/edgelesssys/marblerun/coordinator/store"
+	"github.com/edgelesssys/marblerun/coordinator/webhook"
 	"github.com/edgelesssys/marblerun/util"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
@@ -35,6 +44,11 @@ import (
 type reservedSecrets struct {
 	RootCA     manifest.Secret
 	MarbleCert manifest.Secret
+	UUID       string
+	Tags       map[string]string
+	// PreviousSecrets holds the Marble's secrets with derived keys from the previous derivation root.
+	// Outside of a rotation's grace period, it equals the Marble's current secrets.
+	PreviousSecrets map[string]manifest.Secret
 }
 
 // Defines the "MarbleRun" prefix when mentioned in a manifest.
@@ -48,58 +62,364 @@ type secretsWrapper struct {
 // Verifies the marble's integrity and subsequently provides the marble with a certificate for authentication and application-specific parameters as defined in the Coordinator's manifest.
 //
 // Parameter req needs to contain a MarbleType present in the Coordinator's manifest and a CSR with the Subject and DNSNames set with desired values.
+// It may omit the UUID and contain the Marble's hostname instead, if the manifest lets the Marble derive its UUID.
+// If the request names a Group, the response is held until all members of the group have been verified on their own connections.
 //
 // Returns a signed certificate-key-pair and the application's parameters if the authentication was successful.
 // Returns an error if the authentication failed.
 func (c *Core) Activate(ctx context.Context, req *rpc.ActivationReq) (*rpc.ActivationResp, error) {
+	resp, infraName, err := c.activate(ctx, req)
+
+	if c.activationWebhook != nil {
+		event := webhook.ActivationEvent{
+			Success:        err == nil,
+			MarbleType:     req.GetMarbleType(),
+			UUID:           req.GetUUID(),
+			Infrastructure: infraName,
+			Timestamp:      time.Now().UTC(),
+		}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		c.activationWebhook.Notify(event)
+	}
+
+	return resp, err
+}
+
+// activate performs the activation of a Marble and additionally returns the name of the matched infrastructure.
+func (c *Core) activate(ctx context.Context, req *rpc.ActivationReq) (*rpc.ActivationResp, string, error) {
 	c.zaplogger.Info("Received activation request", zap.String("MarbleType", req.MarbleType))
 	c.metrics.marbleAPI.activation.WithLabelValues(req.GetMarbleType(), req.GetUUID()).Inc()
 
+	// reject oversized requests before any expensive parsing
+	if len(req.GetCSR()) > c.maxCSRSize {
+		return nil, "", status.Errorf(codes.InvalidArgument, "CSR exceeds the maximum size of %d bytes", c.maxCSRSize)
+	}
+	if len(req.GetQuote()) > c.maxQuoteSize {
+		return nil, "", status.Errorf(codes.InvalidArgument, "quote exceeds the maximum size of %d bytes", c.maxQuoteSize)
+	}
+
+	if req.GetGroup() != "" {
+		return c.activateGroupMember(ctx, req)
+	}
+
 	defer c.mux.Unlock()
 	if err := c.requireState(stateAcceptingMarbles); err != nil {
-		return nil, status.Error(codes.FailedPrecondition, "cannot accept marbles in current state")
+		return nil, "", activationStateError(err)
+	}
+	if c.paused {
+		return nil, "", status.Error(codes.FailedPrecondition, "activations are paused for maintenance")
 	}
 
 	// get the marble's TLS cert (used in this connection) and check corresponding quote
 	tlsCert := getClientTLSCert(ctx)
 	if tlsCert == nil {
-		return nil, status.Error(codes.Unauthenticated, "couldn't get marble TLS certificate")
+		return nil, "", status.Error(codes.Unauthenticated, "couldn't get marble TLS certificate")
 	}
-	if err := c.verifyManifestRequirement(tlsCert, req.GetQuote(), req.GetMarbleType()); err != nil {
-		return nil, err
+	infraName, err := c.verifyManifestRequirement(ctx, tlsCert, req.GetQuote(), req.GetMarbleType())
+	if err != nil {
+		return nil, infraName, err
 	}
 
-	marbleUUID, err := uuid.Parse(req.GetUUID())
+	tx, err := c.store.BeginTransaction(ctx)
 	if err != nil {
-		return nil, err
+		return nil, infraName, err
+	}
+	defer tx.Rollback()
+
+	// reserve the activation before any credentials are issued, so exhausted budgets do not result in signed certificates
+	txdata := storeWrapper{store: tx, ctx: ctx}
+	activations, maxActivations, err := txdata.compareAndIncrementActivations(req.GetMarbleType(), 1)
+	if err == errActivationsExhausted {
+		scope := fmt.Sprintf("marble type %s", req.GetMarbleType())
+		if infraName != "" {
+			scope += fmt.Sprintf(" (activated on infrastructure %s)", infraName)
+		}
+		return nil, infraName, status.Errorf(codes.ResourceExhausted, "reached max activations count for %s: %d/%d activations", scope, activations, maxActivations)
+	}
+	if err != nil {
+		c.zaplogger.Error("Could not increment activations.", zap.Error(err))
+		return nil, infraName, err
+	}
+
+	// the issued certificate is only recorded if the activation is committed
+	resp, marble, err := c.prepareActivation(txdata, req, infraName)
+	if err != nil {
+		return nil, infraName, err
+	}
+	if err := c.recordQuoteSample(txdata, req, tlsCert, infraName); err != nil {
+		return nil, infraName, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, infraName, err
+	}
+
+	c.metrics.marbleAPI.activationSuccess.WithLabelValues(req.GetMarbleType(), req.GetUUID()).Inc()
+	c.zaplogger.Info("Successfully activated new Marble", zap.String("MarbleType", req.MarbleType), zap.String("UUID", req.GetUUID()), zap.Any("Tags", marble.Tags))
+	return resp, infraName, nil
+}
+
+// activationGroup collects the members of a group activation until all of them have been verified.
+// The activations of its members are only counted, and their credentials only issued, once the group is complete.
+type activationGroup struct {
+	size    uint32
+	members []*groupMember
+	// done is closed once the group was committed or aborted. err is only read after done is closed.
+	done chan struct{}
+	err  error
+}
+
+// groupMember is a verified member of an activation group.
+// resp and marble are set when the group is committed.
+type groupMember struct {
+	req       *rpc.ActivationReq
+	tlsCert   *x509.Certificate
+	infraName string
+	resp      *rpc.ActivationResp
+	marble    manifest.Marble
+}
+
+// activateGroupMember performs the activation of a Marble which is part of a group.
+// Each member is verified on its own connection, but the credentials of the members are only issued once all members of the group have been verified
+// and their activations were counted. If the group does not complete in time or a member cancels its request, none of the members is activated.
+func (c *Core) activateGroupMember(ctx context.Context, req *rpc.ActivationReq) (*rpc.ActivationResp, string, error) {
+	group, member, err := c.joinActivationGroup(ctx, req)
+	if err != nil {
+		return nil, member.infraName, err
+	}
+
+	timer := time.NewTimer(c.groupActivationTimeout)
+	defer timer.Stop()
+	select {
+	case <-group.done:
+	case <-ctx.Done():
+		c.abortActivationGroup(req.GetGroup(), group, status.Errorf(codes.Aborted, "a member of activation group %s canceled its request", req.GetGroup()))
+	case <-timer.C:
+		c.abortActivationGroup(req.GetGroup(), group, status.Errorf(codes.DeadlineExceeded, "activation group %s did not complete within %v", req.GetGroup(), c.groupActivationTimeout))
+	}
+	<-group.done
+	if group.err != nil {
+		return nil, member.infraName, group.err
 	}
 
+	c.metrics.marbleAPI.activationSuccess.WithLabelValues(req.GetMarbleType(), req.GetUUID()).Inc()
+	c.zaplogger.Info("Successfully activated new Marble", zap.String("MarbleType", req.MarbleType), zap.String("UUID", req.GetUUID()), zap.String("Group", req.GetGroup()), zap.Any("Tags", member.marble.Tags))
+	return member.resp, member.infraName, nil
+}
+
+// joinActivationGroup verifies a Marble and adds it to its activation group.
+// The last member to join commits the activations of the whole group.
+// A member which fails verification is rejected without affecting the other members of the group.
+func (c *Core) joinActivationGroup(ctx context.Context, req *rpc.ActivationReq) (*activationGroup, *groupMember, error) {
+	if req.GetGroupSize() < 2 {
+		return nil, &groupMember{}, status.Errorf(codes.InvalidArgument, "activation group %s must have at least 2 members", req.GetGroup())
+	}
+
+	defer c.mux.Unlock()
+	if err := c.requireState(stateAcceptingMarbles); err != nil {
+		return nil, &groupMember{}, activationStateError(err)
+	}
+	if c.paused {
+		return nil, &groupMember{}, status.Error(codes.FailedPrecondition, "activations are paused for maintenance")
+	}
+
+	tlsCert := getClientTLSCert(ctx)
+	if tlsCert == nil {
+		return nil, &groupMember{}, status.Error(codes.Unauthenticated, "couldn't get marble TLS certificate")
+	}
+	infraName, err := c.verifyManifestRequirement(ctx, tlsCert, req.GetQuote(), req.GetMarbleType())
+	member := &groupMember{req: req, tlsCert: tlsCert, infraName: infraName}
+	if err != nil {
+		return nil, member, err
+	}
+
+	group, ok := c.activationGroups[req.GetGroup()]
+	if ok && group.size != req.GetGroupSize() {
+		return nil, member, status.Errorf(codes.InvalidArgument, "activation group %s has %d members, but the request specifies %d", req.GetGroup(), group.size, req.GetGroupSize())
+	}
+
+	if !ok {
+		group = &activationGroup{size: req.GetGroupSize(), done: make(chan struct{})}
+		c.activationGroups[req.GetGroup()] = group
+	}
+	group.members = append(group.members, member)
+	c.zaplogger.Info("Marble joined activation group", zap.String("MarbleType", req.MarbleType), zap.String("Group", req.GetGroup()), zap.Int("members", len(group.members)), zap.Uint32("size", group.size))
+
+	if uint32(len(group.members)) == group.size {
+		group.err = c.commitActivationGroup(ctx, req.GetGroup(), group)
+		delete(c.activationGroups, req.GetGroup())
+		close(group.done)
+	}
+	return group, member, nil
+}
+
+// commitActivationGroup checks the activation budgets of all members of a complete group, counts their activations,
+// and issues their credentials in a single transaction, so none of them is activated if any fails.
+func (c *Core) commitActivationGroup(ctx context.Context, name string, group *activationGroup) error {
+	var marbleTypes []string
+	requested := map[string]uint{}
+	for _, member := range group.members {
+		if requested[member.req.GetMarbleType()] == 0 {
+			marbleTypes = append(marbleTypes, member.req.GetMarbleType())
+		}
+		requested[member.req.GetMarbleType()]++
+	}
+
+	tx, err := c.store.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	txdata := storeWrapper{store: tx, ctx: ctx}
+	for _, marbleType := range marbleTypes {
+		count := requested[marbleType]
+		activations, maxActivations, err := txdata.compareAndIncrementActivations(marbleType, count)
+		if err == errActivationsExhausted {
+			return status.Errorf(codes.ResourceExhausted, "activation group %s exceeds max activations count for marble type %s: %d activations requested, %d/%d activations", name, marbleType, count, activations, maxActivations)
+		}
+		if err != nil {
+			c.zaplogger.Error("Could not increment activations.", zap.Error(err))
+			return err
+		}
+	}
+	for _, member := range group.members {
+		if member.resp, member.marble, err = c.prepareActivation(txdata, member.req, member.infraName); err != nil {
+			return err
+		}
+		if err := c.recordQuoteSample(txdata, member.req, member.tlsCert, member.infraName); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// abortActivationGroup fails all members of an activation group, unless it was already committed.
+func (c *Core) abortActivationGroup(name string, group *activationGroup, err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	select {
+	case <-group.done:
+		return
+	default:
+	}
+	group.err = err
+	if c.activationGroups[name] == group {
+		delete(c.activationGroups, name)
+	}
+	close(group.done)
+}
+
+// quoteSample is the quote of the latest activation of a Marble type with a distinct measurement.
+// It is kept to check which Marble types a proposed update manifest would reject.
+type quoteSample struct {
+	Quote []byte
+	// Cert is the TLS certificate the quote was issued for.
+	Cert []byte
+	// Infrastructure is the name of the infrastructure the quote was verified for, if any.
+	Infrastructure string
+}
+
+// recordQuoteSample saves the quote of an activation as the sample of its measurement for the Marble type.
+// One sample is kept per measurement, so builds of a Marble type which still run are not hidden by the activation of a newer build.
+// Activations without a quote, e.g., in simulation mode, are not recorded.
+func (c *Core) recordQuoteSample(data storeWrapper, req *rpc.ActivationReq, tlsCert *x509.Certificate, infraName string) error {
+	if len(req.GetQuote()) == 0 {
+		return nil
+	}
+	props, err := c.qv.PackageProperties(req.GetQuote())
+	if err != nil {
+		return fmt.Errorf("reading package properties of quote: %w", err)
+	}
+	samples, err := data.getQuoteSamples(req.GetMarbleType())
+	if err != nil && !store.IsStoreValueUnsetError(err) {
+		return err
+	}
+	if samples == nil {
+		samples = make(map[string]quoteSample)
+	}
+	samples[measurementKey(props)] = quoteSample{Quote: req.GetQuote(), Cert: tlsCert.Raw, Infrastructure: infraName}
+	return data.putQuoteSamples(req.GetMarbleType(), samples)
+}
+
+// measurementKey identifies the measurement of an enclave by its UniqueID, or by its SignerID, ProductID, and SecurityVersion.
+func measurementKey(props quote.PackageProperties) string {
+	if props.UniqueID != "" {
+		return strings.ToLower(props.UniqueID)
+	}
+	key := strings.ToLower(props.SignerID)
+	if props.ProductID != nil {
+		key += fmt.Sprintf(":%d", *props.ProductID)
+	}
+	if props.SecurityVersion != nil {
+		key += fmt.Sprintf(":%d", *props.SecurityVersion)
+	}
+	return key
+}
+
+// prepareActivation generates the credentials and parameters of a verified Marble.
+// It does not count the activation, which is left to the caller. data should be the transaction the activation is counted in,
+// so the issued certificate is only recorded if the activation succeeds.
+func (c *Core) prepareActivation(data storeWrapper, req *rpc.ActivationReq, infraName string) (*rpc.ActivationResp, manifest.Marble, error) {
+	marbleUUID, err := c.getMarbleUUID(data, req)
+	if err != nil {
+		return nil, manifest.Marble{}, err
+	}
+	// record a derived UUID, so it is reported in metrics and activation events
+	req.UUID = marbleUUID.String()
+
 	// Generate marble authentication secrets
-	authSecrets, err := c.generateMarbleAuthSecrets(req, marbleUUID)
+	authSecrets, err := c.generateMarbleAuthSecrets(data, req, marbleUUID)
 	if err != nil {
-		return nil, err
+		return nil, manifest.Marble{}, err
 	}
 
-	marbleRootCert, err := c.data.getCertificate(sKMarbleRootCert)
+	marbleRootCert, err := data.getCertificate(sKMarbleRootCert)
 	if err != nil {
 		c.zaplogger.Error("Could not retrieve marbleRootCert certificate.", zap.Error(err))
-		return nil, err
+		return nil, manifest.Marble{}, err
 	}
-	intermediatePrivK, err := c.data.getPrivK(sKCoordinatorIntermediateKey)
+	intermediatePrivK, err := c.getIntermediatePrivK(data)
 	if err != nil {
-		c.zaplogger.Error("Could not retrieve marbleRootCert private key.", zap.Error(err))
+		return nil, manifest.Marble{}, err
 	}
 
-	secrets, err := c.data.getSecretMap()
+	secrets, err := data.getSecretMap()
 	if err != nil {
-		return nil, err
+		return nil, manifest.Marble{}, err
+	}
+
+	marble, err := data.getMarble(req.MarbleType)
+	if err != nil {
+		return nil, manifest.Marble{}, err
+	}
+
+	// only Marbles allowed to hold a CA receive ca-cert secrets
+	if !marble.AllowCA {
+		for name, secret := range secrets {
+			if secret.Type == "ca-cert" {
+				delete(secrets, name)
+			}
+		}
+	}
+	// secrets restricted to a group of Marbles are only received by its members
+	secrets = secretsAvailableTo(secrets, req.GetMarbleType())
+	// unattested Marbles on a hardware Coordinator only receive their own secrets
+	if !c.inSimulationMode() && c.skipsQuoteValidation(marble) {
+		c.zaplogger.Warn("Marble is not attested. Shared and user-defined secrets are withheld.", zap.String("MarbleType", req.MarbleType))
+		for name, secret := range secrets {
+			if secret.Shared || secret.UserDefined {
+				delete(secrets, name)
+			}
+		}
 	}
 
 	// Generate unique (= per marble) secrets
-	privateSecrets, err := c.generateSecrets(ctx, secrets, marbleUUID, marbleRootCert, intermediatePrivK)
+	privateSecrets, err := c.generateSecrets(data, secrets, marbleUUID, marbleRootCert, intermediatePrivK)
 	if err != nil {
 		c.zaplogger.Error("Could not generate specified secrets for the given manifest.", zap.Error(err))
-		return nil, err
+		return nil, manifest.Marble{}, err
 	}
 
 	// Union newly generated unique secrets with shared and user-defined secrets
@@ -107,167 +427,416 @@ func (c *Core) Activate(ctx context.Context, req *rpc.ActivationReq) (*rpc.Activ
 		secrets[k] = v
 	}
 
-	marble, err := c.data.getMarble(req.MarbleType)
+	mnf, err := data.getManifest()
 	if err != nil {
-		return nil, err
+		return nil, manifest.Marble{}, err
+	}
+	// bundles may have been updated since the manifest was set
+	if err := data.resolveBundles(&mnf); err != nil {
+		return nil, manifest.Marble{}, err
+	}
+
+	authSecrets.Tags = marble.Tags
+
+	root, err := data.getDerivationRoot()
+	if err != nil {
+		return nil, manifest.Marble{}, err
+	}
+	authSecrets.PreviousSecrets, err = previousDerivedSecrets(root, secrets, marbleUUID)
+	if err != nil {
+		return nil, manifest.Marble{}, err
+	}
+	// platform-bound secrets are passed to the premain unrendered, so templates can not reference them
+	var boundSecrets, previousBoundSecrets map[string][]byte
+	if marble.PlatformBoundSecrets {
+		secrets, boundSecrets = splitPlatformBoundSecrets(secrets)
+		authSecrets.PreviousSecrets, previousBoundSecrets = splitPlatformBoundSecrets(authSecrets.PreviousSecrets)
 	}
 
 	// add TTLS config to Env
-	if err := c.setTTLSConfig(marble, authSecrets, secrets); err != nil {
+	skippedTLSEntries, err := c.setTTLSConfig(data, marble, authSecrets, secrets, mnf.LenientTLS)
+	if err != nil {
 		c.zaplogger.Error("Could not create TTLS config.", zap.Error(err))
-		return nil, err
+		return nil, manifest.Marble{}, err
+	}
+	if len(skippedTLSEntries) > 0 {
+		c.zaplogger.Warn("Skipped unresolvable TTLS entries.", zap.String("MarbleType", req.MarbleType), zap.Strings("entries", skippedTLSEntries))
 	}
 
-	params, err := customizeParameters(marble.Parameters, authSecrets, secrets)
+	resolvedParams, err := mnf.ResolveInfrastructureParameters(marble, infraName)
+	if err != nil {
+		c.zaplogger.Error("Could not resolve parameters.", zap.Error(err))
+		return nil, manifest.Marble{}, err
+	}
+	params, err := customizeParameters(resolvedParams, authSecrets, secrets, mnf.CoordinatorEnv, mnf.CoordinatorFiles, c.maxParametersSize)
 	if err != nil {
 		c.zaplogger.Error("Could not customize parameters.", zap.Error(err))
-		return nil, err
+		return nil, manifest.Marble{}, err
+	}
+	setLogLevel(params, marble.LogLevel)
+	omitReservedEnv(params, marble.OmitReservedEnv)
+	params.PlatformBoundSecrets = boundSecrets
+	params.PreviousPlatformBoundSecrets = previousBoundSecrets
+	if marble.FilesArchive {
+		if err := archiveFiles(params); err != nil {
+			c.zaplogger.Error("Could not archive files.", zap.Error(err))
+			return nil, manifest.Marble{}, err
+		}
+	}
+	if marble.EncryptedParameters != nil {
+		if err := encryptParameters(params, *marble.EncryptedParameters, req.GetCSR()); err != nil {
+			c.zaplogger.Error("Could not encrypt parameters.", zap.Error(err))
+			return nil, manifest.Marble{}, err
+		}
 	}
 
 	// write response
 	resp := &rpc.ActivationResp{
 		Parameters: params,
 	}
-
-	tx, err := c.store.BeginTransaction()
+	if err := setActivationCredentials(resp, authSecrets); err != nil {
+		c.zaplogger.Error("Could not encode Marble credentials.", zap.Error(err))
+		return nil, manifest.Marble{}, err
+	}
+	pkg, err := data.getPackage(marble.Package)
 	if err != nil {
-		return nil, err
+		return nil, manifest.Marble{}, err
 	}
-	defer tx.Rollback()
+	resp.PackageUpdated, resp.SecurityVersion = packagePolicy(mnf.Packages[marble.Package], pkg)
 
-	if err := (storeWrapper{tx}).incrementActivations(req.GetMarbleType()); err != nil {
-		c.zaplogger.Error("Could not increment activations.", zap.Error(err))
-		return nil, err
+	return resp, marble, nil
+}
+
+// packagePolicy reports whether the SecurityVersion enforced for a package differs from the one in the original manifest,
+// i.e., was raised by a manifest update, and returns the enforced SecurityVersion.
+func packagePolicy(original, enforced quote.PackageProperties) (bool, uint64) {
+	var originalVersion, enforcedVersion uint64
+	if original.SecurityVersion != nil {
+		originalVersion = uint64(*original.SecurityVersion)
 	}
-	if err := tx.Commit(); err != nil {
-		return nil, err
+	if enforced.SecurityVersion != nil {
+		enforcedVersion = uint64(*enforced.SecurityVersion)
 	}
+	return originalVersion != enforcedVersion, enforcedVersion
+}
 
-	c.metrics.marbleAPI.activationSuccess.WithLabelValues(req.GetMarbleType(), req.GetUUID()).Inc()
-	c.zaplogger.Info("Successfully activated new Marble", zap.String("MarbleType", req.MarbleType), zap.String("UUID", marbleUUID.String()))
-	return resp, nil
+// marbleUUIDNamespace is the namespace of the UUIDs derived for Marbles from their type and hostname.
+var marbleUUIDNamespace = uuid.MustParse("0d2c5c8e-6f4b-4b8a-9a53-2e7c1f5d9b31")
+
+// getMarbleUUID returns the UUID of the Marble requesting activation.
+// If the request omits the UUID, it is derived from the Marble's type and hostname, provided the manifest permits this for the Marble.
+func (c *Core) getMarbleUUID(data storeWrapper, req *rpc.ActivationReq) (uuid.UUID, error) {
+	if req.GetUUID() != "" {
+		return uuid.Parse(req.GetUUID())
+	}
+
+	marble, err := data.getMarble(req.GetMarbleType())
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	if !marble.DeriveUUID {
+		return uuid.UUID{}, status.Error(codes.InvalidArgument, "activation request does not contain a UUID")
+	}
+	if req.GetHostname() == "" {
+		return uuid.UUID{}, status.Error(codes.InvalidArgument, "activation request contains neither a UUID nor a hostname to derive it from")
+	}
+	return uuid.NewSHA1(marbleUUIDNamespace, []byte(req.GetMarbleType()+"/"+req.GetHostname())), nil
 }
 
 // verifyManifestRequirement verifies marble attempting to register with respect to manifest.
-func (c *Core) verifyManifestRequirement(tlsCert *x509.Certificate, certQuote []byte, marbleType string) error {
-	marble, err := c.data.getMarble(marbleType)
+// It returns the name of the matched infrastructure, if any.
+func (c *Core) verifyManifestRequirement(ctx context.Context, tlsCert *x509.Certificate, certQuote []byte, marbleType string) (string, error) {
+	data := c.data.withContext(ctx)
+
+	marble, err := data.getMarble(marbleType)
 	if err != nil {
 		if store.IsStoreValueUnsetError(err) {
-			return status.Error(codes.InvalidArgument, "unknown marble type requested")
+			return "", status.Error(codes.InvalidArgument, "unknown marble type requested")
 		}
-		return status.Error(codes.Internal, fmt.Sprintf("unable to load marble data: %v", err))
+		return "", status.Error(codes.Internal, fmt.Sprintf("unable to load marble data: %v", err))
 	}
 
-	pkg, err := c.data.getPackage(marble.Package)
+	pkg, err := data.getPackage(marble.Package)
 	if err != nil {
 		if store.IsStoreValueUnsetError(err) {
-			return status.Error(codes.Internal, "undefined package")
+			return "", status.Error(codes.Internal, "undefined package")
 		}
-		return status.Error(codes.Internal, fmt.Sprintf("unable to load package data: %v", err))
+		return "", status.Error(codes.Internal, fmt.Sprintf("unable to load package data: %v", err))
 	}
 
-	infraIter, err := c.data.getIterator(requestInfrastructure)
+	infraIter, err := data.getIterator(requestInfrastructure)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if !c.inSimulationMode() {
+	var infraName string
+	if !c.skipsQuoteValidation(marble) {
+		var matchedInfra quote.InfrastructureProperties
+		// validation errors by infrastructure name, the empty name is used if no infrastructures are defined
+		validationErrs := map[string]error{}
 		if !infraIter.HasNext() {
 			if err := c.qv.Validate(certQuote, tlsCert.Raw, pkg, quote.InfrastructureProperties{}); err != nil {
-				return status.Errorf(codes.Unauthenticated, "invalid quote: %v", err)
+				validationErrs[""] = err
 			}
 		} else {
 			infraMatch := false
 			for infraIter.HasNext() {
-				infraName, err := infraIter.GetNext()
+				name, err := infraIter.GetNext()
 				if err != nil {
-					return err
+					return "", err
 				}
-				infra, err := c.data.getInfrastructure(infraName)
+				infra, err := data.getInfrastructure(name)
 				if err != nil {
-					return err
+					return "", err
 				}
-				if c.qv.Validate(certQuote, tlsCert.Raw, pkg, infra) == nil {
-					infraMatch = true
-					break
+				if err := c.qv.Validate(certQuote, tlsCert.Raw, pkg, infra); err != nil {
+					validationErrs[name] = err
+					continue
 				}
+				infraName = name
+				matchedInfra = infra
+				infraMatch = true
+				break
+			}
+			if infraMatch {
+				validationErrs = nil
 			}
-			if !infraMatch {
-				return status.Error(codes.Unauthenticated, "invalid quote")
+		}
+		if len(validationErrs) > 0 {
+			c.zaplogger.Warn("Quote validation failed.", zap.String("MarbleType", marbleType), zap.String("diagnostic", quoteDiagnostic(validationErrs, true)))
+			// detailed errors may help an attacker to forge a quote, so they are only returned for development setups
+			verbose := c.inSimulationMode() || pkg.Debug
+			return "", status.Error(codes.Unauthenticated, "invalid quote: "+quoteDiagnostic(validationErrs, verbose))
+		}
+
+		// reject quotes of blocked enclave builds, regardless of the package's own requirements
+		blocklist, err := data.getBlocklist(marble.Package)
+		if err != nil && !store.IsStoreValueUnsetError(err) {
+			return infraName, status.Error(codes.Internal, fmt.Sprintf("unable to load package blocklist: %v", err))
+		}
+		if c.isBlocked(certQuote, tlsCert.Raw, blocklist, matchedInfra) {
+			return infraName, status.Error(codes.Unauthenticated, "quote matches a blocked package entry")
+		}
+	}
+
+	// check activation schedule
+	if marble.ActivationSchedule != nil {
+		allowed, err := marble.ActivationSchedule.Allows(time.Now())
+		if err != nil {
+			return infraName, status.Error(codes.Internal, fmt.Sprintf("invalid activation schedule: %v", err))
+		}
+		if !allowed {
+			return infraName, status.Error(codes.FailedPrecondition, "marble type can not be activated outside of its activation schedule")
+		}
+	}
+
+	// the activation budget is checked when the activation is counted
+	return infraName, nil
+}
+
+// isBlocked returns true if the quote matches an entry of the blocklist, regardless of the entry's Debug flag.
+func (c *Core) isBlocked(certQuote []byte, cert []byte, blocklist []quote.PackageProperties, infra quote.InfrastructureProperties) bool {
+	for _, blocked := range blocklist {
+		for _, debug := range []bool{false, true} {
+			blocked.Debug = debug
+			if c.qv.Validate(certQuote, cert, blocked, infra) == nil {
+				return true
 			}
 		}
 	}
+	return false
+}
 
-	// check activation budget (MaxActivations == 0 means infinite budget)
-	activations, err := c.data.getActivations(marbleType)
-	if store.IsStoreValueUnsetError(err) {
-		activations = 0
-	} else if err != nil {
-		return status.Error(codes.Internal, "could not retrieve activations for marble type")
+// quoteDiagnostic summarizes the errors of a failed quote validation by infrastructure name.
+// Unless verbose is set, it only names the kind of each failure and the mismatching package properties, but no values.
+func quoteDiagnostic(validationErrs map[string]error, verbose bool) string {
+	names := make([]string, 0, len(validationErrs))
+	for name := range validationErrs {
+		names = append(names, name)
 	}
-	if marble.MaxActivations > 0 && activations >= marble.MaxActivations {
-		return status.Error(codes.ResourceExhausted, "reached max activations count for marble type")
+	sort.Strings(names)
+
+	diagnostics := make([]string, 0, len(names))
+	for _, name := range names {
+		err := validationErrs[name]
+		var diagnostic string
+		var mismatchErr *quote.PackageMismatchError
+		switch {
+		case verbose:
+			diagnostic = err.Error()
+		case errors.As(err, &mismatchErr):
+			diagnostic = "package properties do not match: " + strings.Join(mismatchErr.Fields, ", ")
+		case errors.Is(err, quote.ErrMessageMismatch):
+			diagnostic = "quote was not issued for the Marble's TLS certificate"
+		case errors.Is(err, quote.ErrInfrastructureMismatch):
+			diagnostic = "infrastructure properties do not match"
+		default:
+			diagnostic = "quote verification failed"
+		}
+		if name != "" {
+			diagnostic = fmt.Sprintf("infrastructure %s: %s", name, diagnostic)
+		}
+		diagnostics = append(diagnostics, diagnostic)
 	}
-	return nil
+	return strings.Join(diagnostics, "; ")
 }
 
-// generateCertFromCSR signs the CSR from marble attempting to register.
-func (c *Core) generateCertFromCSR(csrReq []byte, pubk ecdsa.PublicKey, marbleType string, marbleUUID string) ([]byte, error) {
+// generateCertFromCSR signs the CSR from marble attempting to register and records the certificate in the issuance log of data.
+func (c *Core) generateCertFromCSR(data storeWrapper, csrReq []byte, pubk ecdsa.PublicKey, marbleType string, marbleUUID string) ([]byte, error) {
 	// parse and verify CSR
 	csr, err := x509.ParseCertificateRequest(csrReq)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "failed to parse CSR")
 	}
+	if sans := len(csr.DNSNames) + len(csr.IPAddresses) + len(csr.URIs); sans > c.maxCSRSANs {
+		return nil, status.Errorf(codes.InvalidArgument, "CSR contains %d subject alternative names, exceeding the maximum of %d", sans, c.maxCSRSANs)
+	}
 	if csr.CheckSignature() != nil {
 		return nil, status.Error(codes.InvalidArgument, "signature over CSR is invalid")
 	}
 
-	serialNumber, err := util.GenerateCertificateSerialNumber()
+	keyUsage, extKeyUsage, err := util.KeyUsageFromCSR(csr)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	marble, err := data.getMarble(marbleType)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "failed to generate serial")
+		return nil, err
+	}
+	if missing := missingDNSNames(csr.DNSNames, marble.RequiredDNSNames); len(missing) > 0 {
+		if marble.MergeRequiredDNSNames {
+			// RequiredDNSNames may differ only in case, so check each name against the merged list
+			for _, name := range missing {
+				if len(missingDNSNames(csr.DNSNames, []string{name})) > 0 {
+					csr.DNSNames = append(csr.DNSNames, name)
+				}
+			}
+		} else {
+			return nil, status.Errorf(codes.InvalidArgument, "CSR misses required DNS names: %s", strings.Join(missing, ", "))
+		}
 	}
 
-	marbleRootCert, err := c.data.getCertificate(sKMarbleRootCert)
+	marbleRootCert, err := data.getCertificate(sKMarbleRootCert)
 	if err != nil {
 		return nil, err
 	}
-	intermediatePrivK, err := c.data.getPrivK(sKCoordinatorIntermediateKey)
+	intermediatePrivK, err := c.getIntermediatePrivK(data)
 	if err != nil {
 		return nil, err
 	}
 
 	// create certificate
+	// CommonName and Organization are always set, even if the CSR has an empty subject
 	csr.Subject.CommonName = marbleUUID
 	csr.Subject.Organization = marbleRootCert.Issuer.Organization
-	notBefore := time.Now()
-	// TODO: produce shorter lived certificates
-	notAfter := notBefore.Add(math.MaxInt64)
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject:      csr.Subject,
-		NotBefore:    notBefore,
-		NotAfter:     notAfter,
-
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-		BasicConstraintsValid: true,
-		IsCA:                  false,
-		DNSNames:              csr.DNSNames,
-		IPAddresses:           csr.IPAddresses,
+	if len(csr.Subject.Organization) == 0 {
+		csr.Subject.Organization = []string{marbleOrganization}
 	}
-
-	certRaw, err := x509.CreateCertificate(rand.Reader, &template, marbleRootCert, &pubk, intermediatePrivK)
+	policies, err := marble.PolicyIdentifiers()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	allowedExtensions, err := marble.CSRExtensionIdentifiers()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	extensions, err := csrExtensions(csr, allowedExtensions)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	signatureAlgorithm, err := marble.CertificateSignatureAlgorithm()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	notAfter := time.Now().Add(marbleCertValidity)
+	certRaw, err := util.CreateCertificateFromCSR(csr, &pubk, keyUsage, extKeyUsage, policies, extensions, signatureAlgorithm, time.Now().Add(-c.certClockSkew), notAfter, marbleRootCert, intermediatePrivK)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "failed to issue certificate")
 	}
+	c.metrics.marbleAPI.certExpiry.update(marbleType, notAfter)
+
+	if err := data.recordIssuedCertificate(certRaw, marbleType, ""); err != nil {
+		c.zaplogger.Error("Could not record issued certificate.", zap.Error(err))
+		return nil, status.Error(codes.Internal, "failed to record issued certificate")
+	}
 
 	return certRaw, nil
 }
 
+// activationStateError converts an error of requireState to the status returned to Marbles.
+// While the Coordinator shuts down, Unavailable is returned, so Marbles retry their activation.
+func activationStateError(err error) error {
+	if errors.Is(err, errDraining) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.FailedPrecondition, "cannot accept marbles in current state")
+}
+
+// getIntermediatePrivK returns the private key of the Coordinator's intermediate CA, which signs Marble certificates.
+// The key can be briefly unavailable, e.g., while the store is resealed or recovered.
+// In that case, a FailedPrecondition error is returned, so the Marble can retry its activation.
+func (c *Core) getIntermediatePrivK(data storeWrapper) (*ecdsa.PrivateKey, error) {
+	intermediatePrivK, err := data.getPrivK(sKCoordinatorIntermediateKey)
+	if err == nil {
+		return intermediatePrivK, nil
+	}
+	// aborted requests keep their error, so they are not reported as retryable
+	if data.context().Err() != nil {
+		return nil, err
+	}
+	c.zaplogger.Warn("Could not retrieve intermediate private key.", zap.Error(err))
+	return nil, status.Error(codes.FailedPrecondition, "the Coordinator's intermediate key is currently unavailable, retry the activation later")
+}
+
+// csrExtensions returns the extensions of the CSR which are allowed to be copied to the certificate.
+// Allowed extensions must not be critical, as clients failing to understand them would reject the certificate.
+func csrExtensions(csr *x509.CertificateRequest, allowed []asn1.ObjectIdentifier) ([]pkix.Extension, error) {
+	var extensions []pkix.Extension
+	for _, extension := range csr.Extensions {
+		for _, oid := range allowed {
+			if !extension.Id.Equal(oid) {
+				continue
+			}
+			if extension.Critical {
+				return nil, fmt.Errorf("CSR extension %s must not be critical", extension.Id)
+			}
+			extensions = append(extensions, extension)
+		}
+	}
+	return extensions, nil
+}
+
+// missingDNSNames returns the required DNS names which are not contained in dnsNames.
+// DNS names are compared case-insensitively.
+func missingDNSNames(dnsNames, required []string) []string {
+	var missing []string
+	for _, requiredName := range required {
+		found := false
+		for _, name := range dnsNames {
+			if strings.EqualFold(name, requiredName) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, requiredName)
+		}
+	}
+	return missing
+}
+
 // customizeParameters replaces the placeholders in the manifest's parameters with the actual values.
-func customizeParameters(params manifest.Parameters, specialSecrets reservedSecrets, userSecrets map[string]manifest.Secret) (*rpc.Parameters, error) {
+// If maxSize is positive, the total size of the rendered Files and Env must not exceed it.
+func customizeParameters(params manifest.Parameters, specialSecrets reservedSecrets, userSecrets map[string]manifest.Secret, coordinatorEnv []string, coordinatorFiles map[string]string, maxSize int) (*rpc.Parameters, error) {
+	fileFuncMap := manifest.TemplateFuncMapWithCoordinatorFiles(manifest.TemplateFuncMapWithCoordinatorEnv(manifest.ManifestFileTemplateFuncMap, coordinatorEnv), coordinatorFiles)
+	envFuncMap := manifest.TemplateFuncMapWithCoordinatorFiles(manifest.TemplateFuncMapWithCoordinatorEnv(manifest.ManifestEnvTemplateFuncMap, coordinatorEnv), coordinatorFiles)
+	return customizeParametersWithFuncs(params, specialSecrets, userSecrets, fileFuncMap, envFuncMap, maxSize)
+}
+
+// customizeParametersWithFuncs is like customizeParameters, but executes the templates with the given functions.
+func customizeParametersWithFuncs(params manifest.Parameters, specialSecrets reservedSecrets, userSecrets map[string]manifest.Secret, fileFuncMap, envFuncMap template.FuncMap, maxSize int) (*rpc.Parameters, error) {
 	customParams := rpc.Parameters{
-		Argv:  params.Argv,
 		Files: make(map[string][]byte),
 		Env:   make(map[string][]byte),
 	}
@@ -281,33 +850,68 @@ func customizeParameters(params manifest.Parameters, specialSecrets reservedSecr
 	var err error
 	var newValue string
 
+	// files and env variables are rendered in a fixed order, so the same entry exceeds the size limit each time
+	var totalSize int
+	checkSize := func(entry string) error {
+		totalSize += len(newValue)
+		if maxSize > 0 && totalSize > maxSize {
+			return status.Errorf(codes.ResourceExhausted, "%s exceeds the maximum total size of %d bytes for the Marble's parameters", entry, maxSize)
+		}
+		return nil
+	}
+
 	// replace placeholders in files
-	for path, data := range params.Files {
-		if data.NoTemplates {
-			newValue = data.Data
-		} else {
-			newValue, err = parseSecrets(data.Data, manifest.ManifestFileTemplateFuncMap, secretsWrapped)
-			if err != nil {
-				return nil, err
-			}
+	for _, path := range sortedKeys(params.Files) {
+		data := params.Files[path]
+		switch {
+		case data.Secret != "":
+			// only the secret's name is part of the template, its binary value is copied verbatim
+			newValue, err = parseSecrets(data.SecretTemplate(), fileFuncMap, secretsWrapped)
+		case data.NoTemplates:
+			newValue, err = data.Data, nil
+		default:
+			newValue, err = parseSecrets(data.Data, fileFuncMap, secretsWrapped)
+		}
+		if err != nil {
+			return nil, err
 		}
 
+		if err := checkSize("file " + path); err != nil {
+			return nil, err
+		}
 		customParams.Files[path] = []byte(newValue)
 	}
 
-	for name, data := range params.Env {
-		if data.NoTemplates {
-			newValue = data.Data
-		} else {
-			newValue, err = parseSecrets(data.Data, manifest.ManifestEnvTemplateFuncMap, secretsWrapped)
-			if err != nil {
-				return nil, err
-			}
+	for _, name := range sortedKeys(params.Env) {
+		data := params.Env[name]
+		switch {
+		case data.Secret != "":
+			// only the secret's name is part of the template, its binary value is copied verbatim
+			newValue, err = parseSecrets(data.SecretTemplate(), envFuncMap, secretsWrapped)
+		case data.NoTemplates:
+			newValue, err = data.Data, nil
+		default:
+			newValue, err = parseSecrets(data.Data, envFuncMap, secretsWrapped)
+		}
+		if err != nil {
+			return nil, err
 		}
 
+		if err := checkSize("env variable " + name); err != nil {
+			return nil, err
+		}
 		customParams.Env[name] = []byte(newValue)
 	}
 
+	// replace placeholders in command line arguments, keeping their order
+	for _, arg := range params.Argv {
+		newValue, err = parseSecrets(arg, envFuncMap, secretsWrapped)
+		if err != nil {
+			return nil, err
+		}
+		customParams.Argv = append(customParams.Argv, newValue)
+	}
+
 	// Set as environment variables
 	rootCaPem, err := manifest.EncodeSecretDataToPem(specialSecrets.RootCA.Cert)
 	if err != nil {
@@ -329,6 +933,137 @@ func customizeParameters(params manifest.Parameters, specialSecrets reservedSecr
 	return &customParams, nil
 }
 
+// setLogLevel passes the LogLevel of a Marble in its environment, if it is set.
+func setLogLevel(params *rpc.Parameters, logLevel string) {
+	if logLevel != "" {
+		params.Env[manifest.MarbleEnvironmentLogLevel] = []byte(logLevel)
+	}
+}
+
+// omitReservedEnv removes the named reserved environment variables from params.
+func omitReservedEnv(params *rpc.Parameters, names []string) {
+	for _, name := range names {
+		delete(params.Env, name)
+	}
+}
+
+// filesArchiveMode is the mode of the files in the archive created by archiveFiles.
+// It matches the mode the premain writes separate Files with.
+const filesArchiveMode = 0o600
+
+// archiveFiles packs the Files of params into a tar archive, which is passed base64-encoded in the MARBLE_FILES_ARCHIVE environment variable.
+// The Files are removed from params, so the premain can extract them at once.
+func archiveFiles(params *rpc.Parameters) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	paths := make([]string, 0, len(params.Files))
+	for path := range params.Files {
+		paths = append(paths, path)
+	}
+	// a fixed order makes the archive reproducible
+	sort.Strings(paths)
+	for _, path := range paths {
+		data := params.Files[path]
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path,
+			Mode:     filesArchiveMode,
+			Size:     int64(len(data)),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("archiving file %s: %w", path, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("archiving file %s: %w", path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	params.Env[util.MarbleEnvironmentFilesArchive] = []byte(base64.StdEncoding.EncodeToString(buf.Bytes()))
+	params.Files = make(map[string][]byte)
+	return nil
+}
+
+// encryptParameters encrypts the named Files and Env of params to the public key of the Marble's CSR.
+// A fresh ephemeral key is used for each activation. Names which are not part of params are skipped.
+func encryptParameters(params *rpc.Parameters, encrypted manifest.EncryptedParameters, rawCSR []byte) error {
+	csr, err := x509.ParseCertificateRequest(rawCSR)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "failed to parse CSR")
+	}
+	marblePubKey, ok := csr.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return status.Error(codes.InvalidArgument, "encrypted parameters require an ECDSA key in the CSR")
+	}
+	ephemeralKey, err := ecdsa.GenerateKey(marblePubKey.Curve, rand.Reader)
+	if err != nil {
+		return err
+	}
+	key, err := util.DeriveParametersKey(ephemeralKey, marblePubKey)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	encrypt := func(paramType string, values map[string][]byte, names []string) ([]string, error) {
+		var encryptedNames []string
+		for _, name := range names {
+			value, ok := values[name]
+			if !ok {
+				continue
+			}
+			ciphertext, err := ecrypto.Encrypt(value, key, util.ParametersAdditionalData(paramType, name))
+			if err != nil {
+				return nil, err
+			}
+			values[name] = ciphertext
+			encryptedNames = append(encryptedNames, name)
+		}
+		return encryptedNames, nil
+	}
+	if params.EncryptedFiles, err = encrypt("Files", params.Files, encrypted.Files); err != nil {
+		return err
+	}
+	if params.EncryptedEnv, err = encrypt("Env", params.Env, encrypted.Env); err != nil {
+		return err
+	}
+	params.EncryptionKey = elliptic.Marshal(marblePubKey.Curve, ephemeralKey.X, ephemeralKey.Y)
+	return nil
+}
+
+// sortedKeys returns the names of Files or Env variables in sorted order.
+func sortedKeys(files map[string]manifest.File) []string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setActivationCredentials sets the PEM-encoded Marble certificate, its private key and the CA chain of an activation response,
+// so clients do not need to extract them from the environment variables of the Marble's parameters.
+func setActivationCredentials(resp *rpc.ActivationResp, specialSecrets reservedSecrets) error {
+	rootCaPem, err := manifest.EncodeSecretDataToPem(specialSecrets.RootCA.Cert)
+	if err != nil {
+		return err
+	}
+	marbleCertPem, err := manifest.EncodeSecretDataToPem(specialSecrets.MarbleCert.Cert)
+	if err != nil {
+		return err
+	}
+	encodedPrivKey, err := manifest.EncodeSecretDataToPem(specialSecrets.MarbleCert.Private)
+	if err != nil {
+		return err
+	}
+
+	resp.Certificate = []byte(marbleCertPem)
+	resp.PrivateKey = []byte(encodedPrivKey)
+	resp.CAChain = []byte(rootCaPem)
+	return nil
+}
+
 func parseSecrets(data string, tplFunc template.FuncMap, secretsWrapped secretsWrapper) (string, error) {
 	var templateResult bytes.Buffer
 
@@ -344,7 +1079,7 @@ func parseSecrets(data string, tplFunc template.FuncMap, secretsWrapped secretsW
 	return templateResult.String(), nil
 }
 
-func (c *Core) generateMarbleAuthSecrets(req *rpc.ActivationReq, marbleUUID uuid.UUID) (reservedSecrets, error) {
+func (c *Core) generateMarbleAuthSecrets(data storeWrapper, req *rpc.ActivationReq, marbleUUID uuid.UUID) (reservedSecrets, error) {
 	// generate key-pair for marble
 	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -360,7 +1095,7 @@ func (c *Core) generateMarbleAuthSecrets(req *rpc.ActivationReq, marbleUUID uuid
 	}
 
 	// Generate Marble certificate
-	certRaw, err := c.generateCertFromCSR(req.GetCSR(), privk.PublicKey, req.GetMarbleType(), marbleUUID.String())
+	certRaw, err := c.generateCertFromCSR(data, req.GetCSR(), privk.PublicKey, req.GetMarbleType(), marbleUUID.String())
 	if err != nil {
 		return reservedSecrets{}, err
 	}
@@ -370,7 +1105,7 @@ func (c *Core) generateMarbleAuthSecrets(req *rpc.ActivationReq, marbleUUID uuid
 		return reservedSecrets{}, err
 	}
 
-	marbleRootCert, err := c.data.getCertificate(sKMarbleRootCert)
+	marbleRootCert, err := data.getCertificate(sKMarbleRootCert)
 	if err != nil {
 		return reservedSecrets{}, err
 	}
@@ -378,14 +1113,31 @@ func (c *Core) generateMarbleAuthSecrets(req *rpc.ActivationReq, marbleUUID uuid
 	authSecrets := reservedSecrets{
 		RootCA:     manifest.Secret{Cert: manifest.Certificate(*marbleRootCert)},
 		MarbleCert: manifest.Secret{Cert: manifest.Certificate(*marbleCert), Public: encodedPubKey, Private: encodedPrivKey},
+		UUID:       marbleUUID.String(),
 	}
 
 	return authSecrets, nil
 }
 
-func (c *Core) setTTLSConfig(marble manifest.Marble, specialSecrets reservedSecrets, userSecrets map[string]manifest.Secret) error {
+func (c *Core) setTTLSConfig(data storeWrapper, marble manifest.Marble, specialSecrets reservedSecrets, userSecrets map[string]manifest.Secret, lenient bool) ([]string, error) {
+	ttlsConfJSON, skipped, err := c.renderTTLSConfig(data, marble, specialSecrets, userSecrets, lenient)
+	if err != nil || ttlsConfJSON == nil {
+		return nil, err
+	}
+	if marble.Parameters.Env == nil {
+		marble.Parameters.Env = make(map[string]manifest.File)
+	}
+	marble.Parameters.Env["MARBLE_TTLS_CONFIG"] = manifest.File{Data: string(ttlsConfJSON), Encoding: "string"}
+
+	return skipped, nil
+}
+
+// renderTTLSConfig returns the TTLS config of a Marble as JSON, or nil if the Marble has no TLS tags.
+// In lenient mode, it additionally returns the incoming entries whose certificate can not be resolved.
+// They present the Marble's certificate and require client authentication instead.
+func (c *Core) renderTTLSConfig(data storeWrapper, marble manifest.Marble, specialSecrets reservedSecrets, userSecrets map[string]manifest.Secret, lenient bool) ([]byte, []string, error) {
 	if len(marble.TLS) == 0 {
-		return nil
+		return nil, nil, nil
 	}
 
 	ttlsConf := make(map[string]map[string]map[string]map[string]interface{})
@@ -393,9 +1145,9 @@ func (c *Core) setTTLSConfig(marble manifest.Marble, specialSecrets reservedSecr
 	ttlsConf["tls"]["Incoming"] = make(map[string]map[string]interface{})
 	ttlsConf["tls"]["Outgoing"] = make(map[string]map[string]interface{})
 
-	marbleRootCert, err := c.data.getCertificate(sKMarbleRootCert)
+	marbleRootCert, err := data.getCertificate(sKMarbleRootCert)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	pemCaCert := pem.Block{Type: "CERTIFICATE", Bytes: marbleRootCert.Raw}
@@ -407,10 +1159,15 @@ func (c *Core) setTTLSConfig(marble manifest.Marble, specialSecrets reservedSecr
 	pemClientKey := pem.Block{Type: "PRIVATE KEY", Bytes: specialSecrets.MarbleCert.Private}
 	stringClientKey := string(pem.EncodeToMemory(&pemClientKey))
 
+	// In lenient mode, incoming entries whose certificate can not be resolved fall back to the Marble's certificate
+	// and require client authentication instead of failing the activation. They are never served without TLS.
+	var skipped []string
+
 	for _, tagName := range marble.TLS {
-		tag, err := c.data.getTLS(tagName)
+		// the incoming entries of a tag which can not be resolved are unknown, so the activation fails even in lenient mode
+		tag, err := data.getTLS(tagName)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		for _, entry := range tag.Outgoing {
 			connConf := make(map[string]interface{})
@@ -418,17 +1175,26 @@ func (c *Core) setTTLSConfig(marble manifest.Marble, specialSecrets reservedSecr
 			connConf["clicrt"] = stringClientCert
 			connConf["clikey"] = stringClientKey
 
-			ttlsConf["tls"]["Outgoing"][entry.Addr+":"+entry.Port] = connConf
+			ttlsConf["tls"]["Outgoing"][ttlsAddress(entry.Addr, entry.Port)] = connConf
 		}
 		for _, entry := range tag.Incoming {
 			connConf := make(map[string]interface{})
 
 			// use user-defined values if present
-			if entry.Cert != "" {
-				pemUserClientCert := pem.Block{Type: "CERTIFICATE", Bytes: userSecrets[entry.Cert].Cert.Raw}
+			userSecret, ok := userSecrets[entry.Cert]
+			resolved := ok && len(userSecret.Cert.Raw) > 0 && len(userSecret.Private) > 0
+			if entry.Cert != "" && !resolved {
+				if !lenient {
+					return nil, nil, fmt.Errorf("TLS tag %s: incoming entry for port %s references unset secret %s", tagName, entry.Port, entry.Cert)
+				}
+				skipped = append(skipped, tagName+".Incoming.*:"+entry.Port)
+			}
+			if entry.Cert != "" && resolved {
+
+				pemUserClientCert := pem.Block{Type: "CERTIFICATE", Bytes: userSecret.Cert.Raw}
 				stringUserClientCert := string(pem.EncodeToMemory(&pemUserClientCert))
 
-				pemUserClientKey := pem.Block{Type: "PRIVATE KEY", Bytes: userSecrets[entry.Cert].Private}
+				pemUserClientKey := pem.Block{Type: "PRIVATE KEY", Bytes: userSecret.Private}
 				stringUserClientKey := string(pem.EncodeToMemory(&pemUserClientKey))
 
 				connConf["clicrt"] = stringUserClientCert
@@ -442,18 +1208,19 @@ func (c *Core) setTTLSConfig(marble manifest.Marble, specialSecrets reservedSecr
 				connConf["clientAuth"] = true
 			}
 
-			ttlsConf["tls"]["Incoming"]["*:"+entry.Port] = connConf
+			ttlsConf["tls"]["Incoming"][ttlsAddress("*", entry.Port)] = connConf
 		}
 	}
 
 	ttlsConfJSON, err := json.Marshal(ttlsConf)
 	if err != nil {
-		return err
-	}
-	if marble.Parameters.Env == nil {
-		marble.Parameters.Env = make(map[string]manifest.File)
+		return nil, nil, err
 	}
-	marble.Parameters.Env["MARBLE_TTLS_CONFIG"] = manifest.File{Data: string(ttlsConfJSON), Encoding: "string"}
+	return ttlsConfJSON, skipped, nil
+}
 
-	return nil
+// ttlsAddress composes the key of a connection in the TTLS config.
+// IPv6 addresses are enclosed in brackets, e.g., [::1]:443, matching the format Go uses for dialed addresses.
+func ttlsAddress(host, port string) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
 }
@@ -7,32 +7,54 @@
 package core
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
 	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/edgelesssys/ego/ecrypto"
 	libMarble "github.com/edgelesssys/ego/marble"
 	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
 	"github.com/edgelesssys/marblerun/coordinator/recovery"
 	"github.com/edgelesssys/marblerun/coordinator/rpc"
 	"github.com/edgelesssys/marblerun/coordinator/seal"
+	"github.com/edgelesssys/marblerun/coordinator/store"
+	"github.com/edgelesssys/marblerun/coordinator/webhook"
 	"github.com/edgelesssys/marblerun/test"
 	"github.com/edgelesssys/marblerun/util"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 func TestActivate(t *testing.T) {
@@ -179,6 +201,20 @@ func (ms *marbleSpawner) newMarble(marbleType string, infraName string, shouldSu
 	ms.assert.NotNil(pMarbleRoot)
 	ms.assert.Empty(rest)
 
+	// Validate explicit credentials of the response
+	ms.assert.Equal(params.Env[libMarble.MarbleEnvironmentPrivateKey], resp.GetPrivateKey())
+	ms.assert.Equal(pem.EncodeToMemory(pLeaf), resp.GetCertificate())
+	ms.assert.Equal(params.Env[libMarble.MarbleEnvironmentRootCA], resp.GetCAChain())
+
+	// Validate the reported package policy
+	enforcedPkg, err := ms.coreServer.data.getPackage(marble.Package)
+	ms.assert.NoError(err)
+	if enforcedPkg.SecurityVersion != nil {
+		ms.assert.EqualValues(*enforcedPkg.SecurityVersion, resp.GetSecurityVersion())
+	} else {
+		ms.assert.Zero(resp.GetSecurityVersion())
+	}
+
 	newMarbleRootCert, err := x509.ParseCertificate(pMarbleRoot.Bytes)
 	ms.assert.NoError(err)
 	newLeafCert, err := x509.ParseCertificate(pLeaf.Bytes)
@@ -226,6 +262,7 @@ func (ms *marbleSpawner) newMarble(marbleType string, infraName string, shouldSu
 	}
 	_, err = newLeafCert.Verify(opts)
 	ms.assert.NoError(err, "failed to verify new certificate: %v", err)
+	ms.assert.WithinDuration(time.Now().Add(marbleCertValidity), newLeafCert.NotAfter, time.Minute)
 
 	// Shared & non-shared secret checks
 	if marbleType == "backendFirst" {
@@ -312,6 +349,58 @@ func (ms *marbleSpawner) verifyCertificateFromEnvironment(envName string, params
 	return *certificate
 }
 
+type fakeNotifier struct {
+	mux    sync.Mutex
+	events []webhook.ActivationEvent
+}
+
+func (f *fakeNotifier) Notify(event webhook.ActivationEvent) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.events = append(f.events, event)
+}
+
+func TestActivationWebhook(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	coreServer, err := NewCore([]string{"localhost"}, validator, issuer, &seal.MockSealer{}, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	notifier := &fakeNotifier{}
+	coreServer.SetActivationWebhook(notifier)
+
+	spawner := marbleSpawner{
+		assert:     assert,
+		require:    require,
+		issuer:     issuer,
+		validator:  validator,
+		manifest:   manifest,
+		coreServer: coreServer,
+	}
+	_, err = coreServer.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	uuidSuccess := spawner.newMarble("backendFirst", "Azure", true)
+	uuidFailure := spawner.newMarble("backendFirst", "Azure", false)
+
+	require.Len(notifier.events, 2)
+	assert.True(notifier.events[0].Success)
+	assert.Equal("backendFirst", notifier.events[0].MarbleType)
+	assert.Equal(uuidSuccess, notifier.events[0].UUID)
+	assert.Equal("Azure", notifier.events[0].Infrastructure)
+	assert.Empty(notifier.events[0].Error)
+	assert.False(notifier.events[0].Timestamp.IsZero())
+
+	assert.False(notifier.events[1].Success)
+	assert.Equal(uuidFailure, notifier.events[1].UUID)
+	assert.NotEmpty(notifier.events[1].Error)
+}
+
 func TestParseSecrets(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -348,11 +437,13 @@ func TestParseSecrets(t *testing.T) {
 		"anothercoolsecret": {Type: "symmetric-key", Size: 8, Public: []byte{7, 6, 5, 4, 3, 2, 1, 0}, Private: []byte{7, 6, 5, 4, 3, 2, 1, 0}},
 		"testcertificate":   {Type: "cert-rsa", Size: 2048, Cert: manifest.Certificate(*testCert), Public: pubKey, Private: privKey},
 		"emptysecret":       {},
+		"hmackey":           {Type: "hmac", Size: 32, Algorithm: "sha384", Public: []byte{1, 2, 3, 4}, Private: []byte{1, 2, 3, 4}},
 	}
 
 	testReservedSecrets := reservedSecrets{
 		RootCA:     manifest.Secret{Public: []byte{0, 0, 42}, Private: []byte{0, 0, 7}},
 		MarbleCert: manifest.Secret{Public: []byte{42, 0, 0}, Private: []byte{7, 0, 0}},
+		Tags:       map[string]string{"team": "payments"},
 	}
 
 	testWrappedSecrets := secretsWrapper{
@@ -360,8 +451,13 @@ func TestParseSecrets(t *testing.T) {
 		Secrets:   testSecrets,
 	}
 
+	// Tags are available in the templating context
+	parsedSecret, err := parseSecrets("{{ .MarbleRun.Tags.team }}", manifest.ManifestEnvTemplateFuncMap, testWrappedSecrets)
+	require.NoError(err)
+	assert.Equal("payments", parsedSecret)
+
 	// Test all formats, pem should fail for raw/symmetric secrets
-	parsedSecret, err := parseSecrets("{{ raw .Secrets.mysecret }}", manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
+	parsedSecret, err = parseSecrets("{{ raw .Secrets.mysecret }}", manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
 	require.NoError(err)
 	assert.EqualValues(testSecrets["mysecret"].Public, []byte(parsedSecret))
 
@@ -376,6 +472,29 @@ func TestParseSecrets(t *testing.T) {
 	require.NoError(err)
 	assert.EqualValues("AAECAwQFBgcICQoLDA0ODw==", parsedSecret)
 
+	parsedSecret, err = parseSecrets("{{ hexColon .Secrets.anothercoolsecret }}", manifest.ManifestEnvTemplateFuncMap, testWrappedSecrets)
+	require.NoError(err)
+	assert.EqualValues("07:06:05:04:03:02:01:00", parsedSecret)
+
+	// hmac keys are available together with their algorithm
+	parsedSecret, err = parseSecrets("{{ .Secrets.hmackey.Algorithm }}:{{ hex .Secrets.hmackey }}", manifest.ManifestEnvTemplateFuncMap, testWrappedSecrets)
+	require.NoError(err)
+	assert.Equal("sha384:01020304", parsedSecret)
+
+	// Secrets can be composed into a dotenv file
+	parsedSecret, err = parseSecrets(`{{ dotenv "KEY" (hex .Secrets.mysecret) "CERT" (pem .Secrets.testcertificate.Cert) }}`, manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
+	require.NoError(err)
+	lines := strings.Split(strings.TrimSuffix(parsedSecret, "\n"), "\n")
+	require.Len(lines, 2)
+	assert.Equal(`KEY="000102030405060708090a0b0c0d0e0f"`, lines[0])
+	assert.True(strings.HasPrefix(lines[1], `CERT="-----BEGIN CERTIFICATE-----\n`))
+	assert.True(strings.HasSuffix(lines[1], `-----END CERTIFICATE-----\n"`))
+
+	_, err = parseSecrets(`{{ dotenv "KEY" }}`, manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
+	assert.Error(err)
+	_, err = parseSecrets(`{{ dotenv "1KEY" (hex .Secrets.mysecret) }}`, manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
+	assert.Error(err)
+
 	// Check if we can decode a certificate from PEM
 	parsedSecret, err = parseSecrets("{{ pem .Secrets.testcertificate.Cert }}", manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
 	require.NoError(err)
@@ -387,6 +506,37 @@ func TestParseSecrets(t *testing.T) {
 	require.NoError(err)
 	assert.EqualValues(testCert, parsedCertificate)
 
+	// Check if we can bundle a certificate, its key, and a CA in the requested order
+	parsedSecret, err = parseSecrets(`{{ bundle "cert, key, ca" .Secrets.testcertificate.Cert .Secrets.testcertificate.Private .Secrets.testcertificate.Cert }}`, manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
+	require.NoError(err)
+	var blockTypes []string
+	for rest := []byte(parsedSecret); ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			assert.Empty(rest)
+			break
+		}
+		blockTypes = append(blockTypes, block.Type)
+	}
+	assert.Equal([]string{"CERTIFICATE", "PRIVATE KEY", "CERTIFICATE"}, blockTypes)
+
+	parsedSecret, err = parseSecrets(`{{ bundle "key,cert" .Secrets.testcertificate.Cert .Secrets.testcertificate.Private nil }}`, manifest.ManifestEnvTemplateFuncMap, testWrappedSecrets)
+	require.NoError(err)
+	p, _ = pem.Decode([]byte(parsedSecret))
+	require.NotNil(p)
+	assert.Equal("PRIVATE KEY", p.Type)
+	assert.Contains(parsedSecret, "-----END PRIVATE KEY-----\n-----BEGIN CERTIFICATE-----\n")
+
+	_, err = parseSecrets(`{{ bundle "cert,key,cert" .Secrets.testcertificate.Cert .Secrets.testcertificate.Private nil }}`, manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
+	assert.Error(err)
+	_, err = parseSecrets(`{{ bundle "cert,chain" .Secrets.testcertificate.Cert .Secrets.testcertificate.Private nil }}`, manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
+	assert.Error(err)
+	_, err = parseSecrets(`{{ bundle "cert,ca" .Secrets.testcertificate.Cert .Secrets.testcertificate.Private nil }}`, manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
+	assert.Error(err)
+	_, err = parseSecrets(`{{ bundle "cert" .Secrets.mysecret nil nil }}`, manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
+	assert.Error(err)
+
 	// Check if we can parse a certificate from the outputted raw type
 	parsedSecret, err = parseSecrets("{{ raw .Secrets.testcertificate.Cert }}", manifest.ManifestFileTemplateFuncMap, testWrappedSecrets)
 	require.NoError(err)
@@ -443,150 +593,1925 @@ func TestParseSecrets(t *testing.T) {
 	assert.Error(err)
 }
 
-func TestSecurityLevelUpdate(t *testing.T) {
+func TestCustomizeParametersArgv(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
-	// parse manifest
-	var manifest manifest.Manifest
-	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &manifest))
+	marbleCert, _, privKey := util.MustGenerateTestMarbleCredentials()
+	encodedPrivKey, err := x509.MarshalPKCS8PrivateKey(privKey)
+	require.NoError(err)
+	marbleUUID := uuid.New().String()
+	specialSecrets := reservedSecrets{
+		RootCA:     manifest.Secret{Cert: manifest.Certificate(*marbleCert)},
+		MarbleCert: manifest.Secret{Cert: manifest.Certificate(*marbleCert), Private: encodedPrivKey},
+		UUID:       marbleUUID,
+	}
+	userSecrets := map[string]manifest.Secret{
+		"symmetricKey": {Type: "symmetric-key", Public: []byte{0xAB, 0xCD}},
+	}
 
-	// setup mock zaplogger which can be passed to Core
-	zapLogger, err := zap.NewDevelopment()
+	// templates in arguments are replaced, the order is preserved
+	params := manifest.Parameters{
+		Argv: []string{"serve", "--uuid={{ .MarbleRun.UUID }}", "--key", "{{ hex .Secrets.symmetricKey }}"},
+	}
+	customParams, err := customizeParameters(params, specialSecrets, userSecrets, nil, nil, 0)
 	require.NoError(err)
-	defer zapLogger.Sync()
+	assert.Equal([]string{"serve", "--uuid=" + marbleUUID, "--key", "abcd"}, customParams.Argv)
 
-	// create core
-	validator := quote.NewMockValidator()
-	issuer := quote.NewMockIssuer()
-	sealer := &seal.MockSealer{}
-	recovery := recovery.NewSinglePartyRecovery()
-	coreServer, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery, zapLogger, nil)
+	// no arguments
+	customParams, err = customizeParameters(manifest.Parameters{}, specialSecrets, userSecrets, nil, nil, 0)
 	require.NoError(err)
-	require.NotNil(coreServer)
+	assert.Empty(customParams.Argv)
 
-	spawner := marbleSpawner{
-		assert:     assert,
-		require:    require,
-		issuer:     issuer,
-		validator:  validator,
-		manifest:   manifest,
-		coreServer: coreServer,
+	// raw secrets are not allowed in arguments
+	params.Argv = []string{"{{ raw .Secrets.symmetricKey }}"}
+	_, err = customizeParameters(params, specialSecrets, userSecrets, nil, nil, 0)
+	assert.Error(err)
+}
+
+func TestCustomizeParametersBinary(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	marbleCert, _, privKey := util.MustGenerateTestMarbleCredentials()
+	encodedPrivKey, err := x509.MarshalPKCS8PrivateKey(privKey)
+	require.NoError(err)
+	specialSecrets := reservedSecrets{
+		RootCA:     manifest.Secret{Cert: manifest.Certificate(*marbleCert)},
+		MarbleCert: manifest.Secret{Cert: manifest.Certificate(*marbleCert), Private: encodedPrivKey},
+		UUID:       uuid.New().String(),
 	}
-	// set manifest
-	_, err = coreServer.SetManifest(context.TODO(), []byte(test.ManifestJSONWithRecoveryKey))
+	// binary data that is neither valid UTF-8 nor a valid template
+	binary := []byte{0xff, 0x00, '{', '{', ' ', '.', 'x', 0xfe, '}', '}', 0x80, '{', '{'}
+	userSecrets := map[string]manifest.Secret{
+		"binaryKey": {Type: "symmetric-key", Public: binary, Private: binary},
+	}
+
+	var params manifest.Parameters
+	require.NoError(json.Unmarshal([]byte(`{"Files": {
+		"/verbatim": {"Encoding": "base64", "NoTemplates": true, "Data": "`+base64.StdEncoding.EncodeToString(binary)+`"},
+		"/secret": {"Secret": "binaryKey"}
+	}}`), &params))
+
+	customParams, err := customizeParameters(params, specialSecrets, userSecrets, nil, nil, 0)
 	require.NoError(err)
+	assert.Equal(binary, customParams.Files["/verbatim"])
+	assert.Equal(binary, customParams.Files["/secret"])
 
-	admin, err := coreServer.data.getUser("admin")
-	assert.NoError(err)
+	// the same data fails as a template
+	_, err = customizeParameters(manifest.Parameters{Files: map[string]manifest.File{"/template": {Data: string(binary)}}}, specialSecrets, userSecrets, nil, nil, 0)
+	assert.Error(err)
 
-	// try to activate another first backend, should succeed as SecurityLevel matches the definition in the manifest
-	spawner.newMarble("frontend", "Azure", true)
+	// an unknown secret fails
+	_, err = customizeParameters(manifest.Parameters{Files: map[string]manifest.File{"/secret": {Secret: "unknown"}}}, specialSecrets, userSecrets, nil, nil, 0)
+	assert.Error(err)
 
-	// update manifest
-	err = coreServer.UpdateManifest(context.TODO(), []byte(test.UpdateManifest), admin)
-	require.NoError(err)
+	// the dry run checks the secret and rejects Data next to it
+	mnf := manifest.Manifest{
+		Marbles: map[string]manifest.Marble{"marble": {Parameters: params}},
+	}
+	assert.NoError(templateDryRun(mnf, userSecrets))
+	assert.Error(templateDryRun(mnf, nil))
+	mnf.Marbles["marble"] = manifest.Marble{Parameters: manifest.Parameters{
+		Files: map[string]manifest.File{"/secret": {Secret: "binaryKey", Data: "data"}},
+	}}
+	assert.Error(templateDryRun(mnf, userSecrets))
+}
 
-	// try to activate another first backend, should fail as required SecurityLevel is now higher after manifest update
-	spawner.newMarble("frontend", "Azure", false)
+func TestCustomizeParametersJSONField(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
 
-	// Use a new core and test if updated manifest persisted after restart
-	coreServer2, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery, zapLogger, nil)
+	marbleCert, _, privKey := util.MustGenerateTestMarbleCredentials()
+	encodedPrivKey, err := x509.MarshalPKCS8PrivateKey(privKey)
 	require.NoError(err)
-	coreServer2State, err := coreServer2.data.getState()
-	assert.NoError(err)
-	coreServer2UpdatedPkg, err := coreServer2.data.getPackage("frontend")
-	assert.NoError(err)
-	assert.Equal(stateAcceptingMarbles, coreServer2State)
-	assert.EqualValues(5, *coreServer2UpdatedPkg.SecurityVersion)
+	specialSecrets := reservedSecrets{
+		RootCA:     manifest.Secret{Cert: manifest.Certificate(*marbleCert)},
+		MarbleCert: manifest.Secret{Cert: manifest.Certificate(*marbleCert), Private: encodedPrivKey},
+		UUID:       uuid.New().String(),
+	}
+	userSecrets := map[string]manifest.Secret{
+		"creds": {Type: "plain", UserDefined: true, Public: []byte(`{"client": {"id": "marble", "secret": "s3cr3t"}}`)},
+	}
+	params := manifest.Parameters{
+		Files: map[string]manifest.File{"/client-id": {Data: `{{ jsonField .Secrets.creds "client.id" }}`}},
+		Env:   map[string]manifest.File{"CLIENT_SECRET": {Data: `{{ jsonField .Secrets.creds "client.secret" }}`}},
+	}
+	customParams, err := customizeParameters(params, specialSecrets, userSecrets, nil, nil, 0)
+	require.NoError(err)
+	assert.Equal("marble", string(customParams.Files["/client-id"]))
+	assert.Equal("s3cr3t", string(customParams.Env["CLIENT_SECRET"]))
 
-	// This should still fail after a restart, as the update manifest should have been reloaded from the sealed state correctly
-	spawner.coreServer = coreServer2
-	spawner.newMarble("frontend", "Azure", false)
+	// the dry run accepts placeholders instead of JSON documents, but checks the path
+	mnf := manifest.Manifest{
+		Marbles: map[string]manifest.Marble{"marble": {Parameters: params}},
+	}
+	placeholders := map[string]manifest.Secret{"creds": {Type: "plain", UserDefined: true, Public: []byte{0x41}}}
+	assert.NoError(templateDryRun(mnf, placeholders))
+	mnf.Marbles["marble"] = manifest.Marble{Parameters: manifest.Parameters{
+		Env: map[string]manifest.File{"CLIENT_ID": {Data: `{{ jsonField .Secrets.creds "client..id" }}`}},
+	}}
+	assert.Error(templateDryRun(mnf, placeholders))
 }
 
-func (ms *marbleSpawner) shortMarbleActivation(marbleType string, infraName string, shouldSucceed bool) {
-	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+func TestCustomizeParametersHostFile(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
 
-	// create mock quote using values from the manifest
-	quote, err := ms.issuer.Issue(cert.Raw)
-	ms.assert.NotNil(quote)
-	ms.assert.Nil(err)
-	marble, ok := ms.manifest.Marbles[marbleType]
-	ms.assert.True(ok)
-	pkg, ok := ms.manifest.Packages[marble.Package]
-	ms.assert.True(ok)
-	infra, ok := ms.manifest.Infrastructures[infraName]
-	ms.assert.True(ok)
-	ms.validator.AddValidQuote(quote, cert.Raw, pkg, infra)
+	dir, err := ioutil.TempDir("", "unittest")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	hostPath := filepath.Join(dir, "shared.conf")
+	require.NoError(ioutil.WriteFile(hostPath, []byte("version: 1"), 0o600))
 
-	tlsInfo := credentials.TLSInfo{
-		State: tls.ConnectionState{
-			PeerCertificates: []*x509.Certificate{cert},
+	marbleCert, _, privKey := util.MustGenerateTestMarbleCredentials()
+	encodedPrivKey, err := x509.MarshalPKCS8PrivateKey(privKey)
+	require.NoError(err)
+	specialSecrets := reservedSecrets{
+		RootCA:     manifest.Secret{Cert: manifest.Certificate(*marbleCert)},
+		MarbleCert: manifest.Secret{Cert: manifest.Certificate(*marbleCert), Private: encodedPrivKey},
+		UUID:       uuid.New().String(),
+	}
+	params := manifest.Parameters{
+		Files: map[string]manifest.File{"/etc/shared.conf": {Data: `{{ hostFile "` + hostPath + `" }}`}},
+	}
+
+	hash := sha256.Sum256([]byte("version: 1"))
+	coordinatorFiles := map[string]string{hostPath: hex.EncodeToString(hash[:])}
+
+	// the file is read on each activation and must match the hash of the manifest
+	customParams, err := customizeParameters(params, specialSecrets, nil, nil, coordinatorFiles, 0)
+	require.NoError(err)
+	assert.Equal("version: 1", string(customParams.Files["/etc/shared.conf"]))
+	require.NoError(ioutil.WriteFile(hostPath, []byte("version: 2"), 0o600))
+	_, err = customizeParameters(params, specialSecrets, nil, nil, coordinatorFiles, 0)
+	assert.Error(err)
+	require.NoError(ioutil.WriteFile(hostPath, []byte("version: 1"), 0o600))
+
+	// files which are not listed can not be read
+	_, err = customizeParameters(params, specialSecrets, nil, nil, nil, 0)
+	assert.Error(err)
+
+	// the dry run checks the file, but does not reveal its contents
+	mnf := manifest.Manifest{
+		Marbles:          map[string]manifest.Marble{"marble": {Parameters: params}},
+		CoordinatorFiles: coordinatorFiles,
+	}
+	assert.NoError(templateDryRun(mnf, nil))
+	mnf.CoordinatorFiles = nil
+	assert.Error(templateDryRun(mnf, nil))
+}
+
+func TestCustomizeParametersSizeLimit(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	marbleCert, _, privKey := util.MustGenerateTestMarbleCredentials()
+	encodedPrivKey, err := x509.MarshalPKCS8PrivateKey(privKey)
+	require.NoError(err)
+	specialSecrets := reservedSecrets{
+		RootCA:     manifest.Secret{Cert: manifest.Certificate(*marbleCert)},
+		MarbleCert: manifest.Secret{Cert: manifest.Certificate(*marbleCert), Private: encodedPrivKey},
+		UUID:       uuid.New().String(),
+	}
+	params := manifest.Parameters{
+		Files: map[string]manifest.File{
+			"/a": {Data: strings.Repeat("a", 40)},
+			"/b": {Data: strings.Repeat("b", 40)},
 		},
+		Env: map[string]manifest.File{"UUID": {Data: "{{ .MarbleRun.UUID }}"}},
 	}
 
-	ctx := peer.NewContext(context.TODO(), &peer.Peer{
-		AuthInfo: tlsInfo,
-	})
+	// the rendered size counts, not the size of the template
+	_, err = customizeParameters(params, specialSecrets, nil, nil, nil, 116)
+	assert.NoError(err)
 
-	resp, err := ms.coreServer.Activate(ctx, &rpc.ActivationReq{
-		CSR:        csr,
-		MarbleType: marbleType,
-		Quote:      quote,
+	_, err = customizeParameters(params, specialSecrets, nil, nil, nil, 115)
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+	assert.Contains(err.Error(), "env variable UUID")
+
+	_, err = customizeParameters(params, specialSecrets, nil, nil, nil, 79)
+	assert.Contains(err.Error(), "file /b")
+}
+
+func TestCustomizeParametersDefaults(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	marbleCert, _, privKey := util.MustGenerateTestMarbleCredentials()
+	encodedPrivKey, err := x509.MarshalPKCS8PrivateKey(privKey)
+	require.NoError(err)
+	specialSecrets := reservedSecrets{
+		RootCA:     manifest.Secret{Cert: manifest.Certificate(*marbleCert)},
+		MarbleCert: manifest.Secret{Cert: manifest.Certificate(*marbleCert), Private: encodedPrivKey},
 		UUID:       uuid.New().String(),
-	})
+	}
 
-	ms.assert.NoError(err, "Activate failed: %v", err)
-	ms.assert.NotNil(resp)
+	defaults := manifest.DefaultParameters{
+		Env: map[string]manifest.File{
+			"LOG_LEVEL":                       {Data: "info"},
+			"COORDINATOR":                     {Data: "{{ .MarbleRun.UUID }}"},
+			libMarble.MarbleEnvironmentRootCA: {Data: "overwritten"},
+		},
+		Argv: []string{"serve"},
+	}
 
-	// Validate response
-	params := resp.GetParameters()
-	// Get the marble from the manifest set on the coreServer since this one sets default values for empty values
-	coreServerManifest, err := ms.coreServer.data.getManifest()
-	ms.assert.NoError(err)
-	marble = coreServerManifest.Marbles[marbleType]
-	// Validate Files
-	for k, v := range marble.Parameters.Files {
-		ms.assert.EqualValues(v, params.Files[k])
+	// defaults are inherited, Marble specific values take precedence
+	params := manifest.Parameters{
+		Env: map[string]manifest.File{"LOG_LEVEL": {Data: "debug"}},
 	}
-	// Validate Argv
-	ms.assert.EqualValues(marble.Parameters.Argv, params.Argv)
+	customParams, err := customizeParameters(params.WithDefaults(defaults), specialSecrets, nil, nil, nil, 0)
+	require.NoError(err)
+	assert.Equal("debug", string(customParams.Env["LOG_LEVEL"]))
+	assert.Equal(specialSecrets.UUID, string(customParams.Env["COORDINATOR"]))
+	assert.Equal([]string{"serve"}, customParams.Argv)
+	assert.NotEqual("overwritten", string(customParams.Env[libMarble.MarbleEnvironmentRootCA]))
+	assert.Len(params.Env, 1)
+
+	params.Argv = []string{"run", "--verbose"}
+	customParams, err = customizeParameters(params.WithDefaults(defaults), specialSecrets, nil, nil, nil, 0)
+	require.NoError(err)
+	assert.Equal([]string{"run", "--verbose"}, customParams.Argv)
 }
 
-func TestActivateWithMissingParameters(t *testing.T) {
+func TestGenerateCertFromCSREmptySubject(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
-	// parse manifest
-	var manifest manifest.Manifest
-	require.NoError(json.Unmarshal([]byte(test.ManifestJSONMissingParameters), &manifest))
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
 
-	// setup mock zaplogger which can be passed to Core
-	zapLogger, err := zap.NewDevelopment()
+	// minimal CSR without any subject or subject alternative names
+	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, privk)
 	require.NoError(err)
-	defer zapLogger.Sync()
 
-	// create core
-	validator := quote.NewMockValidator()
-	issuer := quote.NewMockIssuer()
-	sealer := &seal.MockSealer{}
-	recovery := recovery.NewSinglePartyRecovery()
-	coreServer, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery, zapLogger, nil)
+	marbleUUID := uuid.New().String()
+	certRaw, err := c.generateCertFromCSR(c.data, csr, privk.PublicKey, "backendFirst", marbleUUID)
 	require.NoError(err)
-	require.NotNil(coreServer)
+	cert, err := x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.Equal(marbleUUID, cert.Subject.CommonName)
+	assert.NotEmpty(cert.Subject.Organization)
 
-	spawner := marbleSpawner{
-		assert:     assert,
-		require:    require,
-		issuer:     issuer,
-		validator:  validator,
-		manifest:   manifest,
-		coreServer: coreServer,
-	}
-	// set manifest
-	_, err = coreServer.SetManifest(context.TODO(), []byte(test.ManifestJSONMissingParameters))
+	marbleRootCert, err := c.data.getCertificate(sKMarbleRootCert)
 	require.NoError(err)
+	assert.NoError(cert.CheckSignatureFrom(marbleRootCert))
+}
 
-	spawner.shortMarbleActivation("frontend", "Azure", true)
+func TestGenerateCertFromCSRKeyIdentifiers(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, privk)
+	require.NoError(err)
+	certRaw, err := c.generateCertFromCSR(c.data, csr, privk.PublicKey, "backendFirst", uuid.New().String())
+	require.NoError(err)
+	cert, err := x509.ParseCertificate(certRaw)
+	require.NoError(err)
+
+	subjectKeyID, err := util.SubjectKeyID(&privk.PublicKey)
+	require.NoError(err)
+	assert.Equal(subjectKeyID, cert.SubjectKeyId)
+
+	// the Marble certificate can be chained to the intermediate and the Marble root certificate by their key identifiers
+	intermediateCert, err := c.data.getCertificate(skCoordinatorIntermediateCert)
+	require.NoError(err)
+	marbleRootCert, err := c.data.getCertificate(sKMarbleRootCert)
+	require.NoError(err)
+	assert.NotEmpty(intermediateCert.SubjectKeyId)
+	assert.Equal(intermediateCert.SubjectKeyId, cert.AuthorityKeyId)
+	assert.Equal(marbleRootCert.SubjectKeyId, cert.AuthorityKeyId)
+
+	// the intermediate is signed by the root certificate
+	rootCert, err := c.data.getCertificate(sKCoordinatorRootCert)
+	require.NoError(err)
+	assert.NotEmpty(rootCert.SubjectKeyId)
+	assert.Equal(rootCert.SubjectKeyId, intermediateCert.AuthorityKeyId)
+}
+
+func TestGenerateCertFromCSRClockSkew(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, privk)
+	require.NoError(err)
+
+	for _, skew := range []time.Duration{DefaultCertClockSkew, 30 * time.Minute, 0} {
+		c.SetCertClockSkew(skew)
+		issued := time.Now()
+		certRaw, err := c.generateCertFromCSR(c.data, csr, privk.PublicKey, "backendFirst", uuid.New().String())
+		require.NoError(err)
+		cert, err := x509.ParseCertificate(certRaw)
+		require.NoError(err)
+		// certificates store times with a precision of one second
+		assert.WithinDuration(issued.Add(-skew), cert.NotBefore, 2*time.Second)
+		assert.False(cert.NotBefore.After(issued.Add(-skew)))
+	}
+}
+
+func TestGenerateCertFromCSRCertificatePolicies(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	marble, err := c.data.getMarble("backendFirst")
+	require.NoError(err)
+	marble.CertificatePolicies = []string{"2.23.140.1.2.1", "1.3.6.1.4.1.99999.1"}
+	require.NoError(c.data.putMarble("backendFirst", marble))
+
+	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, privk)
+	require.NoError(err)
+
+	certRaw, err := c.generateCertFromCSR(c.data, csr, privk.PublicKey, "backendFirst", uuid.New().String())
+	require.NoError(err)
+	cert, err := x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.Equal([]asn1.ObjectIdentifier{{2, 23, 140, 1, 2, 1}, {1, 3, 6, 1, 4, 1, 99999, 1}}, cert.PolicyIdentifiers)
+
+	// other Marbles are not affected
+	certRaw, err = c.generateCertFromCSR(c.data, csr, privk.PublicKey, "frontend", uuid.New().String())
+	require.NoError(err)
+	cert, err = x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.Empty(cert.PolicyIdentifiers)
+}
+
+func TestGenerateCertFromCSRExtensions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	marble, err := c.data.getMarble("backendFirst")
+	require.NoError(err)
+	marble.AllowedCSRExtensions = []string{"1.3.6.1.4.1.99999.1"}
+	require.NoError(c.data.putMarble("backendFirst", marble))
+
+	allowed := pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}, Value: []byte{0x04, 0x02, 0x01, 0x02}}
+	unlisted := pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}, Value: []byte{0x05, 0x00}}
+	basicConstraints := pkix.Extension{Id: asn1.ObjectIdentifier{2, 5, 29, 19}, Critical: true, Value: []byte{0x30, 0x03, 0x01, 0x01, 0xff}}
+
+	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	createCSR := func(extensions ...pkix.Extension) []byte {
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{ExtraExtensions: extensions}, privk)
+		require.NoError(err)
+		return csr
+	}
+	hasExtension := func(cert *x509.Certificate, id asn1.ObjectIdentifier) bool {
+		for _, extension := range cert.Extensions {
+			if extension.Id.Equal(id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// only the allowed extension is copied
+	certRaw, err := c.generateCertFromCSR(c.data, createCSR(allowed, unlisted, basicConstraints), privk.PublicKey, "backendFirst", uuid.New().String())
+	require.NoError(err)
+	cert, err := x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.True(hasExtension(cert, allowed.Id))
+	assert.False(hasExtension(cert, unlisted.Id))
+	assert.False(cert.IsCA)
+
+	// other Marbles are not affected
+	certRaw, err = c.generateCertFromCSR(c.data, createCSR(allowed), privk.PublicKey, "frontend", uuid.New().String())
+	require.NoError(err)
+	cert, err = x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.False(hasExtension(cert, allowed.Id))
+
+	// allowed extensions must not be critical
+	allowed.Critical = true
+	_, err = c.generateCertFromCSR(c.data, createCSR(allowed), privk.PublicKey, "backendFirst", uuid.New().String())
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+}
+
+func TestGenerateCertFromCSRSignatureAlgorithm(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	marble, err := c.data.getMarble("backendFirst")
+	require.NoError(err)
+	marble.SignatureAlgorithm = "ECDSA-SHA384"
+	require.NoError(c.data.putMarble("backendFirst", marble))
+
+	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, privk)
+	require.NoError(err)
+
+	certRaw, err := c.generateCertFromCSR(c.data, csr, privk.PublicKey, "backendFirst", uuid.New().String())
+	require.NoError(err)
+	cert, err := x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.Equal(x509.ECDSAWithSHA384, cert.SignatureAlgorithm)
+
+	// the default is chosen based on the Coordinator's P-256 key
+	certRaw, err = c.generateCertFromCSR(c.data, csr, privk.PublicKey, "frontend", uuid.New().String())
+	require.NoError(err)
+	cert, err = x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.Equal(x509.ECDSAWithSHA256, cert.SignatureAlgorithm)
+}
+
+func TestGenerateCertFromCSRRequiredDNSNames(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	marble, err := c.data.getMarble("backendFirst")
+	require.NoError(err)
+	marble.RequiredDNSNames = []string{"backend.namespace", "backend"}
+	require.NoError(c.data.putMarble("backendFirst", marble))
+
+	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	createCSR := func(dnsNames ...string) []byte {
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: dnsNames}, privk)
+		require.NoError(err)
+		return csr
+	}
+
+	// all required names are present
+	certRaw, err := c.generateCertFromCSR(c.data, createCSR("localhost", "Backend.Namespace", "backend"), privk.PublicKey, "backendFirst", uuid.New().String())
+	require.NoError(err)
+	cert, err := x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.Equal([]string{"localhost", "Backend.Namespace", "backend"}, cert.DNSNames)
+
+	// a required name is missing
+	_, err = c.generateCertFromCSR(c.data, createCSR("localhost", "backend"), privk.PublicKey, "backendFirst", uuid.New().String())
+	assert.Error(err)
+	assert.Contains(err.Error(), "backend.namespace")
+
+	// other Marbles are not affected
+	_, err = c.generateCertFromCSR(c.data, createCSR("localhost"), privk.PublicKey, "frontend", uuid.New().String())
+	assert.NoError(err)
+
+	// missing names are merged into the certificate
+	marble.RequiredDNSNames = []string{"backend.namespace", "backend", "BACKEND"}
+	marble.MergeRequiredDNSNames = true
+	require.NoError(c.data.putMarble("backendFirst", marble))
+	certRaw, err = c.generateCertFromCSR(c.data, createCSR("localhost", "Backend"), privk.PublicKey, "backendFirst", uuid.New().String())
+	require.NoError(err)
+	cert, err = x509.ParseCertificate(certRaw)
+	require.NoError(err)
+	assert.Equal([]string{"localhost", "Backend", "backend.namespace"}, cert.DNSNames)
+}
+
+func TestSetTTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	marbleCert, _, privKey := util.MustGenerateTestMarbleCredentials()
+	encodedPrivKey, err := x509.MarshalPKCS8PrivateKey(privKey)
+	require.NoError(err)
+	specialSecrets := reservedSecrets{
+		MarbleCert: manifest.Secret{Cert: manifest.Certificate(*marbleCert), Private: encodedPrivKey},
+	}
+	userSecrets := map[string]manifest.Secret{
+		"certShared": {Cert: manifest.Certificate(*marbleCert), Private: encodedPrivKey},
+	}
+
+	newMarble := func() manifest.Marble {
+		return manifest.Marble{
+			TLS:        []string{"web", "anotherWeb"},
+			Parameters: manifest.Parameters{Env: map[string]manifest.File{}},
+		}
+	}
+
+	// all entries can be resolved
+	marble := newMarble()
+	skipped, err := c.setTTLSConfig(c.data, marble, specialSecrets, userSecrets, false)
+	require.NoError(err)
+	assert.Empty(skipped)
+	assert.Contains(marble.Parameters.Env["MARBLE_TTLS_CONFIG"].Data, "service.namespace:4242")
+
+	// unset secrets result in an error in strict mode
+	marble = newMarble()
+	_, err = c.setTTLSConfig(c.data, marble, specialSecrets, nil, false)
+	assert.Error(err)
+
+	// in lenient mode, unresolvable incoming entries fall back to the Marble's certificate and require client authentication
+	marble = newMarble()
+	skipped, err = c.setTTLSConfig(c.data, marble, specialSecrets, nil, true)
+	require.NoError(err)
+	assert.ElementsMatch([]string{"anotherWeb.Incoming.*:8080"}, skipped)
+	ttlsConf := marble.Parameters.Env["MARBLE_TTLS_CONFIG"].Data
+	assert.Contains(ttlsConf, "service.namespace:4242")
+	assert.Contains(ttlsConf, "example.com:40000")
+	var parsedConf struct {
+		TLS struct {
+			Incoming map[string]struct {
+				Clicrt     string
+				ClientAuth bool
+			}
+		}
+	}
+	require.NoError(json.Unmarshal([]byte(ttlsConf), &parsedConf))
+	incoming, ok := parsedConf.TLS.Incoming["*:8080"]
+	require.True(ok)
+	assert.True(incoming.ClientAuth)
+	assert.Equal(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: marbleCert.Raw})), incoming.Clicrt)
+
+	// the incoming entries of undefined tags are unknown, so they can not be skipped
+	marble = newMarble()
+	marble.TLS = append(marble.TLS, "undefinedTag")
+	_, err = c.setTTLSConfig(c.data, marble, specialSecrets, nil, true)
+	assert.Error(err)
+}
+
+func TestSetTTLSConfigAddresses(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	marbleCert, _, privKey := util.MustGenerateTestMarbleCredentials()
+	encodedPrivKey, err := x509.MarshalPKCS8PrivateKey(privKey)
+	require.NoError(err)
+	specialSecrets := reservedSecrets{
+		MarbleCert: manifest.Secret{Cert: manifest.Certificate(*marbleCert), Private: encodedPrivKey},
+	}
+
+	require.NoError(c.data.putTLS("addresses", manifest.TLStag{
+		Outgoing: []manifest.TLSTagEntry{
+			{Addr: "192.0.2.1", Port: "443"},
+			{Addr: "2001:db8::1", Port: "443"},
+			{Addr: "[::1]", Port: "8443"},
+			{Addr: "service.namespace", Port: "4242"},
+		},
+		Incoming: []manifest.TLSTagEntry{{Port: "8080"}},
+	}))
+
+	marble := manifest.Marble{
+		TLS:        []string{"addresses"},
+		Parameters: manifest.Parameters{Env: map[string]manifest.File{}},
+	}
+	_, err = c.setTTLSConfig(c.data, marble, specialSecrets, nil, false)
+	require.NoError(err)
+
+	var config map[string]map[string]map[string]map[string]interface{}
+	require.NoError(json.Unmarshal([]byte(marble.Parameters.Env["MARBLE_TTLS_CONFIG"].Data), &config))
+
+	var outgoing []string
+	for addr := range config["tls"]["Outgoing"] {
+		outgoing = append(outgoing, addr)
+	}
+	assert.ElementsMatch([]string{"192.0.2.1:443", "[2001:db8::1]:443", "[::1]:8443", "service.namespace:4242"}, outgoing)
+	assert.Contains(config["tls"]["Incoming"], "*:8080")
+}
+
+func TestSecurityLevelUpdate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// parse manifest
+	var manifest manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &manifest))
+
+	// setup mock zaplogger which can be passed to Core
+	zapLogger, err := zap.NewDevelopment()
+	require.NoError(err)
+	defer zapLogger.Sync()
+
+	// create core
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	sealer := &seal.MockSealer{}
+	recovery := recovery.NewSinglePartyRecovery()
+	coreServer, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery, zapLogger, nil)
+	require.NoError(err)
+	require.NotNil(coreServer)
+
+	spawner := marbleSpawner{
+		assert:     assert,
+		require:    require,
+		issuer:     issuer,
+		validator:  validator,
+		manifest:   manifest,
+		coreServer: coreServer,
+	}
+	// set manifest
+	_, err = coreServer.SetManifest(context.TODO(), []byte(test.ManifestJSONWithRecoveryKey))
+	require.NoError(err)
+
+	admin, err := coreServer.data.getUser("admin")
+	assert.NoError(err)
+
+	// try to activate another first backend, should succeed as SecurityLevel matches the definition in the manifest
+	spawner.newMarble("frontend", "Azure", true)
+
+	// update manifest
+	err = coreServer.UpdateManifest(context.TODO(), []byte(test.UpdateManifest), admin)
+	require.NoError(err)
+
+	// try to activate another first backend, should fail as required SecurityLevel is now higher after manifest update
+	spawner.newMarble("frontend", "Azure", false)
+
+	// an updated enclave is admitted under the raised SecurityVersion
+	updatedPkg := spawner.manifest.Packages["frontend"]
+	updatedVersion := uint(5)
+	updatedPkg.SecurityVersion = &updatedVersion
+	spawner.manifest.Packages = map[string]quote.PackageProperties{"frontend": updatedPkg}
+	spawner.newMarble("frontend", "Azure", true)
+	spawner.manifest.Packages = manifest.Packages
+
+	// Use a new core and test if updated manifest persisted after restart
+	coreServer2, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery, zapLogger, nil)
+	require.NoError(err)
+	coreServer2State, err := coreServer2.data.getState()
+	assert.NoError(err)
+	coreServer2UpdatedPkg, err := coreServer2.data.getPackage("frontend")
+	assert.NoError(err)
+	assert.Equal(stateAcceptingMarbles, coreServer2State)
+	assert.EqualValues(5, *coreServer2UpdatedPkg.SecurityVersion)
+
+	// This should still fail after a restart, as the update manifest should have been reloaded from the sealed state correctly
+	spawner.coreServer = coreServer2
+	spawner.newMarble("frontend", "Azure", false)
+}
+
+func TestPackagePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	three, five := uint(3), uint(5)
+	updated, version := packagePolicy(quote.PackageProperties{SecurityVersion: &three}, quote.PackageProperties{SecurityVersion: &three})
+	assert.False(updated)
+	assert.EqualValues(3, version)
+
+	updated, version = packagePolicy(quote.PackageProperties{SecurityVersion: &three}, quote.PackageProperties{SecurityVersion: &five})
+	assert.True(updated)
+	assert.EqualValues(5, version)
+
+	updated, version = packagePolicy(quote.PackageProperties{}, quote.PackageProperties{SecurityVersion: &five})
+	assert.True(updated)
+	assert.EqualValues(5, version)
+
+	updated, version = packagePolicy(quote.PackageProperties{}, quote.PackageProperties{})
+	assert.False(updated)
+	assert.Zero(version)
+}
+
+func TestActivationSchedule(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	newSpawner := func(schedule *manifest.ActivationSchedule) *marbleSpawner {
+		var mnf manifest.Manifest
+		require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &mnf))
+		frontend := mnf.Marbles["frontend"]
+		frontend.ActivationSchedule = schedule
+		mnf.Marbles["frontend"] = frontend
+		rawMnf, err := json.Marshal(mnf)
+		require.NoError(err)
+
+		validator := quote.NewMockValidator()
+		issuer := quote.NewMockIssuer()
+		coreServer, err := NewCore([]string{"localhost"}, validator, issuer, &seal.MockSealer{}, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+		require.NoError(err)
+		_, err = coreServer.SetManifest(context.TODO(), rawMnf)
+		require.NoError(err)
+
+		return &marbleSpawner{
+			assert:     assert,
+			require:    require,
+			issuer:     issuer,
+			validator:  validator,
+			manifest:   mnf,
+			coreServer: coreServer,
+		}
+	}
+
+	now := time.Now().UTC()
+	today := now.Weekday().String()
+	tomorrow := now.AddDate(0, 0, 1).Weekday().String()
+
+	newSpawner(&manifest.ActivationSchedule{Days: []string{today}}).newMarble("frontend", "Azure", true)
+	newSpawner(&manifest.ActivationSchedule{Days: []string{tomorrow}}).newMarble("frontend", "Azure", false)
+}
+
+func TestMaxActivationsError(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &mnf))
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	c, err := NewCore([]string{"localhost"}, validator, issuer, &seal.MockSealer{}, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+	require.NoError(c.data.incrementActivations("backendFirst"))
+	issued, err := c.data.getIssuanceLogSize()
+	require.NoError(err)
+
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := issuer.Issue(cert.Raw)
+	require.NoError(err)
+	validator.AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[mnf.Marbles["backendFirst"].Package], mnf.Infrastructures["Azure"])
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+
+	// the error names the marble type, the matched infrastructure and the exhausted budget
+	_, infraName, err := c.activate(ctx, &rpc.ActivationReq{CSR: csr, MarbleType: "backendFirst", Quote: marbleQuote, UUID: uuid.New().String()})
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+	assert.Equal("Azure", infraName)
+	assert.Contains(status.Convert(err).Message(), "marble type backendFirst")
+	assert.Contains(status.Convert(err).Message(), "infrastructure Azure")
+	assert.Contains(status.Convert(err).Message(), "1/1 activations")
+
+	// no certificate is issued for the rejected activation
+	issuedAfter, err := c.data.getIssuanceLogSize()
+	require.NoError(err)
+	assert.Equal(issued, issuedAfter)
+}
+
+func TestMaxActivationsConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &mnf))
+	const maxActivations = 3
+	frontend := mnf.Marbles["frontend"]
+	frontend.MaxActivations = maxActivations
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	// two Coordinators share a store, so their activations are only synchronized by store transactions
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	sealer := &seal.MockSealer{}
+	stor := sharedStore{store.NewStdStore(sealer)}
+	var cores []*Core
+	for i := 0; i < 2; i++ {
+		c, err := NewCoreWithStore([]string{"localhost"}, validator, issuer, sealer, stor, recovery.NewSinglePartyRecovery(), zap.NewNop(), nil)
+		require.NoError(err)
+		cores = append(cores, c)
+	}
+	_, err = cores[0].SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := issuer.Issue(cert.Raw)
+	require.NoError(err)
+	validator.AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[frontend.Package], mnf.Infrastructures["Azure"])
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+
+	const attempts = 20
+	errs := make(chan error, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(c *Core) {
+			defer wg.Done()
+			_, err := c.Activate(ctx, &rpc.ActivationReq{CSR: csr, MarbleType: "frontend", Quote: marbleQuote, UUID: uuid.New().String()})
+			errs <- err
+		}(cores[i%len(cores)])
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else {
+			assert.Equal(codes.ResourceExhausted, status.Code(err), err)
+		}
+	}
+	assert.Equal(maxActivations, succeeded)
+	activations, err := cores[1].data.getActivations("frontend")
+	require.NoError(err)
+	assert.EqualValues(maxActivations, activations)
+}
+
+func TestActivationSizeLimits(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+	c.SetActivationSizeLimits(1024, 2048)
+
+	// oversized inputs are rejected as invalid arguments
+	_, _, err = c.activate(context.TODO(), &rpc.ActivationReq{CSR: make([]byte, 1025), MarbleType: "frontend"})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	_, _, err = c.activate(context.TODO(), &rpc.ActivationReq{Quote: make([]byte, 2049), MarbleType: "frontend"})
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+
+	// inputs within the limits are processed as usual and fail later, as the request has no TLS peer
+	_, _, err = c.activate(context.TODO(), &rpc.ActivationReq{CSR: make([]byte, 1024), Quote: make([]byte, 2048), MarbleType: "frontend"})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func TestMaxCSRSANs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+	c.SetMaxCSRSANs(3)
+
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	createCSR := func(uris ...*url.URL) []byte {
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			DNSNames:    []string{"a.example.com", "b.example.com"},
+			IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+			URIs:        uris,
+		}, privKey)
+		require.NoError(err)
+		return csr
+	}
+
+	// DNS names, IP addresses, and URIs count towards the limit
+	_, err = c.generateCertFromCSR(c.data, createCSR(), privKey.PublicKey, "frontend", uuid.New().String())
+	assert.NoError(err)
+	_, err = c.generateCertFromCSR(c.data, createCSR(&url.URL{Scheme: "spiffe", Host: "example.com"}), privKey.PublicKey, "frontend", uuid.New().String())
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+}
+
+func TestActivatePlatformBoundSecrets(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	frontend := mnf.Marbles["frontend"]
+	frontend.Parameters.Env = map[string]manifest.File{
+		"PRIVATE_KEY": {Data: "{{ hex .Secrets.symmetricKeyPrivate }}", Encoding: "string"},
+		"SHARED_KEY":  {Data: "{{ hex .Secrets.symmetricKeyShared }}", Encoding: "string"},
+	}
+	frontend.PlatformBoundSecrets = true
+	mnf.Marbles["frontend"] = frontend
+
+	// templates can not reference the secrets bound by the premain
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	assert.Error(err)
+
+	delete(frontend.Parameters.Env, "PRIVATE_KEY")
+	rawManifest, err = json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	sharedKey, err := c.data.getSecret("symmetricKeyShared")
+	require.NoError(err)
+	root, err := c.data.getDerivationRoot()
+	require.NoError(err)
+
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := c.qi.Issue(cert.Raw)
+	require.NoError(err)
+	c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[frontend.Package], mnf.Infrastructures["Azure"])
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+	marbleUUID := uuid.New()
+	resp, err := c.Activate(ctx, &rpc.ActivationReq{
+		CSR:        csr,
+		MarbleType: "frontend",
+		Quote:      marbleQuote,
+		UUID:       marbleUUID.String(),
+	})
+	require.NoError(err)
+	unboundKey, err := deriveSecretValue(root.Current, marbleUUID, "symmetricKeyPrivate", 256)
+	require.NoError(err)
+
+	// the per-Marble secret is passed to the premain for binding, shared secrets are rendered as usual
+	assert.Equal(unboundKey, resp.GetParameters().GetPlatformBoundSecrets()["symmetricKeyPrivate"])
+	assert.Equal(unboundKey, resp.GetParameters().GetPreviousPlatformBoundSecrets()["symmetricKeyPrivate"])
+	assert.NotContains(resp.GetParameters().GetPlatformBoundSecrets(), "symmetricKeyShared")
+	assert.Equal(hex.EncodeToString(sharedKey.Private), string(resp.GetParameters().Env["SHARED_KEY"]))
+}
+
+func TestAllowSimulation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, _ := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	cert, _, _ := util.MustGenerateTestMarbleCredentials()
+	invalidQuote := []byte("invalid quote")
+
+	setAllowSimulation := func(allow *bool) {
+		marble, err := c.data.getMarble("frontend")
+		require.NoError(err)
+		marble.AllowSimulation = allow
+		require.NoError(c.data.putMarble("frontend", marble))
+	}
+	allow, deny := true, false
+
+	// by default, quotes are validated if the Coordinator does not run in simulation mode
+	_, err = c.verifyManifestRequirement(context.Background(), cert, invalidQuote, "frontend")
+	assert.Error(err)
+
+	// on hardware, Marbles allowing simulation are only unattested if the Coordinator opts in
+	setAllowSimulation(&allow)
+	_, err = c.verifyManifestRequirement(context.Background(), cert, invalidQuote, "frontend")
+	assert.Error(err)
+	c.SetAllowMarbleSimulation(true)
+	_, err = c.verifyManifestRequirement(context.Background(), cert, invalidQuote, "frontend")
+	assert.NoError(err)
+	_, err = c.verifyManifestRequirement(context.Background(), cert, invalidQuote, "backendFirst")
+	assert.Error(err)
+	c.SetAllowMarbleSimulation(false)
+
+	// in simulation mode, quotes are only validated for Marbles which explicitly deny simulation
+	c.quote = nil
+	setAllowSimulation(nil)
+	_, err = c.verifyManifestRequirement(context.Background(), cert, invalidQuote, "frontend")
+	assert.NoError(err)
+	setAllowSimulation(&deny)
+	_, err = c.verifyManifestRequirement(context.Background(), cert, invalidQuote, "frontend")
+	assert.Error(err)
+	_, err = c.verifyManifestRequirement(context.Background(), cert, invalidQuote, "backendFirst")
+	assert.NoError(err)
+}
+
+func TestBlockedPackage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// parse manifest
+	var manifest manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &manifest))
+
+	// setup mock zaplogger which can be passed to Core
+	zapLogger, err := zap.NewDevelopment()
+	require.NoError(err)
+	defer zapLogger.Sync()
+
+	// create core
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	sealer := &seal.MockSealer{}
+	recovery := recovery.NewSinglePartyRecovery()
+	coreServer, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery, zapLogger, nil)
+	require.NoError(err)
+	require.NotNil(coreServer)
+
+	spawner := marbleSpawner{
+		assert:     assert,
+		require:    require,
+		issuer:     issuer,
+		validator:  validator,
+		manifest:   manifest,
+		coreServer: coreServer,
+	}
+	// set manifest
+	_, err = coreServer.SetManifest(context.TODO(), []byte(test.ManifestJSONWithRecoveryKey))
+	require.NoError(err)
+
+	admin, err := coreServer.data.getUser("admin")
+	require.NoError(err)
+
+	spawner.newMarble("frontend", "Azure", true)
+	intermediateCert, err := coreServer.data.getCertificate(skCoordinatorIntermediateCert)
+	require.NoError(err)
+
+	// blocking a different product should not affect the frontend
+	err = coreServer.UpdateManifest(context.TODO(), []byte(`{
+	"BlockedPackages": {
+		"frontend": [
+			{
+				"SignerID": "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100",
+				"ProductID": 45
+			}
+		]
+	}
+}`), admin)
+	require.NoError(err)
+	spawner.newMarble("frontend", "Azure", true)
+
+	// block the frontend by signer and product ID
+	err = coreServer.UpdateManifest(context.TODO(), []byte(`{
+	"BlockedPackages": {
+		"frontend": [
+			{
+				"SignerID": "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100",
+				"ProductID": 44
+			}
+		]
+	}
+}`), admin)
+	require.NoError(err)
+	spawner.newMarble("frontend", "Azure", false)
+
+	// previously blocked entries are kept
+	blocklist, err := coreServer.data.getBlocklist("frontend")
+	require.NoError(err)
+	assert.Len(blocklist, 2)
+
+	// blocking entries does not rotate the intermediate CA, so running Marbles keep their certificates
+	currentIntermediateCert, err := coreServer.data.getCertificate(skCoordinatorIntermediateCert)
+	require.NoError(err)
+	assert.Equal(intermediateCert.Raw, currentIntermediateCert.Raw)
+
+	updateLog, err := coreServer.GetUpdateLog(context.TODO())
+	require.NoError(err)
+	assert.Contains(updateLog, "Package entry blocked")
+
+	// invalid blocklists are rejected
+	err = coreServer.UpdateManifest(context.TODO(), []byte(`{"BlockedPackages": {"unknown": [{"UniqueID": "00"}]}}`), admin)
+	assert.Error(err)
+	err = coreServer.UpdateManifest(context.TODO(), []byte(`{"BlockedPackages": {"frontend": [{"SignerID": "00"}]}}`), admin)
+	assert.Error(err)
+	err = coreServer.UpdateManifest(context.TODO(), []byte(`{"BlockedPackages": {"frontend": [{"UniqueID": "00", "Debug": true}]}}`), admin)
+	assert.Error(err)
+}
+
+func TestDryRunUpdateManifest(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &manifest))
+
+	zapLogger, err := zap.NewDevelopment()
+	require.NoError(err)
+	defer zapLogger.Sync()
+
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	sealer := &seal.MockSealer{}
+	recovery := recovery.NewSinglePartyRecovery()
+	coreServer, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery, zapLogger, nil)
+	require.NoError(err)
+
+	spawner := marbleSpawner{
+		assert:     assert,
+		require:    require,
+		issuer:     issuer,
+		validator:  validator,
+		manifest:   manifest,
+		coreServer: coreServer,
+	}
+	_, err = coreServer.SetManifest(context.TODO(), []byte(test.ManifestJSONWithRecoveryKey))
+	require.NoError(err)
+	admin, err := coreServer.data.getUser("admin")
+	require.NoError(err)
+
+	// the frontend was activated with SecurityVersion 3, the envMarble was not activated yet
+	spawner.newMarble("frontend", "Azure", true)
+
+	impacts, err := coreServer.DryRunUpdateManifest(context.TODO(), []byte(test.UpdateManifest), admin)
+	require.NoError(err)
+	require.Len(impacts, 2)
+	assert.True(impacts["frontend"].Sampled)
+	assert.True(impacts["frontend"].Failing)
+	assert.Contains(impacts["frontend"].Reason, "SecurityVersion")
+	assert.Equal(UpdateImpact{Package: "frontend"}, impacts["envMarble"])
+
+	// the update was not applied
+	pkg, err := coreServer.data.getPackage("frontend")
+	require.NoError(err)
+	assert.EqualValues(3, *pkg.SecurityVersion)
+	spawner.newMarble("frontend", "Azure", true)
+
+	// a newer build activated later does not hide the older build, which would still be rejected
+	oldPkg := manifest.Packages["frontend"]
+	newPkg := oldPkg
+	newSecurityVersion := uint(5)
+	newPkg.SecurityVersion = &newSecurityVersion
+	manifest.Packages["frontend"] = newPkg
+	spawner.newMarble("frontend", "Azure", true)
+	manifest.Packages["frontend"] = oldPkg
+	samples, err := coreServer.data.getQuoteSamples("frontend")
+	require.NoError(err)
+	assert.Len(samples, 2)
+	impacts, err = coreServer.DryRunUpdateManifest(context.TODO(), []byte(test.UpdateManifest), admin)
+	require.NoError(err)
+	assert.True(impacts["frontend"].Failing)
+	assert.Contains(impacts["frontend"].Reason, "SecurityVersion")
+
+	// blocking a different product does not affect the frontend, blocking its product does
+	impacts, err = coreServer.DryRunUpdateManifest(context.TODO(), []byte(`{"BlockedPackages": {"frontend": [{"SignerID": "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100", "ProductID": 45}]}}`), admin)
+	require.NoError(err)
+	assert.True(impacts["frontend"].Sampled)
+	assert.False(impacts["frontend"].Failing)
+	impacts, err = coreServer.DryRunUpdateManifest(context.TODO(), []byte(`{"BlockedPackages": {"frontend": [{"SignerID": "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100", "ProductID": 44}]}}`), admin)
+	require.NoError(err)
+	assert.True(impacts["frontend"].Failing)
+	assert.Equal("quote matches a blocked package entry", impacts["frontend"].Reason)
+	blocklist, err := coreServer.data.getBlocklist("frontend")
+	assert.True(store.IsStoreValueUnsetError(err))
+	assert.Empty(blocklist)
+
+	// invalid updates are rejected
+	_, err = coreServer.DryRunUpdateManifest(context.TODO(), []byte(`{"Packages": {"frontend": {"SecurityVersion": 1}}}`), admin)
+	assert.Error(err)
+	_, err = coreServer.DryRunUpdateManifest(context.TODO(), []byte(`{"Marbles": {"frontend": {"LogLevel": "debug"}}}`), admin)
+	assert.Error(err)
+}
+
+func (ms *marbleSpawner) shortMarbleActivation(marbleType string, infraName string, shouldSucceed bool) {
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+
+	// create mock quote using values from the manifest
+	quote, err := ms.issuer.Issue(cert.Raw)
+	ms.assert.NotNil(quote)
+	ms.assert.Nil(err)
+	marble, ok := ms.manifest.Marbles[marbleType]
+	ms.assert.True(ok)
+	pkg, ok := ms.manifest.Packages[marble.Package]
+	ms.assert.True(ok)
+	infra, ok := ms.manifest.Infrastructures[infraName]
+	ms.assert.True(ok)
+	ms.validator.AddValidQuote(quote, cert.Raw, pkg, infra)
+
+	tlsInfo := credentials.TLSInfo{
+		State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+		},
+	}
+
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: tlsInfo,
+	})
+
+	resp, err := ms.coreServer.Activate(ctx, &rpc.ActivationReq{
+		CSR:        csr,
+		MarbleType: marbleType,
+		Quote:      quote,
+		UUID:       uuid.New().String(),
+	})
+
+	ms.assert.NoError(err, "Activate failed: %v", err)
+	ms.assert.NotNil(resp)
+
+	// Validate response
+	params := resp.GetParameters()
+	// Get the marble from the manifest set on the coreServer since this one sets default values for empty values
+	coreServerManifest, err := ms.coreServer.data.getManifest()
+	ms.assert.NoError(err)
+	marble = coreServerManifest.Marbles[marbleType]
+	// Validate Files
+	for k, v := range marble.Parameters.Files {
+		ms.assert.EqualValues(v, params.Files[k])
+	}
+	// Validate Argv
+	ms.assert.EqualValues(marble.Parameters.Argv, params.Argv)
+}
+
+func TestActivateWithMissingParameters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// parse manifest
+	var manifest manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONMissingParameters), &manifest))
+
+	// setup mock zaplogger which can be passed to Core
+	zapLogger, err := zap.NewDevelopment()
+	require.NoError(err)
+	defer zapLogger.Sync()
+
+	// create core
+	validator := quote.NewMockValidator()
+	issuer := quote.NewMockIssuer()
+	sealer := &seal.MockSealer{}
+	recovery := recovery.NewSinglePartyRecovery()
+	coreServer, err := NewCore([]string{"localhost"}, validator, issuer, sealer, recovery, zapLogger, nil)
+	require.NoError(err)
+	require.NotNil(coreServer)
+
+	spawner := marbleSpawner{
+		assert:     assert,
+		require:    require,
+		issuer:     issuer,
+		validator:  validator,
+		manifest:   manifest,
+		coreServer: coreServer,
+	}
+	// set manifest
+	_, err = coreServer.SetManifest(context.TODO(), []byte(test.ManifestJSONMissingParameters))
+	require.NoError(err)
+
+	spawner.shortMarbleActivation("frontend", "Azure", true)
+}
+
+// slowStore delays reads of keys with the given prefix until the delay has passed or the context is done.
+type slowStore struct {
+	store.Store
+	prefix string
+	delay  time.Duration
+}
+
+func (s *slowStore) Get(ctx context.Context, request string) ([]byte, error) {
+	if strings.HasPrefix(request, s.prefix) {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return s.Store.Get(ctx, request)
+}
+
+func (s *slowStore) BeginTransaction(ctx context.Context) (store.Transaction, error) {
+	tx, err := s.Store.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &slowTransaction{Transaction: tx, store: s}, nil
+}
+
+// slowTransaction delays reads like its slowStore.
+type slowTransaction struct {
+	store.Transaction
+	store *slowStore
+}
+
+func (t *slowTransaction) Get(ctx context.Context, request string) ([]byte, error) {
+	if strings.HasPrefix(request, t.store.prefix) {
+		select {
+		case <-time.After(t.store.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return t.Transaction.Get(ctx, request)
+}
+
+func TestActivateContextTimeout(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	// replace the store with one whose certificate reads take longer than the request's deadline
+	fastData := c.data
+	slow := &slowStore{Store: c.store, prefix: requestCert, delay: time.Minute}
+	c.store = slow
+	c.data = storeWrapper{store: slow}
+
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := c.qi.Issue(cert.Raw)
+	require.NoError(err)
+	c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[mnf.Marbles["frontend"].Package], mnf.Infrastructures["Azure"])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ctx = peer.NewContext(ctx, &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+
+	start := time.Now()
+	_, err = c.Activate(ctx, &rpc.ActivationReq{
+		CSR:        csr,
+		MarbleType: "frontend",
+		Quote:      marbleQuote,
+		UUID:       uuid.New().String(),
+	})
+	require.Error(err)
+	assert.Contains(err.Error(), context.DeadlineExceeded.Error())
+	assert.Less(int64(time.Since(start)), int64(10*time.Second))
+
+	// the aborted activation was not counted
+	_, err = fastData.getActivations("frontend")
+	assert.True(store.IsStoreValueUnsetError(err))
+}
+
+// unavailableStore fails reads of the given request until it is made available.
+type unavailableStore struct {
+	store.Store
+	request     string
+	unavailable bool
+}
+
+func (s *unavailableStore) Get(ctx context.Context, request string) ([]byte, error) {
+	if s.unavailable && request == s.request {
+		return nil, errors.New("store is being resealed")
+	}
+	return s.Store.Get(ctx, request)
+}
+
+func (s *unavailableStore) BeginTransaction(ctx context.Context) (store.Transaction, error) {
+	tx, err := s.Store.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &unavailableTransaction{Transaction: tx, store: s}, nil
+}
+
+// unavailableTransaction fails reads of the request of its unavailableStore.
+type unavailableTransaction struct {
+	store.Transaction
+	store *unavailableStore
+}
+
+func (t *unavailableTransaction) Get(ctx context.Context, request string) ([]byte, error) {
+	if t.store.unavailable && request == t.store.request {
+		return nil, errors.New("store is being resealed")
+	}
+	return t.Transaction.Get(ctx, request)
+}
+
+func TestActivateIntermediateKeyUnavailable(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	unavailable := &unavailableStore{Store: c.store, request: requestPrivKey + ":" + sKCoordinatorIntermediateKey, unavailable: true}
+	c.store = unavailable
+	c.data = storeWrapper{store: unavailable}
+
+	activate := func() error {
+		cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+		marbleQuote, err := c.qi.Issue(cert.Raw)
+		require.NoError(err)
+		c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[mnf.Marbles["frontend"].Package], mnf.Infrastructures["Azure"])
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+		})
+		_, err = c.Activate(ctx, &rpc.ActivationReq{
+			CSR:        csr,
+			MarbleType: "frontend",
+			Quote:      marbleQuote,
+			UUID:       uuid.New().String(),
+		})
+		return err
+	}
+
+	// the activation fails with a retryable error and is not counted
+	err = activate()
+	assert.Equal(codes.FailedPrecondition, status.Code(err))
+	_, err = c.data.getActivations("frontend")
+	assert.True(store.IsStoreValueUnsetError(err))
+
+	// once the key is available again, the retry succeeds
+	unavailable.unavailable = false
+	assert.NoError(activate())
+}
+
+func TestActivateCASecret(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	mnf.Secrets["issuer"] = manifest.Secret{Type: "ca-cert", Size: 256, NameConstraints: &manifest.NameConstraints{PermittedDNSDomains: []string{"ca.example.com"}}}
+	frontend := mnf.Marbles["frontend"]
+	frontend.AllowCA = true
+	frontend.Parameters.Env = map[string]manifest.File{"CA_CERT": {Data: "{{ pem .Secrets.issuer.Cert }}", Encoding: "string"}}
+	mnf.Marbles["frontend"] = frontend
+	// Marbles not allowed to hold a CA don't receive the secret
+	backend := mnf.Marbles["backendOther"]
+	backend.Parameters.Env = map[string]manifest.File{"CA_KEY": {Data: "{{ pem .Secrets.issuer.Private }}", Encoding: "string"}}
+	mnf.Marbles["backendOther"] = backend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := c.qi.Issue(cert.Raw)
+	require.NoError(err)
+	c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[frontend.Package], mnf.Infrastructures["Azure"])
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+
+	resp, err := c.Activate(ctx, &rpc.ActivationReq{
+		CSR:        csr,
+		MarbleType: "frontend",
+		Quote:      marbleQuote,
+		UUID:       uuid.New().String(),
+	})
+	require.NoError(err)
+
+	// the Marble receives a CA certificate issued by the Coordinator
+	block, _ := pem.Decode(resp.Parameters.Env["CA_CERT"])
+	require.NotNil(block)
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(err)
+	assert.True(caCert.IsCA)
+	assert.True(caCert.MaxPathLenZero)
+	marbleRootCert, err := c.data.getCertificate(sKMarbleRootCert)
+	require.NoError(err)
+	assert.NoError(caCert.CheckSignatureFrom(marbleRootCert))
+	assert.Equal([]string{"ca.example.com"}, caCert.PermittedDNSDomains)
+
+	c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[backend.Package], mnf.Infrastructures["Azure"])
+	_, err = c.Activate(ctx, &rpc.ActivationReq{
+		CSR:        csr,
+		MarbleType: "backendOther",
+		Quote:      marbleQuote,
+		UUID:       uuid.New().String(),
+	})
+	assert.Error(err)
+}
+
+func TestActivateEncryptedParameters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	frontend := mnf.Marbles["frontend"]
+	frontend.Parameters.Files = map[string]manifest.File{
+		"/secret.conf": {Data: "{{ hex .Secrets.symmetricKeyShared }}", Encoding: "string"},
+		"/public.conf": {Data: "public", Encoding: "string"},
+	}
+	frontend.Parameters.Env = map[string]manifest.File{"API_TOKEN": {Data: "token", Encoding: "string"}}
+	frontend.EncryptedParameters = &manifest.EncryptedParameters{Files: []string{"/secret.conf"}, Env: []string{"API_TOKEN"}}
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	sharedKey, err := c.data.getSecret("symmetricKeyShared")
+	require.NoError(err)
+
+	cert, csr, privk := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := c.qi.Issue(cert.Raw)
+	require.NoError(err)
+	c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[frontend.Package], mnf.Infrastructures["Azure"])
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+
+	resp, err := c.Activate(ctx, &rpc.ActivationReq{
+		CSR:        csr,
+		MarbleType: "frontend",
+		Quote:      marbleQuote,
+		UUID:       uuid.New().String(),
+	})
+	require.NoError(err)
+	params := resp.GetParameters()
+	assert.Equal([]string{"/secret.conf"}, params.EncryptedFiles)
+	assert.Equal([]string{"API_TOKEN"}, params.EncryptedEnv)
+	assert.Equal("public", string(params.Files["/public.conf"]))
+	assert.NotEqual("token", string(params.Env["API_TOKEN"]))
+
+	// the Marble derives the key with the private key of its CSR
+	x, y := elliptic.Unmarshal(elliptic.P256(), params.EncryptionKey)
+	require.NotNil(x)
+	key, err := util.DeriveParametersKey(privk, &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+	require.NoError(err)
+	token, err := ecrypto.Decrypt(params.Env["API_TOKEN"], key, util.ParametersAdditionalData("Env", "API_TOKEN"))
+	require.NoError(err)
+	assert.Equal("token", string(token))
+	secretConf, err := ecrypto.Decrypt(params.Files["/secret.conf"], key, util.ParametersAdditionalData("Files", "/secret.conf"))
+	require.NoError(err)
+	assert.Equal(hex.EncodeToString(sharedKey.Private), string(secretConf))
+
+	// ciphertexts are bound to their parameter
+	_, err = ecrypto.Decrypt(params.Env["API_TOKEN"], key, util.ParametersAdditionalData("Files", "API_TOKEN"))
+	assert.Error(err)
+}
+
+func TestActivateOmitReservedEnv(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	frontend := mnf.Marbles["frontend"]
+	frontend.OmitReservedEnv = []string{libMarble.MarbleEnvironmentPrivateKey, libMarble.MarbleEnvironmentCertificateChain}
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := c.qi.Issue(cert.Raw)
+	require.NoError(err)
+	c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[frontend.Package], mnf.Infrastructures["Azure"])
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+
+	resp, err := c.Activate(ctx, &rpc.ActivationReq{
+		CSR:        csr,
+		MarbleType: "frontend",
+		Quote:      marbleQuote,
+		UUID:       uuid.New().String(),
+	})
+	require.NoError(err)
+	env := resp.GetParameters().GetEnv()
+	assert.NotContains(env, libMarble.MarbleEnvironmentPrivateKey)
+	assert.NotContains(env, libMarble.MarbleEnvironmentCertificateChain)
+	assert.Contains(env, libMarble.MarbleEnvironmentRootCA)
+
+	// the preview reflects the omitted variables
+	params, err := c.RenderMarbleParameters(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.NotContains(params.Env, libMarble.MarbleEnvironmentPrivateKey)
+	assert.Contains(params.Env, libMarble.MarbleEnvironmentRootCA)
+}
+
+func TestActivateFilesArchive(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	frontend := mnf.Marbles["frontend"]
+	frontend.Parameters.Files = map[string]manifest.File{
+		"/app/secret.conf": {Data: "{{ hex .Secrets.symmetricKeyShared }}", Encoding: "string"},
+		"/app/public.conf": {Data: "public", Encoding: "string"},
+	}
+	frontend.FilesArchive = true
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	sharedKey, err := c.data.getSecret("symmetricKeyShared")
+	require.NoError(err)
+
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := c.qi.Issue(cert.Raw)
+	require.NoError(err)
+	c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[frontend.Package], mnf.Infrastructures["Azure"])
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+
+	resp, err := c.Activate(ctx, &rpc.ActivationReq{
+		CSR:        csr,
+		MarbleType: "frontend",
+		Quote:      marbleQuote,
+		UUID:       uuid.New().String(),
+	})
+	require.NoError(err)
+	params := resp.GetParameters()
+	assert.Empty(params.Files)
+
+	// the archive contains the rendered files in a fixed order
+	tarData, err := base64.StdEncoding.DecodeString(string(params.Env[util.MarbleEnvironmentFilesArchive]))
+	require.NoError(err)
+	tr := tar.NewReader(bytes.NewReader(tarData))
+	header, err := tr.Next()
+	require.NoError(err)
+	assert.Equal("/app/public.conf", header.Name)
+	assert.EqualValues(0o600, header.Mode)
+	data, err := ioutil.ReadAll(tr)
+	require.NoError(err)
+	assert.Equal("public", string(data))
+	header, err = tr.Next()
+	require.NoError(err)
+	assert.Equal("/app/secret.conf", header.Name)
+	data, err = ioutil.ReadAll(tr)
+	require.NoError(err)
+	assert.Equal(hex.EncodeToString(sharedKey.Private), string(data))
+	_, err = tr.Next()
+	assert.Equal(io.EOF, err)
+
+	// the preview reflects the archive
+	preview, err := c.RenderMarbleParameters(context.TODO(), "frontend")
+	require.NoError(err)
+	assert.Empty(preview.Files)
+	assert.Contains(preview.Env, util.MarbleEnvironmentFilesArchive)
+}
+
+func TestActivateSecretGroups(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	mnf.Secrets["groupKey"] = manifest.Secret{Type: "symmetric-key", Size: 128, Shared: true, Marbles: []string{"frontend"}}
+	frontend := mnf.Marbles["frontend"]
+	frontend.Parameters.Env = map[string]manifest.File{"GROUP_KEY": {Data: "{{ hex .Secrets.groupKey }}", Encoding: "string"}}
+	mnf.Marbles["frontend"] = frontend
+
+	// Marbles outside of the group can not reference the secret
+	backendFirst := mnf.Marbles["backendFirst"]
+	backendFirst.Parameters.Env = map[string]manifest.File{"GROUP_KEY": {Data: "{{ hex .Secrets.groupKey }}", Encoding: "string"}}
+	mnf.Marbles["backendFirst"] = backendFirst
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.Error(err)
+
+	mnf.Marbles["backendFirst"] = manifest.Marble{Package: backendFirst.Package, MaxActivations: backendFirst.MaxActivations}
+	rawManifest, err = json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := c.qi.Issue(cert.Raw)
+	require.NoError(err)
+	c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[frontend.Package], mnf.Infrastructures["Azure"])
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+
+	// members of the group receive the secret
+	resp, err := c.Activate(ctx, &rpc.ActivationReq{
+		CSR:        csr,
+		MarbleType: "frontend",
+		Quote:      marbleQuote,
+		UUID:       uuid.New().String(),
+	})
+	require.NoError(err)
+	groupKey, err := c.data.getSecret("groupKey")
+	require.NoError(err)
+	assert.Equal(hex.EncodeToString(groupKey.Public), string(resp.Parameters.Env["GROUP_KEY"]))
+
+	// other Marbles don't
+	secrets, err := c.data.getSecretMap()
+	require.NoError(err)
+	assert.Contains(secretsAvailableTo(secrets, "frontend"), "groupKey")
+	assert.NotContains(secretsAvailableTo(secrets, "backendFirst"), "groupKey")
+	assert.Contains(secretsAvailableTo(secrets, "backendFirst"), "symmetricKeyShared")
+}
+
+func TestActivateInfrastructureParameters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	frontend := mnf.Marbles["frontend"]
+	frontend.Parameters.Env = map[string]manifest.File{"REGION": {Data: "default", Encoding: "string"}}
+	frontend.InfrastructureParameters = map[string]manifest.Parameters{
+		"Azure": {Env: map[string]manifest.File{"REGION": {Data: "azure {{ .MarbleRun.UUID }}", Encoding: "string"}}},
+	}
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+
+	activate := func(infra quote.InfrastructureProperties) string {
+		cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+		marbleQuote, err := c.qi.Issue(cert.Raw)
+		require.NoError(err)
+		c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages["frontend"], infra)
+		ctx := peer.NewContext(context.TODO(), &peer.Peer{
+			AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+		})
+		marbleUUID := uuid.New().String()
+		resp, err := c.Activate(ctx, &rpc.ActivationReq{
+			CSR:        csr,
+			MarbleType: "frontend",
+			Quote:      marbleQuote,
+			UUID:       marbleUUID,
+		})
+		require.NoError(err)
+		return strings.ReplaceAll(string(resp.Parameters.Env["REGION"]), marbleUUID, "<uuid>")
+	}
+
+	// the parameters of the matched infrastructure are templated like the Marble's own
+	assert.Equal("azure <uuid>", activate(mnf.Infrastructures["Azure"]))
+	assert.Equal("default", activate(mnf.Infrastructures["Alibaba"]))
+
+	// templates of infrastructure parameters are checked when the manifest is set
+	c, mnf = mustSetup()
+	frontend.InfrastructureParameters["Azure"] = manifest.Parameters{Env: map[string]manifest.File{"REGION": {Data: "{{ undefinedFunction }}", Encoding: "string"}}}
+	mnf.Marbles["frontend"] = frontend
+	rawManifest, err = json.Marshal(mnf)
+	require.NoError(err)
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	assert.Error(err)
+}
+
+func TestActivateDerivedUUID(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+	marbleQuote, err := c.qi.Issue(cert.Raw)
+	require.NoError(err)
+	c.qv.(*quote.MockValidator).AddValidQuote(marbleQuote, cert.Raw, mnf.Packages["frontend"], mnf.Infrastructures["Azure"])
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+	activate := func(hostname string) (string, error) {
+		resp, err := c.Activate(ctx, &rpc.ActivationReq{
+			CSR:        csr,
+			MarbleType: "frontend",
+			Quote:      marbleQuote,
+			Hostname:   hostname,
+		})
+		if err != nil {
+			return "", err
+		}
+		block, _ := pem.Decode(resp.Certificate)
+		require.NotNil(block)
+		marbleCert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(err)
+		return marbleCert.Subject.CommonName, nil
+	}
+
+	// the UUID may only be omitted if the manifest permits it
+	_, err = activate("frontend-0")
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+
+	marble, err := c.data.getMarble("frontend")
+	require.NoError(err)
+	marble.DeriveUUID = true
+	require.NoError(c.data.putMarble("frontend", marble))
+
+	_, err = activate("")
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+
+	// the same hostname always results in the same UUID
+	firstUUID, err := activate("frontend-0")
+	require.NoError(err)
+	_, err = uuid.Parse(firstUUID)
+	assert.NoError(err)
+	secondUUID, err := activate("frontend-0")
+	require.NoError(err)
+	assert.Equal(firstUUID, secondUUID)
+	otherUUID, err := activate("frontend-1")
+	require.NoError(err)
+	assert.NotEqual(firstUUID, otherUUID)
+}
+
+func TestQuoteDiagnostic(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+	validator := c.qv.(*quote.MockValidator)
+
+	// a quote of another enclave only reveals the mismatching properties
+	cert, _, _ := util.MustGenerateTestMarbleCredentials()
+	otherEnclave := []byte("other enclave")
+	validator.AddValidQuote(otherEnclave, cert.Raw, quote.PackageProperties{UniqueID: "00"}, mnf.Infrastructures["Azure"])
+	_, err = c.verifyManifestRequirement(context.Background(), cert, otherEnclave, "backendFirst")
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+	assert.Equal("invalid quote: infrastructure Alibaba: package properties do not match: UniqueID; infrastructure Azure: package properties do not match: UniqueID", status.Convert(err).Message())
+
+	// a quote issued for another certificate
+	otherCert, _, _ := util.MustGenerateTestMarbleCredentials()
+	otherMessage := []byte("other message")
+	validator.AddValidQuote(otherMessage, otherCert.Raw, mnf.Packages["backend"], mnf.Infrastructures["Azure"])
+	_, err = c.verifyManifestRequirement(context.Background(), cert, otherMessage, "backendFirst")
+	assert.Contains(status.Convert(err).Message(), "infrastructure Azure: quote was not issued for the Marble's TLS certificate")
+
+	// other errors are not returned in detail, unless the package is built in debug mode
+	invalidQuote := []byte("invalid quote")
+	_, err = c.verifyManifestRequirement(context.Background(), cert, invalidQuote, "backendFirst")
+	assert.Contains(status.Convert(err).Message(), "infrastructure Azure: quote verification failed")
+	_, err = c.verifyManifestRequirement(context.Background(), cert, invalidQuote, "frontend")
+	assert.Contains(status.Convert(err).Message(), "infrastructure Azure: wrong quote")
+
+	assert.Equal("quote verification failed", quoteDiagnostic(map[string]error{"": errors.New("details")}, false))
+	assert.Equal("details", quoteDiagnostic(map[string]error{"": errors.New("details")}, true))
+}
+
+func TestActivateGroup(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c, mnf := mustSetup()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+	c.groupActivationTimeout = 100 * time.Millisecond
+
+	// every member of a group is attested against the TLS certificate of its own connection
+	validator := c.qv.(*quote.MockValidator)
+	newMember := func(marbleType string, group string, size uint32) (context.Context, *rpc.ActivationReq) {
+		cert, csr, _ := util.MustGenerateTestMarbleCredentials()
+		marbleQuote, err := c.qi.Issue(cert.Raw)
+		require.NoError(err)
+		validator.AddValidQuote(marbleQuote, cert.Raw, mnf.Packages[mnf.Marbles[marbleType].Package], mnf.Infrastructures["Azure"])
+		ctx := peer.NewContext(context.TODO(), &peer.Peer{
+			AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+		})
+		return ctx, &rpc.ActivationReq{CSR: csr, MarbleType: marbleType, Quote: marbleQuote, UUID: uuid.New().String(), Group: group, GroupSize: size}
+	}
+	activateAsync := func(ctx context.Context, req *rpc.ActivationReq) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			resp, err := c.Activate(ctx, req)
+			if err == nil && len(resp.GetParameters().GetEnv()) == 0 {
+				err = errors.New("response has no parameters")
+			}
+			errs <- err
+		}()
+		return errs
+	}
+	activations := func(marbleType string) uint {
+		activations, err := c.data.getActivations(marbleType)
+		if store.IsStoreValueUnsetError(err) {
+			return 0
+		}
+		require.NoError(err)
+		return activations
+	}
+	issued := func() uint64 {
+		size, err := c.data.getIssuanceLogSize()
+		require.NoError(err)
+		return size
+	}
+	waitForGroup := func(name string) {
+		require.Eventually(func() bool {
+			c.mux.Lock()
+			defer c.mux.Unlock()
+			_, ok := c.activationGroups[name]
+			return ok
+		}, time.Second, time.Millisecond)
+	}
+
+	frontendErr := activateAsync(newMember("frontend", "group", 2))
+	backendErr := activateAsync(newMember("backendFirst", "group", 2))
+	assert.NoError(<-frontendErr)
+	assert.NoError(<-backendErr)
+	assert.EqualValues(1, activations("frontend"))
+	assert.EqualValues(1, activations("backendFirst"))
+	issuedCerts := issued()
+
+	// the combined activations exceed the budget of backendFirst, so no certificates are issued
+	frontendErr = activateAsync(newMember("frontend", "group", 2))
+	backendErr = activateAsync(newMember("backendFirst", "group", 2))
+	assert.Equal(codes.ResourceExhausted, status.Code(<-frontendErr))
+	assert.Equal(codes.ResourceExhausted, status.Code(<-backendErr))
+	assert.EqualValues(1, activations("frontend"))
+	assert.Equal(issuedCerts, issued())
+
+	// an incomplete group is not activated
+	frontendErr = activateAsync(newMember("frontend", "incomplete", 2))
+	assert.Equal(codes.DeadlineExceeded, status.Code(<-frontendErr))
+	assert.EqualValues(1, activations("frontend"))
+	assert.Equal(issuedCerts, issued())
+
+	// a member which fails verification does not join the group
+	c.groupActivationTimeout = time.Minute
+	frontendErr = activateAsync(newMember("frontend", "verified", 2))
+	waitForGroup("verified")
+	ctx, req := newMember("frontend", "verified", 2)
+	req.Quote = []byte("invalid")
+	_, err = c.Activate(ctx, req)
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+	_, err = c.Activate(newMember("frontend", "verified", 3))
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+	assert.NoError(<-activateAsync(newMember("frontend", "verified", 2)))
+	assert.NoError(<-frontendErr)
+	assert.EqualValues(3, activations("frontend"))
+
+	// a member canceling its request aborts the group
+	ctx, req = newMember("frontend", "canceled", 2)
+	ctx, cancel := context.WithCancel(ctx)
+	frontendErr = activateAsync(ctx, req)
+	waitForGroup("canceled")
+	cancel()
+	assert.Equal(codes.Aborted, status.Code(<-frontendErr))
+	assert.EqualValues(3, activations("frontend"))
+	assert.Equal(issuedCerts+2, issued())
+
+	_, err = c.Activate(newMember("frontend", "single", 1))
+	assert.Equal(codes.InvalidArgument, status.Code(err))
 }
@@ -7,6 +7,9 @@
 package core
 
 import (
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
@@ -46,6 +49,7 @@ func newCoreMetrics(factory *promauto.Factory, core *Core, namespace string) *co
 type marbleAPIMetrics struct {
 	activation        CounterVec
 	activationSuccess CounterVec
+	certExpiry        *certExpiryTracker
 }
 
 func newMarbleAPIMetrics(factory *promauto.Factory, namespace string) *marbleAPIMetrics {
@@ -66,6 +70,7 @@ func newMarbleAPIMetrics(factory *promauto.Factory, namespace string) *marbleAPI
 			},
 			[]string{"type", "uuid"},
 		),
+		certExpiry: newCertExpiryTracker(factory, namespace),
 	}
 }
 
@@ -73,9 +78,58 @@ func newNullMarbleAPIMetrics() *marbleAPIMetrics {
 	return &marbleAPIMetrics{
 		activation:        NullCounterVec{},
 		activationSuccess: NullCounterVec{},
+		certExpiry:        newCertExpiryTracker(nil, ""),
+	}
+}
+
+// certExpiryTracker tracks the earliest expiry of issued Marble certificates per Marble type.
+// A gauge reporting the seconds until this expiry is registered for every Marble type on first use.
+type certExpiryTracker struct {
+	factory   *promauto.Factory
+	namespace string
+	mux       sync.Mutex
+	notAfter  map[string]time.Time
+}
+
+func newCertExpiryTracker(factory *promauto.Factory, namespace string) *certExpiryTracker {
+	return &certExpiryTracker{
+		factory:   factory,
+		namespace: namespace,
+		notAfter:  make(map[string]time.Time),
+	}
+}
+
+// update records the expiry of a newly issued certificate.
+// The tracked value is replaced if the new certificate expires earlier, or if the tracked certificate has already expired.
+func (t *certExpiryTracker) update(marbleType string, notAfter time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	current, ok := t.notAfter[marbleType]
+	if !ok && t.factory != nil {
+		t.factory.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace:   t.namespace,
+				Name:        "marble_certificate_expiry_seconds",
+				Help:        "Seconds until the earliest issued certificate of a Marble type expires.",
+				ConstLabels: prometheus.Labels{"type": marbleType},
+			},
+			func() float64 {
+				return t.secondsUntilExpiry(marbleType)
+			})
+	}
+	if !ok || notAfter.Before(current) || time.Now().After(current) {
+		t.notAfter[marbleType] = notAfter
 	}
 }
 
+// secondsUntilExpiry returns the seconds until the earliest tracked certificate of a Marble type expires.
+func (t *certExpiryTracker) secondsUntilExpiry(marbleType string) float64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return time.Until(t.notAfter[marbleType]).Seconds()
+}
+
 type NullCollector struct{}
 
 func (NullCollector) Describe(chan<- *prometheus.Desc) {}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
@@ -125,4 +126,38 @@ func TestMarbleAPIMetrics(t *testing.T) {
 	promtest.CollectAndCount(metrics.activationSuccess)
 	assert.Equal(float64(1), promtest.ToFloat64(metrics.activation.WithLabelValues("backendFirst", uuid)))
 	assert.Equal(float64(0), promtest.ToFloat64(metrics.activationSuccess.WithLabelValues("backendFirst", uuid)))
+
+	// the certificate expiry of the activated Marble type is exported
+	assert.Equal(1, mustGatherAndCount(t, promRegistry, "coordinator_marble_certificate_expiry_seconds"))
+	// Marble certificates are bounded by marbleCertValidity, so the gauge reports their real expiry
+	assert.InDelta(marbleCertValidity.Seconds(), metrics.certExpiry.secondsUntilExpiry("backendFirst"), 60)
+}
+
+func TestCertExpiryTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	promRegistry := prometheus.NewRegistry()
+	promFactory := promauto.With(promRegistry)
+	tracker := newCertExpiryTracker(&promFactory, "coordinator")
+
+	now := time.Now()
+	tracker.update("frontend", now.Add(2*time.Hour))
+	tracker.update("frontend", now.Add(time.Hour))
+	tracker.update("frontend", now.Add(3*time.Hour))
+	tracker.update("backend", now.Add(4*time.Hour))
+	assert.Equal(2, mustGatherAndCount(t, promRegistry, "coordinator_marble_certificate_expiry_seconds"))
+	assert.InDelta(time.Hour.Seconds(), tracker.secondsUntilExpiry("frontend"), 60)
+	assert.InDelta((4 * time.Hour).Seconds(), tracker.secondsUntilExpiry("backend"), 60)
+
+	// an expired certificate is replaced by the next issued one
+	tracker.update("backend", now.Add(-time.Hour))
+	assert.Less(tracker.secondsUntilExpiry("backend"), float64(0))
+	tracker.update("backend", now.Add(5*time.Hour))
+	assert.InDelta((5 * time.Hour).Seconds(), tracker.secondsUntilExpiry("backend"), 60)
+}
+
+func mustGatherAndCount(t *testing.T, gatherer prometheus.Gatherer, metricName string) int {
+	count, err := promtest.GatherAndCount(gatherer, metricName)
+	require.NoError(t, err)
+	return count
 }
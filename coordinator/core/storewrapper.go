@@ -7,11 +7,15 @@
 package core
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
@@ -21,12 +25,21 @@ import (
 
 const (
 	requestActivations    = "activations"
+	requestBlocklist      = "blocklist"
+	requestBundle         = "bundle"
 	requestCert           = "certificate"
+	requestDerivationRoot = "derivationRoot"
+	requestEffectiveMnf   = "effectiveManifest"
 	requestInfrastructure = "infrastructure"
+	requestIssuedCert     = "issuedCertificate"
+	requestIssuanceLog    = "issuanceLogSize"
 	requestManifest       = "manifest"
 	requestMarble         = "marble"
 	requestPackage        = "package"
 	requestPrivKey        = "privateKey"
+	requestQuoteSamples   = "quoteSamples"
+	requestRecoveryKeys   = "recoveryKeys"
+	requestRevokedCert    = "revokedCertificate"
 	requestSecret         = "secret"
 	requestState          = "state"
 	requestTLS            = "TLS"
@@ -35,12 +48,28 @@ const (
 )
 
 // storeWrapper is a wrapper for the store interface.
+// Store operations are bound to ctx, or to context.Background if it is unset.
 type storeWrapper struct {
 	store interface {
-		Get(string) ([]byte, error)
-		Put(string, []byte) error
-		Iterator(string) (store.Iterator, error)
+		Get(context.Context, string) ([]byte, error)
+		Put(context.Context, string, []byte) error
+		Iterator(context.Context, string) (store.Iterator, error)
 	}
+	ctx context.Context
+}
+
+// withContext returns a copy of the wrapper whose store operations abort once ctx is done.
+func (s storeWrapper) withContext(ctx context.Context) storeWrapper {
+	s.ctx = ctx
+	return s
+}
+
+// context returns the context store operations are bound to.
+func (s storeWrapper) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
 }
 
 // iteratorWrapper is a wrapper for the Iterator interface.
@@ -60,14 +89,14 @@ func (i iteratorWrapper) HasNext() bool {
 
 // getIterator returns a wrapped iterator from store.
 func (s storeWrapper) getIterator(prefix string) (iteratorWrapper, error) {
-	iter, err := s.store.Iterator(prefix)
+	iter, err := s.store.Iterator(s.context(), prefix)
 	return iteratorWrapper{iter, prefix}, err
 }
 
 // getActivations returns activations for a given Marble from store.
 func (s storeWrapper) getActivations(marbleType string) (uint, error) {
 	request := strings.Join([]string{requestActivations, marbleType}, ":")
-	rawActivations, err := s.store.Get(request)
+	rawActivations, err := s.store.Get(s.context(), request)
 	if err != nil {
 		return 0, err
 	}
@@ -81,7 +110,7 @@ func (s storeWrapper) putActivations(marbleType string, activations uint) error
 	request := strings.Join([]string{requestActivations, marbleType}, ":")
 	rawActivations := []byte(strconv.FormatUint(uint64(activations), 16))
 
-	return s.store.Put(request, rawActivations)
+	return s.store.Put(s.context(), request, rawActivations)
 }
 
 // incrementActivations is a wrapper for get/put activations to increment the value for one marble.
@@ -94,10 +123,32 @@ func (s storeWrapper) incrementActivations(marbleType string) error {
 	return s.putActivations(marbleType, activations)
 }
 
+// errActivationsExhausted is returned by compareAndIncrementActivations if an increment would exceed the activation budget.
+var errActivationsExhausted = errors.New("max activations reached")
+
+// compareAndIncrementActivations increments the activations of a Marble by count, unless this exceeds its MaxActivations.
+// On a transaction, the check and the increment are atomic, so concurrent activations cannot exceed the budget.
+// It returns the activations before the increment and the Marble's MaxActivations.
+func (s storeWrapper) compareAndIncrementActivations(marbleType string, count uint) (uint, uint, error) {
+	marble, err := s.getMarble(marbleType)
+	if err != nil {
+		return 0, 0, err
+	}
+	activations, err := s.getActivations(marbleType)
+	if err != nil && !store.IsStoreValueUnsetError(err) {
+		return 0, 0, err
+	}
+	// MaxActivations == 0 means infinite budget
+	if marble.MaxActivations > 0 && activations+count > marble.MaxActivations {
+		return activations, marble.MaxActivations, errActivationsExhausted
+	}
+	return activations, marble.MaxActivations, s.putActivations(marbleType, activations+count)
+}
+
 // getCertificate returns a certificate from store.
 func (s storeWrapper) getCertificate(certType string) (*x509.Certificate, error) {
 	request := strings.Join([]string{requestCert, certType}, ":")
-	rawCert, err := s.store.Get(request)
+	rawCert, err := s.store.Get(s.context(), request)
 	if err != nil {
 		return nil, err
 	}
@@ -108,7 +159,7 @@ func (s storeWrapper) getCertificate(certType string) (*x509.Certificate, error)
 // putCertificate saves a certificate to store.
 func (s storeWrapper) putCertificate(certType string, cert *x509.Certificate) error {
 	request := strings.Join([]string{requestCert, certType}, ":")
-	return s.store.Put(request, cert.Raw)
+	return s.store.Put(s.context(), request, cert.Raw)
 }
 
 // getInfrastructure returns infrastructure information from store.
@@ -147,10 +198,34 @@ func (s storeWrapper) putPackage(pkgName string, pkg quote.PackageProperties) er
 	return s._put(requestPackage, pkgName, pkg)
 }
 
+// getBlocklist returns the blocked entries of a Package from store.
+func (s storeWrapper) getBlocklist(pkgName string) ([]quote.PackageProperties, error) {
+	var blocklist []quote.PackageProperties
+	err := s._get(requestBlocklist, pkgName, &blocklist)
+	return blocklist, err
+}
+
+// putBlocklist saves the blocked entries of a Package to store.
+func (s storeWrapper) putBlocklist(pkgName string, blocklist []quote.PackageProperties) error {
+	return s._put(requestBlocklist, pkgName, blocklist)
+}
+
+// getQuoteSamples returns the quote samples of a Marble type from store, keyed by measurement.
+func (s storeWrapper) getQuoteSamples(marbleType string) (map[string]quoteSample, error) {
+	var samples map[string]quoteSample
+	err := s._get(requestQuoteSamples, marbleType, &samples)
+	return samples, err
+}
+
+// putQuoteSamples saves the quote samples of a Marble type to store.
+func (s storeWrapper) putQuoteSamples(marbleType string, samples map[string]quoteSample) error {
+	return s._put(requestQuoteSamples, marbleType, samples)
+}
+
 // getPrivK returns a private key from store.
 func (s storeWrapper) getPrivK(keyType string) (*ecdsa.PrivateKey, error) {
 	request := strings.Join([]string{requestPrivKey, keyType}, ":")
-	rawKey, err := s.store.Get(request)
+	rawKey, err := s.store.Get(s.context(), request)
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +241,7 @@ func (s storeWrapper) putPrivK(keyType string, privK *ecdsa.PrivateKey) error {
 	}
 
 	request := strings.Join([]string{requestPrivKey, keyType}, ":")
-	return s.store.Put(request, rawKey)
+	return s.store.Put(s.context(), request, rawKey)
 }
 
 // getManifest loads the manifest and marshalls it to manifest.Manifest.
@@ -181,14 +256,77 @@ func (s storeWrapper) getManifest() (manifest.Manifest, error) {
 	return manifest, err
 }
 
+// getCurrentManifest returns the manifest from store, with Marbles, Bundles, and RecoveryKeys replaced by their current definitions.
+// The definitions differ from the raw manifest if their parameters have been updated or a recovery key has been rotated.
+func (s storeWrapper) getCurrentManifest() (manifest.Manifest, error) {
+	mnf, err := s.getManifest()
+	if err != nil {
+		return mnf, err
+	}
+	for name := range mnf.Marbles {
+		marble, err := s.getMarble(name)
+		if err != nil {
+			return mnf, err
+		}
+		mnf.Marbles[name] = marble
+	}
+	if err := s.resolveBundles(&mnf); err != nil {
+		return mnf, err
+	}
+	recoveryKeys, err := s.getRecoveryKeys()
+	if err == nil {
+		mnf.RecoveryKeys = recoveryKeys
+	} else if !store.IsStoreValueUnsetError(err) {
+		return mnf, err
+	}
+	return mnf, nil
+}
+
+// resolveBundles replaces the Bundles of a manifest with their current versions, if they have been updated.
+func (s storeWrapper) resolveBundles(mnf *manifest.Manifest) error {
+	for name := range mnf.Bundles {
+		bundle, err := s.getBundle(name)
+		if store.IsStoreValueUnsetError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		mnf.Bundles[name] = bundle
+	}
+	return nil
+}
+
+// getBundle returns the updated version of a Bundle from store.
+func (s storeWrapper) getBundle(bundleName string) (manifest.Bundle, error) {
+	var bundle manifest.Bundle
+	err := s._get(requestBundle, bundleName, &bundle)
+	return bundle, err
+}
+
+// putBundle saves an updated version of a Bundle to store.
+func (s storeWrapper) putBundle(bundleName string, bundle manifest.Bundle) error {
+	return s._put(requestBundle, bundleName, bundle)
+}
+
 // getRawManifest returns the raw manifest from store.
 func (s storeWrapper) getRawManifest() ([]byte, error) {
-	return s.store.Get(requestManifest)
+	return s.store.Get(s.context(), requestManifest)
 }
 
 // putRawManifest saves the raw manifest to store.
 func (s storeWrapper) putRawManifest(manifest []byte) error {
-	return s.store.Put(requestManifest, manifest)
+	return s.store.Put(s.context(), requestManifest, manifest)
+}
+
+// getEffectiveRawManifest returns the raw manifest with the applied parameter updates from store.
+func (s storeWrapper) getEffectiveRawManifest() ([]byte, error) {
+	return s.store.Get(s.context(), requestEffectiveMnf)
+}
+
+// putEffectiveRawManifest saves the raw manifest with the applied parameter updates to store.
+func (s storeWrapper) putEffectiveRawManifest(manifest []byte) error {
+	return s.store.Put(s.context(), requestEffectiveMnf, manifest)
 }
 
 // getSecret returns a secret from store.
@@ -228,7 +366,7 @@ func (s storeWrapper) getSecretMap() (map[string]manifest.Secret, error) {
 
 // getState returns the state from store.
 func (s storeWrapper) getState() (state, error) {
-	rawState, err := s.store.Get("state")
+	rawState, err := s.store.Get(s.context(), "state")
 	if err != nil {
 		return -1, err
 	}
@@ -244,7 +382,137 @@ func (s storeWrapper) getState() (state, error) {
 // putState saves the state to store.
 func (s storeWrapper) putState(currState state) error {
 	rawState := []byte(strconv.Itoa(int(currState)))
-	return s.store.Put("state", rawState)
+	return s.store.Put(s.context(), "state", rawState)
+}
+
+// getDerivationRoot returns the root of the keys the Coordinator derives for Marbles.
+// Until the root is rotated for the first time, the Coordinator's root private key is used.
+func (s storeWrapper) getDerivationRoot() (derivationRoot, error) {
+	rawRoot, err := s.store.Get(s.context(), requestDerivationRoot)
+	if store.IsStoreValueUnsetError(err) {
+		rootPrivK, err := s.getPrivK(sKCoordinatorRootKey)
+		if err != nil {
+			return derivationRoot{}, err
+		}
+		return derivationRoot{Current: rootPrivK.D.Bytes()}, nil
+	}
+	if err != nil {
+		return derivationRoot{}, err
+	}
+
+	var root derivationRoot
+	err = json.Unmarshal(rawRoot, &root)
+	return root, err
+}
+
+// putDerivationRoot saves the root of the keys the Coordinator derives for Marbles to store.
+func (s storeWrapper) putDerivationRoot(root derivationRoot) error {
+	rawRoot, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(s.context(), requestDerivationRoot, rawRoot)
+}
+
+// getRecoveryKeys returns the recovery keys which replaced the RecoveryKeys of the manifest.
+func (s storeWrapper) getRecoveryKeys() (map[string]string, error) {
+	rawKeys, err := s.store.Get(s.context(), requestRecoveryKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var recoveryKeys map[string]string
+	err = json.Unmarshal(rawKeys, &recoveryKeys)
+	return recoveryKeys, err
+}
+
+// putRecoveryKeys saves the recovery keys which replace the RecoveryKeys of the manifest.
+func (s storeWrapper) putRecoveryKeys(recoveryKeys map[string]string) error {
+	rawKeys, err := json.Marshal(recoveryKeys)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(s.context(), requestRecoveryKeys, rawKeys)
+}
+
+// getIssuanceLogSize returns the number of entries in the issuance log.
+func (s storeWrapper) getIssuanceLogSize() (uint64, error) {
+	rawSize, err := s.store.Get(s.context(), requestIssuanceLog)
+	if store.IsStoreValueUnsetError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(rawSize), 16, 64)
+}
+
+// getIssuedCertificate returns the entry of the issuance log at the given index.
+func (s storeWrapper) getIssuedCertificate(index uint64) (IssuedCertificate, error) {
+	var entry IssuedCertificate
+	err := s._get(requestIssuedCert, fmt.Sprintf("%016x", index), &entry)
+	return entry, err
+}
+
+// recordIssuedCertificate appends a certificate signed by the Coordinator to the issuance log.
+func (s storeWrapper) recordIssuedCertificate(certRaw []byte, marbleType, userName string) error {
+	cert, err := x509.ParseCertificate(certRaw)
+	if err != nil {
+		return err
+	}
+	return s.appendIssuedCertificate(IssuedCertificate{
+		Serial:      cert.SerialNumber.String(),
+		MarbleType:  marbleType,
+		User:        userName,
+		Issued:      time.Now().UTC(),
+		Certificate: certRaw,
+	})
+}
+
+// appendIssuedCertificate appends an entry to the issuance log. Existing entries are never modified.
+func (s storeWrapper) appendIssuedCertificate(entry IssuedCertificate) error {
+	size, err := s.getIssuanceLogSize()
+	if err != nil {
+		return err
+	}
+	if err := s._put(requestIssuedCert, fmt.Sprintf("%016x", size), entry); err != nil {
+		return err
+	}
+	return s.store.Put(s.context(), requestIssuanceLog, []byte(strconv.FormatUint(size+1, 16)))
+}
+
+// getRevokedCertificate returns the revocation of the certificate with the given decimal serial number.
+func (s storeWrapper) getRevokedCertificate(serial string) (RevokedCertificate, error) {
+	var revoked RevokedCertificate
+	err := s._get(requestRevokedCert, serial, &revoked)
+	return revoked, err
+}
+
+// putRevokedCertificate saves the revocation of a certificate to store.
+func (s storeWrapper) putRevokedCertificate(revoked RevokedCertificate) error {
+	return s._put(requestRevokedCert, revoked.Serial, revoked)
+}
+
+// getRevokedCertificates returns all revoked certificates.
+func (s storeWrapper) getRevokedCertificates() ([]RevokedCertificate, error) {
+	iter, err := s.getIterator(requestRevokedCert)
+	if err != nil {
+		return nil, err
+	}
+
+	var revokedCerts []RevokedCertificate
+	for iter.HasNext() {
+		serial, err := iter.GetNext()
+		if err != nil {
+			return nil, err
+		}
+		revoked, err := s.getRevokedCertificate(serial)
+		if err != nil {
+			return nil, err
+		}
+		revokedCerts = append(revokedCerts, revoked)
+	}
+	return revokedCerts, nil
 }
 
 // getTLS returns a named t-TLS config from store.
@@ -261,13 +529,13 @@ func (s storeWrapper) putTLS(tagName string, tag manifest.TLStag) error {
 
 // getUpdateLog returns the update log from store.
 func (s storeWrapper) getUpdateLog() (string, error) {
-	log, err := s.store.Get(requestUpdateLog)
+	log, err := s.store.Get(s.context(), requestUpdateLog)
 	return string(log), err
 }
 
 // putUpdateLog saves the update log to store.
 func (s storeWrapper) putUpdateLog(updateLog string) error {
-	return s.store.Put(requestUpdateLog, []byte(updateLog))
+	return s.store.Put(s.context(), requestUpdateLog, []byte(updateLog))
 }
 
 // appendUpdateLog appends new entries to the log and saves it to store.
@@ -298,13 +566,13 @@ func (s storeWrapper) _put(requestType, requestResource string, target interface
 	if err != nil {
 		return err
 	}
-	return s.store.Put(request, rawData)
+	return s.store.Put(s.context(), request, rawData)
 }
 
 // _get is the default method for loading and unmarshaling data from store.
 func (s storeWrapper) _get(requestType, requestResource string, target interface{}) error {
 	request := strings.Join([]string{requestType, requestResource}, ":")
-	rawData, err := s.store.Get(request)
+	rawData, err := s.store.Get(s.context(), request)
 	if err != nil {
 		return err
 	}
@@ -7,6 +7,7 @@
 package core
 
 import (
+	"context"
 	"testing"
 
 	"github.com/edgelesssys/marblerun/coordinator/manifest"
@@ -44,9 +45,9 @@ func TestStoreWrapper(t *testing.T) {
 	testUser := user.NewUser("test-user", testUserCert)
 
 	// save values to store
-	tx, err := c.store.BeginTransaction()
+	tx, err := c.store.BeginTransaction(context.Background())
 	assert.NoError(err)
-	txdata := storeWrapper{tx}
+	txdata := storeWrapper{store: tx}
 	assert.NoError(txdata.putActivations("test-marble", testActivations))
 	assert.NoError(txdata.putCertificate("some-cert", someCert))
 	assert.NoError(txdata.putPrivK("some-key", somePrivK))
@@ -117,14 +118,14 @@ func TestStoreWrapperRollback(t *testing.T) {
 	c := NewCoreWithMocks()
 
 	activations := uint(15)
-	tx, err := c.store.BeginTransaction()
+	tx, err := c.store.BeginTransaction(context.Background())
 	assert.NoError(err)
-	assert.NoError(storeWrapper{tx}.putActivations("test-marble-1", activations))
+	assert.NoError(storeWrapper{store: tx}.putActivations("test-marble-1", activations))
 	assert.NoError(tx.Commit())
 
-	tx, err = c.store.BeginTransaction()
+	tx, err = c.store.BeginTransaction(context.Background())
 	assert.NoError(err)
-	assert.NoError(storeWrapper{tx}.putActivations("test-marble-2", uint(20)))
+	assert.NoError(storeWrapper{store: tx}.putActivations("test-marble-2", uint(20)))
 	tx.Rollback()
 
 	val, err := c.data.getActivations("test-marble-1")
@@ -133,3 +134,34 @@ func TestStoreWrapperRollback(t *testing.T) {
 	_, err = c.data.getActivations("test-marble-2")
 	assert.True(store.IsStoreValueUnsetError(err))
 }
+
+func TestStoreWrapperContext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := NewCoreWithMocks()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data := c.data.withContext(ctx)
+
+	_, err = data.getCertificate(sKMarbleRootCert)
+	assert.Equal(context.Canceled, err)
+	_, err = data.getPrivK(sKCoordinatorIntermediateKey)
+	assert.Equal(context.Canceled, err)
+	_, err = data.getManifest()
+	assert.Equal(context.Canceled, err)
+	_, err = data.getSecretMap()
+	assert.Equal(context.Canceled, err)
+	_, err = data.getActivations("frontend")
+	assert.Equal(context.Canceled, err)
+	assert.Equal(context.Canceled, data.incrementActivations("frontend"))
+
+	// the wrapped store is not bound to the context
+	_, err = c.data.getCertificate(sKMarbleRootCert)
+	assert.NoError(err)
+	_, err = c.data.getActivations("frontend")
+	assert.True(store.IsStoreValueUnsetError(err))
+}
@@ -8,19 +8,36 @@ package manifest
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
+	// embed the time zone database, as the Coordinator's environment may not provide one
+	_ "time/tzdata"
+
+	"github.com/c2h5oh/datasize"
+	libMarble "github.com/edgelesssys/ego/marble"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
 	"github.com/edgelesssys/marblerun/coordinator/user"
+	"github.com/edgelesssys/marblerun/util"
 	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 // Manifest defines the rules of a mesh
@@ -41,6 +58,29 @@ type Manifest struct {
 	Roles map[string]Role
 	// TLS contains tags which can be assiged to Marbles to specify which connections should be elevated to TLS
 	TLS map[string]TLStag
+	// LenientTLS lets Marbles activate although an incoming TLS entry references an unset user-defined secret.
+	// Such entries present the Marble's certificate and require client authentication instead, so they are never served without TLS.
+	// This is meant to speed up development and should not be used in production.
+	LenientTLS bool `json:",omitempty"`
+	// CoordinatorEnv lists environment variables of the Coordinator which can be injected into Marble parameters using the coordinatorEnv template function.
+	CoordinatorEnv []string `json:",omitempty"`
+	// CoordinatorFiles maps absolute paths of files on the Coordinator's host which can be injected into Marble parameters using the hostFile template function
+	// to the hex-encoded SHA-256 hash of their expected contents.
+	// The files are read on each activation and rejected if their contents differ.
+	CoordinatorFiles map[string]string `json:",omitempty"`
+	// DefaultParameters contains environment variables and commandline arguments which are inherited by all Marbles.
+	DefaultParameters DefaultParameters
+	// BlockedPackages lists revoked enclave builds per package. Marbles whose quote matches a blocked entry are rejected during activation.
+	// An entry matches by UniqueID (MRENCLAVE) or by SignerID and ProductID. It can only be set in an update manifest.
+	// Unlike a raised SecurityVersion, blocking entries does not rotate the intermediate CA, so running Marbles keep their certificates.
+	BlockedPackages map[string][]quote.PackageProperties `json:",omitempty"`
+	// Templates contains partial Parameters which Marbles can inherit from.
+	Templates map[string]ParameterTemplate `json:",omitempty"`
+	// Bundles contains named, versioned sets of Files which Marbles can include.
+	// An update manifest can replace a bundle with a new Version, which changes the Files of all Marbles including it.
+	Bundles map[string]Bundle `json:",omitempty"`
+	// Metadata holds human annotations, e.g. an owner or a ticket reference. It is not interpreted by the Coordinator.
+	Metadata map[string]string `json:",omitempty"`
 }
 
 // Marble describes a service in the mesh that should be handled and verified by the Coordinator
@@ -48,12 +88,373 @@ type Marble struct {
 	// Package references one of the allowed enclaves in the manifest.
 	Package string
 	// MaxActivations allows to limit the number of marbles of a kind.
+	// It can be raised or lowered by an update manifest. Lowering it below the number of activations only rejects further activations.
 	MaxActivations uint
 	// Parameters contains lists for files, environment variables and commandline arguments that should be passed to the application.
 	// Placeholder variables are supported for specific assets of the marble's activation process.
 	Parameters Parameters
+	// InfrastructureParameters maps names of Infrastructures to Parameters which are merged over the Marble's Parameters
+	// if the Marble's quote was verified for this infrastructure.
+	// This lets one Marble definition use different Files, Env, and Argv depending on where it runs.
+	InfrastructureParameters map[string]Parameters `json:",omitempty"`
 	// TLS holds a list of tags which are specified in the manifest
 	TLS []string
+	// Inherits lists Templates whose Parameters are merged in order before the Marble's own Parameters.
+	Inherits []string `json:",omitempty"`
+	// Bundles lists Bundles whose Files are added to the Marble's Files. Bundles included by the same Marble may not contain the same path.
+	// The Marble's own Files take precedence over those of its Bundles.
+	Bundles []string `json:",omitempty"`
+	// Tags holds metadata, e.g. for cost attribution, which is available in templates as {{ .MarbleRun.Tags.<name> }}.
+	Tags map[string]string `json:",omitempty"`
+	// ActivationSchedule optionally restricts activations of the Marble to a recurring time window.
+	ActivationSchedule *ActivationSchedule `json:",omitempty"`
+	// RequiredDNSNames lists DNS names which must be requested in the Marble's CSR, e.g. its service name.
+	// Activations with a CSR missing any of them are rejected, unless MergeRequiredDNSNames is set.
+	RequiredDNSNames []string `json:",omitempty"`
+	// MergeRequiredDNSNames adds RequiredDNSNames missing from the Marble's CSR to its certificate instead of rejecting the activation.
+	// DNS names supplied by the Marble are kept.
+	MergeRequiredDNSNames bool `json:",omitempty"`
+	// CertificatePolicies lists OIDs in dotted notation, e.g., "2.23.140.1.2.1", which are added as policies to the Marble's certificate.
+	CertificatePolicies []string `json:",omitempty"`
+	// AllowedCSRExtensions lists OIDs in dotted notation of extensions which are copied from the Marble's CSR to its certificate,
+	// e.g., an embedded SCT or a custom identity claim. Other extensions of the CSR are dropped.
+	// Extensions set by the Coordinator, like BasicConstraints or KeyUsage, can not be allowed.
+	AllowedCSRExtensions []string `json:",omitempty"`
+	// SignatureAlgorithm forces the algorithm the Coordinator signs the Marble's certificate with, e.g., "ECDSA-SHA384".
+	// It must match the Coordinator's ECDSA key. If unset, the algorithm is chosen based on the key.
+	SignatureAlgorithm string `json:",omitempty"`
+	// Metadata holds human annotations, e.g. an owner or a description. It is not interpreted by the Coordinator.
+	Metadata map[string]string `json:",omitempty"`
+	// AllowSimulation controls whether the quote of the Marble is validated.
+	// If true, the quote is not validated if the Coordinator runs in simulation mode or was started with EDG_COORDINATOR_ALLOW_MARBLE_SIMULATION.
+	// Such Marbles only receive their own secrets, but no shared or user-defined ones, from a Coordinator on SGX hardware.
+	// If false, the quote is always validated.
+	// If unset, the quote is only validated if the Coordinator itself does not run in simulation mode.
+	AllowSimulation *bool `json:",omitempty"`
+	// AllowCA permits the Marble to receive secrets of type ca-cert, which it can use to issue certificates itself.
+	AllowCA bool `json:",omitempty"`
+	// DeriveUUID lets Marbles omit their UUID on activation. The Coordinator then derives a deterministic UUID from the Marble's type and hostname,
+	// so a restarted Marble keeps its identity and per-Marble secrets without persisting its UUID.
+	DeriveUUID bool `json:",omitempty"`
+	// EncryptedParameters names Files and Env which are additionally encrypted to the key of the Marble's CSR in the activation response.
+	// The premain decrypts them, so their values are not transmitted in plaintext, even inside the attested TLS channel.
+	EncryptedParameters *EncryptedParameters `json:",omitempty"`
+	// FilesArchive delivers the Marble's Files as a single tar archive in the MARBLE_FILES_ARCHIVE environment variable instead of separate entries.
+	// The premain extracts the archive and only moves the files to their paths once all of them have been written.
+	FilesArchive bool `json:",omitempty"`
+	// PlatformBoundSecrets binds the Marble's derived secrets, i.e., symmetric-key and hmac secrets which are neither shared nor user-defined,
+	// to the SGX platform. The Coordinator passes them to the premain instead of the Marble's templates, and the premain combines them with
+	// a key derived from its seal key, so the resulting values can only be obtained by the Marble on its original hardware.
+	// The Marble receives them in the MARBLE_PLATFORM_BOUND_SECRETS environment variable. Marbles running in simulation mode receive the unbound values.
+	PlatformBoundSecrets bool `json:",omitempty"`
+	// Resources holds hints on the resources the Marble needs. They are not enforced by the Coordinator,
+	// but exposed to tooling, e.g., to generate the resource requests of the Marble's pods.
+	Resources *Resources `json:",omitempty"`
+	// OmitReservedEnv lists reserved environment variables (MARBLE_PREDEFINED_ROOT_CA, MARBLE_PREDEFINED_MARBLE_CERTIFICATE_CHAIN, MARBLE_PREDEFINED_PRIVATE_KEY)
+	// which are not passed to the Marble, e.g., because it obtains its identity another way. By default, all of them are set.
+	OmitReservedEnv []string `json:",omitempty"`
+	// LogLevel is passed to the Marble in the MARBLE_LOG_LEVEL environment variable, e.g., to raise the verbosity of a misbehaving Marble type.
+	// It is not interpreted by the Coordinator and can be changed for subsequent activations by a parameters-only update.
+	LogLevel string `json:",omitempty"`
+}
+
+// PolicyIdentifiers returns the parsed CertificatePolicies of the Marble.
+func (m Marble) PolicyIdentifiers() ([]asn1.ObjectIdentifier, error) {
+	var policies []asn1.ObjectIdentifier
+	for _, oid := range m.CertificatePolicies {
+		policy, err := util.ParseOID(oid)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// coordinatorExtensions lists the OIDs of certificate extensions which are set by the Coordinator and can not be copied from a CSR.
+var coordinatorExtensions = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14}, // Subject Key Identifier
+	{2, 5, 29, 15}, // Key Usage
+	{2, 5, 29, 17}, // Subject Alternative Name
+	{2, 5, 29, 19}, // Basic Constraints
+	{2, 5, 29, 30}, // Name Constraints
+	{2, 5, 29, 32}, // Certificate Policies
+	{2, 5, 29, 35}, // Authority Key Identifier
+	{2, 5, 29, 37}, // Extended Key Usage
+}
+
+// CSRExtensionIdentifiers returns the parsed AllowedCSRExtensions of the Marble.
+func (m Marble) CSRExtensionIdentifiers() ([]asn1.ObjectIdentifier, error) {
+	var extensions []asn1.ObjectIdentifier
+	for _, oid := range m.AllowedCSRExtensions {
+		extension, err := util.ParseOID(oid)
+		if err != nil {
+			return nil, err
+		}
+		for _, reserved := range coordinatorExtensions {
+			if extension.Equal(reserved) {
+				return nil, fmt.Errorf("extension %s is set by the Coordinator", extension)
+			}
+		}
+		extensions = append(extensions, extension)
+	}
+	return extensions, nil
+}
+
+// issuerKeyAlgorithm is the type of the Coordinator's intermediate key, which signs the certificates of Marbles.
+const issuerKeyAlgorithm = x509.ECDSA
+
+// signatureAlgorithmKeys maps the SignatureAlgorithms supported for Marble certificates to the key type they require.
+// Algorithms using MD5 or SHA-1 are not supported.
+var signatureAlgorithmKeys = map[x509.SignatureAlgorithm]x509.PublicKeyAlgorithm{
+	x509.SHA256WithRSA:    x509.RSA,
+	x509.SHA384WithRSA:    x509.RSA,
+	x509.SHA512WithRSA:    x509.RSA,
+	x509.SHA256WithRSAPSS: x509.RSA,
+	x509.SHA384WithRSAPSS: x509.RSA,
+	x509.SHA512WithRSAPSS: x509.RSA,
+	x509.ECDSAWithSHA256:  x509.ECDSA,
+	x509.ECDSAWithSHA384:  x509.ECDSA,
+	x509.ECDSAWithSHA512:  x509.ECDSA,
+	x509.PureEd25519:      x509.Ed25519,
+}
+
+// CertificateSignatureAlgorithm returns the parsed SignatureAlgorithm of the Marble.
+// If it is unset, x509.UnknownSignatureAlgorithm is returned, which lets the algorithm be chosen based on the issuer key.
+func (m Marble) CertificateSignatureAlgorithm() (x509.SignatureAlgorithm, error) {
+	if m.SignatureAlgorithm == "" {
+		return x509.UnknownSignatureAlgorithm, nil
+	}
+	for algorithm, keyAlgorithm := range signatureAlgorithmKeys {
+		if !strings.EqualFold(algorithm.String(), m.SignatureAlgorithm) {
+			continue
+		}
+		if keyAlgorithm != issuerKeyAlgorithm {
+			return x509.UnknownSignatureAlgorithm, fmt.Errorf("SignatureAlgorithm %s requires an %s key, but the Coordinator signs with an %s key", algorithm, keyAlgorithm, issuerKeyAlgorithm)
+		}
+		return algorithm, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported SignatureAlgorithm %q", m.SignatureAlgorithm)
+}
+
+// MarbleEnvironmentLogLevel is the environment variable holding the LogLevel of a Marble, if it is set.
+const MarbleEnvironmentLogLevel = "MARBLE_LOG_LEVEL"
+
+// logLevelPattern matches valid values of a Marble's LogLevel, e.g. "debug".
+var logLevelPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Resources describes the expected resource usage of a Marble.
+type Resources struct {
+	// Memory is the enclave size of the Marble in the notation of Gramine's sgx.enclave_size, e.g., "1024M" or "2G".
+	Memory string `json:",omitempty"`
+	// CPU is the amount of CPU the Marble needs as a Kubernetes quantity, e.g., "500m" or "2".
+	CPU string `json:",omitempty"`
+}
+
+// MemoryBytes returns the parsed Memory in bytes, or 0 if it is unset.
+func (r Resources) MemoryBytes() (uint64, error) {
+	if r.Memory == "" {
+		return 0, nil
+	}
+	var size datasize.ByteSize
+	if err := size.UnmarshalText([]byte(r.Memory)); err != nil {
+		return 0, fmt.Errorf("invalid Memory %q: %w", r.Memory, err)
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("invalid Memory %q: must be positive", r.Memory)
+	}
+	return size.Bytes(), nil
+}
+
+// check checks if the resource hints are valid.
+func (r Resources) check() error {
+	if _, err := r.MemoryBytes(); err != nil {
+		return err
+	}
+	if r.CPU != "" {
+		cpu, err := resource.ParseQuantity(r.CPU)
+		if err != nil {
+			return fmt.Errorf("invalid CPU %q: %w", r.CPU, err)
+		}
+		if cpu.Sign() <= 0 {
+			return fmt.Errorf("invalid CPU %q: must be positive", r.CPU)
+		}
+	}
+	return nil
+}
+
+// checkLogLevel checks if the LogLevel of a Marble is empty or a valid value.
+func (m Marble) checkLogLevel() error {
+	if m.LogLevel != "" && !logLevelPattern.MatchString(m.LogLevel) {
+		return fmt.Errorf("invalid LogLevel %q: only letters, digits, '_', '.', and '-' are allowed", m.LogLevel)
+	}
+	return nil
+}
+
+// reservedEnv lists the environment variables the Coordinator sets for every Marble.
+var reservedEnv = []string{libMarble.MarbleEnvironmentRootCA, libMarble.MarbleEnvironmentCertificateChain, libMarble.MarbleEnvironmentPrivateKey}
+
+// EncryptedParameters names the Parameters of a Marble which are encrypted in the activation response.
+type EncryptedParameters struct {
+	// Files lists paths of the Marble's Files.
+	Files []string `json:",omitempty"`
+	// Env lists names of the Marble's environment variables.
+	Env []string `json:",omitempty"`
+}
+
+// check checks if all named parameters are defined for the Marble, either in params or in any of its InfrastructureParameters.
+func (e EncryptedParameters) check(params Parameters, infrastructureParams map[string]Parameters) error {
+	defined := func(name string, get func(Parameters) map[string]File) bool {
+		if _, ok := get(params)[name]; ok {
+			return true
+		}
+		for _, infraParams := range infrastructureParams {
+			if _, ok := get(infraParams)[name]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	for _, name := range e.Files {
+		if !defined(name, func(p Parameters) map[string]File { return p.Files }) {
+			return fmt.Errorf("EncryptedParameters references undefined file %s", name)
+		}
+	}
+	for _, name := range e.Env {
+		if !defined(name, func(p Parameters) map[string]File { return p.Env }) {
+			return fmt.Errorf("EncryptedParameters references undefined environment variable %s", name)
+		}
+	}
+	return nil
+}
+
+// checkFilesArchive checks if the parameters of a Marble with FilesArchive can be delivered as an archive.
+func checkFilesArchive(marble Marble, params Parameters) error {
+	if marble.EncryptedParameters != nil && len(marble.EncryptedParameters.Files) > 0 {
+		return errors.New("EncryptedParameters cannot name Files if FilesArchive is set")
+	}
+	allParams := []Parameters{params}
+	for _, infraParams := range marble.InfrastructureParameters {
+		allParams = append(allParams, infraParams)
+	}
+	for _, p := range allParams {
+		if _, ok := p.Env[util.MarbleEnvironmentFilesArchive]; ok {
+			return fmt.Errorf("environment variable %s is reserved for the FilesArchive", util.MarbleEnvironmentFilesArchive)
+		}
+	}
+	return nil
+}
+
+// ActivationSchedule defines a recurring time window in which a Marble may be activated.
+type ActivationSchedule struct {
+	// Days lists the weekdays on which activations are allowed, e.g. "Monday". If empty, every day is allowed.
+	Days []string `json:",omitempty"`
+	// Start and End define the daily window in 24-hour format, e.g. "08:00" and "18:00". End is exclusive.
+	// If End is before Start, the window spans midnight. If both are empty, the whole day is allowed.
+	Start string `json:",omitempty"`
+	End   string `json:",omitempty"`
+	// Timezone is the IANA name of the time zone the schedule is defined in, e.g. "Europe/Berlin". Defaults to UTC.
+	Timezone string `json:",omitempty"`
+}
+
+// Check checks if the ActivationSchedule is valid.
+func (s ActivationSchedule) Check() error {
+	_, err := s.location()
+	if err != nil {
+		return err
+	}
+	for _, day := range s.Days {
+		if _, err := parseWeekday(day); err != nil {
+			return err
+		}
+	}
+	_, _, err = s.window()
+	return err
+}
+
+// Allows returns true if activations are allowed at the given time.
+func (s ActivationSchedule) Allows(t time.Time) (bool, error) {
+	loc, err := s.location()
+	if err != nil {
+		return false, err
+	}
+	t = t.In(loc)
+
+	if len(s.Days) > 0 {
+		dayAllowed := false
+		for _, day := range s.Days {
+			weekday, err := parseWeekday(day)
+			if err != nil {
+				return false, err
+			}
+			if weekday == t.Weekday() {
+				dayAllowed = true
+				break
+			}
+		}
+		if !dayAllowed {
+			return false, nil
+		}
+	}
+
+	start, end, err := s.window()
+	if err != nil {
+		return false, err
+	}
+	if start == end {
+		return true, nil
+	}
+	now := sinceMidnight(t)
+	if start < end {
+		return start <= now && now < end, nil
+	}
+	return now >= start || now < end, nil
+}
+
+func (s ActivationSchedule) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %s: %w", s.Timezone, err)
+	}
+	return loc, nil
+}
+
+// window returns Start and End as offsets from midnight.
+func (s ActivationSchedule) window() (time.Duration, time.Duration, error) {
+	if s.Start == "" && s.End == "" {
+		return 0, 0, nil
+	}
+	if s.Start == "" || s.End == "" {
+		return 0, 0, errors.New("activation schedule must define both Start and End")
+	}
+	start, err := time.Parse("15:04", s.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Start %s: %w", s.Start, err)
+	}
+	end, err := time.Parse("15:04", s.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid End %s: %w", s.End, err)
+	}
+	if start.Equal(end) {
+		return 0, 0, errors.New("activation schedule defines an empty time window")
+	}
+	return sinceMidnight(start), sinceMidnight(end), nil
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+}
+
+func parseWeekday(day string) (time.Weekday, error) {
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if strings.EqualFold(day, weekday.String()) {
+			return weekday, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %s", day)
 }
 
 // Parameters contains lists for files, environment variables and commandline arguments that should be passed to an application
@@ -63,6 +464,142 @@ type Parameters struct {
 	Argv  []string
 }
 
+// DefaultParameters contains environment variables and commandline arguments that are passed to every application of the manifest
+type DefaultParameters struct {
+	Env  map[string]File `json:",omitempty"`
+	Argv []string        `json:",omitempty"`
+}
+
+// WithDefaults returns a copy of the Parameters with the defaults merged in.
+// Environment variables of the Parameters override defaults of the same name, and Argv replaces the default Argv if set.
+func (p Parameters) WithDefaults(defaults DefaultParameters) Parameters {
+	return Parameters{Env: defaults.Env, Argv: defaults.Argv}.merge(p)
+}
+
+// merge returns a copy of the Parameters with overlay merged on top.
+// Files and environment variables of overlay override those of the same name, and Argv of overlay replaces Argv if set.
+func (p Parameters) merge(overlay Parameters) Parameters {
+	merged := Parameters{
+		Files: mergeFiles(p.Files, overlay.Files),
+		Env:   mergeFiles(p.Env, overlay.Env),
+		Argv:  overlay.Argv,
+	}
+	if len(merged.Argv) == 0 {
+		merged.Argv = p.Argv
+	}
+	return merged
+}
+
+func mergeFiles(base, overlay map[string]File) map[string]File {
+	if len(base) == 0 {
+		return overlay
+	}
+	if len(overlay) == 0 {
+		return base
+	}
+	merged := make(map[string]File, len(base)+len(overlay))
+	for name, file := range base {
+		merged[name] = file
+	}
+	for name, file := range overlay {
+		merged[name] = file
+	}
+	return merged
+}
+
+// ParameterTemplate contains partial Parameters which can be inherited by Marbles and other templates.
+type ParameterTemplate struct {
+	// Inherits lists Templates which are merged in order before the template's own Parameters.
+	Inherits []string `json:",omitempty"`
+	Parameters
+}
+
+// Bundle is a versioned set of Files which can be included by multiple Marbles.
+type Bundle struct {
+	// Version identifies the content of the bundle. It has to change whenever the bundle is updated.
+	Version string
+	// Files maps paths to the content of the files.
+	Files map[string]File
+}
+
+// ResolveParameters returns the Parameters of a Marble with the manifest's DefaultParameters, all inherited Templates, and included Bundles merged in.
+// Defaults are applied first, followed by the inherited Templates in order, the Files of the Bundles, and finally the Marble's own Parameters.
+func (m Manifest) ResolveParameters(marble Marble) (Parameters, error) {
+	params := Parameters{Env: m.DefaultParameters.Env, Argv: m.DefaultParameters.Argv}
+	for _, name := range marble.Inherits {
+		tmpl, err := m.resolveTemplate(name, nil)
+		if err != nil {
+			return Parameters{}, err
+		}
+		params = params.merge(tmpl)
+	}
+	bundleFiles, err := m.resolveBundles(marble.Bundles)
+	if err != nil {
+		return Parameters{}, err
+	}
+	params = params.merge(Parameters{Files: bundleFiles})
+	return params.merge(marble.Parameters), nil
+}
+
+// resolveBundles returns the combined Files of the named bundles.
+// It fails if a bundle does not exist or if two bundles contain the same path.
+func (m Manifest) resolveBundles(names []string) (map[string]File, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	files := map[string]File{}
+	origin := map[string]string{}
+	for _, name := range names {
+		bundle, ok := m.Bundles[name]
+		if !ok {
+			return nil, fmt.Errorf("manifest does not contain bundle %s", name)
+		}
+		for path, file := range bundle.Files {
+			if other, ok := origin[path]; ok {
+				return nil, fmt.Errorf("bundles %s and %s both contain file %s", other, name, path)
+			}
+			origin[path] = name
+			files[path] = file
+		}
+	}
+	return files, nil
+}
+
+// ResolveInfrastructureParameters returns the Parameters of a Marble activated on the named infrastructure.
+// The Marble's InfrastructureParameters for this infrastructure, if any, are merged over the result of ResolveParameters.
+func (m Manifest) ResolveInfrastructureParameters(marble Marble, infrastructure string) (Parameters, error) {
+	params, err := m.ResolveParameters(marble)
+	if err != nil {
+		return Parameters{}, err
+	}
+	return params.merge(marble.InfrastructureParameters[infrastructure]), nil
+}
+
+// resolveTemplate returns the Parameters of a template with all templates it inherits from merged in.
+// path holds the templates currently being resolved and is used to detect cyclic inheritance.
+func (m Manifest) resolveTemplate(name string, path []string) (Parameters, error) {
+	for i, visited := range path {
+		if visited == name {
+			return Parameters{}, fmt.Errorf("cyclic template inheritance: %s", strings.Join(append(path[i:], name), " -> "))
+		}
+	}
+	tmpl, ok := m.Templates[name]
+	if !ok {
+		return Parameters{}, fmt.Errorf("manifest does not contain template %s", name)
+	}
+
+	path = append(path, name)
+	var params Parameters
+	for _, parent := range tmpl.Inherits {
+		parentParams, err := m.resolveTemplate(parent, path)
+		if err != nil {
+			return Parameters{}, err
+		}
+		params = params.merge(parentParams)
+	}
+	return params.merge(tmpl.Parameters), nil
+}
+
 // File defines data, encoding type, and if data contains templates for a File or Env variable
 type File struct {
 	// Data is the data to be saved as a file or environment variable
@@ -71,6 +608,15 @@ type File struct {
 	Encoding string
 	// NoTemplates specifies if Data contains templates which should be filled with information by the Coordinator
 	NoTemplates bool
+	// Secret names a secret whose raw value is used instead of Data. It is the same as {{ raw .Secrets.<name> }},
+	// but Data is not parsed as a template, so it is the safe way to pass binary secrets.
+	Secret string
+}
+
+// SecretTemplate returns the template that renders the Secret of the File.
+// The template is built from the secret's name only, so the secret's value is never parsed.
+func (f File) SecretTemplate() string {
+	return fmt.Sprintf("{{ raw (index .Secrets %q) }}", f.Secret)
 }
 
 // MarshalJSON implements the json.Marshaler interface.
@@ -79,9 +625,11 @@ func (f File) MarshalJSON() ([]byte, error) {
 		Data        string
 		Encoding    string
 		NoTemplates bool
+		Secret      string `json:",omitempty"`
 	}{
 		Encoding:    f.Encoding,
 		NoTemplates: f.NoTemplates,
+		Secret:      f.Secret,
 	}
 
 	switch e := f.Encoding; {
@@ -104,6 +652,7 @@ func (f *File) UnmarshalJSON(data []byte) error {
 	// a File or Env in the manifest can be defined two ways:
 	//   1. as a single string: "<name>": "<content>"
 	//   2. as a struct with Data, Encoding, and NoTemplate fields: "<name>": {"Data": "<data>", "Encoding": "<encoding>", "NoTemplates": <true/false>}
+	//      or with a Secret field instead of Data: "<name>": {"Secret": "<secret name>"}
 
 	var v interface{}
 	if err := json.Unmarshal(data, &v); err != nil {
@@ -123,6 +672,7 @@ func (f *File) UnmarshalJSON(data []byte) error {
 			Data        string
 			Encoding    string
 			NoTemplates bool
+			Secret      string
 		}
 		if err := json.Unmarshal(data, &vF); err != nil {
 			return err
@@ -154,6 +704,7 @@ func (f *File) UnmarshalJSON(data []byte) error {
 		}
 
 		f.NoTemplates = vF.NoTemplates
+		f.Secret = vF.Secret
 	default:
 		return fmt.Errorf("got: %t, expected: string or interface", t)
 	}
@@ -171,21 +722,48 @@ type TLStag struct {
 
 // TLSTagEntry describes one connection which should be elevated to ttls
 type TLSTagEntry struct {
-	Port              string
-	Addr              string
-	Cert              string
+	// Port is the numeric port of the connection.
+	Port string
+	// Addr is the host of an outgoing connection. It is ignored for incoming connections.
+	Addr string
+	// Cert optionally references a certificate secret which is presented to clients of an incoming connection instead of the Marble's certificate.
+	Cert string
+	// DisableClientAuth disables client authentication for an incoming connection. It must be set together with Cert.
 	DisableClientAuth bool
 }
 
+// checkTLSPort checks that port is a valid TCP port number.
+func checkTLSPort(port string) error {
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || portNum == 0 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
 // User describes the attributes of a MarbleRun user
 type User struct {
-	// Certificate is the TLS certificate used by the user for authentication
+	// Certificate is the TLS certificate used by the user for authentication.
+	// The CLI also accepts a CertificateFile referencing a PEM file, or a directory containing <user name>.pem, and inlines it.
 	Certificate string
 	// Roles is a list of roles granting permissions to the user
 	Roles []string
 }
 
 // Role describes a set of actions permitted for a specific set of resources
+//
+// A role of ResourceType "Manifest" granting the "ReadManifest" action restricts reading the manifest, the update log,
+// and the Marble parameters rendered by the debug endpoints to users assigned to a role with this permission.
+// A role of ResourceType "Certificates" granting the "SignCertificate" action allows users to have CSRs signed by the Coordinator.
+// Its ResourceNames list the DNS names and IP addresses the CSRs may request.
+// A role of ResourceType "Certificates" granting the "ReadIssuanceLog" action allows users to export the log of all certificates signed by the Coordinator.
+// A role of ResourceType "Marbles" granting the "UpdateParameters" action allows users to update the Parameters, MaxActivations, and LogLevel of the named Marbles.
+// A role of ResourceType "Marbles" granting the "SetActivations" action allows users to set the activation count of the named Marbles, e.g., when migrating an existing fleet.
+// A role of ResourceType "Marbles" granting the "RevokeCertificates" action allows users to revoke all certificates issued for the named Marbles.
+// A role of ResourceType "Secrets" granting the "ExportSecret" action allows users to export the named secrets of a Marble, encrypted for the RecoveryKeys.
+// A role of ResourceType "Coordinator" granting the "PauseActivations" action allows users to pause and resume activations for maintenance.
+// A role of ResourceType "Coordinator" granting the "RotateDerivationRoot" action allows users to rotate the root of the keys derived for Marbles.
+// A role of ResourceType "Coordinator" granting the "RotateRecoveryKey" action allows users to replace a recovery key, given a proof of possession of its current private key.
 type Role struct {
 	// ResourceType is the type of the affected resources
 	ResourceType string
@@ -195,18 +773,53 @@ type Role struct {
 	Actions []string
 }
 
-// Check checks if the manifest is consistent.
+// CheckResult is the result of checking a manifest.
+type CheckResult struct {
+	// Err is set if the manifest is inconsistent. Such a manifest must be rejected.
+	Err error
+	// Warnings describe valid, but questionable settings, e.g., settings which should not be used in production.
+	// They are surfaced to the operator, but do not prevent the manifest from being set.
+	Warnings []string
+}
+
+// Check checks if the manifest is consistent. Warnings are logged to zaplogger.
 func (m Manifest) Check(ctx context.Context, zaplogger *zap.Logger) error {
+	result := m.Validate(ctx)
+	for _, warning := range result.Warnings {
+		zaplogger.Warn(warning)
+	}
+	return result.Err
+}
+
+// Validate checks if the manifest is consistent and collects warnings about questionable settings.
+func (m Manifest) Validate(ctx context.Context) CheckResult {
+	var result CheckResult
+	seen := map[string]bool{}
+	result.Err = m.check(ctx, func(warning string) {
+		// warnings about packages are found for each Marble using the package, they are only reported once
+		if !seen[warning] {
+			seen[warning] = true
+			result.Warnings = append(result.Warnings, warning)
+		}
+	})
+	return result
+}
+
+// check checks if the manifest is consistent and reports questionable settings to warn.
+func (m Manifest) check(ctx context.Context, warn func(string)) error {
 	if len(m.Packages) <= 0 {
 		return errors.New("no allowed packages defined")
 	}
 	if len(m.Marbles) <= 0 {
 		return errors.New("no allowed marbles defined")
 	}
+	if len(m.BlockedPackages) > 0 {
+		return errors.New("BlockedPackages can only be set by an update manifest")
+	}
 	// if len(m.Infrastructures) <= 0 {
 	// 	return errors.New("no allowed infrastructures defined")
 	// }
-	for _, marble := range m.Marbles {
+	for marbleName, marble := range m.Marbles {
 		singlePackage, ok := m.Packages[marble.Package]
 		if !ok {
 			return errors.New("manifest does not contain marble package " + marble.Package)
@@ -215,23 +828,23 @@ func (m Manifest) Check(ctx context.Context, zaplogger *zap.Logger) error {
 		// Debug mode bypasses this requirement and throws a warning instead
 		if singlePackage.UniqueID != "" && (singlePackage.SignerID != "" || singlePackage.ProductID != nil || singlePackage.SecurityVersion != nil) {
 			if singlePackage.Debug {
-				zaplogger.Warn("Manifest specifies UniqueID *and* SignerID/ProductID/SecurityVersion. This is not accepted in non-debug mode, please check your configuration.", zap.String("packageName", marble.Package))
+				warn(fmt.Sprintf("package %s specifies UniqueID *and* SignerID/ProductID/SecurityVersion. This is not accepted in non-debug mode, please check your configuration.", marble.Package))
 			} else {
 				return fmt.Errorf("manifest specfies both UniqueID *and* SignerID/ProductID/SecurityVersion in package %s", marble.Package)
 			}
 		} else if singlePackage.UniqueID == "" {
 			if singlePackage.SignerID == "" {
-				if err := warnOrFailForMissingValue(singlePackage.Debug, "SignerID", marble.Package, zaplogger); err != nil {
+				if err := warnOrFailForMissingValue(singlePackage.Debug, "SignerID", marble.Package, warn); err != nil {
 					return err
 				}
 			}
 			if singlePackage.ProductID == nil {
-				if err := warnOrFailForMissingValue(singlePackage.Debug, "ProductID", marble.Package, zaplogger); err != nil {
+				if err := warnOrFailForMissingValue(singlePackage.Debug, "ProductID", marble.Package, warn); err != nil {
 					return err
 				}
 			}
 			if singlePackage.SecurityVersion == nil {
-				if err := warnOrFailForMissingValue(singlePackage.Debug, "SecurityVersion", marble.Package, zaplogger); err != nil {
+				if err := warnOrFailForMissingValue(singlePackage.Debug, "SecurityVersion", marble.Package, warn); err != nil {
 					return err
 				}
 			}
@@ -241,16 +854,95 @@ func (m Manifest) Check(ctx context.Context, zaplogger *zap.Logger) error {
 				return fmt.Errorf("manifest misses TLS entry for %s", tag)
 			}
 		}
+		for infraName := range marble.InfrastructureParameters {
+			if _, ok := m.Infrastructures[infraName]; !ok {
+				return fmt.Errorf("marble %s: InfrastructureParameters references undefined infrastructure %s", marbleName, infraName)
+			}
+		}
+		if marble.ActivationSchedule != nil {
+			if err := marble.ActivationSchedule.Check(); err != nil {
+				return fmt.Errorf("marble %s: %w", marbleName, err)
+			}
+		}
+		if marble.AllowSimulation != nil && *marble.AllowSimulation {
+			warn(fmt.Sprintf("marble %s allows simulation mode. Its quote is not validated, do not use this setting in production.", marbleName))
+		}
+		for _, dnsName := range marble.RequiredDNSNames {
+			if dnsName == "" {
+				return fmt.Errorf("marble %s: RequiredDNSNames contains an empty name", marbleName)
+			}
+		}
+		if _, err := marble.PolicyIdentifiers(); err != nil {
+			return fmt.Errorf("marble %s: CertificatePolicies: %w", marbleName, err)
+		}
+		if _, err := marble.CSRExtensionIdentifiers(); err != nil {
+			return fmt.Errorf("marble %s: AllowedCSRExtensions: %w", marbleName, err)
+		}
+		if _, err := marble.CertificateSignatureAlgorithm(); err != nil {
+			return fmt.Errorf("marble %s: %w", marbleName, err)
+		}
+		if err := marble.checkLogLevel(); err != nil {
+			return fmt.Errorf("marble %s: %w", marbleName, err)
+		}
+		if marble.Resources != nil {
+			if err := marble.Resources.check(); err != nil {
+				return fmt.Errorf("marble %s: Resources: %w", marbleName, err)
+			}
+		}
+		for _, name := range marble.OmitReservedEnv {
+			reserved := false
+			for _, reservedName := range reservedEnv {
+				reserved = reserved || name == reservedName
+			}
+			if !reserved {
+				return fmt.Errorf("marble %s: OmitReservedEnv contains %s, which is not a reserved environment variable", marbleName, name)
+			}
+		}
+	}
+	for name := range m.Templates {
+		if _, err := m.resolveTemplate(name, nil); err != nil {
+			return err
+		}
+	}
+	for name, bundle := range m.Bundles {
+		if bundle.Version == "" {
+			return fmt.Errorf("bundle %s has no Version", name)
+		}
+	}
+	for marbleName, marble := range m.Marbles {
+		params, err := m.ResolveParameters(marble)
+		if err != nil {
+			return fmt.Errorf("marble %s: %w", marbleName, err)
+		}
+		if marble.EncryptedParameters != nil {
+			if err := marble.EncryptedParameters.check(params, marble.InfrastructureParameters); err != nil {
+				return fmt.Errorf("marble %s: %w", marbleName, err)
+			}
+		}
+		if marble.FilesArchive {
+			if err := checkFilesArchive(marble, params); err != nil {
+				return fmt.Errorf("marble %s: %w", marbleName, err)
+			}
+		}
 	}
 	for key, TLStag := range m.TLS {
 		for _, entry := range TLStag.Incoming {
 			if entry.Port == "" {
 				return fmt.Errorf("manifest misses Port in TLS.Incoming.%s", key)
 			}
+			if err := checkTLSPort(entry.Port); err != nil {
+				return fmt.Errorf("TLS.Incoming.%s: %w", key, err)
+			}
 			if entry.Cert != "" {
-				if _, ok := m.Secrets[entry.Cert]; !ok {
+				secret, ok := m.Secrets[entry.Cert]
+				if !ok {
 					return fmt.Errorf("TLS.Incoming.%s references undefined secret %s", key, entry.Cert)
 				}
+				switch secret.Type {
+				case "cert-rsa", "cert-ecdsa", "cert-ed25519", "ca-cert":
+				default:
+					return fmt.Errorf("TLS.Incoming.%s references secret %s of type %s, but a certificate is required", key, entry.Cert, secret.Type)
+				}
 				if !entry.DisableClientAuth {
 					return fmt.Errorf("TLS.Incoming.%s defines Cert but does not disable client authentication", key)
 				}
@@ -261,12 +953,33 @@ func (m Manifest) Check(ctx context.Context, zaplogger *zap.Logger) error {
 			}
 		}
 		for _, entry := range TLStag.Outgoing {
-			if entry.Addr == "" {
+			if strings.TrimSpace(entry.Addr) == "" {
 				return fmt.Errorf("manifest misses Addr in TLS.Outgoing.%s", key)
 			}
 			if entry.Port == "" {
 				return fmt.Errorf("manifest misses Port in TLS.Outgoing.%s", key)
 			}
+			if err := checkTLSPort(entry.Port); err != nil {
+				return fmt.Errorf("TLS.Outgoing.%s: %w", key, err)
+			}
+			if entry.Cert != "" || entry.DisableClientAuth {
+				return fmt.Errorf("TLS.Outgoing.%s: Cert and DisableClientAuth can only be set for incoming connections", key)
+			}
+		}
+	}
+
+	for _, envName := range m.CoordinatorEnv {
+		if envName == "" || strings.ContainsAny(envName, "=\x00") {
+			return fmt.Errorf("invalid environment variable name in CoordinatorEnv: %q", envName)
+		}
+	}
+
+	for path, hash := range m.CoordinatorFiles {
+		if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+			return fmt.Errorf("invalid path in CoordinatorFiles: %q must be absolute and clean", path)
+		}
+		if !isSHA256Hex(hash) {
+			return fmt.Errorf("CoordinatorFiles.%s: value must be a hex-encoded SHA-256 hash", path)
 		}
 	}
 
@@ -274,6 +987,13 @@ func (m Manifest) Check(ctx context.Context, zaplogger *zap.Logger) error {
 		if len(user.Certificate) <= 0 {
 			return fmt.Errorf("manifest does not contain a certificate for user %s", userName)
 		}
+		block, _ := pem.Decode([]byte(user.Certificate))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return fmt.Errorf("manifest contains an invalid PEM certificate for user %s", userName)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("manifest contains an invalid certificate for user %s: %w", userName, err)
+		}
 		for _, role := range user.Roles {
 			if _, ok := m.Roles[role]; !ok {
 				return fmt.Errorf("manifest specifies role %s for user %s, but role does not exist", role, userName)
@@ -297,15 +1017,17 @@ func (m Manifest) Check(ctx context.Context, zaplogger *zap.Logger) error {
 		case "Secrets":
 			var writeRole bool
 			var readRole bool
+			var exportRole bool
 			for _, action := range role.Actions {
-				if !(strings.ToLower(action) == user.PermissionWriteSecret || strings.ToLower(action) == user.PermissionReadSecret) {
-					return fmt.Errorf("unknown action: %s for type Secrets in role: %s", action, roleName)
-				}
-				if strings.ToLower(action) == user.PermissionWriteSecret {
+				switch strings.ToLower(action) {
+				case user.PermissionWriteSecret:
 					writeRole = true
-				}
-				if strings.ToLower(action) == user.PermissionReadSecret {
+				case user.PermissionReadSecret:
 					readRole = true
+				case user.PermissionExportSecret:
+					exportRole = true
+				default:
+					return fmt.Errorf("unknown action: %s for type Secrets in role: %s", action, roleName)
 				}
 			}
 			for _, secretName := range role.ResourceNames {
@@ -319,6 +1041,49 @@ func (m Manifest) Check(ctx context.Context, zaplogger *zap.Logger) error {
 				if !secret.Shared && !secret.UserDefined && readRole {
 					return fmt.Errorf("manifest specifies read permission for role %s and per-marble-unique secret %s", roleName, secretName)
 				}
+				if !secret.Shared && !secret.UserDefined && secret.Type != "symmetric-key" && secret.Type != "hmac" && exportRole {
+					return fmt.Errorf("manifest specifies export permission for role %s and secret %s, but per-marble-unique secrets of type %s can not be re-derived", roleName, secretName, secret.Type)
+				}
+			}
+		case "Manifest":
+			if len(role.ResourceNames) > 0 {
+				return fmt.Errorf("role %s: resources of type Manifest can not be named", roleName)
+			}
+			for _, action := range role.Actions {
+				if !(strings.ToLower(action) == user.PermissionReadManifest) {
+					return fmt.Errorf("unknown action: %s for type Manifest in role: %s", action, roleName)
+				}
+			}
+		case "Certificates":
+			for _, resource := range role.ResourceNames {
+				if resource == "" {
+					return fmt.Errorf("role %s: resources of type Certificates can not be empty", roleName)
+				}
+			}
+			for _, action := range role.Actions {
+				if !(strings.ToLower(action) == user.PermissionSignCert || strings.ToLower(action) == user.PermissionReadIssuanceLog) {
+					return fmt.Errorf("unknown action: %s for type Certificates in role: %s", action, roleName)
+				}
+			}
+		case "Coordinator":
+			if len(role.ResourceNames) > 0 {
+				return fmt.Errorf("role %s: resources of type Coordinator can not be named", roleName)
+			}
+			for _, action := range role.Actions {
+				if !(strings.ToLower(action) == user.PermissionPause || strings.ToLower(action) == user.PermissionRotateDerivationRoot || strings.ToLower(action) == user.PermissionRotateRecoveryKey) {
+					return fmt.Errorf("unknown action: %s for type Coordinator in role: %s", action, roleName)
+				}
+			}
+		case "Marbles":
+			for _, resource := range role.ResourceNames {
+				if _, ok := m.Marbles[resource]; !ok {
+					return fmt.Errorf("role %s: resource %s of type Marbles is not defined in manifest", roleName, resource)
+				}
+			}
+			for _, action := range role.Actions {
+				if !(strings.ToLower(action) == user.PermissionUpdateParams || strings.ToLower(action) == user.PermissionSetActivations || strings.ToLower(action) == user.PermissionRevokeCertificates) {
+					return fmt.Errorf("unknown action: %s for type Marbles in role: %s", action, roleName)
+				}
 			}
 		default:
 			return fmt.Errorf("unrecognized resource type: %s for role: %s", role, roleName)
@@ -326,18 +1091,87 @@ func (m Manifest) Check(ctx context.Context, zaplogger *zap.Logger) error {
 	}
 
 	for name, s := range m.Secrets {
+		// Deterministic derivation is only supported for shared symmetric keys, per-marble keys are always derived
+		if s.Deterministic && (s.Type != "symmetric-key" || !s.Shared || s.UserDefined) {
+			return fmt.Errorf("secret %s: Deterministic is only supported for shared secrets of type symmetric-key", name)
+		}
+		if s.Algorithm != "" && s.Type != "hmac" {
+			return fmt.Errorf("secret %s: Algorithm is only supported for secrets of type hmac", name)
+		}
+		if s.PathLen != 0 && s.Type != "ca-cert" {
+			return fmt.Errorf("secret %s: PathLen is only supported for secrets of type ca-cert", name)
+		}
+		if s.NameConstraints != nil {
+			if s.Type != "ca-cert" {
+				return fmt.Errorf("secret %s: NameConstraints are only supported for secrets of type ca-cert", name)
+			}
+			if err := s.NameConstraints.check(); err != nil {
+				return fmt.Errorf("secret %s: NameConstraints: %w", name, err)
+			}
+		}
+		if len(s.Marbles) > 0 && !s.Shared && !s.UserDefined {
+			return fmt.Errorf("secret %s: Marbles is only supported for shared or user-defined secrets", name)
+		}
+		for _, marbleName := range s.Marbles {
+			if _, ok := m.Marbles[marbleName]; !ok {
+				return fmt.Errorf("secret %s: Marbles references undefined marble %s", name, marbleName)
+			}
+		}
+		if err := s.checkSize(name, warn); err != nil {
+			return err
+		}
 		switch s.Type {
 		case "plain", "symmetric-key":
 			continue
+		case "hmac":
+			switch s.Algorithm {
+			case "", "sha256", "sha384", "sha512":
+			default:
+				return fmt.Errorf("unknown hmac algorithm: %s for secret: %s", s.Algorithm, name)
+			}
 		case "cert-rsa", "cert-ed25519", "cert-ecdsa":
 			if !s.Cert.NotAfter.IsZero() && (s.ValidFor != 0) {
 				return fmt.Errorf("ambigious certificate validity duration for secret: %s, both NotAfter and ValidFor are specified", name)
 			}
+		case "ca-cert":
+			if s.UserDefined {
+				return fmt.Errorf("secret %s: secrets of type ca-cert are generated by the Coordinator and can not be user-defined", name)
+			}
+			if s.PathLen < 0 {
+				return fmt.Errorf("secret %s: PathLen must not be negative", name)
+			}
+			switch s.Size {
+			case 224, 256, 384, 521:
+			default:
+				return fmt.Errorf("secret %s: unsupported size %d for ca-cert, expected one of the ECDSA curves 224, 256, 384, or 521", name, s.Size)
+			}
+			if !s.Cert.NotAfter.IsZero() && (s.ValidFor != 0) {
+				return fmt.Errorf("ambigious certificate validity duration for secret: %s, both NotAfter and ValidFor are specified", name)
+			}
+			// the CA is signed by the Coordinator's intermediate CA, so it could otherwise issue certificates for the names of the Coordinator and other Marbles
+			if s.NameConstraints == nil || !s.NameConstraints.permitsAny() {
+				return fmt.Errorf("secret %s: secrets of type ca-cert require NameConstraints with at least one permitted DNS domain, IP range, or URI domain", name)
+			}
 		default:
 			return fmt.Errorf("unknown type: %s for secret: %s", s.Type, name)
 		}
 	}
 
+	// only Marbles allowed to hold a CA may present ca-cert secrets on incoming connections.
+	// Other references in templates fail on activation, as such Marbles do not receive ca-cert secrets.
+	for marbleName, marble := range m.Marbles {
+		if marble.AllowCA {
+			continue
+		}
+		for _, tag := range marble.TLS {
+			for _, entry := range m.TLS[tag].Incoming {
+				if secret, ok := m.Secrets[entry.Cert]; ok && secret.Type == "ca-cert" {
+					return fmt.Errorf("marble %s uses ca-cert secret %s, but does not set AllowCA", marbleName, entry.Cert)
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -349,14 +1183,210 @@ type PublicKey []byte
 
 // Secret defines a structure for storing certificates & encryption keys
 type Secret struct {
-	Type        string
-	Size        uint
-	Shared      bool
-	UserDefined bool
-	Cert        Certificate
-	ValidFor    uint
-	Private     PrivateKey
-	Public      PublicKey
+	Type          string
+	Size          uint
+	Shared        bool
+	UserDefined   bool
+	Deterministic bool
+	Cert          Certificate
+	ValidFor      uint
+	Private       PrivateKey
+	Public        PublicKey
+	// Algorithm is the hash function an hmac secret is intended for: sha256 (default), sha384, or sha512.
+	Algorithm string `json:",omitempty"`
+	// PathLen is the maximum number of intermediate CAs a ca-cert secret may issue below itself.
+	// The default of 0 only allows issuing leaf certificates.
+	PathLen int `json:",omitempty"`
+	// NameConstraints restricts the names a ca-cert secret can issue certificates for. They are required for ca-cert secrets.
+	NameConstraints *NameConstraints `json:",omitempty"`
+	// Marbles restricts a shared or user-defined secret to a group of Marble types.
+	// Only the listed Marbles receive the secret on activation. If empty, all Marbles receive it.
+	Marbles []string `json:",omitempty"`
+}
+
+// NameConstraints restricts the names certificates issued below a CA may contain.
+// A name is permitted if it matches any permitted constraint of its kind, if there are any, and no excluded one.
+// DNS and URI domain constraints match the domain and its subdomains, a leading "." only matches subdomains.
+type NameConstraints struct {
+	PermittedDNSDomains []string `json:",omitempty"`
+	ExcludedDNSDomains  []string `json:",omitempty"`
+	// PermittedIPRanges and ExcludedIPRanges are given in CIDR notation, e.g., "10.0.0.0/8".
+	PermittedIPRanges   []string `json:",omitempty"`
+	ExcludedIPRanges    []string `json:",omitempty"`
+	PermittedURIDomains []string `json:",omitempty"`
+	ExcludedURIDomains  []string `json:",omitempty"`
+}
+
+// ApplyTo sets the name constraints in a certificate template. The extension is marked critical, as required by RFC 5280.
+func (n NameConstraints) ApplyTo(template *x509.Certificate) error {
+	permittedIPRanges, err := parseIPRanges(n.PermittedIPRanges)
+	if err != nil {
+		return err
+	}
+	excludedIPRanges, err := parseIPRanges(n.ExcludedIPRanges)
+	if err != nil {
+		return err
+	}
+	template.PermittedDNSDomainsCritical = true
+	template.PermittedDNSDomains = n.PermittedDNSDomains
+	template.ExcludedDNSDomains = n.ExcludedDNSDomains
+	template.PermittedIPRanges = permittedIPRanges
+	template.ExcludedIPRanges = excludedIPRanges
+	template.PermittedURIDomains = n.PermittedURIDomains
+	template.ExcludedURIDomains = n.ExcludedURIDomains
+	return nil
+}
+
+// permitsAny returns true if any permitted constraint is set, i.e., the names of certificates issued below the CA are restricted.
+func (n NameConstraints) permitsAny() bool {
+	return len(n.PermittedDNSDomains) > 0 || len(n.PermittedIPRanges) > 0 || len(n.PermittedURIDomains) > 0
+}
+
+// check checks if all constraints are valid and no permitted constraint is entirely excluded, which would contradict each other.
+func (n NameConstraints) check() error {
+	checkDomains := func(kind string, permitted, excluded []string) error {
+		for _, domain := range append(append([]string{}, permitted...), excluded...) {
+			if strings.Trim(domain, ".") == "" {
+				return fmt.Errorf("empty %s domain constraint", kind)
+			}
+		}
+		for _, permittedDomain := range permitted {
+			for _, excludedDomain := range excluded {
+				if domainConstraintCovers(excludedDomain, permittedDomain) {
+					return fmt.Errorf("permitted %s domain %s is excluded by %s", kind, permittedDomain, excludedDomain)
+				}
+			}
+		}
+		return nil
+	}
+	if err := checkDomains("DNS", n.PermittedDNSDomains, n.ExcludedDNSDomains); err != nil {
+		return err
+	}
+	if err := checkDomains("URI", n.PermittedURIDomains, n.ExcludedURIDomains); err != nil {
+		return err
+	}
+
+	permittedIPRanges, err := parseIPRanges(n.PermittedIPRanges)
+	if err != nil {
+		return err
+	}
+	excludedIPRanges, err := parseIPRanges(n.ExcludedIPRanges)
+	if err != nil {
+		return err
+	}
+	for _, permittedRange := range permittedIPRanges {
+		permittedOnes, permittedBits := permittedRange.Mask.Size()
+		for _, excludedRange := range excludedIPRanges {
+			excludedOnes, excludedBits := excludedRange.Mask.Size()
+			if permittedBits == excludedBits && excludedOnes <= permittedOnes && excludedRange.Contains(permittedRange.IP) {
+				return fmt.Errorf("permitted IP range %s is excluded by %s", permittedRange, excludedRange)
+			}
+		}
+	}
+	return nil
+}
+
+// domainConstraintCovers returns true if every domain matching the constraint inner also matches the constraint outer.
+func domainConstraintCovers(outer, inner string) bool {
+	outer, inner = strings.ToLower(outer), strings.ToLower(inner)
+	if strings.HasPrefix(outer, ".") {
+		return strings.HasSuffix(inner, outer)
+	}
+	return inner == outer || strings.HasSuffix(inner, "."+outer)
+}
+
+// parseIPRanges parses IP ranges in CIDR notation.
+func parseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, ipRange := range ranges {
+		_, ipNet, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q: %w", ipRange, err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// minSymmetricKeySize is the minimum Size in bits of symmetric-key and hmac secrets.
+const minSymmetricKeySize = 128
+
+// checkSize checks if the Size of the secret is appropriate for its Type.
+// ca-cert secrets are checked separately. Sizes which are ignored for the secret's type are reported to warn.
+func (s Secret) checkSize(name string, warn func(string)) error {
+	ignored := func() {
+		if s.Size != 0 {
+			warn(fmt.Sprintf("secret %s: Size is ignored for secrets of type %s", name, s.Type))
+		}
+	}
+	switch s.Type {
+	case "symmetric-key", "hmac":
+		if s.Size%8 != 0 {
+			return fmt.Errorf("secret %s: Size %d is not a multiple of 8", name, s.Size)
+		}
+		if s.Size < minSymmetricKeySize {
+			return fmt.Errorf("secret %s: Size %d is too small for %s, at least %d bits are required", name, s.Size, s.Type, minSymmetricKeySize)
+		}
+		// keys shorter than the hash output weaken the HMAC (RFC 2104, section 3)
+		if s.Type == "hmac" {
+			outputSize := map[string]uint{"": 256, "sha256": 256, "sha384": 384, "sha512": 512}[s.Algorithm]
+			if s.Size < outputSize {
+				warn(fmt.Sprintf("secret %s: Size %d is smaller than the %d bit output of the hmac algorithm", name, s.Size, outputSize))
+			}
+		}
+	case "cert-rsa":
+		if s.UserDefined {
+			ignored()
+			return nil
+		}
+		switch s.Size {
+		case 2048, 3072, 4096:
+		default:
+			return fmt.Errorf("secret %s: unsupported size %d for cert-rsa, expected one of 2048, 3072, or 4096", name, s.Size)
+		}
+	case "cert-ecdsa":
+		if s.UserDefined {
+			ignored()
+			return nil
+		}
+		switch s.Size {
+		case 224, 256, 384, 521:
+		default:
+			return fmt.Errorf("secret %s: unsupported size %d for cert-ecdsa, expected one of the ECDSA curves 224, 256, 384, or 521", name, s.Size)
+		}
+	case "cert-ed25519":
+		if s.Size != 0 && !s.UserDefined {
+			return fmt.Errorf("secret %s: cert-ed25519 has a fixed key size, Size must not be set", name)
+		}
+		ignored()
+	case "plain":
+		ignored()
+	}
+	return nil
+}
+
+// AvailableTo returns true if Marbles of type marbleType receive the secret.
+func (s Secret) AvailableTo(marbleType string) bool {
+	if len(s.Marbles) == 0 {
+		return true
+	}
+	for _, name := range s.Marbles {
+		if name == marbleType {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultHMACAlgorithm is the Algorithm of hmac secrets which do not specify one.
+const DefaultHMACAlgorithm = "sha256"
+
+// WithDefaultAlgorithm returns a copy of the secret with Algorithm set to DefaultHMACAlgorithm if it is an hmac secret without Algorithm.
+func (s Secret) WithDefaultAlgorithm() Secret {
+	if s.Type == "hmac" && s.Algorithm == "" {
+		s.Algorithm = DefaultHMACAlgorithm
+	}
+	return s
 }
 
 // Certificate is an x509.Certificate
@@ -414,6 +1444,34 @@ func EncodeSecretDataToPem(data interface{}) (string, error) {
 	return string(pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: bytes})), nil
 }
 
+// EncodeSecretDataToPemBundle encodes a certificate, a private key, and a CA certificate into a single PEM bundle.
+// order is a comma-separated list of "cert", "key", and "ca" defining which parts are included and in which order,
+// e.g., "cert,key,ca". Parts not listed in order are ignored and may be left unset.
+func EncodeSecretDataToPemBundle(order string, cert, key, ca interface{}) (string, error) {
+	parts := map[string]interface{}{"cert": cert, "key": key, "ca": ca}
+
+	var bundle strings.Builder
+	used := map[string]bool{}
+	for _, name := range strings.Split(order, ",") {
+		name = strings.TrimSpace(name)
+		data, ok := parts[name]
+		if !ok {
+			return "", fmt.Errorf("invalid bundle part %q, expected cert, key, or ca", name)
+		}
+		if used[name] {
+			return "", fmt.Errorf("bundle part %q is listed more than once", name)
+		}
+		used[name] = true
+
+		encoded, err := EncodeSecretDataToPem(data)
+		if err != nil {
+			return "", fmt.Errorf("encoding bundle part %q: %w", name, err)
+		}
+		bundle.WriteString(encoded)
+	}
+	return bundle.String(), nil
+}
+
 // EncodeSecretDataToHex encodes a secret to a hex string.
 func EncodeSecretDataToHex(data interface{}) (string, error) {
 	raw, err := EncodeSecretDataToRaw(data)
@@ -423,6 +1481,20 @@ func EncodeSecretDataToHex(data interface{}) (string, error) {
 	return hex.EncodeToString([]byte(raw)), nil
 }
 
+// EncodeSecretDataToHexColon encodes a secret to colon-separated pairs of uppercase hex digits (AA:BB:CC...).
+// This matches the format of fingerprints printed by tools like openssl.
+func EncodeSecretDataToHexColon(data interface{}) (string, error) {
+	raw, err := EncodeSecretDataToRaw(data)
+	if err != nil {
+		return "", err
+	}
+	pairs := make([]string, len(raw))
+	for i := 0; i < len(raw); i++ {
+		pairs[i] = fmt.Sprintf("%02X", raw[i])
+	}
+	return strings.Join(pairs, ":"), nil
+}
+
 // EncodeSecretDataToRaw encodes a secret to a raw byte string.
 func EncodeSecretDataToRaw(data interface{}) (string, error) {
 	var raw []byte
@@ -459,6 +1531,15 @@ func EncodeSecretDataToBase64(data interface{}) (string, error) {
 	return base64.StdEncoding.EncodeToString([]byte(raw)), nil
 }
 
+// EncodeSecretDataToBase64URLRaw encodes the byte value of a secret to an unpadded base64url string, as used in JWTs.
+func EncodeSecretDataToBase64URLRaw(data interface{}) (string, error) {
+	raw, err := EncodeSecretDataToRaw(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(raw)), nil
+}
+
 // EncodeSecretDataToString encodes secrets to C type strings (no NULL bytes allowed as part of the string).
 func EncodeSecretDataToString(data interface{}) (string, error) {
 	switch secret := data.(type) {
@@ -477,25 +1558,218 @@ func EncodeSecretDataToString(data interface{}) (string, error) {
 	}
 }
 
+// EncodeSecretDataToJSONField extracts a field from a secret holding a JSON document, e.g. {{ jsonField .Secrets.creds "client.id" }}.
+// The path consists of object keys and array indices separated by dots.
+// Strings are returned without quotes, other values are returned in their JSON encoding.
+func EncodeSecretDataToJSONField(data interface{}, path string) (string, error) {
+	if err := CheckJSONFieldPath(path); err != nil {
+		return "", err
+	}
+	raw, err := EncodeSecretDataToRaw(data)
+	if err != nil {
+		return "", err
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("secret is not a valid JSON document: %w", err)
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			field, ok := node[key]
+			if !ok {
+				return "", fmt.Errorf("field %s of path %s does not exist", key, path)
+			}
+			value = field
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", fmt.Errorf("invalid array index %s in path %s", key, path)
+			}
+			value = node[index]
+		default:
+			return "", fmt.Errorf("field %s of path %s can not be accessed on a JSON value that is neither an object nor an array", key, path)
+		}
+	}
+
+	if value, ok := value.(string); ok {
+		return value, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// CheckJSONFieldPath checks if path is a valid path for the jsonField template function.
+func CheckJSONFieldPath(path string) error {
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return fmt.Errorf("invalid JSON field path %q: empty field name", path)
+		}
+	}
+	return nil
+}
+
+// EncodeDotenv formats pairs of names and values as a dotenv file with one NAME="value" line per pair.
+// Values are usually the output of another encoding function, e.g. {{ dotenv "KEY" (hex .Secrets.key) "CERT" (pem .Secrets.cert.Cert) }}.
+// Newlines, quotes, backslashes, and dollar signs in values are escaped, so multi-line values like PEM data fit on one line.
+func EncodeDotenv(pairs ...string) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", errors.New("dotenv expects pairs of names and values")
+	}
+
+	var dotenv strings.Builder
+	for i := 0; i < len(pairs); i += 2 {
+		name, value := pairs[i], pairs[i+1]
+		if !isDotenvName(name) {
+			return "", fmt.Errorf("invalid dotenv variable name: %q", name)
+		}
+		if strings.Contains(value, string([]byte{0x00})) {
+			return "", fmt.Errorf("value of dotenv variable %s contains null bytes", name)
+		}
+		fmt.Fprintf(&dotenv, "%s=\"%s\"\n", name, dotenvEscaper.Replace(value))
+	}
+	return dotenv.String(), nil
+}
+
+var dotenvEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+
+// isDotenvName returns true if name is a valid shell variable name.
+func isDotenvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
 // ManifestTemplateFuncMap defines the functions which can be specified for secret injections into files in the in Go template format.
 var ManifestFileTemplateFuncMap = template.FuncMap{
-	"pem":    EncodeSecretDataToPem,
-	"hex":    EncodeSecretDataToHex,
-	"raw":    EncodeSecretDataToRaw,
-	"base64": EncodeSecretDataToBase64,
+	"pem":          EncodeSecretDataToPem,
+	"bundle":       EncodeSecretDataToPemBundle,
+	"hex":          EncodeSecretDataToHex,
+	"hexColon":     EncodeSecretDataToHexColon,
+	"raw":          EncodeSecretDataToRaw,
+	"base64":       EncodeSecretDataToBase64,
+	"base64urlRaw": EncodeSecretDataToBase64URLRaw,
+	"dotenv":       EncodeDotenv,
+	"jsonField":    EncodeSecretDataToJSONField,
 }
 
 // ManifestEnvTemplateFuncMap defines the functions which can be specified for secret injections into Env variables in the Go template format.
 var ManifestEnvTemplateFuncMap = template.FuncMap{
-	"pem":    EncodeSecretDataToPem,
-	"hex":    EncodeSecretDataToHex,
-	"string": EncodeSecretDataToString,
-	"base64": EncodeSecretDataToBase64,
+	"pem":          EncodeSecretDataToPem,
+	"bundle":       EncodeSecretDataToPemBundle,
+	"hex":          EncodeSecretDataToHex,
+	"hexColon":     EncodeSecretDataToHexColon,
+	"string":       EncodeSecretDataToString,
+	"base64":       EncodeSecretDataToBase64,
+	"base64urlRaw": EncodeSecretDataToBase64URLRaw,
+	"jsonField":    EncodeSecretDataToJSONField,
+}
+
+// RestrictsManifestRead returns true if the manifest defines a role, which grants permission to read the manifest.
+// In that case, only users with this permission are allowed to read the manifest.
+func (m Manifest) RestrictsManifestRead() bool {
+	for _, role := range m.Roles {
+		if role.ResourceType != "Manifest" {
+			continue
+		}
+		for _, action := range role.Actions {
+			if strings.ToLower(action) == user.PermissionReadManifest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CoordinatorEnvTemplateFunc returns a template function which reads an environment variable of the Coordinator.
+// Only variables contained in allowedEnv can be read, all other requests result in an error.
+func CoordinatorEnvTemplateFunc(allowedEnv []string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		for _, allowed := range allowedEnv {
+			if name == allowed {
+				return os.Getenv(name), nil
+			}
+		}
+		return "", fmt.Errorf("environment variable %s is not listed in CoordinatorEnv", name)
+	}
+}
+
+// HostFileTemplateFunc returns a template function which reads a file on the Coordinator's host.
+// Only files contained in allowedFiles can be read, all other requests result in an error.
+// allowedFiles maps the paths to the hex-encoded SHA-256 hash of their expected contents.
+func HostFileTemplateFunc(allowedFiles map[string]string) func(string) (string, error) {
+	return func(path string) (string, error) {
+		hash, ok := allowedFiles[path]
+		if !ok {
+			return "", fmt.Errorf("file %s is not listed in CoordinatorFiles", path)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading host file %s: %w", path, err)
+		}
+		if !matchesSHA256(string(content), hash) {
+			return "", fmt.Errorf("host file %s does not match the hash in CoordinatorFiles", path)
+		}
+		return string(content), nil
+	}
+}
+
+// isSHA256Hex checks if hash is a hex-encoded SHA-256 hash.
+func isSHA256Hex(hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// matchesSHA256 checks if the SHA-256 hash of value equals the hex-encoded hash.
+func matchesSHA256(value, hash string) bool {
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	actual := sha256.Sum256([]byte(value))
+	return subtle.ConstantTimeCompare(actual[:], expected) == 1
+}
+
+// TemplateFuncMapWithCoordinatorFiles returns a copy of funcMap extended by the hostFile function, restricted to allowedFiles.
+func TemplateFuncMapWithCoordinatorFiles(funcMap template.FuncMap, allowedFiles map[string]string) template.FuncMap {
+	newFuncMap := template.FuncMap{"hostFile": HostFileTemplateFunc(allowedFiles)}
+	for name, fn := range funcMap {
+		newFuncMap[name] = fn
+	}
+	return newFuncMap
+}
+
+// TemplateFuncMap returns a copy of funcMap extended by the coordinatorEnv and hostFile functions,
+// restricted to the manifest's CoordinatorEnv and CoordinatorFiles.
+func (m Manifest) TemplateFuncMap(funcMap template.FuncMap) template.FuncMap {
+	return TemplateFuncMapWithCoordinatorFiles(TemplateFuncMapWithCoordinatorEnv(funcMap, m.CoordinatorEnv), m.CoordinatorFiles)
+}
+
+// TemplateFuncMapWithCoordinatorEnv returns a copy of funcMap extended by the coordinatorEnv function, restricted to allowedEnv.
+func TemplateFuncMapWithCoordinatorEnv(funcMap template.FuncMap, allowedEnv []string) template.FuncMap {
+	newFuncMap := template.FuncMap{"coordinatorEnv": CoordinatorEnvTemplateFunc(allowedEnv)}
+	for name, fn := range funcMap {
+		newFuncMap[name] = fn
+	}
+	return newFuncMap
 }
 
 // CheckUpdate checks if the manifest is consistent and only contains supported values.
 func (m Manifest) CheckUpdate(ctx context.Context, originalPackages map[string]quote.PackageProperties) error {
-	if len(m.Packages) <= 0 {
+	if len(m.Packages) <= 0 && len(m.BlockedPackages) <= 0 {
 		return errors.New("no packages defined")
 	}
 
@@ -522,6 +1796,64 @@ func (m Manifest) CheckUpdate(ctx context.Context, originalPackages map[string]q
 		}
 	}
 
+	for packageName, blockedEntries := range m.BlockedPackages {
+		if _, ok := originalPackages[packageName]; !ok {
+			return fmt.Errorf("update manifest blocks package %s which the original manifest does not contain", packageName)
+		}
+		if len(blockedEntries) <= 0 {
+			return fmt.Errorf("update manifest blocks no entries for package %s", packageName)
+		}
+		for _, entry := range blockedEntries {
+			if entry.UniqueID == "" && (entry.SignerID == "" || entry.ProductID == nil) {
+				return fmt.Errorf("blocked entry for package %s must specify a UniqueID or a SignerID and ProductID", packageName)
+			}
+			if entry.UniqueID != "" && (entry.SignerID != "" || entry.ProductID != nil || entry.SecurityVersion != nil) {
+				return fmt.Errorf("blocked entry for package %s must not mix UniqueID with SignerID, ProductID or SecurityVersion", packageName)
+			}
+			if entry.Debug {
+				return fmt.Errorf("blocked entry for package %s must not set Debug", packageName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckParametersUpdate checks if the manifest is a valid update of the given Marbles and Bundles.
+// Only the Parameters, MaxActivations, and LogLevel of existing Marbles may be set. Existing Bundles may be replaced with a new Version.
+// setFields holds the lowercased names of the fields set for each Marble in the raw update manifest.
+func (m Manifest) CheckParametersUpdate(ctx context.Context, originalMarbles map[string]Marble, originalBundles map[string]Bundle, setFields map[string]map[string]bool) error {
+	if len(m.Packages) > 0 || len(m.BlockedPackages) > 0 {
+		return errors.New("Marble parameters can not be updated together with packages")
+	}
+	if len(m.Marbles) <= 0 && len(m.Bundles) <= 0 {
+		return errors.New("no marbles or bundles defined")
+	}
+
+	for name, bundle := range m.Bundles {
+		originalBundle, ok := originalBundles[name]
+		if !ok {
+			return fmt.Errorf("update manifest specifies bundle %s which the original manifest does not contain", name)
+		}
+		if bundle.Version == "" || bundle.Version == originalBundle.Version {
+			return fmt.Errorf("update manifest does not specify a new Version for bundle %s", name)
+		}
+	}
+
+	for marbleName, marble := range m.Marbles {
+		if _, ok := originalMarbles[marbleName]; !ok {
+			return fmt.Errorf("update manifest specifies marble %s which the original manifest does not contain", marbleName)
+		}
+		for field := range setFields[marbleName] {
+			if field != "parameters" && field != "maxactivations" && field != "loglevel" {
+				return fmt.Errorf("update manifest contains unupdatable value %s for marble %s", field, marbleName)
+			}
+		}
+		if err := marble.checkLogLevel(); err != nil {
+			return fmt.Errorf("marble %s: %w", marbleName, err)
+		}
+	}
+
 	return nil
 }
 
@@ -551,7 +1883,7 @@ func ParseUserSecrets(ctx context.Context, newSecrets map[string]UserSecret, ori
 
 		// check correctness of the supplied secrets
 		switch originalSecret.Type {
-		case "symmetric-key":
+		case "symmetric-key", "hmac":
 			// verify the length specified in the original manifest is constant
 			if originalSecret.Size == 0 || originalSecret.Size%8 != 0 {
 				return nil, fmt.Errorf("invalid secret size: %s", secretName)
@@ -562,9 +1894,9 @@ func ParseUserSecrets(ctx context.Context, newSecrets map[string]UserSecret, ori
 			}
 			// make sure only a symmetric key was supplied
 			if singleSecret.Cert.Raw != nil || singleSecret.Private != nil {
-				return nil, fmt.Errorf("secret %s is set to be of type symmetric-key but specified values for a certificate", secretName)
+				return nil, fmt.Errorf("secret %s is set to be of type %s but specified values for a certificate", secretName, originalSecret.Type)
 			}
-			parsedSecret := originalSecret
+			parsedSecret := originalSecret.WithDefaultAlgorithm()
 			parsedSecret.Private = singleSecret.Key
 			parsedSecret.Public = singleSecret.Key
 			parsedSecrets[secretName] = parsedSecret
@@ -598,9 +1930,9 @@ func ParseUserSecrets(ctx context.Context, newSecrets map[string]UserSecret, ori
 	return parsedSecrets, nil
 }
 
-func warnOrFailForMissingValue(debugMode bool, parameter string, packageName string, zaplogger *zap.Logger) error {
+func warnOrFailForMissingValue(debugMode bool, parameter string, packageName string, warn func(string)) error {
 	if debugMode {
-		zaplogger.Warn("Manifest misses value in package declaration. This is not accepted in non-debug mode, please check your configuration.", zap.String("parameter", parameter), zap.String("packageName", packageName))
+		warn(fmt.Sprintf("package %s misses a value for %s. This is not accepted in non-debug mode, please check your configuration.", packageName, parameter))
 		return nil
 	}
 
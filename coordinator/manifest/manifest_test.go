@@ -8,11 +8,20 @@ package manifest
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/edgelesssys/marblerun/coordinator/quote"
 	"github.com/edgelesssys/marblerun/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -45,6 +54,9 @@ func TestFile(t *testing.T) {
 		"Encoding": "string",
 		"NoTemplates": true,
 		"Data": "{{ string .Secrets.symmetricKeyShared }}"
+	},
+	"secret": {
+		"Secret": "symmetricKeyShared"
 	}
 }`)
 	assert := assert.New(t)
@@ -60,6 +72,9 @@ func TestFile(t *testing.T) {
 	assert.Equal("YmFy", testFiles["base64Value"].Data)
 	assert.Equal("MarbleRun", testFiles["hex"].Data)
 	assert.Equal("{{ string .Secrets.symmetricKeyShared }}", testFiles["withoutTemplates"].Data)
+	assert.Equal("symmetricKeyShared", testFiles["secret"].Secret)
+	assert.Empty(testFiles["secret"].Data)
+	assert.Equal(`{{ raw (index .Secrets "symmetricKeyShared") }}`, testFiles["secret"].SecretTemplate())
 
 	_, err = json.Marshal(testFiles)
 	assert.NoError(err)
@@ -77,6 +92,883 @@ func TestManifestCheck(t *testing.T) {
 	require.NoError(err)
 	err = manifest.Check(context.TODO(), zap)
 	assert.NoError(err)
+
+	// only shared symmetric keys can be derived deterministically
+	var secretManifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &secretManifest))
+	secretManifest.Secrets["deterministic"] = Secret{Type: "symmetric-key", Size: 128, Shared: true, Deterministic: true}
+	assert.NoError(secretManifest.Check(context.TODO(), zap))
+	secretManifest.Secrets["deterministic"] = Secret{Type: "symmetric-key", Size: 128, Deterministic: true}
+	assert.Error(secretManifest.Check(context.TODO(), zap))
+	secretManifest.Secrets["deterministic"] = Secret{Type: "cert-ecdsa", Size: 256, Shared: true, Deterministic: true}
+	assert.Error(secretManifest.Check(context.TODO(), zap))
+
+	// hmac secrets support a selection of hash algorithms
+	secretManifest.Secrets["deterministic"] = Secret{Type: "hmac", Size: 256, Algorithm: "sha384"}
+	assert.NoError(secretManifest.Check(context.TODO(), zap))
+	secretManifest.Secrets["deterministic"] = Secret{Type: "hmac", Size: 256, Algorithm: "md5"}
+	assert.Error(secretManifest.Check(context.TODO(), zap))
+	secretManifest.Secrets["deterministic"] = Secret{Type: "symmetric-key", Size: 256, Algorithm: "sha256"}
+	assert.Error(secretManifest.Check(context.TODO(), zap))
+
+	// package mismatches are reported by property name
+	productID, securityVersion, lowerSecurityVersion := uint64(3), uint(2), uint(1)
+	requiredPkg := quote.PackageProperties{SignerID: "ab", ProductID: &productID, SecurityVersion: &securityVersion}
+	assert.Empty(requiredPkg.Mismatches(quote.PackageProperties{SignerID: "AB", ProductID: &productID, SecurityVersion: &securityVersion}))
+	assert.Equal([]string{"Debug", "SignerID", "SecurityVersion"}, requiredPkg.Mismatches(quote.PackageProperties{Debug: true, SignerID: "cd", ProductID: &productID, SecurityVersion: &lowerSecurityVersion}))
+	assert.Equal([]string{"ProductID", "SecurityVersion"}, requiredPkg.Mismatches(quote.PackageProperties{SignerID: "ab"}))
+
+	// blocked packages can only be set by an update manifest
+	var blockManifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &blockManifest))
+	blockManifest.BlockedPackages = map[string][]quote.PackageProperties{"frontend": {{UniqueID: "00"}}}
+	assert.Error(blockManifest.Check(context.TODO(), zap))
+
+	// required DNS names must not be empty
+	var dnsManifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &dnsManifest))
+	frontend := dnsManifest.Marbles["frontend"]
+	frontend.RequiredDNSNames = []string{"frontend.namespace"}
+	dnsManifest.Marbles["frontend"] = frontend
+	assert.NoError(dnsManifest.Check(context.TODO(), zap))
+	frontend.RequiredDNSNames = []string{"frontend.namespace", ""}
+	dnsManifest.Marbles["frontend"] = frontend
+	assert.Error(dnsManifest.Check(context.TODO(), zap))
+
+	// ca-cert secrets need a valid path length and name constraints, and may only be used by Marbles allowed to hold a CA
+	var caManifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &caManifest))
+	constraints := &NameConstraints{PermittedDNSDomains: []string{"ca.example.com"}}
+	caManifest.Secrets["issuer"] = Secret{Type: "ca-cert", Size: 256, PathLen: 1, NameConstraints: constraints}
+	assert.NoError(caManifest.Check(context.TODO(), zap))
+	caManifest.Secrets["issuer"] = Secret{Type: "ca-cert", Size: 256, PathLen: -1, NameConstraints: constraints}
+	assert.Error(caManifest.Check(context.TODO(), zap))
+	caManifest.Secrets["issuer"] = Secret{Type: "ca-cert", Size: 2048, NameConstraints: constraints}
+	assert.Error(caManifest.Check(context.TODO(), zap))
+	caManifest.Secrets["issuer"] = Secret{Type: "ca-cert", Size: 256, UserDefined: true, NameConstraints: constraints}
+	assert.Error(caManifest.Check(context.TODO(), zap))
+	caManifest.Secrets["issuer"] = Secret{Type: "cert-ecdsa", Size: 256, PathLen: 1}
+	assert.Error(caManifest.Check(context.TODO(), zap))
+	caManifest.Secrets["issuer"] = Secret{Type: "ca-cert", Size: 256}
+	assert.Error(caManifest.Check(context.TODO(), zap))
+	caManifest.Secrets["issuer"] = Secret{Type: "ca-cert", Size: 256, NameConstraints: &NameConstraints{ExcludedDNSDomains: []string{"example.com"}}}
+	assert.Error(caManifest.Check(context.TODO(), zap))
+
+	caManifest.Secrets["issuer"] = Secret{Type: "ca-cert", Size: 256, NameConstraints: constraints}
+	caManifest.TLS["ca"] = TLStag{Incoming: []TLSTagEntry{{Port: "8443", Cert: "issuer", DisableClientAuth: true}}}
+	caMarble := caManifest.Marbles["frontend"]
+	caMarble.TLS = []string{"ca"}
+	caManifest.Marbles["frontend"] = caMarble
+	err = caManifest.Check(context.TODO(), zap)
+	require.Error(err)
+	assert.Contains(err.Error(), "AllowCA")
+	caMarble.AllowCA = true
+	caManifest.Marbles["frontend"] = caMarble
+	assert.NoError(caManifest.Check(context.TODO(), zap))
+
+	// name constraints of ca-cert secrets need to be valid and not contradict each other
+	validateConstraints := func(secretType string, constraints NameConstraints) error {
+		caManifest.Secrets["issuer"] = Secret{Type: secretType, Size: 256, NameConstraints: &constraints}
+		return caManifest.Check(context.TODO(), zap)
+	}
+	assert.NoError(validateConstraints("ca-cert", NameConstraints{
+		PermittedDNSDomains: []string{"example.com"},
+		ExcludedDNSDomains:  []string{"secret.example.com"},
+		PermittedIPRanges:   []string{"10.0.0.0/8"},
+		ExcludedIPRanges:    []string{"10.0.0.0/16"},
+		PermittedURIDomains: []string{".example.com"},
+	}))
+	assert.Error(validateConstraints("cert-ecdsa", NameConstraints{PermittedDNSDomains: []string{"example.com"}}))
+	assert.Error(validateConstraints("ca-cert", NameConstraints{PermittedDNSDomains: []string{""}}))
+	assert.Error(validateConstraints("ca-cert", NameConstraints{PermittedIPRanges: []string{"10.0.0.1"}}))
+	assert.Error(validateConstraints("ca-cert", NameConstraints{PermittedDNSDomains: []string{"app.example.com"}, ExcludedDNSDomains: []string{"example.com"}}))
+	assert.Error(validateConstraints("ca-cert", NameConstraints{PermittedDNSDomains: []string{".example.com"}, ExcludedDNSDomains: []string{"EXAMPLE.com"}}))
+	assert.Error(validateConstraints("ca-cert", NameConstraints{PermittedIPRanges: []string{"10.1.0.0/16"}, ExcludedIPRanges: []string{"10.0.0.0/8"}}))
+	assert.Error(validateConstraints("ca-cert", NameConstraints{PermittedURIDomains: []string{"example.com"}, ExcludedURIDomains: []string{"example.com"}}))
+	// excluding only subdomains of a permitted domain is not contradictory
+	assert.NoError(validateConstraints("ca-cert", NameConstraints{PermittedDNSDomains: []string{"example.com"}, ExcludedDNSDomains: []string{".example.com"}}))
+
+	// user certificates need to be valid PEM encoded certificates
+	var userManifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &userManifest))
+	require.NoError(userManifest.Check(context.TODO(), zap))
+
+	adminUser := userManifest.Users["admin"]
+	adminUser.Certificate = "-----BEGIN CERTIFICATE-----\nTUFSQkxFUlVO\n-----END CERTIFICATE-----\n"
+	userManifest.Users["admin"] = adminUser
+	err = userManifest.Check(context.TODO(), zap)
+	require.Error(err)
+	assert.Contains(err.Error(), "admin")
+
+	adminUser.Certificate = "not a certificate"
+	userManifest.Users["admin"] = adminUser
+	err = userManifest.Check(context.TODO(), zap)
+	require.Error(err)
+	assert.Contains(err.Error(), "admin")
+
+	// TLS entries need valid ports and certificate references
+	tlsTestCases := map[string]struct {
+		tag     TLStag
+		wantErr bool
+	}{
+		"valid": {
+			tag: TLStag{
+				Outgoing: []TLSTagEntry{{Port: "443", Addr: "service"}},
+				Incoming: []TLSTagEntry{{Port: "8443", Cert: "certShared", DisableClientAuth: true}},
+			},
+		},
+		"non-numeric port": {
+			tag:     TLStag{Incoming: []TLSTagEntry{{Port: "https"}}},
+			wantErr: true,
+		},
+		"port out of range": {
+			tag:     TLStag{Outgoing: []TLSTagEntry{{Port: "65536", Addr: "service"}}},
+			wantErr: true,
+		},
+		"port zero": {
+			tag:     TLStag{Incoming: []TLSTagEntry{{Port: "0"}}},
+			wantErr: true,
+		},
+		"blank address": {
+			tag:     TLStag{Outgoing: []TLSTagEntry{{Port: "443", Addr: " "}}},
+			wantErr: true,
+		},
+		"cert is not a certificate": {
+			tag:     TLStag{Incoming: []TLSTagEntry{{Port: "8443", Cert: "symmetricKeyShared", DisableClientAuth: true}}},
+			wantErr: true,
+		},
+		"outgoing cert": {
+			tag:     TLStag{Outgoing: []TLSTagEntry{{Port: "443", Addr: "service", Cert: "certShared"}}},
+			wantErr: true,
+		},
+	}
+	for name, tc := range tlsTestCases {
+		var tlsManifest Manifest
+		require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &tlsManifest))
+		tlsManifest.TLS["web"] = tc.tag
+		err := tlsManifest.Check(context.TODO(), zap)
+		if tc.wantErr {
+			assert.Error(err, name)
+		} else {
+			assert.NoError(err, name)
+		}
+	}
+}
+
+func TestCoordinatorEnvTemplateFunc(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	require.NoError(os.Setenv("MARBLERUN_TEST_REGION", "eu-west"))
+	defer os.Unsetenv("MARBLERUN_TEST_REGION")
+	require.NoError(os.Setenv("MARBLERUN_TEST_SECRET", "secret"))
+	defer os.Unsetenv("MARBLERUN_TEST_SECRET")
+
+	coordinatorEnv := CoordinatorEnvTemplateFunc([]string{"MARBLERUN_TEST_REGION", "MARBLERUN_TEST_UNSET"})
+
+	value, err := coordinatorEnv("MARBLERUN_TEST_REGION")
+	require.NoError(err)
+	assert.Equal("eu-west", value)
+
+	value, err = coordinatorEnv("MARBLERUN_TEST_UNSET")
+	require.NoError(err)
+	assert.Empty(value)
+
+	_, err = coordinatorEnv("MARBLERUN_TEST_SECRET")
+	assert.Error(err)
+
+	// the function is only added to a copy of the original map
+	funcMap := TemplateFuncMapWithCoordinatorEnv(ManifestEnvTemplateFuncMap, nil)
+	assert.Contains(funcMap, "coordinatorEnv")
+	assert.Contains(funcMap, "string")
+	assert.NotContains(ManifestEnvTemplateFuncMap, "coordinatorEnv")
+
+	// invalid names are rejected by Check
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	manifest.CoordinatorEnv = []string{"FOO=BAR"}
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+}
+
+func TestHostFileTemplateFunc(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "unittest")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	allowedPath := filepath.Join(dir, "shared.conf")
+	require.NoError(ioutil.WriteFile(allowedPath, []byte("shared config"), 0o600))
+	otherPath := filepath.Join(dir, "other.conf")
+	require.NoError(ioutil.WriteFile(otherPath, []byte("other config"), 0o600))
+	missingPath := filepath.Join(dir, "missing.conf")
+
+	hostFile := HostFileTemplateFunc(map[string]string{allowedPath: sha256Hex("shared config"), missingPath: sha256Hex("")})
+	content, err := hostFile(allowedPath)
+	require.NoError(err)
+	assert.Equal("shared config", content)
+
+	_, err = hostFile(otherPath)
+	assert.Error(err)
+	_, err = hostFile(missingPath)
+	assert.Error(err)
+
+	// modified files are rejected
+	require.NoError(ioutil.WriteFile(allowedPath, []byte("modified config"), 0o600))
+	_, err = hostFile(allowedPath)
+	assert.Error(err)
+
+	// the function is available to templates of the manifest
+	manifest := Manifest{CoordinatorFiles: map[string]string{allowedPath: sha256Hex("shared config")}}
+	funcMap := manifest.TemplateFuncMap(ManifestFileTemplateFuncMap)
+	assert.Contains(funcMap, "hostFile")
+	assert.Contains(funcMap, "coordinatorEnv")
+	assert.NotContains(ManifestFileTemplateFuncMap, "hostFile")
+
+	// paths need to be absolute and clean
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	manifest.CoordinatorFiles = map[string]string{allowedPath: sha256Hex("shared config")}
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+	manifest.CoordinatorFiles = map[string]string{"relative/shared.conf": sha256Hex("shared config")}
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+	manifest.CoordinatorFiles = map[string]string{dir + "/../shared.conf": sha256Hex("shared config")}
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// the hash is required
+	manifest.CoordinatorFiles = map[string]string{allowedPath: ""}
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+}
+
+func sha256Hex(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestManifestValidate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	result := manifest.Validate(context.TODO())
+	assert.NoError(result.Err)
+	assert.Empty(result.Warnings)
+
+	// questionable settings are reported as warnings
+	frontend := manifest.Packages["frontend"]
+	frontend.SecurityVersion = nil
+	manifest.Packages["frontend"] = frontend
+	allowSimulation := true
+	backendFirst := manifest.Marbles["backendFirst"]
+	backendFirst.AllowSimulation = &allowSimulation
+	manifest.Marbles["backendFirst"] = backendFirst
+	frontendMarble := manifest.Marbles["frontend"]
+	manifest.Marbles["frontendCopy"] = frontendMarble
+
+	result = manifest.Validate(context.TODO())
+	assert.NoError(result.Err)
+	// the warning about the frontend package is reported once, although two Marbles use it
+	assert.Len(result.Warnings, 2)
+	assert.Contains(strings.Join(result.Warnings, "\n"), "package frontend misses a value for SecurityVersion")
+	assert.Contains(strings.Join(result.Warnings, "\n"), "marble backendFirst allows simulation mode")
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// outside of debug mode, the missing value is an error
+	frontend.Debug = false
+	manifest.Packages["frontend"] = frontend
+	result = manifest.Validate(context.TODO())
+	assert.Error(result.Err)
+	assert.Equal(result.Err, manifest.Check(context.TODO(), zap.NewNop()))
+}
+
+func TestSecretMarbles(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+
+	secret := Secret{Type: "symmetric-key", Size: 128, Shared: true}
+	assert.True(secret.AvailableTo("frontend"))
+	secret.Marbles = []string{"frontend", "backendFirst"}
+	assert.True(secret.AvailableTo("frontend"))
+	assert.False(secret.AvailableTo("backendOther"))
+
+	manifest.Secrets["groupKey"] = secret
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// referenced Marbles need to exist
+	secret.Marbles = []string{"unknown"}
+	manifest.Secrets["groupKey"] = secret
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// per-Marble secrets are never shared, so they can not be restricted to a group
+	secret.Marbles = []string{"frontend"}
+	secret.Shared = false
+	manifest.Secrets["groupKey"] = secret
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+	secret.UserDefined = true
+	manifest.Secrets["groupKey"] = secret
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+}
+
+func TestCertificatePolicies(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	validate := func(policies ...string) error {
+		marble := manifest.Marbles["frontend"]
+		marble.CertificatePolicies = policies
+		manifest.Marbles["frontend"] = marble
+		return manifest.Check(context.TODO(), zap.NewNop())
+	}
+
+	assert.NoError(validate("2.23.140.1.2.1", "1.3.6.1.4.1.99999.1"))
+	assert.Error(validate("2.23.140.1.2.1", "not an oid"))
+	assert.Error(validate("4.1"))
+}
+
+func TestAllowedCSRExtensions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	validate := func(extensions ...string) error {
+		marble := manifest.Marbles["frontend"]
+		marble.AllowedCSRExtensions = extensions
+		manifest.Marbles["frontend"] = marble
+		return manifest.Check(context.TODO(), zap.NewNop())
+	}
+
+	assert.NoError(validate("1.3.6.1.4.1.11129.2.4.2", "1.3.6.1.4.1.99999.1"))
+	assert.Error(validate("not an oid"))
+	// extensions set by the Coordinator can not be allowed
+	assert.Error(validate("2.5.29.19"))
+	assert.Error(validate("1.3.6.1.4.1.99999.1", "2.5.29.37"))
+}
+
+func TestSignatureAlgorithm(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	validate := func(algorithm string) error {
+		marble := manifest.Marbles["frontend"]
+		marble.SignatureAlgorithm = algorithm
+		manifest.Marbles["frontend"] = marble
+		return manifest.Check(context.TODO(), zap.NewNop())
+	}
+
+	assert.NoError(validate(""))
+	assert.NoError(validate("ECDSA-SHA384"))
+	assert.NoError(validate("ecdsa-sha512"))
+	// the Coordinator signs with an ECDSA key
+	assert.Error(validate("SHA256-RSA"))
+	assert.Error(validate("Ed25519"))
+	// SHA-1 is not supported
+	assert.Error(validate("ECDSA-SHA1"))
+	assert.Error(validate("unknown"))
+
+	marble := Marble{SignatureAlgorithm: "ECDSA-SHA384"}
+	algorithm, err := marble.CertificateSignatureAlgorithm()
+	require.NoError(err)
+	assert.Equal(x509.ECDSAWithSHA384, algorithm)
+}
+
+func TestSecretSize(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	validate := func(secret Secret) CheckResult {
+		manifest.Secrets["sized"] = secret
+		return manifest.Validate(context.TODO())
+	}
+
+	// symmetric keys require a minimum size
+	assert.NoError(validate(Secret{Type: "symmetric-key", Size: 128}).Err)
+	assert.Error(validate(Secret{Type: "symmetric-key", Size: 56}).Err)
+	assert.Error(validate(Secret{Type: "symmetric-key", Size: 130}).Err)
+	assert.Error(validate(Secret{Type: "hmac", UserDefined: true}).Err)
+
+	// hmac keys shorter than the hash output are accepted with a warning
+	result := validate(Secret{Type: "hmac", Size: 128, Algorithm: "sha512"})
+	assert.NoError(result.Err)
+	assert.Contains(result.Warnings, "secret sized: Size 128 is smaller than the 512 bit output of the hmac algorithm")
+	assert.Empty(validate(Secret{Type: "hmac", Size: 256}).Warnings)
+
+	// generated certificates require a supported key size
+	assert.NoError(validate(Secret{Type: "cert-rsa", Size: 3072}).Err)
+	assert.Error(validate(Secret{Type: "cert-rsa", Size: 1024}).Err)
+	assert.Error(validate(Secret{Type: "cert-rsa"}).Err)
+	assert.Error(validate(Secret{Type: "cert-ecdsa", Size: 512}).Err)
+	assert.Error(validate(Secret{Type: "cert-ed25519", Size: 256}).Err)
+
+	// sizes which are ignored for a type are accepted with a warning
+	for _, secret := range []Secret{
+		{Type: "plain", Size: 128},
+		{Type: "cert-rsa", Size: 1024, UserDefined: true},
+		{Type: "cert-ed25519", Size: 256, UserDefined: true},
+	} {
+		result := validate(secret)
+		assert.NoError(result.Err)
+		assert.Contains(result.Warnings, "secret sized: Size is ignored for secrets of type "+secret.Type)
+	}
+	assert.Empty(validate(Secret{Type: "plain"}).Warnings)
+}
+
+func TestEncryptedParameters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	marble := manifest.Marbles["frontend"]
+	marble.Parameters.Files = map[string]File{"/secret.conf": {Data: "secret"}}
+	marble.InfrastructureParameters = map[string]Parameters{"Azure": {Env: map[string]File{"AZURE_TOKEN": {Data: "token"}}}}
+	marble.EncryptedParameters = &EncryptedParameters{Files: []string{"/secret.conf"}, Env: []string{"AZURE_TOKEN"}}
+	manifest.Marbles["frontend"] = marble
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// named parameters need to be defined for the Marble
+	marble.EncryptedParameters = &EncryptedParameters{Files: []string{"/unknown.conf"}}
+	manifest.Marbles["frontend"] = marble
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+	marble.EncryptedParameters = &EncryptedParameters{Env: []string{"/secret.conf"}}
+	manifest.Marbles["frontend"] = marble
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+}
+
+func TestFilesArchive(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	marble := manifest.Marbles["frontend"]
+	marble.Parameters.Files = map[string]File{"/secret.conf": {Data: "secret"}}
+	marble.FilesArchive = true
+	manifest.Marbles["frontend"] = marble
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// the archive is delivered as a single environment variable, so its files cannot be encrypted by name
+	marble.EncryptedParameters = &EncryptedParameters{Files: []string{"/secret.conf"}}
+	manifest.Marbles["frontend"] = marble
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// the Marble cannot define the variable holding the archive
+	marble.EncryptedParameters = nil
+	marble.InfrastructureParameters = map[string]Parameters{"Azure": {Env: map[string]File{"MARBLE_FILES_ARCHIVE": {Data: "archive"}}}}
+	manifest.Marbles["frontend"] = marble
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+}
+
+func TestResources(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	marble := manifest.Marbles["frontend"]
+	marble.Resources = &Resources{Memory: "1024M", CPU: "500m"}
+	manifest.Marbles["frontend"] = marble
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+	memory, err := marble.Resources.MemoryBytes()
+	require.NoError(err)
+	assert.EqualValues(1024*1024*1024, memory)
+
+	// both hints are optional
+	marble.Resources = &Resources{CPU: "2"}
+	manifest.Marbles["frontend"] = marble
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+	memory, err = marble.Resources.MemoryBytes()
+	require.NoError(err)
+	assert.Zero(memory)
+
+	for _, resources := range []Resources{
+		{Memory: "lots"},
+		{Memory: "0"},
+		{CPU: "two"},
+		{CPU: "-1"},
+		{CPU: "0"},
+	} {
+		marble.Resources = &resources
+		manifest.Marbles["frontend"] = marble
+		assert.Error(manifest.Check(context.TODO(), zap.NewNop()), resources)
+	}
+}
+
+func TestOmitReservedEnv(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	marble := manifest.Marbles["frontend"]
+	marble.OmitReservedEnv = []string{"MARBLE_PREDEFINED_PRIVATE_KEY", "MARBLE_PREDEFINED_ROOT_CA"}
+	manifest.Marbles["frontend"] = marble
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// only reserved environment variables can be omitted
+	marble.OmitReservedEnv = []string{"LOG_LEVEL"}
+	manifest.Marbles["frontend"] = marble
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+}
+
+func TestEncodeSecretDataToBase64URLRaw(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// the value encodes to characters which differ between base64 and base64url, and needs padding in base64
+	value := []byte{0xfb, 0xff, 0xbf, 0x01}
+	encoded, err := EncodeSecretDataToBase64URLRaw(Secret{Public: value})
+	require.NoError(err)
+	assert.Equal("-_-_AQ", encoded)
+	assert.NotContains(encoded, "=")
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	require.NoError(err)
+	assert.Equal(value, decoded)
+
+	_, err = EncodeSecretDataToBase64URLRaw(nil)
+	assert.Error(err)
+}
+
+func TestEncodeSecretDataToJSONField(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	secret := Secret{Type: "plain", Public: []byte(`{"client": {"id": "marble", "port": 8080, "tags": ["a", "b"], "nested": {"ok": true}}}`)}
+
+	value, err := EncodeSecretDataToJSONField(secret, "client.id")
+	require.NoError(err)
+	assert.Equal("marble", value)
+	value, err = EncodeSecretDataToJSONField(secret, "client.port")
+	require.NoError(err)
+	assert.Equal("8080", value)
+	value, err = EncodeSecretDataToJSONField(secret, "client.tags.1")
+	require.NoError(err)
+	assert.Equal("b", value)
+	value, err = EncodeSecretDataToJSONField(secret, "client.nested")
+	require.NoError(err)
+	assert.Equal(`{"ok":true}`, value)
+
+	_, err = EncodeSecretDataToJSONField(secret, "client.unknown")
+	assert.Error(err)
+	_, err = EncodeSecretDataToJSONField(secret, "client.tags.2")
+	assert.Error(err)
+	_, err = EncodeSecretDataToJSONField(secret, "client.id.more")
+	assert.Error(err)
+	_, err = EncodeSecretDataToJSONField(secret, "client..id")
+	assert.Error(err)
+	_, err = EncodeSecretDataToJSONField(Secret{Type: "plain", Public: []byte("no json")}, "client")
+	assert.Error(err)
+	_, err = EncodeSecretDataToJSONField(nil, "client")
+	assert.Error(err)
+}
+
+func TestEncodeDotenv(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dotenv, err := EncodeDotenv("PLAIN", "value", "ESCAPED", "a \"quoted\" $HOME\\path\r\nnext line")
+	require.NoError(err)
+	assert.Equal("PLAIN=\"value\"\nESCAPED=\"a \\\"quoted\\\" \\$HOME\\\\path\\r\\nnext line\"\n", dotenv)
+
+	dotenv, err = EncodeDotenv()
+	require.NoError(err)
+	assert.Empty(dotenv)
+
+	_, err = EncodeDotenv("MISSING_VALUE")
+	assert.Error(err)
+	_, err = EncodeDotenv("INVALID-NAME", "value")
+	assert.Error(err)
+	_, err = EncodeDotenv("", "value")
+	assert.Error(err)
+	_, err = EncodeDotenv("NULL", "a\x00b")
+	assert.Error(err)
+}
+
+func TestResolveParameters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mnf := Manifest{
+		DefaultParameters: DefaultParameters{
+			Env:  map[string]File{"LOG_LEVEL": {Data: "info"}, "REGION": {Data: "eu"}},
+			Argv: []string{"default"},
+		},
+		Templates: map[string]ParameterTemplate{
+			"base": {
+				Parameters: Parameters{
+					Files: map[string]File{"/config": {Data: "base"}},
+					Env:   map[string]File{"LOG_LEVEL": {Data: "debug"}},
+				},
+			},
+			"database": {
+				Inherits:   []string{"base"},
+				Parameters: Parameters{Env: map[string]File{"DB_HOST": {Data: "db"}}, Argv: []string{"database"}},
+			},
+			"region": {
+				Parameters: Parameters{Env: map[string]File{"REGION": {Data: "us"}}},
+			},
+		},
+	}
+
+	params, err := mnf.ResolveParameters(Marble{
+		Inherits:   []string{"database", "region"},
+		Parameters: Parameters{Env: map[string]File{"DB_HOST": {Data: "localhost"}}},
+	})
+	require.NoError(err)
+	assert.Equal(map[string]File{"/config": {Data: "base"}}, params.Files)
+	assert.Equal(map[string]File{
+		"LOG_LEVEL": {Data: "debug"},
+		"REGION":    {Data: "us"},
+		"DB_HOST":   {Data: "localhost"},
+	}, params.Env)
+	assert.Equal([]string{"database"}, params.Argv)
+
+	// templates are not modified by resolving
+	assert.Len(mnf.Templates["database"].Env, 1)
+
+	_, err = mnf.ResolveParameters(Marble{Inherits: []string{"undefined"}})
+	assert.Error(err)
+
+	mnf.Templates["base"] = ParameterTemplate{Inherits: []string{"database"}}
+	_, err = mnf.ResolveParameters(Marble{Inherits: []string{"region", "database"}})
+	require.Error(err)
+	assert.Contains(err.Error(), "cyclic")
+
+	// Check detects undefined templates and cyclic inheritance
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	manifest.Templates = map[string]ParameterTemplate{"base": {Parameters: Parameters{Argv: []string{"base"}}}}
+	frontend := manifest.Marbles["frontend"]
+	frontend.Inherits = []string{"base"}
+	manifest.Marbles["frontend"] = frontend
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+
+	frontend.Inherits = []string{"undefined"}
+	manifest.Marbles["frontend"] = frontend
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+
+	frontend.Inherits = nil
+	manifest.Marbles["frontend"] = frontend
+	manifest.Templates["base"] = ParameterTemplate{Inherits: []string{"base"}}
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+}
+
+func TestBundles(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mnf := Manifest{
+		Templates: map[string]ParameterTemplate{
+			"base": {Parameters: Parameters{Files: map[string]File{"/etc/app.conf": {Data: "template"}, "/etc/base.conf": {Data: "base"}}}},
+		},
+		Bundles: map[string]Bundle{
+			"app":   {Version: "1", Files: map[string]File{"/etc/app.conf": {Data: "bundle"}, "/etc/app.d/a.conf": {Data: "a"}}},
+			"certs": {Version: "1", Files: map[string]File{"/etc/ca.pem": {Data: "ca"}}},
+			"other": {Version: "1", Files: map[string]File{"/etc/ca.pem": {Data: "other ca"}}},
+		},
+	}
+
+	// bundles override templates, the Marble's own Files override bundles
+	params, err := mnf.ResolveParameters(Marble{
+		Inherits:   []string{"base"},
+		Bundles:    []string{"app", "certs"},
+		Parameters: Parameters{Files: map[string]File{"/etc/app.d/a.conf": {Data: "marble"}}},
+	})
+	require.NoError(err)
+	assert.Equal(map[string]File{
+		"/etc/base.conf":    {Data: "base"},
+		"/etc/app.conf":     {Data: "bundle"},
+		"/etc/app.d/a.conf": {Data: "marble"},
+		"/etc/ca.pem":       {Data: "ca"},
+	}, params.Files)
+
+	_, err = mnf.ResolveParameters(Marble{Bundles: []string{"certs", "other"}})
+	require.Error(err)
+	assert.Contains(err.Error(), "/etc/ca.pem")
+	_, err = mnf.ResolveParameters(Marble{Bundles: []string{"undefined"}})
+	assert.Error(err)
+
+	// Check detects undefined bundles, path collisions, and missing versions
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	manifest.Bundles = mnf.Bundles
+	frontend := manifest.Marbles["frontend"]
+	frontend.Bundles = []string{"app", "certs"}
+	manifest.Marbles["frontend"] = frontend
+	assert.NoError(manifest.Check(context.TODO(), zap.NewNop()))
+
+	frontend.Bundles = []string{"undefined"}
+	manifest.Marbles["frontend"] = frontend
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+	frontend.Bundles = []string{"certs", "other"}
+	manifest.Marbles["frontend"] = frontend
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+
+	frontend.Bundles = nil
+	manifest.Marbles["frontend"] = frontend
+	manifest.Bundles["app"] = Bundle{Files: map[string]File{"/etc/app.conf": {Data: "bundle"}}}
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// updates need to change the version of existing bundles
+	update := Manifest{Bundles: map[string]Bundle{"certs": {Version: "2", Files: map[string]File{"/etc/ca.pem": {Data: "new ca"}}}}}
+	assert.NoError(update.CheckParametersUpdate(context.TODO(), mnf.Marbles, mnf.Bundles, nil))
+	update.Bundles["certs"] = Bundle{Version: "1"}
+	assert.Error(update.CheckParametersUpdate(context.TODO(), mnf.Marbles, mnf.Bundles, nil))
+	update.Bundles = map[string]Bundle{"undefined": {Version: "2"}}
+	assert.Error(update.CheckParametersUpdate(context.TODO(), mnf.Marbles, mnf.Bundles, nil))
+}
+
+func TestResolveInfrastructureParameters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var mnf Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &mnf))
+	marble := Marble{
+		Package: "frontend",
+		Parameters: Parameters{
+			Env:  map[string]File{"REGION": {Data: "default"}, "LOG_LEVEL": {Data: "info"}},
+			Argv: []string{"frontend"},
+		},
+		InfrastructureParameters: map[string]Parameters{
+			"Azure": {
+				Files: map[string]File{"/azure.conf": {Data: "azure"}},
+				Env:   map[string]File{"REGION": {Data: "westeurope"}},
+			},
+		},
+	}
+
+	params, err := mnf.ResolveInfrastructureParameters(marble, "Azure")
+	require.NoError(err)
+	assert.Equal(map[string]File{"/azure.conf": {Data: "azure"}}, params.Files)
+	assert.Equal(map[string]File{"REGION": {Data: "westeurope"}, "LOG_LEVEL": {Data: "info"}}, params.Env)
+	assert.Equal([]string{"frontend"}, params.Argv)
+
+	// other infrastructures use the Marble's Parameters
+	params, err = mnf.ResolveInfrastructureParameters(marble, "Alibaba")
+	require.NoError(err)
+	assert.Equal(marble.Parameters, params)
+	params, err = mnf.ResolveInfrastructureParameters(marble, "")
+	require.NoError(err)
+	assert.Equal(marble.Parameters, params)
+
+	// Check rejects undefined infrastructures
+	mnf.Marbles["frontend"] = marble
+	assert.NoError(mnf.Check(context.TODO(), zap.NewNop()))
+	marble.InfrastructureParameters["AWS"] = Parameters{}
+	assert.Error(mnf.Check(context.TODO(), zap.NewNop()))
+}
+
+func TestActivationSchedule(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(err)
+	// Monday, 2021-03-01 09:30 in Berlin
+	monday := time.Date(2021, 3, 1, 9, 30, 0, 0, berlin)
+
+	testCases := map[string]struct {
+		schedule ActivationSchedule
+		time     time.Time
+		allowed  bool
+	}{
+		"empty schedule": {
+			time:    monday,
+			allowed: true,
+		},
+		"allowed day": {
+			schedule: ActivationSchedule{Days: []string{"monday", "Tuesday"}},
+			time:     monday,
+			allowed:  true,
+		},
+		"disallowed day": {
+			schedule: ActivationSchedule{Days: []string{"Tuesday"}},
+			time:     monday,
+			allowed:  false,
+		},
+		"within window": {
+			schedule: ActivationSchedule{Start: "08:00", End: "18:00", Timezone: "Europe/Berlin"},
+			time:     monday,
+			allowed:  true,
+		},
+		"outside window due to timezone": {
+			schedule: ActivationSchedule{Start: "08:00", End: "18:00", Timezone: "America/New_York"},
+			time:     monday,
+			allowed:  false,
+		},
+		"end is exclusive": {
+			schedule: ActivationSchedule{Start: "08:00", End: "09:30", Timezone: "Europe/Berlin"},
+			time:     monday,
+			allowed:  false,
+		},
+		"window spanning midnight": {
+			schedule: ActivationSchedule{Start: "22:00", End: "10:00", Timezone: "Europe/Berlin"},
+			time:     monday,
+			allowed:  true,
+		},
+		"day is evaluated in timezone": {
+			schedule: ActivationSchedule{Days: []string{"Sunday"}, Timezone: "Pacific/Honolulu"},
+			time:     monday,
+			allowed:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(tc.schedule.Check())
+			allowed, err := tc.schedule.Allows(tc.time)
+			require.NoError(err)
+			assert.Equal(tc.allowed, allowed)
+		})
+	}
+
+	assert.Error(ActivationSchedule{Days: []string{"Someday"}}.Check())
+	assert.Error(ActivationSchedule{Start: "08:00"}.Check())
+	assert.Error(ActivationSchedule{Start: "8am", End: "18:00"}.Check())
+	assert.Error(ActivationSchedule{Start: "08:00", End: "08:00"}.Check())
+	assert.Error(ActivationSchedule{Timezone: "Mars/Olympus_Mons"}.Check())
+
+	// Check validates the schedules of all Marbles
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	frontend := manifest.Marbles["frontend"]
+	frontend.ActivationSchedule = &ActivationSchedule{Days: []string{"Someday"}}
+	manifest.Marbles["frontend"] = frontend
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+}
+
+func TestMetadata(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var mnf Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &mnf))
+	mnf.Metadata = map[string]string{"owner": "platform-team", "ticket": "OPS-42"}
+	frontend := mnf.Marbles["frontend"]
+	frontend.Metadata = map[string]string{"description": "serves the web UI"}
+	mnf.Marbles["frontend"] = frontend
+
+	// metadata is not validated
+	assert.NoError(mnf.Check(context.TODO(), zap.NewNop()))
+
+	// metadata survives round-tripping
+	rawMnf, err := json.Marshal(mnf)
+	require.NoError(err)
+	var roundTripped Manifest
+	require.NoError(json.Unmarshal(rawMnf, &roundTripped))
+	assert.Equal(mnf.Metadata, roundTripped.Metadata)
+	assert.Equal("serves the web UI", roundTripped.Marbles["frontend"].Metadata["description"])
+	assert.Nil(roundTripped.Marbles["backendFirst"].Metadata)
 }
 
 func TestCertificate(t *testing.T) {
@@ -0,0 +1,162 @@
+// Copyright (c) Edgeless Systems GmbH.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package manifest
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SecretTypes lists the supported Types of secrets.
+var SecretTypes = []string{"symmetric-key", "hmac", "cert-rsa", "cert-ecdsa", "cert-ed25519", "ca-cert", "plain"}
+
+// RoleResourceTypes lists the supported ResourceTypes of roles.
+var RoleResourceTypes = []string{"Packages", "Secrets", "Manifest", "Certificates", "Coordinator", "Marbles"}
+
+// schemaOverrides holds the schemas of types whose JSON encoding differs from their Go structure.
+var schemaOverrides = map[reflect.Type]map[string]interface{}{
+	// a File is either a string or an object, see File.UnmarshalJSON
+	reflect.TypeOf(File{}): {
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"Data":        map[string]interface{}{"type": "string"},
+					"Encoding":    map[string]interface{}{"type": "string"},
+					"NoTemplates": map[string]interface{}{"type": "boolean"},
+					"Secret":      map[string]interface{}{"type": "string"},
+				},
+				"additionalProperties": false,
+			},
+		},
+	},
+	// a Certificate is a template with fields of x509.Certificate, or the base64-encoded DER certificate
+	reflect.TypeOf(Certificate{}): {"type": []string{"object", "string"}},
+	reflect.TypeOf(time.Time{}):   {"type": "string", "format": "date-time"},
+}
+
+// schemaEnums holds the allowed values of string fields, keyed by the struct type and field name.
+var schemaEnums = map[reflect.Type]map[string][]string{
+	reflect.TypeOf(Secret{}): {"Type": SecretTypes},
+	reflect.TypeOf(Role{}):   {"ResourceType": RoleResourceTypes},
+}
+
+// schemaExtraProperties holds properties which are accepted by the CLI and replaced before the manifest is set.
+var schemaExtraProperties = map[reflect.Type]map[string]interface{}{
+	reflect.TypeOf(User{}): {"CertificateFile": map[string]interface{}{"type": "string"}},
+}
+
+// JSONSchema returns a JSON Schema of the manifest, generated from the Manifest type.
+// It describes the structure of a manifest, so editors can validate it. Semantic checks are left to Manifest.Check.
+func JSONSchema() ([]byte, error) {
+	definitions := map[string]interface{}{}
+	schema := structSchema(reflect.TypeOf(Manifest{}), definitions)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "MarbleRun manifest"
+	schema["definitions"] = definitions
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// schemaForType returns the schema of t. Named structs are added to definitions and referenced.
+func schemaForType(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	if override, ok := schemaOverrides[t]; ok {
+		return override
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem(), definitions)
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		// byte slices are encoded as base64 strings, but can also be decoded from arrays of bytes
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{
+				"type":  []string{"string", "array"},
+				"items": map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 255},
+			}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaForType(t.Elem(), definitions)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaForType(t.Elem(), definitions)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, definitions)
+		}
+		if _, ok := definitions[t.Name()]; !ok {
+			// reserve the name before descending, so recursive types terminate
+			definitions[t.Name()] = nil
+			definitions[t.Name()] = structSchema(t, definitions)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	default:
+		// interfaces and other kinds can hold any value
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema returns the schema of the JSON object a struct is encoded to.
+func structSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	addStructProperties(t, properties, definitions)
+	for name, propertySchema := range schemaExtraProperties[t] {
+		properties[name] = propertySchema
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// addStructProperties adds the schemas of the fields of t to properties.
+// Like encoding/json, the fields of embedded structs are promoted to the outer object.
+func addStructProperties(t reflect.Type, properties map[string]interface{}, definitions map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Name
+		tagName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tagName == "-" {
+			continue
+		}
+		if tagName != "" {
+			name = tagName
+		}
+
+		if field.Anonymous && tagName == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addStructProperties(embedded, properties, definitions)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		fieldSchema := schemaForType(field.Type, definitions)
+		if enum, ok := schemaEnums[t][field.Name]; ok {
+			fieldSchema = map[string]interface{}{"type": "string", "enum": enum}
+		}
+		properties[name] = fieldSchema
+	}
+}
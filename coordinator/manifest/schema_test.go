@@ -0,0 +1,187 @@
+// Copyright (c) Edgeless Systems GmbH.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package manifest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/edgelesssys/marblerun/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestJSONSchema(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rawSchema, err := JSONSchema()
+	require.NoError(err)
+	var schema map[string]interface{}
+	require.NoError(json.Unmarshal(rawSchema, &schema))
+
+	// the test manifests are valid
+	for _, rawManifest := range []string{test.ManifestJSON, test.ManifestJSONWithRecoveryKey, test.IntegrationManifestJSON} {
+		var doc interface{}
+		require.NoError(json.Unmarshal([]byte(rawManifest), &doc))
+		assert.NoError(validateSchema(schema, schema, doc, ""))
+	}
+
+	// structural errors are detected
+	for name, rawManifest := range map[string]string{
+		"unknown field":        `{"Marbles": {"frontend": {"Package": "frontend", "MaxActivation": 1}}}`,
+		"wrong type":           `{"Marbles": {"frontend": {"MaxActivations": "1"}}}`,
+		"unknown secret type":  `{"Secrets": {"key": {"Type": "symmetric"}}}`,
+		"invalid file":         `{"Marbles": {"frontend": {"Parameters": {"Files": {"/a": 1}}}}}`,
+		"unknown file field":   `{"Marbles": {"frontend": {"Parameters": {"Env": {"A": {"Value": "a"}}}}}}`,
+		"unknown role type":    `{"Roles": {"admin": {"ResourceType": "Users"}}}`,
+		"embedded field typo":  `{"Templates": {"base": {"Argvs": ["a"]}}}`,
+		"negative activations": `{"Marbles": {"frontend": {"MaxActivations": -1}}}`,
+	} {
+		var doc interface{}
+		require.NoError(json.Unmarshal([]byte(rawManifest), &doc))
+		assert.Error(validateSchema(schema, schema, doc, ""), name)
+	}
+
+	// fields added by the CLI and promoted from embedded structs are accepted
+	var doc interface{}
+	require.NoError(json.Unmarshal([]byte(`{"Users": {"admin": {"CertificateFile": "admin.pem"}}, "Templates": {"base": {"Inherits": [], "Argv": ["a"]}}}`), &doc))
+	assert.NoError(validateSchema(schema, schema, doc, ""))
+}
+
+func TestSchemaEnums(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// all listed secret types are accepted by Check
+	var manifest Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	sizes := map[string]uint{"symmetric-key": 256, "hmac": 256, "cert-rsa": 2048, "cert-ecdsa": 256, "ca-cert": 256}
+	for _, secretType := range SecretTypes {
+		manifest.Secrets["schemaSecret"] = Secret{Type: secretType, Size: sizes[secretType]}
+		if secretType == "ca-cert" {
+			manifest.Secrets["schemaSecret"] = Secret{Type: secretType, Size: sizes[secretType], NameConstraints: &NameConstraints{PermittedDNSDomains: []string{"example.com"}}}
+		}
+		assert.NoError(manifest.Check(context.TODO(), zap.NewNop()), secretType)
+	}
+	manifest.Secrets["schemaSecret"] = Secret{Type: "symmetric"}
+	assert.Error(manifest.Check(context.TODO(), zap.NewNop()))
+
+	// all listed resource types are accepted by Check
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &manifest))
+	for _, resourceType := range RoleResourceTypes {
+		manifest.Roles = map[string]Role{"role": {ResourceType: resourceType}}
+		err := manifest.Check(context.TODO(), zap.NewNop())
+		if err != nil {
+			assert.NotContains(err.Error(), "unrecognized resource type", resourceType)
+		}
+	}
+}
+
+// validateSchema validates doc against the subset of JSON Schema generated by JSONSchema.
+func validateSchema(root, schema map[string]interface{}, doc interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/definitions/")
+		return validateSchema(root, root["definitions"].(map[string]interface{})[name].(map[string]interface{}), doc, path)
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, option := range oneOf {
+			if validateSchema(root, option.(map[string]interface{}), doc, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: matches %d options of oneOf", path, matches)
+		}
+		return nil
+	}
+	if types, ok := schema["type"]; ok {
+		var allowed []interface{}
+		if list, ok := types.([]interface{}); ok {
+			allowed = list
+		} else {
+			allowed = []interface{}{types}
+		}
+		matched := false
+		for _, allowedType := range allowed {
+			matched = matched || schemaTypeMatches(allowedType.(string), doc)
+		}
+		if !matched {
+			return fmt.Errorf("%s: %v is not of type %v", path, doc, types)
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, value := range enum {
+			found = found || value == doc
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, doc, enum)
+		}
+	}
+	if minimum, ok := schema["minimum"].(float64); ok {
+		if number, ok := doc.(float64); ok && number < minimum {
+			return fmt.Errorf("%s: %v is less than %v", path, doc, minimum)
+		}
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		if array, ok := doc.([]interface{}); ok {
+			for i, item := range array {
+				if err := validateSchema(root, items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	object, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	for key, value := range object {
+		if propertySchema, ok := properties[key]; ok {
+			if err := validateSchema(root, propertySchema.(map[string]interface{}), value, path+"."+key); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: unknown property %s", path, key)
+			}
+		case map[string]interface{}:
+			if err := validateSchema(root, additional, value, path+"."+key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func schemaTypeMatches(schemaType string, doc interface{}) bool {
+	switch v := doc.(type) {
+	case nil:
+		return schemaType == "null"
+	case bool:
+		return schemaType == "boolean"
+	case float64:
+		return schemaType == "number" || (schemaType == "integer" && v == float64(int64(v)))
+	case string:
+		return schemaType == "string"
+	case []interface{}:
+		return schemaType == "array"
+	case map[string]interface{}:
+		return schemaType == "object"
+	}
+	return false
+}
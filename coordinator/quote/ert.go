@@ -42,22 +42,28 @@ type InfrastructureProperties struct {
 
 // IsCompliant checks if the given package properties comply with the requirements.
 func (required PackageProperties) IsCompliant(given PackageProperties) bool {
+	return len(required.Mismatches(given)) == 0
+}
+
+// Mismatches returns the names of the given package properties which do not comply with the requirements.
+func (required PackageProperties) Mismatches(given PackageProperties) []string {
+	var mismatches []string
 	if required.Debug != given.Debug {
-		return false
+		mismatches = append(mismatches, "Debug")
 	}
 	if len(required.UniqueID) > 0 && !strings.EqualFold(required.UniqueID, given.UniqueID) {
-		return false
+		mismatches = append(mismatches, "UniqueID")
 	}
 	if len(required.SignerID) > 0 && !strings.EqualFold(required.SignerID, given.SignerID) {
-		return false
+		mismatches = append(mismatches, "SignerID")
 	}
-	if required.ProductID != nil && *required.ProductID != *given.ProductID {
-		return false
+	if required.ProductID != nil && (given.ProductID == nil || *required.ProductID != *given.ProductID) {
+		mismatches = append(mismatches, "ProductID")
 	}
-	if required.SecurityVersion != nil && *required.SecurityVersion > *given.SecurityVersion {
-		return false
+	if required.SecurityVersion != nil && (given.SecurityVersion == nil || *required.SecurityVersion > *given.SecurityVersion) {
+		mismatches = append(mismatches, "SecurityVersion")
 	}
-	return true
+	return mismatches
 }
 
 // IsCompliant checks if the given infrastructure properties comply with the requirements.
@@ -13,6 +13,7 @@ import (
 	"encoding/hex"
 	"fmt"
 
+	"github.com/edgelesssys/ego/attestation"
 	"github.com/edgelesssys/ego/enclave"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
 )
@@ -36,24 +37,38 @@ func (m *ERTValidator) Validate(givenQuote []byte, cert []byte, pp quote.Package
 	// Check that cert is equal
 	hash := sha256.Sum256(cert)
 	if !bytes.Equal(report.Data[:len(hash)], hash[:]) {
-		return fmt.Errorf("hash(cert) != report.Data: %v != %v", hash, report.Data)
+		return fmt.Errorf("%w: hash(cert) != report.Data: %v != %v", quote.ErrMessageMismatch, hash, report.Data)
 	}
 
 	// Verify PackageProperties
+	reportedProps := packageProperties(report)
+	if mismatches := pp.Mismatches(reportedProps); len(mismatches) > 0 {
+		return fmt.Errorf("PackageProperties not compliant: %w\n%v\n%v", &quote.PackageMismatchError{Fields: mismatches}, reportedProps, pp)
+	}
+
+	// TODO Verify InfrastructureProperties with information from OE Quote
+	return nil
+}
+
+// PackageProperties implements the Validator interface for ERTValidator.
+func (m *ERTValidator) PackageProperties(givenQuote []byte) (quote.PackageProperties, error) {
+	report, err := enclave.VerifyRemoteReport(givenQuote)
+	if err != nil {
+		return quote.PackageProperties{}, fmt.Errorf("verifying quote failed: %v", err)
+	}
+	return packageProperties(report), nil
+}
+
+// packageProperties returns the package properties of a verified report.
+func packageProperties(report attestation.Report) quote.PackageProperties {
 	productID := binary.LittleEndian.Uint64(report.ProductID)
-	reportedProps := quote.PackageProperties{
+	return quote.PackageProperties{
 		UniqueID:        hex.EncodeToString(report.UniqueID),
 		SignerID:        hex.EncodeToString(report.SignerID),
 		Debug:           report.Debug,
 		ProductID:       &productID,
 		SecurityVersion: &report.SecurityVersion,
 	}
-	if !pp.IsCompliant(reportedProps) {
-		return fmt.Errorf("PackageProperties not compliant:\n%v\n%v", reportedProps, pp)
-	}
-
-	// TODO Verify InfrastructureProperties with information from OE Quote
-	return nil
 }
 
 // ERTIssuer is a Quote issuer based on EdgelessRT.
@@ -23,6 +23,11 @@ func (m *FailValidator) Validate(quote []byte, cert []byte, pp PackageProperties
 	return fmt.Errorf("cannot validate quote")
 }
 
+// PackageProperties implements the Validator interface for FailValidator.
+func (m *FailValidator) PackageProperties(quote []byte) (PackageProperties, error) {
+	return PackageProperties{}, fmt.Errorf("cannot validate quote")
+}
+
 // FailIssuer always fails.
 type FailIssuer struct{}
 
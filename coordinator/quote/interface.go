@@ -7,10 +7,34 @@
 // Package quote provides the quoting functionialty for remote attestation on both Coordinator and Marble site.
 package quote
 
+import (
+	"errors"
+	"strings"
+)
+
+// ErrMessageMismatch is returned by validators if a quote is valid, but was not issued for the given message.
+var ErrMessageMismatch = errors.New("quote was not issued for the given message")
+
+// ErrInfrastructureMismatch is returned by validators if a quote does not comply with the given infrastructure properties.
+var ErrInfrastructureMismatch = errors.New("infrastructure does not comply")
+
+// PackageMismatchError is returned by validators if a quote does not comply with the given package properties.
+type PackageMismatchError struct {
+	// Fields lists the names of the package properties which do not comply, e.g. "UniqueID" or "SecurityVersion".
+	Fields []string
+}
+
+// Error implements the error interface.
+func (e *PackageMismatchError) Error() string {
+	return "package does not comply: " + strings.Join(e.Fields, ", ")
+}
+
 // Validator validates quotes.
 type Validator interface {
 	// Validate validates a quote for a given message and properties
 	Validate(quote []byte, cert []byte, pp PackageProperties, ip InfrastructureProperties) error
+	// PackageProperties returns the package properties reported by a quote
+	PackageProperties(quote []byte) (PackageProperties, error)
 }
 
 // Issuer issues quotes.
@@ -41,17 +41,28 @@ func (m *MockValidator) Validate(quote []byte, message []byte, pp PackagePropert
 		return errors.New("wrong quote")
 	}
 	if !bytes.Equal(entry.message, message) {
-		return errors.New("wrong message")
+		return ErrMessageMismatch
 	}
-	if !pp.IsCompliant(entry.pp) {
-		return errors.New("package does not comply")
+	if mismatches := pp.Mismatches(entry.pp); len(mismatches) > 0 {
+		return &PackageMismatchError{Fields: mismatches}
 	}
 	if !ip.IsCompliant(entry.ip) {
-		return errors.New("infrastructure does not comply")
+		return ErrInfrastructureMismatch
 	}
 	return nil
 }
 
+// PackageProperties implements the Validator interface.
+func (m *MockValidator) PackageProperties(quote []byte) (PackageProperties, error) {
+	m.mutex.Lock()
+	entry, found := m.valid[string(quote)]
+	m.mutex.Unlock()
+	if !found {
+		return PackageProperties{}, errors.New("wrong quote")
+	}
+	return entry.pp, nil
+}
+
 // AddValidQuote adds a valid quote.
 func (m *MockValidator) AddValidQuote(quote []byte, message []byte, pp PackageProperties, ip InfrastructureProperties) {
 	m.mutex.Lock()
@@ -7,11 +7,15 @@
 package recovery
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+
+	"github.com/edgelesssys/marblerun/util"
 )
 
 // Recovery describes an interface which the core can use to choose a recoverer (e.g. only single-party recoverer, multi-party recoverer) depending on the version of MarbleRun.
@@ -23,6 +27,33 @@ type Recovery interface {
 	SetRecoveryData(data []byte) error
 }
 
+// EncryptForRecoveryKeys encrypts data with each of the given PEM-encoded RSA recovery keys.
+func EncryptForRecoveryKeys(recoveryKeys map[string]string, data []byte) (map[string][]byte, error) {
+	encrypted := make(map[string][]byte, len(recoveryKeys))
+	for name, value := range recoveryKeys {
+		recoveryk, err := parseRSAPublicKeyFromPEM(value)
+		if err != nil {
+			return nil, err
+		}
+		encrypted[name], err = util.EncryptOAEP(recoveryk, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// VerifyProof verifies that signature is an RSA-PSS signature over the SHA-256 hash of message,
+// created with the private key belonging to the given PEM-encoded RSA recovery key.
+func VerifyProof(recoveryKey string, message, signature []byte) error {
+	recoveryk, err := parseRSAPublicKeyFromPEM(recoveryKey)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(message)
+	return rsa.VerifyPSS(recoveryk, crypto.SHA256, hash[:], signature, nil)
+}
+
 func parseRSAPublicKeyFromPEM(pemContent string) (*rsa.PublicKey, error) {
 	// Retrieve RSA public key for potential key recovery
 	block, _ := pem.Decode([]byte(pemContent))
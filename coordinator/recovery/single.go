@@ -8,8 +8,6 @@ package recovery
 
 import (
 	"errors"
-
-	"github.com/edgelesssys/marblerun/util"
 )
 
 // SinglePartyRecovery is a recoverer with support for single-party recovery only.
@@ -40,20 +38,10 @@ func (r *SinglePartyRecovery) GenerateEncryptionKey(recoveryKeys map[string]stri
 
 // GenerateRecoveryData generates the recovery data which is returned to the user.
 func (r *SinglePartyRecovery) GenerateRecoveryData(recoveryKeys map[string]string) (map[string][]byte, []byte, error) {
-	// For single party recovery, just create a new map here and return one single key
-	secretMap := make(map[string][]byte, 1)
-	for index, value := range recoveryKeys {
-		// Parse RSA Public Key
-		recoveryk, err := parseRSAPublicKeyFromPEM(value)
-		if err != nil {
-			return nil, nil, err
-		}
-
-		// Encrypt encryption key with user-specified RSA public key
-		secretMap[index], err = util.EncryptOAEP(recoveryk, r.encryptionKey)
-		if err != nil {
-			return nil, nil, err
-		}
+	// For single party recovery, encrypt the encryption key with the user-specified RSA public key
+	secretMap, err := EncryptForRecoveryKeys(recoveryKeys, r.encryptionKey)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Return freshly generated map for single-party recovery
@@ -32,6 +32,7 @@ type Sealer interface {
 	Seal(unencryptedData []byte, toBeEncrypted []byte) error
 	Unseal() (unencryptedData []byte, decryptedData []byte, err error)
 	SetEncryptionKey(key []byte) error
+	GetEncryptionKey() ([]byte, error)
 }
 
 // AESGCMSealer implements the Sealer interface using AES-GCM for confidentiallity and authentication.
@@ -183,6 +184,14 @@ func (s *AESGCMSealer) SetEncryptionKey(encryptionKey []byte) error {
 	return nil
 }
 
+// GetEncryptionKey returns the current encryption key, or nil if none was set or generated yet.
+func (s *AESGCMSealer) GetEncryptionKey() ([]byte, error) {
+	if err := s.unsealEncryptionKey(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s.encryptionKey, nil
+}
+
 // backupEncryptionKey creates a backup of an existing seal key.
 func (s *AESGCMSealer) backupEncryptionKey() {
 	if sealedKeyData, err := ioutil.ReadFile(s.getFname(SealedKeyFname)); err == nil {
@@ -217,6 +226,11 @@ func (s *MockSealer) SetEncryptionKey(key []byte) error {
 	return nil
 }
 
+// GetEncryptionKey implements the Sealer interface.
+func (s *MockSealer) GetEncryptionKey() ([]byte, error) {
+	return nil, nil
+}
+
 // NoEnclaveSealer is a sealed for a -noenclave instance and does perform encryption with a fixed key.
 type NoEnclaveSealer struct {
 	sealDir       string
@@ -310,6 +324,14 @@ func (s *NoEnclaveSealer) SetEncryptionKey(key []byte) error {
 	return ioutil.WriteFile(s.getFname(SealedKeyFname), s.encryptionKey, 0o600)
 }
 
+// GetEncryptionKey implements the Sealer interface.
+func (s *NoEnclaveSealer) GetEncryptionKey() ([]byte, error) {
+	if err := s.loadEncryptionKey(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s.encryptionKey, nil
+}
+
 func (s *NoEnclaveSealer) getFname(basename string) string {
 	return filepath.Join(s.sealDir, basename)
 }
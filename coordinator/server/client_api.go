@@ -1,14 +1,18 @@
 package server
 
 import (
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/edgelesssys/marblerun/coordinator/core"
+	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/user"
 )
 
@@ -44,19 +48,95 @@ type ManifestSignatureResp struct {
 	ManifestSignature string
 	// The currently set manifest in base64 encoding. Does not change when an update has been applied.
 	Manifest []byte
+	// A SHA-256 of the effective manifest. Only set if the parameters of Marbles or Bundles have been updated.
+	EffectiveManifestSignature string `json:",omitempty"`
+	// The effective manifest in base64 encoding. It is the currently set manifest with the Marbles and Bundles replaced by their updated definitions.
+	// Only set if the parameters of Marbles or Bundles have been updated.
+	EffectiveManifest []byte `json:",omitempty"`
 }
 
 // RecoveryDataResp contains RSA-encrypted AES state sealing key with public key specified by user in manifest
 type RecoveryDataResp struct {
 	// An array containing key-value mappings for encrypted secrets to be used for recovering the Coordinator in case of disaster recovery.
 	// The key matches each supplied key from RecoveryKeys in the manifest.
-	RecoverySecrets map[string]string
+	RecoverySecrets map[string]string `json:",omitempty"`
+	// Warnings about questionable settings in the manifest, which did not prevent it from being set.
+	Warnings []string `json:",omitempty"`
 }
 
 type RecoveryStatusResp struct {
 	StatusMessage string
 }
 
+type SignCertificateResp struct {
+	// The PEM-encoded certificate signed by the Coordinator's Intermediate CA.
+	Certificate string
+}
+
+// RevokeReq is the request to revoke all certificates of a Marble type.
+type RevokeReq struct {
+	// MarbleType is the name of the Marble in the manifest.
+	MarbleType string
+	// ExhaustActivations set to true raises the activation count to the Marble's MaxActivations, so no replacements can be activated.
+	ExhaustActivations bool
+}
+
+type RevokeResp struct {
+	// The number of certificates revoked by the request. Certificates which were already revoked or have expired are not counted.
+	Revoked int
+}
+
+type CRLResp struct {
+	// The PEM-encoded certificate revocation list signed by the Coordinator's Intermediate CA.
+	CRL string
+}
+
+// MaintenanceReq is the request to pause or resume activations.
+type MaintenanceReq struct {
+	// Paused set to true rejects activations of Marbles until it is set to false again.
+	Paused bool
+}
+
+// SetActivationsReq is the request to set the number of activations counted for a Marble type.
+type SetActivationsReq struct {
+	// MarbleType is the name of the Marble in the manifest.
+	MarbleType string
+	// Activations is the new number of activations. It must not exceed the Marble's MaxActivations.
+	Activations uint
+}
+
+// RotateDerivationRootReq is the request to rotate the root of the keys derived for Marbles.
+type RotateDerivationRootReq struct {
+	// GracePeriod is the duration, e.g. "72h", for which Marbles still receive the keys derived from the previous root.
+	GracePeriod string
+}
+
+// RotateRecoveryKeyReq is the request to replace a recovery key.
+type RotateRecoveryKeyReq struct {
+	// Name is the name of the recovery key in the manifest's RecoveryKeys.
+	Name string
+	// RecoveryKey is the new PEM-encoded RSA public key.
+	RecoveryKey string
+	// Proof is the RSA-PSS signature over the SHA-256 hash of RecoveryKey, created with the current private key of the recovery key.
+	Proof []byte
+}
+
+// RenderedParametersResp contains the parameters a Marble would receive on activation, with secrets replaced by placeholders.
+type RenderedParametersResp struct {
+	Files map[string]string
+	Env   map[string]string
+	Argv  []string
+}
+
+// RenderedTTLSConfigResp contains the TTLS config a Marble would receive on activation, with secrets replaced by placeholders.
+type RenderedTTLSConfigResp struct {
+	// Config is the content of MARBLE_TTLS_CONFIG. It is null if the Marble has no TLS tags.
+	Config json.RawMessage
+	// Skipped lists the incoming TLS entries whose certificate can not be resolved. Because the manifest sets LenientTLS,
+	// they present the Marble's certificate and require client authentication instead.
+	Skipped []string
+}
+
 type clientAPIServer struct {
 	cc core.ClientCore
 }
@@ -69,6 +149,7 @@ type clientAPIServer struct {
 // 1. Coordinator is in recovery mode. Either upload a key to unseal the saved state, or set a new manifest. Waiting for user input on [/recover](../#/features/recovery.md).
 // 1. Coordinator is ready to accept a manifest on [/manifest](../#/workflows/set-manifest.md)
 // 1. Coordinator is running correctly and ready to accept marbles through the [Marble API](../#/workflows/add-service.md)
+// 1. Coordinator is paused for maintenance and does not accept marbles until activations are resumed on /maintenance
 //
 //     Responses:
 //       200: StatusResponse
@@ -89,8 +170,12 @@ func (s *clientAPIServer) statusGet(w http.ResponseWriter, r *http.Request) {
 // The endpoint returns a SHA-256 of the currently set manifest.
 // Further, the manifest itself is returned as base64 encoded bytes.
 // Both values do not change when an update has been applied.
+// If the parameters of Marbles or Bundles have been updated, the effective manifest containing their updated definitions
+// and its SHA-256 are returned additionally.
 //
 // Users can retrieve and inspect the manifest through this endpoint before interacting with the application.
+// If the manifest defines a role of type `Manifest` granting the `ReadManifest` action,
+// only users assigned to such a role can retrieve the manifest. They connect via mutual TLS using their client certificate.
 //
 // Example for verifying the deployed manifest with curl:
 //
@@ -100,13 +185,22 @@ func (s *clientAPIServer) statusGet(w http.ResponseWriter, r *http.Request) {
 //
 //     Responses:
 //       200: ManifestResponse
+//		 401: ErrorResponse
 //		 500: ErrorResponse
 func (s *clientAPIServer) manifestGet(w http.ResponseWriter, r *http.Request) {
+	if !verifyManifestReader(w, r, s.cc) {
+		return
+	}
 	signature, manifest := s.cc.GetManifestSignature(r.Context())
-	writeJSON(w, ManifestSignatureResp{
+	resp := ManifestSignatureResp{
 		ManifestSignature: hex.EncodeToString(signature),
 		Manifest:          manifest,
-	})
+	}
+	if effectiveSignature, effectiveManifest := s.cc.GetEffectiveManifestSignature(r.Context()); effectiveManifest != nil {
+		resp.EffectiveManifestSignature = hex.EncodeToString(effectiveSignature)
+		resp.EffectiveManifest = effectiveManifest
+	}
+	writeJSON(w, resp)
 }
 
 // swagger:route POST /manifest manifest manifestPost
@@ -116,6 +210,7 @@ func (s *clientAPIServer) manifestGet(w http.ResponseWriter, r *http.Request) {
 // Before deploying the application to the cluster the manifest needs to be set once by the provider.
 // On success, an array containing key-value mapping for encrypted secrets to be used for recovering the Coordinator in case of disaster recovery.
 // The key matches each supplied key from RecoveryKeys in the Manifest.
+// Manifests with errors are rejected. Warnings about questionable settings, e.g., packages in debug mode, don't prevent the manifest from being set and are returned as well.
 //
 // 	Example for setting the manifest with curl:
 //
@@ -127,24 +222,32 @@ func (s *clientAPIServer) manifestGet(w http.ResponseWriter, r *http.Request) {
 //       200: RecoveryDataResponse
 //		 500: ErrorResponse
 func (s *clientAPIServer) manifestPost(w http.ResponseWriter, r *http.Request) {
-	manifest, err := ioutil.ReadAll(r.Body)
+	rawManifest, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		writeJSONError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	recoverySecretMap, err := s.cc.SetManifest(r.Context(), manifest)
+	recoverySecretMap, err := s.cc.SetManifest(r.Context(), rawManifest)
 	if err != nil {
 		writeJSONError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// If recovery data is set, return it
-	if len(recoverySecretMap) > 0 {
+	// the manifest was accepted, so it can be parsed to echo its warnings
+	var mnf manifest.Manifest
+	if err := json.Unmarshal(rawManifest, &mnf); err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	warnings := mnf.Validate(r.Context()).Warnings
+
+	// If recovery data is set or there are warnings, return them
+	if len(recoverySecretMap) > 0 || len(warnings) > 0 {
 		secretMap := make(map[string]string, len(recoverySecretMap))
 		for name, secret := range recoverySecretMap {
 			secretMap[name] = base64.StdEncoding.EncodeToString(secret)
 		}
-		writeJSON(w, RecoveryDataResp{secretMap})
+		writeJSON(w, RecoveryDataResp{RecoverySecrets: secretMap, Warnings: warnings})
 	} else {
 		writeJSON(w, nil)
 	}
@@ -243,11 +346,16 @@ func (s *clientAPIServer) recoverPost(w http.ResponseWriter, r *http.Request) {
 // Get a log of all performed updates.
 //
 // Returns a structured log of all updates performed via the `/update` or `/secrets` endpoint, including timestamp, author, and affected resources.
+// Access to the log is restricted in the same way as access to the manifest.
 //
 //     Responses:
 //       200: UpdateLogResponse
+//		 401: ErrorResponse
 //		 500: ErrorResponse
 func (s *clientAPIServer) updateGet(w http.ResponseWriter, r *http.Request) {
+	if !verifyManifestReader(w, r, s.cc) {
+		return
+	}
 	updateLog, err := s.cc.GetUpdateLog(r.Context())
 	if err != nil {
 		writeJSONError(w, err.Error(), http.StatusInternalServerError)
@@ -259,6 +367,10 @@ func (s *clientAPIServer) updateGet(w http.ResponseWriter, r *http.Request) {
 //
 // Update a specific package set in the manifest.
 //
+// Alternatively, a parameters-only update manifest containing just `Marbles` replaces the `Parameters`, `MaxActivations`, or `LogLevel` of existing Marbles.
+// It may also contain `Bundles`, which replace existing bundles with a new `Version` for all Marbles including them.
+// The new values apply to future activations. Packages, secrets, and certificates are not affected.
+//
 // This API endpoint only works if `Users` are defined in the Manifest.
 // For more information, have a look at [updating a Manifest](../#/workflows/update-manifest.md).
 //
@@ -290,6 +402,43 @@ func (s *clientAPIServer) updatePost(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, nil)
 }
 
+// swagger:route POST /update/dryrun update updateDryRunPost
+//
+// Check which Marble types a package update manifest would reject, without applying it.
+//
+// The Coordinator keeps the quote of the latest activation of each distinct enclave measurement of a Marble type.
+// For each Marble type whose package is updated or blocked, these quotes are validated against the proposed `SecurityVersion` and `BlockedPackages`.
+// Marble types reported as `Failing` would be rejected on their next activation. Marble types without a recorded quote are reported as not `Sampled`.
+// The user needs the same permissions as for applying the update.
+//
+// Example for checking an update manifest with curl:
+//
+// ```bash
+// curl --cacert marblerun.crt --cert user_certificate.crt --key user_private.key --data-binary @update_manifest.json https://$MARBLERUN/update/dryrun
+// ```
+//
+//     Responses:
+//       200: UpdateDryRunResponse
+//		 400: ErrorResponse
+//		 500: ErrorResponse
+func (s *clientAPIServer) updateDryRunPost(w http.ResponseWriter, r *http.Request) {
+	user := verifyUser(w, r, s.cc)
+	if user == nil {
+		return
+	}
+	updateManifest, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	impacts, err := s.cc.DryRunUpdateManifest(r.Context(), updateManifest, user)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, impacts)
+}
+
 // swagger:route GET /secrets secrets secretsGet
 //
 // Retrieve secrets.
@@ -341,6 +490,56 @@ func (s *clientAPIServer) secretsGet(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, response)
 }
 
+// swagger:route GET /secrets/export secrets secretsExportGet
+//
+// Export secrets of a Marble for backup.
+//
+// Returns the requested secrets of the Marble with the given UUID, encrypted for the RecoveryKeys of the manifest.
+// Shared and user-defined secrets are retrieved, per-Marble symmetric keys are re-derived.
+// The secrets are JSON-encoded and encrypted with a random AES-GCM key, which is in turn encrypted with RSA-OAEP for each recovery key.
+//
+// This API endpoint only works when `Users` and `RecoveryKeys` were defined in the manifest.
+// The user connects via mutual TLS using the user client certificate in the TLS Handshake
+// and needs to be assigned a role of type `Secrets` granting the `ExportSecret` action for all requested secrets.
+//
+// Example for exporting the secret `symmetricKeyPrivate` of a Marble:
+//
+// ```bash
+// curl --cacert marblerun.crt --cert user_certificate.crt --key user_private.key "https://$MARBLERUN/secrets/export?uuid=$MARBLE_UUID&s=symmetricKeyPrivate"
+// ```
+//
+//     Responses:
+//       200: SuccessResponse
+//		 400: ErrorResponse
+// 		 401: ErrorResponse
+//		 500: ErrorResponse
+func (s *clientAPIServer) secretsExportGet(w http.ResponseWriter, r *http.Request) {
+	user := verifyUser(w, r, s.cc)
+	if user == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	marbleUUID := query.Get("uuid")
+	requestedSecrets := query["s"]
+	if marbleUUID == "" || len(requestedSecrets) <= 0 {
+		writeJSONError(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	for _, req := range requestedSecrets {
+		if len(req) <= 0 {
+			writeJSONError(w, "malformed query string", http.StatusBadRequest)
+			return
+		}
+	}
+	backup, err := s.cc.ExportSecrets(r.Context(), marbleUUID, requestedSecrets, user)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, backup)
+}
+
 // swagger:route POST /secrets secrets secretsPost
 //
 // Set secrets.
@@ -380,6 +579,446 @@ func (s *clientAPIServer) secretsPost(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, nil)
 }
 
+// swagger:route POST /sign sign signPost
+//
+// Sign a certificate signing request.
+//
+// Issues a short-lived certificate for a PEM or DER encoded CSR, signed by the Coordinator's Intermediate CA.
+// The certificate is valid for 24 hours and can be used for TLS server and client authentication.
+// The CommonName of the CSR may not be a UUID, as these are reserved for Marbles.
+//
+// This API endpoint only works when `Users` were defined in the manifest.
+// The user connects via mutual TLS using the user client certificate in the TLS Handshake
+// and needs to be assigned a role of type `Certificates` granting the `SignCertificate` action.
+//
+// Example for signing the CSR `tool.csr`:
+//
+// ```bash
+// curl --cacert marblerun.crt --cert user_certificate.crt --key user_private.key --data-binary @tool.csr https://$MARBLERUN/sign
+// ```
+//
+//     Responses:
+//       200: SignCertificateResponse
+//		 400: ErrorResponse
+//		 401: ErrorResponse
+//		 500: ErrorResponse
+func (s *clientAPIServer) signPost(w http.ResponseWriter, r *http.Request) {
+	user := verifyUser(w, r, s.cc)
+	if user == nil {
+		return
+	}
+
+	csr, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if block, _ := pem.Decode(csr); block != nil {
+		csr = block.Bytes
+	}
+	cert, err := s.cc.SignCertificate(r.Context(), csr, user)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, SignCertificateResp{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}))})
+}
+
+// swagger:route GET /sign/log sign signLogGet
+//
+// Export the log of all certificates signed by the Coordinator.
+//
+// Returns every certificate issued by the Coordinator's Intermediate CA, both for Marbles and for users via [/sign](#/sign),
+// in order of issuance with its DER encoding, serial number, and the Marble type or user it was issued for.
+// For tamper evidence, the certificates are hashed into a Merkle tree as specified in RFC 6962.
+// The number of entries and the tree hash are signed with the Coordinator's root key, which can be verified using the Coordinator's root certificate.
+//
+// This API endpoint only works when `Users` were defined in the manifest.
+// The user connects via mutual TLS using the user client certificate in the TLS Handshake
+// and needs to be assigned a role of type `Certificates` granting the `ReadIssuanceLog` action.
+//
+// Example for exporting the issuance log:
+//
+// ```bash
+// curl --cacert marblerun.crt --cert user_certificate.crt --key user_private.key https://$MARBLERUN/sign/log
+// ```
+//
+//     Responses:
+//       200: SuccessResponse
+//		 400: ErrorResponse
+//		 401: ErrorResponse
+func (s *clientAPIServer) signLogGet(w http.ResponseWriter, r *http.Request) {
+	user := verifyUser(w, r, s.cc)
+	if user == nil {
+		return
+	}
+
+	log, err := s.cc.GetIssuanceLog(r.Context(), user)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, log)
+}
+
+// swagger:route POST /revoke sign revokePost
+//
+// Revoke all certificates issued for a Marble type.
+//
+// If a whole service is compromised, this revokes every unexpired certificate the issuance log records for the Marble type at once.
+// The revoked certificates are added to the certificate revocation list served at [/crl](#/crl) in a single transaction.
+// If `ExhaustActivations` is set, the activation count is raised to the Marble's `MaxActivations`, so no replacements can be activated
+// until the count is lowered again via [/activations](#/activations).
+//
+// This API endpoint only works when `Users` were defined in the manifest.
+// The user connects via mutual TLS using the user client certificate in the TLS Handshake
+// and needs to be assigned a role of type `Marbles` granting the `RevokeCertificates` action for the Marble.
+//
+// Example for revoking the certificates of the Marble frontend:
+//
+// ```bash
+// curl --cacert marblerun.crt --cert user_certificate.crt --key user_private.key --data '{"MarbleType": "frontend", "ExhaustActivations": true}' https://$MARBLERUN/revoke
+// ```
+//
+//     Responses:
+//       200: RevokeResponse
+//		 400: ErrorResponse
+//		 401: ErrorResponse
+func (s *clientAPIServer) revokePost(w http.ResponseWriter, r *http.Request) {
+	user := verifyUser(w, r, s.cc)
+	if user == nil {
+		return
+	}
+
+	var req RevokeReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	revoked, err := s.cc.RevokeMarbleCertificates(r.Context(), req.MarbleType, req.ExhaustActivations, user)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, RevokeResp{Revoked: revoked})
+}
+
+// swagger:route GET /crl sign crlGet
+//
+// Get the certificate revocation list of the Coordinator's Intermediate CA.
+//
+// The list contains the unexpired certificates revoked via [/revoke](#/revoke) and is signed by the Coordinator's Intermediate CA.
+// It should be fetched again before its NextUpdate, which is 24 hours after it was created.
+// Marble certificates are valid for 30 days. Peers which only verify the Coordinator's CA, such as the TTLS configuration of Marbles,
+// don't consult this list, so a revoked certificate is accepted by them until it expires. Marbles need to be restarted to obtain a new certificate.
+//
+// Example for getting the revocation list:
+//
+// ```bash
+// curl --cacert marblerun.crt https://$MARBLERUN/crl
+// ```
+//
+//     Responses:
+//       200: CRLResponse
+//		 500: ErrorResponse
+func (s *clientAPIServer) crlGet(w http.ResponseWriter, r *http.Request) {
+	crl, err := s.cc.GetCRL(r.Context())
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, CRLResp{string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}))})
+}
+
+// swagger:route POST /maintenance maintenance maintenancePost
+//
+// Pause or resume activations of Marbles.
+//
+// While activations are paused, the Coordinator keeps serving the Client API, but rejects new Marbles.
+// This can be used during maintenance windows. The paused state is not persisted and is reset when the Coordinator restarts.
+//
+// This API endpoint only works when `Users` were defined in the manifest.
+// The user connects via mutual TLS using the user client certificate in the TLS Handshake
+// and needs to be assigned a role of type `Coordinator` granting the `PauseActivations` action.
+//
+// Example for pausing activations:
+//
+// ```bash
+// curl --cacert marblerun.crt --cert user_certificate.crt --key user_private.key --data '{"Paused": true}' https://$MARBLERUN/maintenance
+// ```
+//
+//     Responses:
+//       200: SuccessResponse
+//		 400: ErrorResponse
+//		 401: ErrorResponse
+func (s *clientAPIServer) maintenancePost(w http.ResponseWriter, r *http.Request) {
+	user := verifyUser(w, r, s.cc)
+	if user == nil {
+		return
+	}
+
+	var req MaintenanceReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.cc.SetPaused(r.Context(), req.Paused, user); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, nil)
+}
+
+// swagger:route GET /activations activations activationsGet
+//
+// Get the activation budget, count, and resource hints of each Marble type.
+//
+// Returns the `MaxActivations` (0 means unlimited) and the number of counted activations for each Marble in the manifest.
+// If the manifest defines `Resources` for a Marble, they are included, so tooling can derive the resource requests of the Marble's pods.
+// Access is restricted in the same way as access to the manifest.
+//
+// Example for getting the activations:
+//
+// ```bash
+// curl --cacert marblerun.crt https://$MARBLERUN/activations
+// ```
+//
+//     Responses:
+//       200: ActivationsResponse
+//		 401: ErrorResponse
+//		 500: ErrorResponse
+func (s *clientAPIServer) activationsGet(w http.ResponseWriter, r *http.Request) {
+	if !verifyManifestReader(w, r, s.cc) {
+		return
+	}
+	activations, err := s.cc.GetActivations(r.Context())
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, activations)
+}
+
+// swagger:route POST /activations activations activationsPost
+//
+// Set the number of activations counted for a Marble type.
+//
+// When migrating an existing fleet to MarbleRun, the activation budget defined by `MaxActivations` can start from the number of already running instances.
+// The count must not exceed the Marble's `MaxActivations`.
+//
+// This API endpoint only works when `Users` were defined in the manifest.
+// The user connects via mutual TLS using the user client certificate in the TLS Handshake
+// and needs to be assigned a role of type `Marbles` granting the `SetActivations` action for the Marble.
+//
+// Example for counting three running instances of the Marble frontend:
+//
+// ```bash
+// curl --cacert marblerun.crt --cert user_certificate.crt --key user_private.key --data '{"MarbleType": "frontend", "Activations": 3}' https://$MARBLERUN/activations
+// ```
+//
+//     Responses:
+//       200: SuccessResponse
+//		 400: ErrorResponse
+//		 401: ErrorResponse
+func (s *clientAPIServer) activationsPost(w http.ResponseWriter, r *http.Request) {
+	user := verifyUser(w, r, s.cc)
+	if user == nil {
+		return
+	}
+
+	var req SetActivationsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.cc.SetActivations(r.Context(), req.MarbleType, req.Activations, user); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, nil)
+}
+
+// swagger:route POST /secrets/rotate secrets secretsRotatePost
+//
+// Rotate the root of the keys derived for Marbles.
+//
+// Symmetric keys and HMAC secrets which are unique to each Marble or marked as deterministic are derived from this root.
+// Marbles commonly use them to seal their data. After a rotation, Marbles receive the keys derived from the new root as `{{ .Secrets }}`.
+// Until the grace period has passed, the keys derived from the previous root are available as `{{ .MarbleRun.PreviousSecrets }}`,
+// so Marbles can unseal their data and seal it again with the new keys.
+// Another rotation is rejected until the grace period of the previous one has passed.
+//
+// This API endpoint only works when `Users` were defined in the manifest.
+// The user connects via mutual TLS using the user client certificate in the TLS Handshake
+// and needs to be assigned a role of type `Coordinator` granting the `RotateDerivationRoot` action.
+//
+// Example for rotating the root with a grace period of three days:
+//
+// ```bash
+// curl --cacert marblerun.crt --cert user_certificate.crt --key user_private.key --data '{"GracePeriod": "72h"}' https://$MARBLERUN/secrets/rotate
+// ```
+//
+//     Responses:
+//       200: SuccessResponse
+//		 400: ErrorResponse
+//		 401: ErrorResponse
+func (s *clientAPIServer) secretsRotatePost(w http.ResponseWriter, r *http.Request) {
+	user := verifyUser(w, r, s.cc)
+	if user == nil {
+		return
+	}
+
+	var req RotateDerivationRootReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gracePeriod, err := time.ParseDuration(req.GracePeriod)
+	if err != nil {
+		writeJSONError(w, fmt.Sprintf("invalid grace period: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.cc.RotateDerivationRoot(r.Context(), gracePeriod, user); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, nil)
+}
+
+// swagger:route POST /recover/rotate recover recoverRotatePost
+//
+// Replace a recovery key of the manifest.
+//
+// Use this if the private key of a recovery key was lost or compromised, while the Coordinator is still running.
+// The request proves possession of the current private key with an RSA-PSS signature over the SHA-256 hash of the new PEM-encoded public key.
+// The Coordinator seals its state with a newly generated encryption key and returns it encrypted for the new recovery key, just like when setting the manifest.
+// Previous recovery secrets can not be used to recover the state anymore.
+//
+// This API endpoint only works when `Users` were defined in the manifest.
+// The user connects via mutual TLS using the user client certificate in the TLS Handshake
+// and needs to be assigned a role of type `Coordinator` granting the `RotateRecoveryKey` action.
+//
+// Example for replacing the recovery key recoveryKey1:
+//
+// ```bash
+// openssl dgst -sha256 -sigopt rsa_padding_mode:pss -sign recovery_priv.key -out proof.bin new_recovery_pub.pem
+// jq -n --rawfile key new_recovery_pub.pem --arg proof "$(base64 -w0 proof.bin)" '{"Name": "recoveryKey1", "RecoveryKey": $key, "Proof": $proof}' \
+//   | curl --cacert marblerun.crt --cert user_certificate.crt --key user_private.key --data @- https://$MARBLERUN/recover/rotate
+// ```
+//
+//     Responses:
+//       200: RecoveryDataResponse
+//		 400: ErrorResponse
+//		 401: ErrorResponse
+func (s *clientAPIServer) recoverRotatePost(w http.ResponseWriter, r *http.Request) {
+	user := verifyUser(w, r, s.cc)
+	if user == nil {
+		return
+	}
+
+	var req RotateRecoveryKeyReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recoverySecretMap, err := s.cc.RotateRecoveryKey(r.Context(), req.Name, req.RecoveryKey, req.Proof, user)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secretMap := make(map[string]string, len(recoverySecretMap))
+	for name, secret := range recoverySecretMap {
+		secretMap[name] = base64.StdEncoding.EncodeToString(secret)
+	}
+	writeJSON(w, RecoveryDataResp{RecoverySecrets: secretMap})
+}
+
+// debugStateGet returns a snapshot of the Coordinator's internal state.
+// The endpoint is only served if debug endpoints are enabled and is not part of the public API.
+func (s *clientAPIServer) debugStateGet(w http.ResponseWriter, r *http.Request) {
+	state, err := s.cc.GetDebugState(r.Context())
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, state)
+}
+
+// debugParametersGet renders the parameters of a Marble type without activating a Marble.
+// The Marble type is requested via the query string in the form of ?marbleType=<type>.
+// The endpoint is only served if debug endpoints are enabled, requires a user of the manifest, and is not part of the public API.
+func (s *clientAPIServer) debugParametersGet(w http.ResponseWriter, r *http.Request) {
+	if verifyUser(w, r, s.cc) == nil || !verifyManifestReader(w, r, s.cc) {
+		return
+	}
+	marbleType := r.URL.Query().Get("marbleType")
+	if marbleType == "" {
+		writeJSONError(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	params, err := s.cc.RenderMarbleParameters(r.Context(), marbleType)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := RenderedParametersResp{
+		Files: make(map[string]string, len(params.Files)),
+		Env:   make(map[string]string, len(params.Env)),
+		Argv:  params.Argv,
+	}
+	for path, data := range params.Files {
+		resp.Files[path] = string(data)
+	}
+	for name, data := range params.Env {
+		resp.Env[name] = string(data)
+	}
+	writeJSON(w, resp)
+}
+
+// debugActivationGet returns the activation response a Marble of a type would receive, with placeholder secrets.
+// The data of the response can be saved as a fixture and loaded into an rpc.ActivationResp to test applications without a Coordinator.
+// The Marble type is requested via the query string in the form of ?marbleType=<type>.
+// The endpoint is only served if debug endpoints are enabled, requires a user of the manifest, and is not part of the public API.
+func (s *clientAPIServer) debugActivationGet(w http.ResponseWriter, r *http.Request) {
+	if verifyUser(w, r, s.cc) == nil || !verifyManifestReader(w, r, s.cc) {
+		return
+	}
+	marbleType := r.URL.Query().Get("marbleType")
+	if marbleType == "" {
+		writeJSONError(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	resp, err := s.cc.RenderActivationResponse(r.Context(), marbleType)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// debugTTLSGet returns the TTLS config a Marble of a type would receive, with placeholder secrets.
+// It lets operators check the addresses and client authentication settings resulting from their TLS tags before deploying.
+// The Marble type is requested via the query string in the form of ?marbleType=<type>.
+// The endpoint is only served if debug endpoints are enabled, requires a user of the manifest, and is not part of the public API.
+func (s *clientAPIServer) debugTTLSGet(w http.ResponseWriter, r *http.Request) {
+	if verifyUser(w, r, s.cc) == nil || !verifyManifestReader(w, r, s.cc) {
+		return
+	}
+	marbleType := r.URL.Query().Get("marbleType")
+	if marbleType == "" {
+		writeJSONError(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	config, skipped, err := s.cc.RenderTTLSConfig(r.Context(), marbleType)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, RenderedTTLSConfigResp{Config: config, Skipped: skipped})
+}
+
 func (s *clientAPIServer) methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
 	writeJSONError(w, "", http.StatusMethodNotAllowed)
 }
@@ -398,6 +1037,19 @@ func verifyUser(w http.ResponseWriter, r *http.Request, cc core.ClientCore) *use
 	return verifiedUser
 }
 
+// verifyManifestReader checks if the requesting user is allowed to read the manifest and writes an error response if not.
+func verifyManifestReader(w http.ResponseWriter, r *http.Request, cc core.ClientCore) bool {
+	var clientCerts []*x509.Certificate
+	if r.TLS != nil {
+		clientCerts = r.TLS.PeerCertificates
+	}
+	if err := cc.VerifyManifestReader(r.Context(), clientCerts); err != nil {
+		writeJSONError(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
 func writeJSON(w http.ResponseWriter, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dataToReturn := GeneralResponse{Status: "success", Data: v}
@@ -8,7 +8,9 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"net/http"
 	"os"
@@ -27,12 +29,15 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
 )
 
 // RunMarbleServer starts a gRPC with the given Coordinator core.
 // `address` is the desired TCP address like "localhost:0".
 // The effective TCP address is returned via `addrChan`.
-func RunMarbleServer(core *core.Core, addr string, addrChan chan string, errChan chan error, zapLogger *zap.Logger, promRegistry *prometheus.Registry) {
+// If `enableReflection` is set, gRPC server reflection is registered for debugging.
+// The server is stopped once ctx is done.
+func RunMarbleServer(ctx context.Context, core *core.Core, addr string, addrChan chan string, errChan chan error, zapLogger *zap.Logger, promRegistry *prometheus.Registry, enableReflection bool) {
 	tlsConfig := tls.Config{
 		GetCertificate: core.GetTLSMarbleRootCertificate,
 		// NOTE: we'll verify the cert later using the given quote
@@ -59,6 +64,9 @@ func RunMarbleServer(core *core.Core, addr string, addrChan chan string, errChan
 	)
 
 	rpc.RegisterMarbleServer(grpcServer, core)
+	if enableReflection {
+		reflection.Register(grpcServer)
+	}
 	if promRegistry != nil {
 		grpcMetrics.InitializeMetrics(grpcServer)
 		promRegistry.MustRegister(grpcMetrics)
@@ -69,6 +77,10 @@ func RunMarbleServer(core *core.Core, addr string, addrChan chan string, errChan
 		return
 	}
 	addrChan <- socket.Addr().String()
+	go func() {
+		<-ctx.Done()
+		grpcServer.Stop()
+	}()
 	err = grpcServer.Serve(socket)
 	if err != nil {
 		errChan <- err
@@ -91,24 +103,52 @@ func CreateServeMux(cc core.ClientCore, promFactory *promauto.Factory) serveMux
 	router.HandleFunc("/manifest", server.manifestPost).Methods("POST")
 	router.HandleFunc("/quote", server.quoteGet).Methods("GET")
 	router.HandleFunc("/recover", server.recoverPost).Methods("POST")
+	router.HandleFunc("/recover/rotate", server.recoverRotatePost).Methods("POST")
 	router.HandleFunc("/update", server.updateGet).Methods("GET")
 	router.HandleFunc("/update", server.updatePost).Methods("POST")
+	router.HandleFunc("/update/dryrun", server.updateDryRunPost).Methods("POST")
 	router.HandleFunc("/secrets", server.secretsPost).Methods("POST")
 	router.HandleFunc("/secrets", server.secretsGet).Methods("GET")
+	router.HandleFunc("/secrets/export", server.secretsExportGet).Methods("GET")
+	router.HandleFunc("/secrets/rotate", server.secretsRotatePost).Methods("POST")
+	router.HandleFunc("/sign", server.signPost).Methods("POST")
+	router.HandleFunc("/sign/log", server.signLogGet).Methods("GET")
+	router.HandleFunc("/revoke", server.revokePost).Methods("POST")
+	router.HandleFunc("/crl", server.crlGet).Methods("GET")
+	router.HandleFunc("/maintenance", server.maintenancePost).Methods("POST")
+	router.HandleFunc("/activations", server.activationsGet).Methods("GET")
+	router.HandleFunc("/activations", server.activationsPost).Methods("POST")
 	return router
 }
 
-// RunClientServer runs a HTTP server serving mux.
-func RunClientServer(mux http.Handler, address string, tlsConfig *tls.Config, zapLogger *zap.Logger) {
+// EnableDebugEndpoints adds endpoints exposing the Coordinator's internal state to the client API mux.
+// Endpoints rendering Marble parameters require a user of the manifest and are subject to the manifest's ReadManifest restriction.
+// The debug state endpoint is unauthenticated. None of them may be enabled in production.
+func EnableDebugEndpoints(router serveMux, cc core.ClientCore) {
+	server := clientAPIServer{cc}
+	router.HandleFunc("/debug/state", server.debugStateGet).Methods("GET")
+	router.HandleFunc("/debug/parameters", server.debugParametersGet).Methods("GET")
+	router.HandleFunc("/debug/activation", server.debugActivationGet).Methods("GET")
+	router.HandleFunc("/debug/ttls", server.debugTTLSGet).Methods("GET")
+}
+
+// RunClientServer runs a HTTP server serving mux until ctx is done.
+func RunClientServer(ctx context.Context, mux http.Handler, address string, tlsConfig *tls.Config, zapLogger *zap.Logger) {
 	loggedRouter := handlers.LoggingHandler(os.Stdout, mux)
 	server := http.Server{
 		Addr:      address,
 		Handler:   loggedRouter,
 		TLSConfig: tlsConfig,
 	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
 	zapLogger.Info("starting client https server", zap.String("address", address))
 	err := server.ListenAndServeTLS("", "")
-	zapLogger.Warn(err.Error())
+	if !errors.Is(err, http.ErrServerClosed) {
+		zapLogger.Warn(err.Error())
+	}
 }
 
 // RunPrometheusServer runs a HTTP server handling the prometheus metrics endpoint.
@@ -7,12 +7,14 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -21,6 +23,8 @@ import (
 	"testing"
 
 	"github.com/edgelesssys/marblerun/coordinator/core"
+	"github.com/edgelesssys/marblerun/coordinator/manifest"
+	"github.com/edgelesssys/marblerun/coordinator/rpc"
 	"github.com/edgelesssys/marblerun/test"
 	"github.com/edgelesssys/marblerun/util"
 	"github.com/stretchr/testify/assert"
@@ -99,6 +103,33 @@ func TestManifestWithRecoveryKey(t *testing.T) {
 	require.NotNil(recoveryData)
 }
 
+func TestManifestWarnings(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &mnf))
+	allowSimulation := true
+	backendFirst := mnf.Marbles["backendFirst"]
+	backendFirst.AllowSimulation = &allowSimulation
+	mnf.Marbles["backendFirst"] = backendFirst
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	c := core.NewCoreWithMocks()
+	mux := CreateServeMux(c, nil)
+
+	// warnings do not prevent the manifest from being set, but are returned
+	req := httptest.NewRequest(http.MethodPost, "/manifest", strings.NewReader(string(rawManifest)))
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	require.Equal(http.StatusOK, resp.Code)
+	warnings := gjson.Get(resp.Body.String(), "data.Warnings").Array()
+	require.Len(warnings, 1)
+	assert.Contains(warnings[0].String(), "backendFirst")
+	assert.False(gjson.Get(resp.Body.String(), "data.RecoverySecrets").Exists())
+}
+
 func TestGetUpdateLog(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -116,6 +147,43 @@ func TestGetUpdateLog(t *testing.T) {
 	assert.EqualValues('{', resp.Body.String()[0])
 }
 
+func TestManifestReadRestricted(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Restrict reading the manifest to the admin user
+	var mnf manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &mnf))
+	mnf.Roles["manifestReader"] = manifest.Role{ResourceType: "Manifest", Actions: []string{"ReadManifest"}}
+	admin := mnf.Users["admin"]
+	admin.Roles = append(admin.Roles, "manifestReader")
+	mnf.Users["admin"] = admin
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+
+	// Setup mock core and set a manifest
+	c := core.NewCoreWithMocks()
+	_, err = c.SetManifest(context.TODO(), rawManifest)
+	require.NoError(err)
+	mux := CreateServeMux(c, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/manifest", nil)
+	resp := httptest.NewRecorder()
+	assert.NoError(testRequestWithCert(req, resp, mux))
+
+	req = httptest.NewRequest(http.MethodGet, "/update", nil)
+	resp = httptest.NewRecorder()
+	assert.NoError(testRequestWithCert(req, resp, mux))
+
+	// debug endpoints render parameters from the manifest
+	EnableDebugEndpoints(mux, c)
+	for _, endpoint := range []string{"/debug/parameters", "/debug/activation", "/debug/ttls"} {
+		req = httptest.NewRequest(http.MethodGet, endpoint+"?marbleType=frontend", nil)
+		resp = httptest.NewRecorder()
+		assert.NoError(testRequestWithCert(req, resp, mux), endpoint)
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -133,6 +201,28 @@ func TestUpdate(t *testing.T) {
 	assert.NoError(err)
 }
 
+func TestUpdateDryRun(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Setup mock core and set a manifest
+	c := core.NewCoreWithMocks()
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSONWithRecoveryKey))
+	require.NoError(err)
+	mux := CreateServeMux(c, nil)
+
+	// Make HTTP dry run request with no TLS at all, should be unauthenticated
+	req := httptest.NewRequest(http.MethodPost, "/update/dryrun", strings.NewReader(test.UpdateManifest))
+	resp := httptest.NewRecorder()
+	err = testRequestWithCert(req, resp, mux)
+	assert.NoError(err)
+
+	// the update was not applied
+	updateLog, err := c.GetUpdateLog(context.TODO())
+	require.NoError(err)
+	assert.NotContains(updateLog, "SecurityVersion increased")
+}
+
 func TestReadSecret(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -197,6 +287,25 @@ func testRequestWithCert(req *http.Request, resp *httptest.ResponseRecorder, mux
 	return nil
 }
 
+// manifestWithAdmin returns test.ManifestJSON extended by the admin user of test.ManifestJSONWithRecoveryKey.
+func manifestWithAdmin(require *require.Assertions) []byte {
+	var mnf, userManifest manifest.Manifest
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSON), &mnf))
+	require.NoError(json.Unmarshal([]byte(test.ManifestJSONWithRecoveryKey), &userManifest))
+	mnf.Users = map[string]manifest.User{"admin": {Certificate: userManifest.Users["admin"].Certificate}}
+	rawManifest, err := json.Marshal(mnf)
+	require.NoError(err)
+	return rawManifest
+}
+
+// newAdminRequest returns a GET request authenticated with the certificate of the admin user.
+func newAdminRequest(target string) *http.Request {
+	adminTestCert, _ := test.MustSetupTestCerts(test.RecoveryPrivateKey)
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{adminTestCert}}
+	return req
+}
+
 func TestConcurrent(t *testing.T) {
 	// This test is used to detect data races when run with -race
 
@@ -237,3 +346,196 @@ func TestConcurrent(t *testing.T) {
 	go postManifest()
 	wg.Wait()
 }
+
+func TestActivationsGet(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := core.NewCoreWithMocks()
+	mux := CreateServeMux(c, nil)
+
+	// activations can only be listed after the manifest is set
+	req := httptest.NewRequest(http.MethodGet, "/activations", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(http.StatusInternalServerError, resp.Code)
+
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+	req = httptest.NewRequest(http.MethodGet, "/activations", nil)
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	require.Equal(http.StatusOK, resp.Code)
+	assert.EqualValues(1, gjson.Get(resp.Body.String(), "data.backendFirst.MaxActivations").Int())
+	assert.EqualValues(0, gjson.Get(resp.Body.String(), "data.backendFirst.Activations").Int())
+	assert.True(gjson.Get(resp.Body.String(), "data.frontend").Exists())
+}
+
+func TestCRLGet(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := core.NewCoreWithMocks()
+	mux := CreateServeMux(c, nil)
+	_, err := c.SetManifest(context.TODO(), []byte(test.ManifestJSON))
+	require.NoError(err)
+
+	req := httptest.NewRequest(http.MethodGet, "/crl", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	require.Equal(http.StatusOK, resp.Code)
+	block, _ := pem.Decode([]byte(gjson.Get(resp.Body.String(), "data.CRL").String()))
+	require.NotNil(block)
+	assert.Equal("X509 CRL", block.Type)
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	require.NoError(err)
+	assert.Empty(crl.RevokedCertificateEntries)
+}
+
+func TestDebugState(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// debug endpoints are not served by default
+	mux := CreateServeMux(core.NewCoreWithMocks(), nil)
+	req := httptest.NewRequest(http.MethodGet, "/debug/state", nil)
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	EnableDebugEndpoints(mux, core.NewCoreWithMocks())
+	req = httptest.NewRequest(http.MethodGet, "/debug/state", nil)
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	require.Equal(http.StatusOK, resp.Code)
+	assert.EqualValues(2, gjson.Get(resp.Body.String(), "data.State").Int())
+	assert.True(gjson.Get(resp.Body.String(), "data.Activations").IsObject())
+}
+
+func TestDebugParameters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := core.NewCoreWithMocks()
+	mux := CreateServeMux(c, nil)
+	EnableDebugEndpoints(mux, c)
+
+	// parameters can only be rendered for users of the manifest
+	req := newAdminRequest("/debug/parameters?marbleType=frontend")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(http.StatusUnauthorized, resp.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/manifest", bytes.NewReader(manifestWithAdmin(require)))
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	require.Equal(http.StatusOK, resp.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/debug/parameters?marbleType=backendFirst", nil)
+	assert.NoError(testRequestWithCert(req, httptest.NewRecorder(), mux))
+
+	req = newAdminRequest("/debug/parameters?marbleType=backendFirst")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	require.Equal(http.StatusOK, resp.Code)
+	assert.NotEmpty(gjson.Get(resp.Body.String(), "data.Env.TEST_SECRET_SYMMETRIC_KEY").String())
+	assert.True(gjson.Get(resp.Body.String(), "data.Env.MARBLE_PREDEFINED_ROOT_CA").Exists())
+
+	// rendering does not count as an activation
+	state, err := c.GetDebugState(context.TODO())
+	require.NoError(err)
+	assert.Empty(state.Activations)
+
+	req = newAdminRequest("/debug/parameters?marbleType=unknown")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+
+	req = newAdminRequest("/debug/parameters")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+}
+
+func TestDebugActivation(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := core.NewCoreWithMocks()
+	mux := CreateServeMux(c, nil)
+	EnableDebugEndpoints(mux, c)
+	_, err := c.SetManifest(context.TODO(), manifestWithAdmin(require))
+	require.NoError(err)
+
+	getActivation := func() string {
+		req := newAdminRequest("/debug/activation?marbleType=backendFirst")
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		require.Equal(http.StatusOK, resp.Code)
+		return resp.Body.String()
+	}
+
+	// the response is reproducible, so it can be saved as a fixture
+	fixture := getActivation()
+	assert.Equal(fixture, getActivation())
+
+	var activationResp rpc.ActivationResp
+	require.NoError(json.Unmarshal([]byte(gjson.Get(fixture, "data").Raw), &activationResp))
+	assert.NotEmpty(activationResp.GetParameters().GetEnv()["TEST_SECRET_SYMMETRIC_KEY"])
+	assert.Contains(string(activationResp.GetCertificate()), "CERTIFICATE")
+	assert.NotEmpty(activationResp.GetPrivateKey())
+	assert.NotEmpty(activationResp.GetCAChain())
+
+	// rendering does not count as an activation
+	state, err := c.GetDebugState(context.TODO())
+	require.NoError(err)
+	assert.Empty(state.Activations)
+
+	req := newAdminRequest("/debug/activation?marbleType=unknown")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/debug/activation?marbleType=backendFirst", nil)
+	assert.NoError(testRequestWithCert(req, httptest.NewRecorder(), mux))
+}
+
+func TestDebugTTLS(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	c := core.NewCoreWithMocks()
+	mux := CreateServeMux(c, nil)
+	EnableDebugEndpoints(mux, c)
+	_, err := c.SetManifest(context.TODO(), manifestWithAdmin(require))
+	require.NoError(err)
+
+	getTTLS := func(marbleType string) (int, string) {
+		req := newAdminRequest("/debug/ttls?marbleType=" + marbleType)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp.Code, resp.Body.String()
+	}
+
+	code, body := getTTLS("backendOther")
+	require.Equal(http.StatusOK, code)
+	config := gjson.Get(body, "data.Config.tls")
+	assert.True(config.Get(`Outgoing.localhost:8080`).Exists())
+	assert.Contains(config.Get(`Outgoing.example\.com:40000.cacrt`).String(), "CERTIFICATE")
+	// the incoming entry of anotherWeb uses certShared and disables client authentication
+	assert.False(config.Get(`Incoming.\*:8080.clientAuth`).Bool())
+	assert.Empty(gjson.Get(body, "data.Skipped").Array())
+
+	// Marbles without TLS tags have no config
+	code, body = getTTLS("frontend")
+	require.Equal(http.StatusOK, code)
+	assert.Equal(gjson.Null, gjson.Get(body, "data.Config").Type)
+
+	code, _ = getTTLS("unknown")
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = getTTLS("")
+	assert.Equal(http.StatusBadRequest, code)
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/ttls?marbleType=backendOther", nil)
+	assert.NoError(testRequestWithCert(req, httptest.NewRecorder(), mux))
+}
@@ -0,0 +1,542 @@
+// Copyright (c) Edgeless Systems GmbH.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/edgelesssys/marblerun/coordinator/seal"
+
+	// register the postgres driver for database/sql
+	_ "github.com/lib/pq"
+)
+
+// postgresTable is the table the PostgresStore keeps its state in. It holds a single row.
+const postgresTable = "marblerun_state"
+
+// postgresLockID is the key of the advisory lock that serializes transactions of all Coordinators sharing a database.
+const postgresLockID = 0x6d61726272756e
+
+// postgresKeySize is the size of the AES key the state is encrypted with.
+const postgresKeySize = 32
+
+// ErrStateRollback occurs if the database holds an older state than the Coordinator has already seen.
+var ErrStateRollback = errors.New("the database holds an older state than the Coordinator has already seen")
+
+// PostgresStore is an implementation of the Store interface backed by a PostgreSQL database.
+// It allows multiple Coordinator instances to share their state.
+//
+// The state is encrypted with AES-GCM before it leaves the enclave. Its key is generated in the enclave and sealed with the sealer,
+// like the state of a StdStore. Each commit increments the version of the state, which is bound to the ciphertext,
+// so a Coordinator rejects any state older than the latest one it has seen.
+// The database also holds the key encrypted with the recovery encryption key, so further Coordinators, or a Coordinator whose sealed key was lost,
+// obtain it by recovery.
+type PostgresStore struct {
+	db     *sql.DB
+	sealer seal.Sealer
+
+	mux, txmux   sync.Mutex
+	key          []byte
+	aead         cipher.AEAD
+	wrappedKey   []byte
+	version      uint64
+	recoveryData []byte
+	// in recovery mode, the state is kept in memory only until the key was recovered
+	recoveryMode  bool
+	recoveryState map[string][]byte
+}
+
+// postgresSealedState is the part of a PostgresStore's state sealed on the Coordinator's host.
+type postgresSealedState struct {
+	Key     []byte
+	Version uint64
+}
+
+// postgresRow is the row holding the state in the database.
+type postgresRow struct {
+	version      uint64
+	recoveryData []byte
+	wrappedKey   []byte
+	state        []byte
+}
+
+// NewPostgresStore connects to the database given by dataSourceName and creates the state table if it does not exist.
+// The state is loaded by LoadState.
+func NewPostgresStore(ctx context.Context, dataSourceName string, sealer seal.Sealer) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+postgresTable+
+		" (id INTEGER PRIMARY KEY CHECK (id = 1), version BIGINT NOT NULL, recovery_data BYTEA, wrapped_key BYTEA, state BYTEA NOT NULL)"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating table %s: %w", postgresTable, err)
+	}
+	return &PostgresStore{db: db, sealer: sealer}, nil
+}
+
+// Close closes the database connection.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// LoadState unseals the key of the state and verifies the state in the database.
+// It returns the recovery data of the state. If the key can't be unsealed, or this Coordinator has not sealed it yet
+// although the database holds a state, seal.ErrEncryptionKey is returned and the store keeps its state in memory until Recover is called.
+func (s *PostgresStore) LoadState() ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	row, err := postgresReadRow(context.Background(), s.db)
+	if err != nil {
+		return nil, err
+	}
+	sealedRecoveryData, sealedStateRaw, err := s.sealer.Unseal()
+	if row != nil {
+		sealedRecoveryData = row.recoveryData
+	}
+	if err != nil {
+		s.enterRecoveryMode()
+		return sealedRecoveryData, err
+	}
+
+	if len(sealedStateRaw) == 0 {
+		if row != nil {
+			// another Coordinator created the state, its key is obtained by recovery
+			s.enterRecoveryMode()
+			return sealedRecoveryData, seal.ErrEncryptionKey
+		}
+		// no state exists, create it with a new key
+		key := make([]byte, postgresKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := s.setKey(key); err != nil {
+			return nil, err
+		}
+		return nil, s.commit(context.Background(), nil, map[string][]byte{})
+	}
+
+	var sealedState postgresSealedState
+	if err := json.Unmarshal(sealedStateRaw, &sealedState); err != nil {
+		return sealedRecoveryData, err
+	}
+	if row == nil {
+		return sealedRecoveryData, fmt.Errorf("%w: the database holds no state", ErrStateRollback)
+	}
+	if err := s.setKey(sealedState.Key); err != nil {
+		return sealedRecoveryData, err
+	}
+	s.version = sealedState.Version
+	if _, err := s.openRow(row); err != nil {
+		return sealedRecoveryData, err
+	}
+	s.recoveryData = row.recoveryData
+	s.wrappedKey = row.wrappedKey
+	return row.recoveryData, nil
+}
+
+// Recover decrypts the key of the state in the database with the recovery encryption key and seals it.
+// It returns the recovery data of the state.
+func (s *PostgresStore) Recover(encryptionKey []byte) ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	row, err := postgresReadRow(context.Background(), s.db)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil || len(row.wrappedKey) == 0 {
+		return nil, errors.New("the database holds no recoverable state")
+	}
+	wrapAEAD, err := newAEAD(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := unsealValue(wrapAEAD, "key", row.wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setKey(key); err != nil {
+		return nil, err
+	}
+	if _, err := s.openRow(row); err != nil {
+		return nil, err
+	}
+	s.recoveryMode = false
+	s.recoveryData = row.recoveryData
+	s.wrappedKey = row.wrappedKey
+	s.version = row.version
+	if err := s.sealLocally(); err != nil {
+		return nil, err
+	}
+	return row.recoveryData, nil
+}
+
+// SetRecoveryData sets the recovery data saved with the state on the next commit.
+func (s *PostgresStore) SetRecoveryData(recoveryData []byte) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.recoveryData = recoveryData
+	s.recoveryMode = false
+}
+
+// SetEncryptionKey encrypts the key of the state with the recovery encryption key. It is saved with the state on the next commit.
+// If the key was not recovered, a new one is generated, so the next commit overwrites the state in the database.
+func (s *PostgresStore) SetEncryptionKey(encryptionKey []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.key == nil {
+		key := make([]byte, postgresKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := s.setKey(key); err != nil {
+			return err
+		}
+	}
+	wrapAEAD, err := newAEAD(encryptionKey)
+	if err != nil {
+		return err
+	}
+	wrappedKey, err := sealValue(wrapAEAD, "key", s.key)
+	if err != nil {
+		return err
+	}
+	s.wrappedKey = wrappedKey
+	return nil
+}
+
+// Get retrieves a value from the state.
+func (s *PostgresStore) Get(ctx context.Context, request string) ([]byte, error) {
+	tx, err := s.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return tx.Get(ctx, request)
+}
+
+// Put saves a value in the state.
+func (s *PostgresStore) Put(ctx context.Context, request string, requestData []byte) error {
+	tx, err := s.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.Put(ctx, request, requestData); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Iterator returns an iterator for keys saved in the state with a given prefix.
+func (s *PostgresStore) Iterator(ctx context.Context, prefix string) (Iterator, error) {
+	tx, err := s.BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return tx.Iterator(ctx, prefix)
+}
+
+// BeginTransaction starts a new transaction on the latest state in the database.
+// Transactions are serialized across all Coordinators sharing the database, like the transactions of StdStore.
+func (s *PostgresStore) BeginTransaction(ctx context.Context) (Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.txmux.Lock()
+	if err := ctx.Err(); err != nil {
+		s.txmux.Unlock()
+		return nil, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.recoveryMode {
+		data := make(map[string][]byte, len(s.recoveryState))
+		for k, v := range s.recoveryState {
+			data[k] = v
+		}
+		return &postgresTransaction{store: s, data: data}, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.txmux.Unlock()
+		return nil, err
+	}
+	data, err := s.readLocked(ctx, tx)
+	if err != nil {
+		tx.Rollback()
+		s.txmux.Unlock()
+		return nil, err
+	}
+	return &postgresTransaction{store: s, tx: tx, data: data}, nil
+}
+
+// readLocked takes the advisory lock of the database and returns the state.
+func (s *PostgresStore) readLocked(ctx context.Context, tx *sql.Tx) (map[string][]byte, error) {
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", postgresLockID); err != nil {
+		return nil, err
+	}
+	row, err := postgresReadRow(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return nil, fmt.Errorf("%w: the database holds no state", ErrStateRollback)
+	}
+	data, err := s.openRow(row)
+	if err != nil {
+		return nil, err
+	}
+	// the state may have been changed by another Coordinator
+	s.version = row.version
+	s.recoveryData = row.recoveryData
+	if s.wrappedKey == nil {
+		s.wrappedKey = row.wrappedKey
+	}
+	return data, nil
+}
+
+// commit saves the state with an incremented version and seals the new version.
+// If tx is nil, a database transaction is started and the state in the database is overwritten.
+func (s *PostgresStore) commit(ctx context.Context, tx *sql.Tx, data map[string][]byte) error {
+	if s.recoveryMode {
+		s.recoveryState = data
+		return nil
+	}
+
+	if tx == nil {
+		var err error
+		if tx, err = s.db.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", postgresLockID); err != nil {
+			return err
+		}
+		// the state was not read before, e.g., because it is overwritten after a failed recovery
+		row, err := postgresReadRow(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if row != nil && row.version > s.version {
+			s.version = row.version
+		}
+	}
+
+	stateRaw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	version := s.version + 1
+	state, err := sealValue(s.aead, postgresStateAdditionalData(version), stateRaw)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO "+postgresTable+" (id, version, recovery_data, wrapped_key, state) VALUES (1, $1, $2, $3, $4)"+
+			" ON CONFLICT (id) DO UPDATE SET version = excluded.version, recovery_data = excluded.recovery_data, wrapped_key = excluded.wrapped_key, state = excluded.state",
+		int64(version), s.recoveryData, s.wrappedKey, state); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.version = version
+	return s.sealLocally()
+}
+
+// openRow decrypts the state of a row. It fails if the row holds an older version than the latest one seen.
+func (s *PostgresStore) openRow(row *postgresRow) (map[string][]byte, error) {
+	if row.version < s.version {
+		return nil, fmt.Errorf("%w: got version %d, expected at least %d", ErrStateRollback, row.version, s.version)
+	}
+	stateRaw, err := unsealValue(s.aead, postgresStateAdditionalData(row.version), row.state)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string][]byte
+	if err := json.Unmarshal(stateRaw, &data); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = map[string][]byte{}
+	}
+	return data, nil
+}
+
+// sealLocally seals the key and the latest version of the state on the Coordinator's host.
+func (s *PostgresStore) sealLocally() error {
+	sealedState, err := json.Marshal(postgresSealedState{Key: s.key, Version: s.version})
+	if err != nil {
+		return err
+	}
+	return s.sealer.Seal(s.recoveryData, sealedState)
+}
+
+func (s *PostgresStore) setKey(key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	s.key = key
+	s.aead = aead
+	return nil
+}
+
+func (s *PostgresStore) enterRecoveryMode() {
+	s.recoveryMode = true
+	s.recoveryState = map[string][]byte{}
+}
+
+type postgresTransaction struct {
+	store *PostgresStore
+	// tx is nil in recovery mode
+	tx   *sql.Tx
+	data map[string][]byte
+}
+
+// Get retrieves a value.
+func (t *postgresTransaction) Get(ctx context.Context, request string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if value, ok := t.data[request]; ok {
+		return value, nil
+	}
+	return nil, &storeValueUnset{requestedValue: request}
+}
+
+// Put saves a value.
+func (t *postgresTransaction) Put(ctx context.Context, request string, requestData []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.data[request] = requestData
+	return nil
+}
+
+// Iterator returns an iterator for all keys in the transaction with a given prefix.
+func (t *postgresTransaction) Iterator(ctx context.Context, prefix string) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for k := range t.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return &StdIterator{0, keys}, nil
+}
+
+// Commit ends a transaction and persists the changes.
+func (t *postgresTransaction) Commit() error {
+	if t.store == nil {
+		return errors.New("transaction already ended")
+	}
+	t.store.mux.Lock()
+	err := t.store.commit(context.Background(), t.tx, t.data)
+	t.store.mux.Unlock()
+	if err != nil && t.tx != nil {
+		_ = t.tx.Rollback()
+	}
+	t.end()
+	return err
+}
+
+// Rollback aborts a transaction.
+func (t *postgresTransaction) Rollback() {
+	if t.store == nil {
+		return
+	}
+	if t.tx != nil {
+		// returns sql.ErrTxDone if the transaction was already committed
+		_ = t.tx.Rollback()
+	}
+	t.end()
+}
+
+func (t *postgresTransaction) end() {
+	t.store.txmux.Unlock()
+	t.store = nil
+}
+
+// queryer is implemented by sql.DB and sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// postgresReadRow returns the row holding the state, or nil if there is none.
+func postgresReadRow(ctx context.Context, q queryer) (*postgresRow, error) {
+	var row postgresRow
+	var version int64
+	err := q.QueryRowContext(ctx, "SELECT version, recovery_data, wrapped_key, state FROM "+postgresTable+" WHERE id = 1").
+		Scan(&version, &row.recoveryData, &row.wrappedKey, &row.state)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	row.version = uint64(version)
+	return &row, nil
+}
+
+// postgresStateAdditionalData binds the encrypted state to its version.
+func postgresStateAdditionalData(version uint64) string {
+	return "state:" + strconv.FormatUint(version, 10)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealValue encrypts a value. The additional data is authenticated, so values cannot be swapped in the database.
+func sealValue(aead cipher.AEAD, additionalData string, value []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, value, []byte(additionalData)), nil
+}
+
+// unsealValue decrypts a value created by sealValue.
+func unsealValue(aead cipher.AEAD, additionalData string, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, []byte(additionalData))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", additionalData, err)
+	}
+	return value, nil
+}
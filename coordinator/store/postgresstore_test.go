@@ -0,0 +1,169 @@
+// Copyright (c) Edgeless Systems GmbH.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/edgelesssys/marblerun/coordinator/seal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealValue(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	aead, err := newAEAD(make([]byte, 32))
+	require.NoError(err)
+
+	sealed, err := sealValue(aead, "test:input", []byte("test data"))
+	require.NoError(err)
+	assert.NotContains(string(sealed), "test data")
+	value, err := unsealValue(aead, "test:input", sealed)
+	require.NoError(err)
+	assert.Equal([]byte("test data"), value)
+
+	// values are bound to their key
+	_, err = unsealValue(aead, "another:input", sealed)
+	assert.Error(err)
+	_, err = unsealValue(aead, "test:input", sealed[:4])
+	assert.Error(err)
+
+	_, err = newAEAD([]byte("short key"))
+	assert.Error(err)
+}
+
+func TestPostgresOpenRow(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	s := &PostgresStore{}
+	require.NoError(s.setKey(make([]byte, 32)))
+	newRow := func(version uint64, sealedVersion uint64) *postgresRow {
+		state, err := sealValue(s.aead, postgresStateAdditionalData(sealedVersion), []byte(`{"test:input":"dGVzdCBkYXRh"}`))
+		require.NoError(err)
+		return &postgresRow{version: version, state: state}
+	}
+
+	s.version = 2
+	data, err := s.openRow(newRow(3, 3))
+	require.NoError(err)
+	assert.Equal([]byte("test data"), data["test:input"])
+
+	// the state is bound to its version
+	_, err = s.openRow(newRow(3, 2))
+	assert.Error(err)
+
+	// older states are rejected
+	_, err = s.openRow(newRow(1, 1))
+	assert.True(errors.Is(err, ErrStateRollback))
+}
+
+// TestPostgresStore runs against the database given by EDG_TEST_POSTGRES_DSN and is skipped if it is unset.
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("EDG_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("EDG_TEST_POSTGRES_DSN is not set")
+	}
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx := context.Background()
+
+	sealer := &seal.MockSealer{}
+	store, err := NewPostgresStore(ctx, dsn, sealer)
+	require.NoError(err)
+	defer store.Close()
+	_, err = store.db.ExecContext(ctx, "DELETE FROM "+postgresTable)
+	require.NoError(err)
+	_, err = store.LoadState()
+	require.NoError(err)
+
+	_, err = store.Get(ctx, "test:input")
+	assert.True(IsStoreValueUnsetError(err))
+
+	// rolled back changes are discarded
+	tx, err := store.BeginTransaction(ctx)
+	require.NoError(err)
+	require.NoError(tx.Put(ctx, "test:input", []byte("test data")))
+	tx.Rollback()
+	_, err = store.Get(ctx, "test:input")
+	assert.True(IsStoreValueUnsetError(err))
+
+	tx, err = store.BeginTransaction(ctx)
+	require.NoError(err)
+	require.NoError(tx.Put(ctx, "test:input", []byte("test data")))
+	require.NoError(tx.Put(ctx, "test:other", []byte("more test data")))
+	require.NoError(tx.Put(ctx, "value:1", []byte{}))
+	require.NoError(tx.Commit())
+	tx.Rollback()
+
+	val, err := store.Get(ctx, "test:input")
+	assert.NoError(err)
+	assert.Equal([]byte("test data"), val)
+	require.NoError(store.Put(ctx, "test:input", []byte("new data")))
+	val, err = store.Get(ctx, "test:input")
+	assert.NoError(err)
+	assert.Equal([]byte("new data"), val)
+
+	iter, err := store.Iterator(ctx, "test:")
+	require.NoError(err)
+	count := 0
+	for iter.HasNext() {
+		key, err := iter.GetNext()
+		assert.NoError(err)
+		assert.Contains(key, "test:")
+		count++
+	}
+	assert.Equal(2, count)
+
+	// the same sealed key loads the state
+	restarted, err := NewPostgresStore(ctx, dsn, sealer)
+	require.NoError(err)
+	defer restarted.Close()
+	_, err = restarted.LoadState()
+	require.NoError(err)
+	val, err = restarted.Get(ctx, "test:input")
+	assert.NoError(err)
+	assert.Equal([]byte("new data"), val)
+
+	// a replayed older state is rejected
+	var oldVersion int64
+	var oldState []byte
+	require.NoError(store.db.QueryRowContext(ctx, "SELECT version, state FROM "+postgresTable).Scan(&oldVersion, &oldState))
+	require.NoError(store.Put(ctx, "test:input", []byte("newer data")))
+	var newVersion int64
+	var newState []byte
+	require.NoError(store.db.QueryRowContext(ctx, "SELECT version, state FROM "+postgresTable).Scan(&newVersion, &newState))
+	_, err = store.db.ExecContext(ctx, "UPDATE "+postgresTable+" SET version = $1, state = $2", oldVersion, oldState)
+	require.NoError(err)
+	_, err = store.Get(ctx, "test:input")
+	assert.True(errors.Is(err, ErrStateRollback))
+	_, err = store.db.ExecContext(ctx, "UPDATE "+postgresTable+" SET version = $1, state = $2", newVersion, newState)
+	require.NoError(err)
+
+	// another Coordinator obtains the key by recovery
+	encryptionKey := make([]byte, 16)
+	require.NoError(store.SetEncryptionKey(encryptionKey))
+	store.SetRecoveryData([]byte("recovery data"))
+	require.NoError(store.Put(ctx, "test:input", []byte("recoverable data")))
+
+	replica, err := NewPostgresStore(ctx, dsn, &seal.MockSealer{})
+	require.NoError(err)
+	defer replica.Close()
+	recoveryData, err := replica.LoadState()
+	assert.Equal(seal.ErrEncryptionKey, err)
+	assert.Equal([]byte("recovery data"), recoveryData)
+	_, err = replica.Recover(make([]byte, 16))
+	require.NoError(err)
+	val, err = replica.Get(ctx, "test:input")
+	assert.NoError(err)
+	assert.Equal([]byte("recoverable data"), val)
+}
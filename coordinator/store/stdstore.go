@@ -7,6 +7,7 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -35,7 +36,11 @@ func NewStdStore(sealer seal.Sealer) *StdStore {
 }
 
 // Get retrieves a value from StdStore by Type and Name.
-func (s *StdStore) Get(request string) ([]byte, error) {
+func (s *StdStore) Get(ctx context.Context, request string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	s.mux.Lock()
 	value, ok := s.data[request]
 	s.mux.Unlock()
@@ -47,13 +52,13 @@ func (s *StdStore) Get(request string) ([]byte, error) {
 }
 
 // Put saves a value in StdStore by Type and Name.
-func (s *StdStore) Put(request string, requestData []byte) error {
-	tx, err := s.BeginTransaction()
+func (s *StdStore) Put(ctx context.Context, request string, requestData []byte) error {
+	tx, err := s.BeginTransaction(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
-	if err := tx.Put(request, requestData); err != nil {
+	if err := tx.Put(ctx, request, requestData); err != nil {
 		return err
 	}
 	return tx.Commit()
@@ -61,7 +66,11 @@ func (s *StdStore) Put(request string, requestData []byte) error {
 
 // Iterator returns an iterator for keys saved in StdStore with a given prefix.
 // For an empty prefix this is an iterator for all keys in StdStore.
-func (s *StdStore) Iterator(prefix string) (Iterator, error) {
+func (s *StdStore) Iterator(ctx context.Context, prefix string) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	keys := make([]string, 0)
 	for k := range s.data {
 		if strings.HasPrefix(k, prefix) {
@@ -73,9 +82,19 @@ func (s *StdStore) Iterator(prefix string) (Iterator, error) {
 }
 
 // BeginTransaction starts a new transaction.
-func (s *StdStore) BeginTransaction() (Transaction, error) {
+// It fails if the context is done before the transaction could be started.
+func (s *StdStore) BeginTransaction(ctx context.Context) (Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	tx := transaction{store: s, data: map[string][]byte{}}
 	s.txmux.Lock()
+	// the context may have been cancelled while waiting for another transaction
+	if err := ctx.Err(); err != nil {
+		s.txmux.Unlock()
+		return nil, err
+	}
 
 	s.mux.Lock()
 	for k, v := range s.data {
@@ -143,7 +162,10 @@ type transaction struct {
 }
 
 // Get retrieves a value.
-func (t *transaction) Get(request string) ([]byte, error) {
+func (t *transaction) Get(ctx context.Context, request string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if value, ok := t.data[request]; ok {
 		return value, nil
 	}
@@ -151,13 +173,20 @@ func (t *transaction) Get(request string) ([]byte, error) {
 }
 
 // Put saves a value.
-func (t *transaction) Put(request string, requestData []byte) error {
+func (t *transaction) Put(ctx context.Context, request string, requestData []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	t.data[request] = requestData
 	return nil
 }
 
 // Iterator returns an iterator for all keys in the transaction with a given prefix.
-func (t *transaction) Iterator(prefix string) (Iterator, error) {
+func (t *transaction) Iterator(ctx context.Context, prefix string) (Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	keys := make([]string, 0)
 	for k := range t.data {
 		if strings.HasPrefix(k, prefix) {
@@ -7,6 +7,7 @@
 package store
 
 import (
+	"context"
 	"testing"
 
 	"github.com/edgelesssys/marblerun/coordinator/seal"
@@ -15,6 +16,7 @@ import (
 
 func TestStdStore(t *testing.T) {
 	assert := assert.New(t)
+	ctx := context.Background()
 
 	store := NewStdStore(&seal.MockSealer{})
 	_, err := store.LoadState()
@@ -24,31 +26,32 @@ func TestStdStore(t *testing.T) {
 	testData2 := []byte("more test data")
 
 	// request unset value
-	_, err = store.Get("test:input")
+	_, err = store.Get(ctx, "test:input")
 	assert.Error(err)
 
 	// test Put method
-	tx, err := store.BeginTransaction()
+	tx, err := store.BeginTransaction(ctx)
 	assert.NoError(err)
-	assert.NoError(tx.Put("test:input", testData1))
-	assert.NoError(tx.Put("another:input", testData2))
+	assert.NoError(tx.Put(ctx, "test:input", testData1))
+	assert.NoError(tx.Put(ctx, "another:input", testData2))
 	assert.NoError(tx.Commit())
 
 	// make sure values have been set
-	val, err := store.Get("test:input")
+	val, err := store.Get(ctx, "test:input")
 	assert.NoError(err)
 	assert.Equal(testData1, val)
-	val, err = store.Get("another:input")
+	val, err = store.Get(ctx, "another:input")
 	assert.NoError(err)
 	assert.Equal(testData2, val)
 
-	_, err = store.Get("invalid:key")
+	_, err = store.Get(ctx, "invalid:key")
 	assert.Error(err)
 	assert.True(IsStoreValueUnsetError(err))
 }
 
 func TestStdIterator(t *testing.T) {
 	assert := assert.New(t)
+	ctx := context.Background()
 
 	sealer := &seal.MockSealer{}
 	store := NewStdStore(sealer)
@@ -60,7 +63,7 @@ func TestStdIterator(t *testing.T) {
 		"something": {0x00},
 	}
 
-	iter, err := store.Iterator("test")
+	iter, err := store.Iterator(ctx, "test")
 	assert.NoError(err)
 	idx := 0
 	for iter.HasNext() {
@@ -71,7 +74,7 @@ func TestStdIterator(t *testing.T) {
 	}
 	assert.EqualValues(3, idx)
 
-	iter, err = store.Iterator("value")
+	iter, err = store.Iterator(ctx, "value")
 	assert.NoError(err)
 	idx = 0
 	for iter.HasNext() {
@@ -82,7 +85,7 @@ func TestStdIterator(t *testing.T) {
 	}
 	assert.EqualValues(1, idx)
 
-	iter, err = store.Iterator("")
+	iter, err = store.Iterator(ctx, "")
 	assert.NoError(err)
 	idx = 0
 	for iter.HasNext() {
@@ -92,7 +95,7 @@ func TestStdIterator(t *testing.T) {
 	}
 	assert.EqualValues(5, idx)
 
-	iter, err = store.Iterator("empty")
+	iter, err = store.Iterator(ctx, "empty")
 	assert.NoError(err)
 	assert.False(iter.HasNext())
 
@@ -102,6 +105,7 @@ func TestStdIterator(t *testing.T) {
 
 func TestStdStoreSealing(t *testing.T) {
 	assert := assert.New(t)
+	ctx := context.Background()
 
 	sealer := &seal.MockSealer{}
 	store := NewStdStore(sealer)
@@ -109,19 +113,20 @@ func TestStdStoreSealing(t *testing.T) {
 	assert.NoError(err)
 
 	testData1 := []byte("test data")
-	assert.NoError(store.Put("test:input", testData1))
+	assert.NoError(store.Put(ctx, "test:input", testData1))
 
 	// Check sealing with a new store initialized with the sealed state
 	store2 := NewStdStore(sealer)
 	_, err = store2.LoadState()
 	assert.NoError(err)
-	val, err := store2.Get("test:input")
+	val, err := store2.Get(ctx, "test:input")
 	assert.NoError(err)
 	assert.Equal(testData1, val)
 }
 
 func TestStdStoreRollback(t *testing.T) {
 	assert := assert.New(t)
+	ctx := context.Background()
 
 	store := NewStdStore(&seal.MockSealer{})
 	_, err := store.LoadState()
@@ -132,37 +137,78 @@ func TestStdStoreRollback(t *testing.T) {
 	testData3 := []byte("and even more data")
 
 	// save data to store and seal
-	tx, err := store.BeginTransaction()
+	tx, err := store.BeginTransaction(ctx)
 	assert.NoError(err)
-	assert.NoError(tx.Put("test:input", testData1))
+	assert.NoError(tx.Put(ctx, "test:input", testData1))
 	assert.NoError(tx.Commit())
 
 	// save more data to store
-	tx, err = store.BeginTransaction()
+	tx, err = store.BeginTransaction(ctx)
 	assert.NoError(err)
-	assert.NoError(tx.Put("another:input", testData2))
+	assert.NoError(tx.Put(ctx, "another:input", testData2))
 
 	// rollback and verify only testData1 exists
 	tx.Rollback()
-	val, err := store.Get("test:input")
+	val, err := store.Get(ctx, "test:input")
 	assert.NoError(err)
 	assert.Equal(testData1, val)
-	_, err = store.Get("another:input")
+	_, err = store.Get(ctx, "another:input")
 	assert.Error(err)
 
 	// save something new
-	tx, err = store.BeginTransaction()
+	tx, err = store.BeginTransaction(ctx)
 	assert.NoError(err)
-	assert.NoError(tx.Put("last:input", testData3))
+	assert.NoError(tx.Put(ctx, "last:input", testData3))
 	assert.NoError(tx.Commit())
 
 	// verify values
-	val, err = store.Get("test:input")
+	val, err = store.Get(ctx, "test:input")
 	assert.NoError(err)
 	assert.Equal(testData1, val)
-	val, err = store.Get("last:input")
+	val, err = store.Get(ctx, "last:input")
 	assert.NoError(err)
 	assert.Equal(testData3, val)
-	_, err = store.Get("another:input")
+	_, err = store.Get(ctx, "another:input")
 	assert.Error(err)
 }
+
+func TestStdStoreCancelledContext(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewStdStore(&seal.MockSealer{})
+	_, err := store.LoadState()
+	assert.NoError(err)
+	assert.NoError(store.Put(context.Background(), "test:input", []byte("test data")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = store.Get(ctx, "test:input")
+	assert.Equal(context.Canceled, err)
+	assert.Equal(context.Canceled, store.Put(ctx, "test:input", []byte("new data")))
+	_, err = store.Iterator(ctx, "test")
+	assert.Equal(context.Canceled, err)
+	_, err = store.BeginTransaction(ctx)
+	assert.Equal(context.Canceled, err)
+
+	// a transaction aborts if its context is cancelled while waiting for another transaction
+	tx, err := store.BeginTransaction(context.Background())
+	assert.NoError(err)
+	waitCtx, waitCancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := store.BeginTransaction(waitCtx)
+		done <- err
+	}()
+	waitCancel()
+	tx.Rollback()
+	assert.Equal(context.Canceled, <-done)
+
+	// the store is still usable and unchanged
+	val, err := store.Get(context.Background(), "test:input")
+	assert.NoError(err)
+	assert.Equal([]byte("test data"), val)
+	tx, err = store.BeginTransaction(context.Background())
+	assert.NoError(err)
+	tx.Rollback()
+}
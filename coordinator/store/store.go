@@ -6,28 +6,32 @@
 
 package store
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 // Store is the interface for persistence.
+// Operations abort with the context's error if the context is done.
 type Store interface {
 	// BeginTransaction starts a new transaction
-	BeginTransaction() (Transaction, error)
+	BeginTransaction(context.Context) (Transaction, error)
 	// Get returns a value from store by key
-	Get(string) ([]byte, error)
+	Get(context.Context, string) ([]byte, error)
 	// Put saves a value to store by key
-	Put(string, []byte) error
+	Put(context.Context, string, []byte) error
 	// Iterator returns an Iterator for a given prefix
-	Iterator(string) (Iterator, error)
+	Iterator(context.Context, string) (Iterator, error)
 }
 
 // Transaction is a Store transaction.
 type Transaction interface {
 	// Get returns a value from store by key
-	Get(string) ([]byte, error)
+	Get(context.Context, string) ([]byte, error)
 	// Put saves a value to store by key
-	Put(string, []byte) error
+	Put(context.Context, string, []byte) error
 	// Iterator returns an Iterator for a given prefix
-	Iterator(string) (Iterator, error)
+	Iterator(context.Context, string) (Iterator, error)
 	// Commit ends a transaction and persists the changes
 	Commit() error
 	// Rollback aborts a transaction. Noop if already committed.
@@ -12,9 +12,19 @@ import (
 )
 
 const (
-	PermissionWriteSecret   = "writesecret"
-	PermissionReadSecret    = "readsecret"
-	PermissionUpdatePackage = "updatesecurityversion"
+	PermissionWriteSecret          = "writesecret"
+	PermissionReadSecret           = "readsecret"
+	PermissionUpdatePackage        = "updatesecurityversion"
+	PermissionReadManifest         = "readmanifest"
+	PermissionSignCert             = "signcertificate"
+	PermissionUpdateParams         = "updateparameters"
+	PermissionExportSecret         = "exportsecret"
+	PermissionPause                = "pauseactivations"
+	PermissionRotateDerivationRoot = "rotatederivationroot"
+	PermissionRotateRecoveryKey    = "rotaterecoverykey"
+	PermissionSetActivations       = "setactivations"
+	PermissionReadIssuanceLog      = "readissuancelog"
+	PermissionRevokeCertificates   = "revokecertificates"
 )
 
 // User represents a privileged user of MarbleRun.
@@ -0,0 +1,155 @@
+// Copyright (c) Edgeless Systems GmbH.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package webhook delivers signed notifications about Coordinator events to an external HTTP endpoint.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SignatureHeader is the HTTP header holding the hex-encoded HMAC-SHA256 of the request body.
+const SignatureHeader = "X-MarbleRun-Signature"
+
+const (
+	queueSize     = 256
+	maxAttempts   = 5
+	retryInterval = 2 * time.Second
+	clientTimeout = 10 * time.Second
+)
+
+// ActivationEvent describes the outcome of a Marble's activation.
+type ActivationEvent struct {
+	Success        bool
+	MarbleType     string
+	UUID           string
+	Infrastructure string `json:",omitempty"`
+	Error          string `json:",omitempty"`
+	Timestamp      time.Time
+}
+
+// Dispatcher sends events to a webhook in the background.
+//
+// Events are queued and delivered in order. Failed deliveries are retried with an increasing delay.
+// If the queue is full, new events are dropped, so sending an event never blocks the caller.
+type Dispatcher struct {
+	url           string
+	key           []byte
+	client        *http.Client
+	queue         chan ActivationEvent
+	retryInterval time.Duration
+	zaplogger     *zap.Logger
+	// mux guards closed, so no event is queued after the queue was closed
+	mux    sync.Mutex
+	closed bool
+	// done is closed once the delivery loop has processed all queued events
+	done chan struct{}
+}
+
+// NewDispatcher creates a Dispatcher posting events to url, signed with key, and starts its delivery loop.
+func NewDispatcher(url string, key []byte, zapLogger *zap.Logger) *Dispatcher {
+	d := &Dispatcher{
+		url:           url,
+		key:           key,
+		client:        &http.Client{Timeout: clientTimeout},
+		queue:         make(chan ActivationEvent, queueSize),
+		retryInterval: retryInterval,
+		zaplogger:     zapLogger,
+		done:          make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Notify queues an event for delivery without blocking. Events are dropped once the Dispatcher is closed.
+func (d *Dispatcher) Notify(event ActivationEvent) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.closed {
+		d.zaplogger.Warn("webhook dispatcher is closed, dropping event", zap.String("MarbleType", event.MarbleType), zap.String("UUID", event.UUID))
+		return
+	}
+	select {
+	case d.queue <- event:
+	default:
+		d.zaplogger.Warn("webhook queue is full, dropping event", zap.String("MarbleType", event.MarbleType), zap.String("UUID", event.UUID))
+	}
+}
+
+// Close stops the delivery loop and waits until all queued events have been processed.
+// It is safe to call Close multiple times and concurrently with Notify.
+func (d *Dispatcher) Close() {
+	d.mux.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mux.Unlock()
+	<-d.done
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for event := range d.queue {
+		d.deliver(event)
+	}
+}
+
+// deliver posts an event to the webhook, retrying failed attempts.
+func (d *Dispatcher) deliver(event ActivationEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		d.zaplogger.Error("could not marshal webhook event", zap.Error(err))
+		return
+	}
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = d.post(body); err == nil {
+			return
+		}
+		if attempt < maxAttempts {
+			time.Sleep(time.Duration(attempt) * d.retryInterval)
+		}
+	}
+	d.zaplogger.Error("could not deliver webhook event", zap.String("MarbleType", event.MarbleType), zap.String("UUID", event.UUID), zap.Error(err))
+}
+
+func (d *Dispatcher) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(body, d.key))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of body using key.
+// Receivers of a webhook can use it to verify the SignatureHeader.
+func Sign(body []byte, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Edgeless Systems GmbH.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDispatcher(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	key := []byte("secret")
+	received := make(chan ActivationEvent, 1)
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first deliveries to test retries
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(err)
+		assert.Equal(Sign(body, key), r.Header.Get(SignatureHeader))
+		var event ActivationEvent
+		require.NoError(json.Unmarshal(body, &event))
+		received <- event
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(server.URL, key, zap.NewNop())
+	d.retryInterval = time.Millisecond
+	defer d.Close()
+
+	sent := ActivationEvent{
+		Success:        true,
+		MarbleType:     "frontend",
+		UUID:           "8b9b4b7b-8d6e-4c5a-9a1f-3c2f0e7d6b5a",
+		Infrastructure: "Azure",
+		Timestamp:      time.Now().UTC().Round(time.Second),
+	}
+	d.Notify(sent)
+
+	select {
+	case event := <-received:
+		assert.Equal(sent, event)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook event was not delivered")
+	}
+	assert.Zero(failures)
+}
+
+func TestDispatcherClose(t *testing.T) {
+	assert := assert.New(t)
+
+	received := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(server.URL, []byte("secret"), zap.NewNop())
+	d.Notify(ActivationEvent{MarbleType: "frontend"})
+
+	// Close waits for queued events to be delivered
+	d.Close()
+	assert.Len(received, 1)
+
+	// events after Close are dropped instead of panicking
+	assert.NotPanics(func() { d.Notify(ActivationEvent{MarbleType: "frontend"}) })
+	assert.NotPanics(d.Close)
+	assert.Len(received, 1)
+}
+
+func TestSign(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(Sign([]byte("body"), []byte("key")), Sign([]byte("body"), []byte("key")))
+	assert.NotEqual(Sign([]byte("body"), []byte("key")), Sign([]byte("body"), []byte("other")))
+	assert.Len(Sign([]byte("body"), []byte("key")), 64)
+}
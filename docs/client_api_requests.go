@@ -30,3 +30,10 @@ type RecoverPostRequest struct {
 	// The base64 decoded and decrypted recovery secret
 	RecoverySecret []byte
 }
+
+// swagger:parameters signPost
+type SignPostRequest struct {
+	// in:body
+	// The PEM or DER encoded certificate signing request
+	CSR []byte
+}
@@ -1,6 +1,7 @@
 package docs
 
 import (
+	"github.com/edgelesssys/marblerun/coordinator/core"
 	"github.com/edgelesssys/marblerun/coordinator/manifest"
 	"github.com/edgelesssys/marblerun/coordinator/server"
 )
@@ -98,3 +99,55 @@ type SecretsMapResponse struct {
 		Data map[string]manifest.Secret
 	}
 }
+
+// swagger:response SignCertificateResponse
+type SignCertificateResponse struct {
+	// in:body
+	Body struct {
+		// example: success
+		Status string
+		Data   server.SignCertificateResp
+	}
+}
+
+// swagger:response RevokeResponse
+type RevokeResponse struct {
+	// in:body
+	Body struct {
+		// example: success
+		Status string
+		Data   server.RevokeResp
+	}
+}
+
+// swagger:response CRLResponse
+type CRLResponse struct {
+	// in:body
+	Body struct {
+		// example: success
+		Status string
+		Data   server.CRLResp
+	}
+}
+
+// swagger:response UpdateDryRunResponse
+type UpdateDryRunResponse struct {
+	// in:body
+	Body struct {
+		// example: success
+		Status string
+		// A map containing the impact of the update for each affected Marble type.
+		Data map[string]core.UpdateImpact
+	}
+}
+
+// swagger:response ActivationsResponse
+type ActivationsResponse struct {
+	// in:body
+	Body struct {
+		// example: success
+		Status string
+		// A map containing the activation budget, count, and resource hints for each Marble type.
+		Data map[string]core.MarbleActivations
+	}
+}
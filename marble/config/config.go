@@ -33,3 +33,24 @@ const UUIDFile = "EDG_MARBLE_UUID_FILE"
 
 // UUIDFileDefault is the default file path to store the marble's uuid.
 func UUIDFileDefault() string { return filepath.Join(util.MustGetwd(), "uuid") }
+
+// DeriveUUID lets the coordinator derive the marble's uuid from its hostname instead of loading or generating it.
+// The marble's entry in the manifest needs to set DeriveUUID as well.
+const DeriveUUID = "EDG_MARBLE_DERIVE_UUID"
+
+// DeriveUUIDDefault is the default setting for deriving the marble's uuid.
+const DeriveUUIDDefault = "0"
+
+// SealPolicy selects the SGX seal key the premain binds the marble's derived secrets to.
+// Valid values are "product" (seal key derived from the signer and product id) and "unique" (seal key derived from the enclave's measurement).
+// The marble's entry in the manifest needs to set PlatformBoundSecrets. The seal key, and thus the secrets, change if the CPU's security version is updated.
+const SealPolicy = "EDG_MARBLE_SEAL_POLICY"
+
+// SealPolicyDefault is the default seal policy. Marbles without a seal policy fail to activate if the manifest requires platform-bound secrets.
+const SealPolicyDefault = ""
+
+// SealPolicyProduct uses the product seal key of the marble's enclave.
+const SealPolicyProduct = "product"
+
+// SealPolicyUnique uses the unique seal key of the marble's enclave.
+const SealPolicyUnique = "unique"
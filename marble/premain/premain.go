@@ -8,16 +8,26 @@
 package premain
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"syscall"
 
+	"github.com/edgelesssys/ego/ecrypto"
+	"github.com/edgelesssys/ego/enclave"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
 	"github.com/edgelesssys/marblerun/coordinator/quote/ertvalidator"
 	"github.com/edgelesssys/marblerun/coordinator/rpc"
@@ -115,6 +125,31 @@ func PreMainMock() error {
 	return PreMainEx(quote.NewFailIssuer(), ActivateRPC, hostfs, hostfs)
 }
 
+// getSealKey returns the SGX seal key of the enclave for the given seal policy.
+var getSealKey = func(sealPolicy string) ([]byte, error) {
+	var sealKey []byte
+	var err error
+	switch sealPolicy {
+	case config.SealPolicyProduct:
+		sealKey, _, err = enclave.GetProductSealKey()
+	case config.SealPolicyUnique:
+		sealKey, _, err = enclave.GetUniqueSealKey()
+	default:
+		return nil, fmt.Errorf("unknown seal policy: %s", sealPolicy)
+	}
+	return sealKey, err
+}
+
+// getSealingParameter derives the key the Marble's platform-bound secrets are bound to from the enclave's seal key.
+// Neither the seal key nor the derived key leave the enclave.
+func getSealingParameter(sealPolicy string) ([]byte, error) {
+	sealKey, err := getSealKey(sealPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get seal key: %v", err)
+	}
+	return util.DeriveKey(sealKey, []byte("MarbleRun sealing parameter"), 32)
+}
+
 // PreMainEx is like PreMain, but allows to customize the quoting and file system handling.
 func PreMainEx(issuer quote.Issuer, activate ActivateFunc, hostfs, enclavefs afero.Fs) error {
 	prefixBackup := log.Prefix()
@@ -129,6 +164,8 @@ func PreMainEx(issuer quote.Issuer, activate ActivateFunc, hostfs, enclavefs afe
 	marbleDNSNamesString := util.Getenv(config.DNSNames, config.DNSNamesDefault)
 	marbleDNSNames := strings.Split(marbleDNSNamesString, ",")
 	uuidFile := util.Getenv(config.UUIDFile, config.UUIDFileDefault())
+	deriveUUID := util.Getenv(config.DeriveUUID, config.DeriveUUIDDefault) == "1"
+	sealPolicy := util.Getenv(config.SealPolicy, config.SealPolicyDefault)
 
 	cert, privk, err := generateCertificate()
 	if err != nil {
@@ -142,10 +179,20 @@ func PreMainEx(issuer quote.Issuer, activate ActivateFunc, hostfs, enclavefs afe
 		return err
 	}
 
-	// load or generate UUID
-	marbleUUID, err := getUUID(hostfs, uuidFile)
-	if err != nil {
-		return err
+	// load or generate UUID, unless the Coordinator derives it from the hostname
+	var marbleUUID, hostname string
+	if deriveUUID {
+		log.Println("UUID will be derived by the Coordinator")
+		hostname, err = os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get hostname: %v", err)
+		}
+	} else {
+		loadedUUID, err := getUUID(hostfs, uuidFile)
+		if err != nil {
+			return err
+		}
+		marbleUUID = loadedUUID.String()
 	}
 
 	// generate CSR
@@ -175,13 +222,21 @@ func PreMainEx(issuer quote.Issuer, activate ActivateFunc, hostfs, enclavefs afe
 		CSR:        csr.Raw,
 		MarbleType: marbleType,
 		Quote:      quote,
-		UUID:       marbleUUID.String(),
+		UUID:       marbleUUID,
+		Hostname:   hostname,
 	}
 	log.Println("activating marble of type", marbleType)
 	params, err := activate(req, coordAddr, tlsCredentials)
 	if err != nil {
 		return err
 	}
+	if err := decryptParameters(params, privk); err != nil {
+		return err
+	}
+	// no seal key of the platform is available in simulation mode
+	if err := bindPlatformSecrets(params, sealPolicy, len(quote) == 0); err != nil {
+		return err
+	}
 
 	if err := applyParameters(params, enclavefs); err != nil {
 		return err
@@ -207,11 +262,107 @@ func ActivateRPC(req *rpc.ActivationReq, coordAddr string, tlsCredentials creden
 	if err != nil {
 		return nil, err
 	}
+	if activationResp.GetPackageUpdated() {
+		log.Println("activated under updated package SecurityVersion", activationResp.GetSecurityVersion())
+	}
 
 	return activationResp.GetParameters(), nil
 }
 
+// decryptParameters decrypts the Files and Env which the Coordinator encrypted to the key of the Marble's CSR.
+func decryptParameters(params *rpc.Parameters, privk *ecdsa.PrivateKey) error {
+	if len(params.GetEncryptedFiles()) == 0 && len(params.GetEncryptedEnv()) == 0 {
+		return nil
+	}
+
+	log.Println("decrypting encrypted parameters")
+	x, y := elliptic.Unmarshal(privk.Curve, params.GetEncryptionKey())
+	if x == nil {
+		return errors.New("invalid encryption key in parameters")
+	}
+	key, err := util.DeriveParametersKey(privk, &ecdsa.PublicKey{Curve: privk.Curve, X: x, Y: y})
+	if err != nil {
+		return err
+	}
+
+	decrypt := func(paramType string, values map[string][]byte, names []string) error {
+		for _, name := range names {
+			ciphertext, ok := values[name]
+			if !ok {
+				return fmt.Errorf("encrypted parameter %s is missing in %s", name, paramType)
+			}
+			plaintext, err := ecrypto.Decrypt(ciphertext, key, util.ParametersAdditionalData(paramType, name))
+			if err != nil {
+				return fmt.Errorf("decrypting %s %s: %v", paramType, name, err)
+			}
+			values[name] = plaintext
+		}
+		return nil
+	}
+	if err := decrypt("Files", params.Files, params.GetEncryptedFiles()); err != nil {
+		return err
+	}
+	return decrypt("Env", params.Env, params.GetEncryptedEnv())
+}
+
+// bindPlatformSecrets binds the derived secrets the Coordinator sent for a Marble with PlatformBoundSecrets to the enclave's seal key.
+// The bound values are passed to the Marble as JSON objects in MARBLE_PLATFORM_BOUND_SECRETS and MARBLE_PREVIOUS_PLATFORM_BOUND_SECRETS.
+// In simulation mode, the unbound values are passed.
+func bindPlatformSecrets(params *rpc.Parameters, sealPolicy string, simulation bool) error {
+	if len(params.GetPlatformBoundSecrets()) == 0 && len(params.GetPreviousPlatformBoundSecrets()) == 0 {
+		return nil
+	}
+
+	var sealingParameter []byte
+	if simulation {
+		log.Println("secrets are not bound to the platform in simulation mode")
+	} else {
+		if sealPolicy == "" {
+			return fmt.Errorf("the manifest requires platform-bound secrets, but %s is not set", config.SealPolicy)
+		}
+		log.Println("binding secrets to the platform with seal policy", sealPolicy)
+		var err error
+		if sealingParameter, err = getSealingParameter(sealPolicy); err != nil {
+			return err
+		}
+	}
+
+	bind := func(envName string, secrets map[string][]byte) error {
+		bound := make(map[string][]byte, len(secrets))
+		for name, value := range secrets {
+			if sealingParameter != nil {
+				var err error
+				if value, err = util.DeriveKey(value, sealingParameter, uint(len(value))); err != nil {
+					return fmt.Errorf("binding secret %s: %v", name, err)
+				}
+			}
+			bound[name] = value
+		}
+		encoded, err := json.Marshal(bound)
+		if err != nil {
+			return err
+		}
+		if params.Env == nil {
+			params.Env = make(map[string][]byte)
+		}
+		params.Env[envName] = encoded
+		return nil
+	}
+	if err := bind(util.MarbleEnvironmentPlatformBoundSecrets, params.GetPlatformBoundSecrets()); err != nil {
+		return err
+	}
+	return bind(util.MarbleEnvironmentPreviousPlatformBoundSecrets, params.GetPreviousPlatformBoundSecrets())
+}
+
 func applyParameters(params *rpc.Parameters, fs afero.Fs) error {
+	if archive, ok := params.Env[util.MarbleEnvironmentFilesArchive]; ok {
+		log.Println("extracting files archive from manifest")
+		if err := extractFilesArchive(archive, fs); err != nil {
+			return fmt.Errorf("extracting files archive: %w", err)
+		}
+		delete(params.Env, util.MarbleEnvironmentFilesArchive)
+	}
+
 	// Store files in file system
 	log.Println("creating files from manifest")
 	for path, data := range params.Files {
@@ -240,3 +391,57 @@ func applyParameters(params *rpc.Parameters, fs afero.Fs) error {
 
 	return nil
 }
+
+// extractFilesArchive writes the files of a base64-encoded tar archive created by the Coordinator.
+// All files are written to temporary paths first and only renamed once every file has been written,
+// so the Marble never sees a partial set of files.
+func extractFilesArchive(archive []byte, fs afero.Fs) (err error) {
+	tarData, err := base64.StdEncoding.DecodeString(string(archive))
+	if err != nil {
+		return err
+	}
+
+	type extractedFile struct{ tmpPath, path string }
+	var extracted []extractedFile
+	defer func() {
+		if err != nil {
+			for _, file := range extracted {
+				_ = fs.Remove(file.tmpPath)
+			}
+		}
+	}()
+
+	tr := tar.NewReader(bytes.NewReader(tarData))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%s is not a regular file", header.Name)
+		}
+		path := filepath.Clean(header.Name)
+		if err := fs.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return err
+		}
+		tmpPath := path + ".marblerun-tmp"
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := afero.WriteFile(fs, tmpPath, data, os.FileMode(header.Mode).Perm()); err != nil {
+			return err
+		}
+		extracted = append(extracted, extractedFile{tmpPath: tmpPath, path: path})
+	}
+
+	for _, file := range extracted {
+		if err := fs.Rename(file.tmpPath, file.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
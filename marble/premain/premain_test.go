@@ -7,14 +7,23 @@
 package premain
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"os"
 	"testing"
 
+	"github.com/edgelesssys/ego/ecrypto"
 	"github.com/edgelesssys/marblerun/coordinator/quote"
 	"github.com/edgelesssys/marblerun/coordinator/rpc"
 	"github.com/edgelesssys/marblerun/marble/config"
+	"github.com/edgelesssys/marblerun/util"
 	"github.com/google/uuid"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -40,8 +49,12 @@ func TestPreMain(t *testing.T) {
 		assert.NotNil(tlsCredentials)
 		assert.Equal("type", req.MarbleType)
 		assert.NotEmpty(req.Quote)
-		_, err := uuid.Parse(req.UUID)
-		assert.NoError(err)
+		if req.Hostname == "" {
+			_, err := uuid.Parse(req.UUID)
+			assert.NoError(err)
+		} else {
+			assert.Empty(req.UUID)
+		}
 
 		csr, err := x509.ParseCertificateRequest(req.CSR)
 		require.NoError(err)
@@ -145,4 +158,205 @@ func TestPreMain(t *testing.T) {
 
 		assert.Equal([]string{"not modified"}, os.Args)
 	}
+	{
+		// the UUID is neither loaded nor stored if the Coordinator derives it
+		parameters = &rpc.Parameters{}
+		activateError = nil
+		require.NoError(os.Setenv(config.DeriveUUID, "1"))
+		defer os.Unsetenv(config.DeriveUUID)
+
+		hostfs := afero.NewMemMapFs()
+		enclavefs := afero.NewMemMapFs()
+		require.NoError(PreMainEx(issuer, activate, hostfs, enclavefs))
+
+		exists, err := afero.Exists(hostfs, "uuidfile")
+		require.NoError(err)
+		assert.False(exists)
+	}
+}
+
+func TestPreMainPlatformBoundSecrets(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	argsBackup := os.Args
+	defer func() { os.Args = argsBackup }()
+	getSealKeyBackup := getSealKey
+	defer func() { getSealKey = getSealKeyBackup }()
+
+	sealKeys := map[string][]byte{
+		config.SealPolicyProduct: bytes.Repeat([]byte{1}, 16),
+		config.SealPolicyUnique:  bytes.Repeat([]byte{2}, 16),
+	}
+	getSealKey = func(sealPolicy string) ([]byte, error) {
+		sealKey, ok := sealKeys[sealPolicy]
+		if !ok {
+			return nil, errors.New("unknown seal policy")
+		}
+		return sealKey, nil
+	}
+
+	unboundKey := bytes.Repeat([]byte{3}, 32)
+	previousKey := bytes.Repeat([]byte{4}, 32)
+	activate := func(req *rpc.ActivationReq, coordAddr string, tlsCredentials credentials.TransportCredentials) (*rpc.Parameters, error) {
+		return &rpc.Parameters{
+			PlatformBoundSecrets:         map[string][]byte{"key": unboundKey},
+			PreviousPlatformBoundSecrets: map[string][]byte{"key": previousKey},
+		}, nil
+	}
+	preMain := func(issuer quote.Issuer) (map[string][]byte, map[string][]byte, error) {
+		os.Unsetenv(util.MarbleEnvironmentPlatformBoundSecrets)
+		os.Unsetenv(util.MarbleEnvironmentPreviousPlatformBoundSecrets)
+		if err := PreMainEx(issuer, activate, afero.NewMemMapFs(), afero.NewMemMapFs()); err != nil {
+			return nil, nil, err
+		}
+		var secrets, previousSecrets map[string][]byte
+		require.NoError(json.Unmarshal([]byte(os.Getenv(util.MarbleEnvironmentPlatformBoundSecrets)), &secrets))
+		require.NoError(json.Unmarshal([]byte(os.Getenv(util.MarbleEnvironmentPreviousPlatformBoundSecrets)), &previousSecrets))
+		return secrets, previousSecrets, nil
+	}
+
+	require.NoError(os.Setenv(config.Type, "type"))
+	require.NoError(os.Setenv(config.UUIDFile, "uuidfile"))
+	defer os.Unsetenv(util.MarbleEnvironmentPlatformBoundSecrets)
+	defer os.Unsetenv(util.MarbleEnvironmentPreviousPlatformBoundSecrets)
+
+	// secrets are not passed unbound if no seal policy is set
+	_, _, err := preMain(quote.NewMockIssuer())
+	assert.Error(err)
+
+	// the secrets are bound to the seal key of the given policy
+	require.NoError(os.Setenv(config.SealPolicy, config.SealPolicyProduct))
+	defer os.Unsetenv(config.SealPolicy)
+	secrets, previousSecrets, err := preMain(quote.NewMockIssuer())
+	require.NoError(err)
+	productParameter, err := getSealingParameter(config.SealPolicyProduct)
+	require.NoError(err)
+	boundKey, err := util.DeriveKey(unboundKey, productParameter, 32)
+	require.NoError(err)
+	boundPreviousKey, err := util.DeriveKey(previousKey, productParameter, 32)
+	require.NoError(err)
+	assert.Equal(boundKey, secrets["key"])
+	assert.Equal(boundPreviousKey, previousSecrets["key"])
+
+	require.NoError(os.Setenv(config.SealPolicy, config.SealPolicyUnique))
+	secrets, _, err = preMain(quote.NewMockIssuer())
+	require.NoError(err)
+	assert.Len(secrets["key"], 32)
+	assert.NotEqual(boundKey, secrets["key"])
+	assert.NotEqual(unboundKey, secrets["key"])
+
+	// the unbound secrets are passed in simulation mode
+	secrets, _, err = preMain(quote.NewFailIssuer())
+	require.NoError(err)
+	assert.Equal(unboundKey, secrets["key"])
+
+	require.NoError(os.Setenv(config.SealPolicy, "invalid"))
+	_, _, err = preMain(quote.NewMockIssuer())
+	assert.Error(err)
+}
+
+func TestDecryptParameters(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	marbleKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	ephemeralKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	key, err := util.DeriveParametersKey(ephemeralKey, &marbleKey.PublicKey)
+	require.NoError(err)
+	encryptedFile, err := ecrypto.Encrypt([]byte("secret"), key, util.ParametersAdditionalData("Files", "/secret.conf"))
+	require.NoError(err)
+	encryptedEnv, err := ecrypto.Encrypt([]byte("token"), key, util.ParametersAdditionalData("Env", "API_TOKEN"))
+	require.NoError(err)
+
+	newParams := func() *rpc.Parameters {
+		return &rpc.Parameters{
+			Files:          map[string][]byte{"/secret.conf": encryptedFile, "/public.conf": []byte("public")},
+			Env:            map[string][]byte{"API_TOKEN": encryptedEnv},
+			EncryptedFiles: []string{"/secret.conf"},
+			EncryptedEnv:   []string{"API_TOKEN"},
+			EncryptionKey:  elliptic.Marshal(elliptic.P256(), ephemeralKey.X, ephemeralKey.Y),
+		}
+	}
+
+	params := newParams()
+	require.NoError(decryptParameters(params, marbleKey))
+	assert.Equal("secret", string(params.Files["/secret.conf"]))
+	assert.Equal("public", string(params.Files["/public.conf"]))
+	assert.Equal("token", string(params.Env["API_TOKEN"]))
+
+	// parameters without encrypted values are left unchanged
+	assert.NoError(decryptParameters(&rpc.Parameters{Env: map[string][]byte{"API_TOKEN": []byte("token")}}, marbleKey))
+
+	// another key can not decrypt the parameters
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	assert.Error(decryptParameters(newParams(), otherKey))
+
+	// values can not be swapped between parameters
+	params = newParams()
+	params.Env["API_TOKEN"] = encryptedFile
+	assert.Error(decryptParameters(params, marbleKey))
+
+	params = newParams()
+	params.EncryptionKey = []byte("invalid")
+	assert.Error(decryptParameters(params, marbleKey))
+}
+
+func TestExtractFilesArchive(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	createArchive := func(files map[string]string, extra ...*tar.Header) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for path, data := range files {
+			require.NoError(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: path, Mode: 0o640, Size: int64(len(data))}))
+			_, err := tw.Write([]byte(data))
+			require.NoError(err)
+		}
+		for _, header := range extra {
+			require.NoError(tw.WriteHeader(header))
+		}
+		require.NoError(tw.Close())
+		return []byte(base64.StdEncoding.EncodeToString(buf.Bytes()))
+	}
+
+	fs := afero.NewMemMapFs()
+	params := &rpc.Parameters{
+		Files: map[string][]byte{"/app/extra.conf": []byte("extra")},
+		Env: map[string][]byte{
+			util.MarbleEnvironmentFilesArchive: createArchive(map[string]string{"/app/a.conf": "a", "/app/config/b.conf": "b"}),
+		},
+	}
+	require.NoError(applyParameters(params, fs))
+
+	data, err := afero.ReadFile(fs, "/app/a.conf")
+	require.NoError(err)
+	assert.Equal("a", string(data))
+	data, err = afero.ReadFile(fs, "/app/config/b.conf")
+	require.NoError(err)
+	assert.Equal("b", string(data))
+	info, err := fs.Stat("/app/config/b.conf")
+	require.NoError(err)
+	assert.Equal(os.FileMode(0o640), info.Mode().Perm())
+	data, err = afero.ReadFile(fs, "/app/extra.conf")
+	require.NoError(err)
+	assert.Equal("extra", string(data))
+
+	// the archive is not passed to the Marble
+	_, ok := os.LookupEnv(util.MarbleEnvironmentFilesArchive)
+	assert.False(ok)
+
+	// no file is written if the archive is invalid
+	fs = afero.NewMemMapFs()
+	archive := createArchive(map[string]string{"/app/a.conf": "a"}, &tar.Header{Typeflag: tar.TypeSymlink, Name: "/app/link", Linkname: "/etc/passwd"})
+	assert.Error(extractFilesArchive(archive, fs))
+	_, err = fs.Stat("/app/a.conf")
+	assert.True(os.IsNotExist(err))
+	_, err = fs.Stat("/app/a.conf.marblerun-tmp")
+	assert.True(os.IsNotExist(err))
+	assert.Error(extractFilesArchive([]byte("invalid"), fs))
 }
@@ -10,12 +10,18 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
 	"math"
 	"math/big"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc/credentials"
@@ -23,6 +29,18 @@ import (
 
 const marbleName string = "MarbleRun Marble"
 
+// AllowedKeyUsage and AllowedExtKeyUsage are the usages permitted for certificates issued from a CSR.
+const AllowedKeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+
+var AllowedExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+
+var (
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidExtKeyUsageServerAuth     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	oidExtKeyUsageClientAuth     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}
+)
+
 // MustGenerateTestMarbleCredentials returns dummy Marble TLS credentials for testing.
 func MustGenerateTestMarbleCredentials() (cert *x509.Certificate, csrRaw []byte, privk *ecdsa.PrivateKey) {
 	dnsNames := []string{"localhost", "*.foobar.net", "*.example.org"}
@@ -102,10 +120,152 @@ func GenerateCSR(dnsNames []string, privk *ecdsa.PrivateKey) (*x509.CertificateR
 	return csr, nil
 }
 
-// GenerateCertificateSerialNumber generates a random serial number for an X.509 certificate.
+// CreateCertificateFromCSR creates a leaf certificate for pubKey, signed by parentCert and parentKey.
+//
+// Subject and subject alternative names are taken from the CSR, which needs to be verified by the caller.
+// The certificate is valid from notBefore until notAfter and uses the given key usages, see KeyUsageFromCSR.
+// If policies are given, they are added in a Certificate Policies extension. extraExtensions are added as they are.
+// If signatureAlgorithm is x509.UnknownSignatureAlgorithm, the algorithm is chosen based on parentKey.
+// Its Subject Key Identifier is computed from pubKey, its Authority Key Identifier matches the key of parentCert.
+func CreateCertificateFromCSR(csr *x509.CertificateRequest, pubKey interface{}, keyUsage x509.KeyUsage, extKeyUsage []x509.ExtKeyUsage, policies []asn1.ObjectIdentifier, extraExtensions []pkix.Extension, signatureAlgorithm x509.SignatureAlgorithm, notBefore, notAfter time.Time, parentCert *x509.Certificate, parentKey interface{}) ([]byte, error) {
+	serialNumber, err := GenerateCertificateSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	subjectKeyID, err := SubjectKeyID(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	// the parent's Subject Key Identifier takes precedence, this is a fallback for parents created without one
+	authorityKeyID, err := SubjectKeyID(parentCert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      csr.Subject,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+		SubjectKeyId:          subjectKeyID,
+		AuthorityKeyId:        authorityKeyID,
+		PolicyIdentifiers:     policies,
+		ExtraExtensions:       extraExtensions,
+		SignatureAlgorithm:    signatureAlgorithm,
+	}
+
+	return x509.CreateCertificate(rand.Reader, &template, parentCert, pubKey, parentKey)
+}
+
+// ParseOID parses an object identifier in dotted notation, e.g., "2.23.140.1.2.1".
+func ParseOID(oid string) (asn1.ObjectIdentifier, error) {
+	arcs := strings.Split(oid, ".")
+	if len(arcs) < 2 {
+		return nil, fmt.Errorf("invalid OID %q: at least two arcs are required", oid)
+	}
+	result := make(asn1.ObjectIdentifier, len(arcs))
+	for i, arc := range arcs {
+		value, err := strconv.Atoi(arc)
+		// the round trip rejects signs and leading zeros
+		if err != nil || value < 0 || strconv.Itoa(value) != arc {
+			return nil, fmt.Errorf("invalid OID %q: arc %q is not a non-negative integer", oid, arc)
+		}
+		result[i] = value
+	}
+	if result[0] > 2 || (result[0] < 2 && result[1] >= 40) {
+		return nil, fmt.Errorf("invalid OID %q: the first arcs are out of range", oid)
+	}
+	return result, nil
+}
+
+// SubjectKeyID computes the Subject Key Identifier of a public key.
+// It is the SHA-1 hash of the key's BIT STRING, following method (1) of RFC 5280, section 4.2.1.2.
+func SubjectKeyID(pubKey interface{}) ([]byte, error) {
+	encodedKey, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(encodedKey, &spki); err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return hash[:], nil
+}
+
+// KeyUsageFromCSR returns the key usages to issue for a CSR.
+//
+// Usages requested in the CSR's extensions are intersected with AllowedKeyUsage and AllowedExtKeyUsage.
+// If the CSR does not request any usage, the allowed usages are returned.
+// An error is returned if the CSR only requests usages which are not allowed.
+func KeyUsageFromCSR(csr *x509.CertificateRequest) (x509.KeyUsage, []x509.ExtKeyUsage, error) {
+	keyUsage := AllowedKeyUsage
+	extKeyUsage := AllowedExtKeyUsage
+
+	for _, ext := range csr.Extensions {
+		switch {
+		case ext.Id.Equal(oidExtensionKeyUsage):
+			var usageBits asn1.BitString
+			if rest, err := asn1.Unmarshal(ext.Value, &usageBits); err != nil || len(rest) != 0 {
+				return 0, nil, errors.New("invalid key usage extension in CSR")
+			}
+			var requested x509.KeyUsage
+			for i := 0; i < 9; i++ {
+				if usageBits.At(i) != 0 {
+					requested |= 1 << uint(i)
+				}
+			}
+			keyUsage = requested & AllowedKeyUsage
+			if keyUsage == 0 {
+				return 0, nil, errors.New("CSR does not request any permitted key usage")
+			}
+		case ext.Id.Equal(oidExtensionExtendedKeyUsage):
+			var requested []asn1.ObjectIdentifier
+			if rest, err := asn1.Unmarshal(ext.Value, &requested); err != nil || len(rest) != 0 {
+				return 0, nil, errors.New("invalid extended key usage extension in CSR")
+			}
+			extKeyUsage = nil
+			for _, oid := range requested {
+				switch {
+				case oid.Equal(oidExtKeyUsageServerAuth):
+					extKeyUsage = append(extKeyUsage, x509.ExtKeyUsageServerAuth)
+				case oid.Equal(oidExtKeyUsageClientAuth):
+					extKeyUsage = append(extKeyUsage, x509.ExtKeyUsageClientAuth)
+				}
+			}
+			if len(extKeyUsage) == 0 {
+				return 0, nil, errors.New("CSR does not request any permitted extended key usage")
+			}
+		}
+	}
+
+	return keyUsage, extKeyUsage, nil
+}
+
+// CertificateSerialNumberBits is the bit length of serial numbers generated by GenerateCertificateSerialNumber.
+// The most significant bit is always set, so serial numbers contain CertificateSerialNumberBits-1 bits of entropy,
+// well above the 64 bits required by the CA/Browser Forum, and fit into the 20 octets allowed by RFC 5280.
+const CertificateSerialNumberBits = 128
+
+// GenerateCertificateSerialNumber generates a random, positive serial number for an X.509 certificate.
+// It is used for all certificates issued by MarbleRun, including the Coordinator's CAs, Marble certificates, and secrets.
 func GenerateCertificateSerialNumber() (*big.Int, error) {
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	return rand.Int(rand.Reader, serialNumberLimit)
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), CertificateSerialNumberBits-1)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, err
+	}
+	return serialNumber.SetBit(serialNumber, CertificateSerialNumberBits-1, 1), nil
 }
 
 // LoadGRPCTLSCredentials returns a TLS configuration based on cert and privk.
@@ -7,9 +7,11 @@
 package util
 
 import (
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -41,6 +43,37 @@ func DeriveKey(secret, salt []byte, length uint) ([]byte, error) {
 	return key, nil
 }
 
+// DeriveParametersKey derives the AES-256 key which encrypts a Marble's parameters from an ECDH key exchange.
+// The Coordinator uses its ephemeral private key and the public key of the Marble's CSR, the Marble its private key and the Coordinator's ephemeral public key.
+func DeriveParametersKey(privKey *ecdsa.PrivateKey, pubKey *ecdsa.PublicKey) ([]byte, error) {
+	if privKey.Curve != pubKey.Curve || !pubKey.Curve.IsOnCurve(pubKey.X, pubKey.Y) {
+		return nil, errors.New("public key is not on the curve of the private key")
+	}
+	x, _ := privKey.Curve.ScalarMult(pubKey.X, pubKey.Y, privKey.D.Bytes())
+
+	// left-pad the shared secret to the size of the curve
+	shared := make([]byte, (privKey.Curve.Params().BitSize+7)/8)
+	xBytes := x.Bytes()
+	copy(shared[len(shared)-len(xBytes):], xBytes)
+	return DeriveKey(shared, []byte("MarbleRun parameters"), 32)
+}
+
+// ParametersAdditionalData returns the additional data which binds an encrypted parameter to its type, i.e., "Files" or "Env", and its name.
+func ParametersAdditionalData(paramType, name string) []byte {
+	return []byte(paramType + ":" + name)
+}
+
+// MarbleEnvironmentFilesArchive is the environment variable holding the base64-encoded tar archive of a Marble's Files if the manifest sets FilesArchive.
+// The premain extracts the archive and does not pass the variable to the Marble.
+const MarbleEnvironmentFilesArchive = "MARBLE_FILES_ARCHIVE"
+
+// MarbleEnvironmentPlatformBoundSecrets is the environment variable holding the derived secrets of a Marble if the manifest sets PlatformBoundSecrets.
+// The premain binds them to the enclave's seal key and passes them as a JSON object mapping their names to their base64-encoded values.
+const MarbleEnvironmentPlatformBoundSecrets = "MARBLE_PLATFORM_BOUND_SECRETS"
+
+// MarbleEnvironmentPreviousPlatformBoundSecrets is like MarbleEnvironmentPlatformBoundSecrets, but holds the secrets derived from the previous derivation root.
+const MarbleEnvironmentPreviousPlatformBoundSecrets = "MARBLE_PREVIOUS_PLATFORM_BOUND_SECRETS"
+
 // MustGetenv returns the environment variable `name` if it exists or panics otherwise.
 func MustGetenv(name string) string {
 	value := os.Getenv(name)
@@ -7,6 +7,12 @@
 package util
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"os"
 	"testing"
 
@@ -67,3 +73,98 @@ func TestXORBytes(t *testing.T) {
 	require.NoError(err)
 	assert.Equal(expectedResult, result)
 }
+
+func TestKeyUsageFromCSR(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	privk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	createCSR := func(extensions ...pkix.Extension) *x509.CertificateRequest {
+		csrRaw, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{ExtraExtensions: extensions}, privk)
+		require.NoError(err)
+		csr, err := x509.ParseCertificateRequest(csrRaw)
+		require.NoError(err)
+		return csr
+	}
+	mustMarshal := func(val interface{}) []byte {
+		data, err := asn1.Marshal(val)
+		require.NoError(err)
+		return data
+	}
+
+	// digitalSignature and keyEncipherment
+	keyUsageExt := pkix.Extension{Id: oidExtensionKeyUsage, Value: mustMarshal(asn1.BitString{Bytes: []byte{0xA0}, BitLength: 3})}
+	// keyEncipherment only
+	badKeyUsageExt := pkix.Extension{Id: oidExtensionKeyUsage, Value: mustMarshal(asn1.BitString{Bytes: []byte{0x20}, BitLength: 3})}
+	clientAuthExt := pkix.Extension{Id: oidExtensionExtendedKeyUsage, Value: mustMarshal([]asn1.ObjectIdentifier{oidExtKeyUsageClientAuth})}
+	codeSigningExt := pkix.Extension{Id: oidExtensionExtendedKeyUsage, Value: mustMarshal([]asn1.ObjectIdentifier{{1, 3, 6, 1, 5, 5, 7, 3, 3}})}
+
+	// no requested usages results in the allowed usages
+	keyUsage, extKeyUsage, err := KeyUsageFromCSR(createCSR())
+	require.NoError(err)
+	assert.Equal(AllowedKeyUsage, keyUsage)
+	assert.Equal(AllowedExtKeyUsage, extKeyUsage)
+
+	// requested usages are narrowed down to the allowed ones
+	keyUsage, extKeyUsage, err = KeyUsageFromCSR(createCSR(keyUsageExt, clientAuthExt))
+	require.NoError(err)
+	assert.Equal(x509.KeyUsageDigitalSignature, keyUsage)
+	assert.Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, extKeyUsage)
+
+	// requesting only usages that are not allowed fails
+	_, _, err = KeyUsageFromCSR(createCSR(badKeyUsageExt))
+	assert.Error(err)
+	_, _, err = KeyUsageFromCSR(createCSR(codeSigningExt))
+	assert.Error(err)
+}
+
+func TestSubjectKeyID(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cert, _, privKey := MustGenerateTestMarbleCredentials()
+	subjectKeyID, err := SubjectKeyID(&privKey.PublicKey)
+	require.NoError(err)
+	assert.Len(subjectKeyID, 20)
+
+	otherID, err := SubjectKeyID(cert.PublicKey)
+	require.NoError(err)
+	assert.Equal(subjectKeyID, otherID)
+
+	_, err = SubjectKeyID("no key")
+	assert.Error(err)
+}
+
+func TestGenerateCertificateSerialNumber(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	serialNumbers := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		serialNumber, err := GenerateCertificateSerialNumber()
+		require.NoError(err)
+		assert.Equal(1, serialNumber.Sign())
+		assert.Equal(CertificateSerialNumberBits, serialNumber.BitLen())
+		assert.GreaterOrEqual(serialNumber.BitLen()-1, 64)
+		assert.False(serialNumbers[serialNumber.String()], "serial number was issued twice")
+		serialNumbers[serialNumber.String()] = true
+	}
+}
+
+func TestParseOID(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	oid, err := ParseOID("2.23.140.1.2.1")
+	require.NoError(err)
+	assert.Equal(asn1.ObjectIdentifier{2, 23, 140, 1, 2, 1}, oid)
+	oid, err = ParseOID("1.3.6.1.4.1.0")
+	require.NoError(err)
+	assert.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 0}, oid)
+
+	for _, invalid := range []string{"", "1", "1.", ".1.2", "1..2", "1.a", "1.-2", "1.+2", "1.02", "3.1", "1.40", " 1.2"} {
+		_, err := ParseOID(invalid)
+		assert.Error(err, invalid)
+	}
+}